@@ -0,0 +1,158 @@
+/*
+Package acceptsig reads and writes the Accept-Signature field, which a server
+uses to tell a client how to sign its requests, as described in RFC 9421
+section 5.
+
+Each member of the field is a signature the server will accept. This package
+treats the members as alternatives, one per algorithm the server allows, so a
+client signs with the first member it can satisfy.
+
+	Accept-Signature: sig1=("@method" "@target-uri");alg="ecdsa-p256-sha256";tag="foo";nonce="...";created
+*/
+package acceptsig
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/dunglas/httpsfv"
+)
+
+// HeaderName is the name of the Accept-Signature field
+const HeaderName = "Accept-Signature"
+
+// Request is a signature requested in an Accept-Signature field
+type Request struct {
+	// Label of the member in the field
+	Label string
+
+	// CoveredComponents the signature must cover
+	CoveredComponents []string
+
+	// KeyID, Alg, and Tag, if set, are the values the signature must use
+	KeyID string
+	Alg   string
+	Tag   string
+
+	// Nonce, if set, is the nonce the signature must include
+	Nonce string
+
+	// Created is true if the signature must include its created time
+	Created bool
+}
+
+// Satisfies returns true if a signer with the key ID and algorithm can make
+// the requested signature
+func (r Request) Satisfies(keyID, alg string) bool {
+	return (r.KeyID == "" || r.KeyID == keyID) && (r.Alg == "" || r.Alg == alg)
+}
+
+// Marshal returns the value of an Accept-Signature field requesting the
+// signatures. Requests without a label are labelled `sig1`, `sig2`, and so
+// on.
+func Marshal(requests []Request) (string, error) {
+	dict := httpsfv.NewDictionary()
+	for i, r := range requests {
+		list := httpsfv.InnerList{
+			Items:  make([]httpsfv.Item, len(r.CoveredComponents)),
+			Params: httpsfv.NewParams(),
+		}
+		for j, c := range r.CoveredComponents {
+			list.Items[j] = httpsfv.NewItem(c)
+		}
+		for _, p := range []struct{ key, value string }{
+			{"keyid", r.KeyID}, {"alg", r.Alg}, {"tag", r.Tag}, {"nonce", r.Nonce},
+		} {
+			if p.value != "" {
+				list.Params.Add(p.key, p.value)
+			}
+		}
+		if r.Created {
+			list.Params.Add("created", true)
+		}
+		label := r.Label
+		if label == "" {
+			label = "sig" + strconv.Itoa(i+1)
+		}
+		dict.Add(label, list)
+	}
+	return httpsfv.Marshal(dict)
+}
+
+// Parse returns the signatures requested in the values of an
+// Accept-Signature field, in order
+func Parse(values []string) ([]Request, error) {
+	dict, err := httpsfv.UnmarshalDictionary(values)
+	if err != nil {
+		return nil, fmt.Errorf("Accept-Signature header is malformed: %w", err)
+	}
+	requests := []Request{}
+	for _, label := range dict.Names() {
+		member, _ := dict.Get(label)
+		list, ok := member.(httpsfv.InnerList)
+		if !ok {
+			return nil, fmt.Errorf("Accept-Signature member %q is not an inner list", label)
+		}
+		r := Request{Label: label, CoveredComponents: make([]string, len(list.Items))}
+		for i, item := range list.Items {
+			c, ok := item.Value.(string)
+			if !ok {
+				return nil, fmt.Errorf("Accept-Signature member %q has a component that is not a string", label)
+			}
+			r.CoveredComponents[i] = c
+		}
+		for _, p := range []struct {
+			key   string
+			value *string
+		}{
+			{"keyid", &r.KeyID}, {"alg", &r.Alg}, {"tag", &r.Tag}, {"nonce", &r.Nonce},
+		} {
+			v, ok := list.Params.Get(p.key)
+			if !ok {
+				continue
+			}
+			if *p.value, ok = v.(string); !ok {
+				return nil, fmt.Errorf("Accept-Signature member %q has a %s that is not a string", label, p.key)
+			}
+		}
+		if v, ok := list.Params.Get("created"); ok {
+			r.Created, _ = v.(bool)
+		}
+		requests = append(requests, r)
+	}
+	return requests, nil
+}
+
+// FromResponse returns the signatures requested by a response, or nil if it
+// doesn't request any
+func FromResponse(res *http.Response) ([]Request, error) {
+	values := res.Header.Values(HeaderName)
+	if len(values) == 0 {
+		return nil, nil
+	}
+	return Parse(values)
+}
+
+// Find returns the first request a signer with the key ID and algorithm can
+// satisfy
+func Find(requests []Request, keyID, alg string) (Request, bool) {
+	i := slices.IndexFunc(requests, func(r Request) bool { return r.Satisfies(keyID, alg) })
+	if i < 0 {
+		return Request{}, false
+	}
+	return requests[i], true
+}
+
+// NewNonce returns a random nonce for a server to request
+func NewNonce() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
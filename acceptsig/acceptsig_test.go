@@ -0,0 +1,88 @@
+package acceptsig
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMarshalParse(t *testing.T) {
+	requests := []Request{
+		{
+			CoveredComponents: []string{"@method", "@target-uri", "content-digest"},
+			Alg:               "ecdsa-p256-sha256",
+			Tag:               "foo",
+			Nonce:             "abc",
+			Created:           true,
+		},
+		{
+			Label:             "hmac",
+			CoveredComponents: []string{"@method"},
+			KeyID:             "kid-1",
+			Alg:               "hmac-sha256",
+		},
+	}
+	value, err := Marshal(requests)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	want := `sig1=("@method" "@target-uri" "content-digest");alg="ecdsa-p256-sha256";tag="foo";nonce="abc";created, hmac=("@method");keyid="kid-1";alg="hmac-sha256"`
+	if value != want {
+		t.Errorf("expected %s, got %s", want, value)
+	}
+
+	got, err := Parse([]string{value})
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	requests[0].Label = "sig1"
+	if !reflect.DeepEqual(got, requests) {
+		t.Errorf("expected %+v, got %+v", requests, got)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	cases := []struct {
+		name  string
+		value string
+	}{
+		{name: "malformed", value: `sig1=(`},
+		{name: "not an inner list", value: `sig1="@method"`},
+		{name: "component not a string", value: `sig1=(1)`},
+		{name: "tag not a string", value: `sig1=("@method");tag=1`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse([]string{tc.value})
+			if err == nil {
+				t.Error("expected error, got none")
+			}
+		})
+	}
+}
+
+func TestFind(t *testing.T) {
+	requests := []Request{
+		{Label: "sig1", Alg: "ecdsa-p256-sha256"},
+		{Label: "sig2", KeyID: "other", Alg: "hmac-sha256"},
+		{Label: "sig3", Alg: "hmac-sha256"},
+	}
+	cases := []struct {
+		name      string
+		keyID     string
+		alg       string
+		wantLabel string
+		wantOK    bool
+	}{
+		{name: "first match", keyID: "kid-1", alg: "ecdsa-p256-sha256", wantLabel: "sig1", wantOK: true},
+		{name: "skips other key id", keyID: "kid-1", alg: "hmac-sha256", wantLabel: "sig3", wantOK: true},
+		{name: "no match", keyID: "kid-1", alg: "ed25519"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := Find(requests, tc.keyID, tc.alg)
+			if ok != tc.wantOK || got.Label != tc.wantLabel {
+				t.Errorf("expected %q %t, got %q %t", tc.wantLabel, tc.wantOK, got.Label, ok)
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"os"
+	"time"
 
 	"github.com/common-fate/httpsig"
 	"github.com/micahhausler/httpsig-scratch/cmd"
@@ -19,6 +20,7 @@ func main() {
 	keyFile := flag.String("key", "", "path to private key")
 	host := flag.String("host", "localhost", "host to connect to")
 	port := flag.Int("port", 9091, "port to connect to")
+	maxClockSkew := flag.Duration("max-clock-skew", 30*time.Second, "warn if the local clock is further than this from the server's")
 	logLevel := cmd.LevelFlag(slog.LevelInfo)
 	flag.Var(&logLevel, "log-level", "log level")
 	flag.Parse()
@@ -41,18 +43,27 @@ func main() {
 		os.Exit(1)
 	}
 
-	client := httpsig.NewClient(httpsig.ClientOpts{
-		KeyID: algorithm.KeyID(),
-		Tag:   "foo",
-		Alg:   algorithm,
-		OnDeriveSigningString: func(ctx context.Context, stringToSign string) {
-			slog.Debug("signing string", "string", stringToSign)
+	client := (&transport.Builder{
+		FallbackHeaders: http.Header{"Content-Type": []string{"application/json"}},
+		ContentDigest:   true,
+		AcceptSignature: true,
+		Retry:           &transport.RetryPolicy{},
+		ClockSkew: &transport.ClockSkewOpts{
+			OnSkew: func(skew time.Duration) {
+				if skew > *maxClockSkew || skew < -*maxClockSkew {
+					slog.Warn("local clock is off from the server's, signatures are adjusted", "skew", skew)
+				}
+			},
 		},
-	})
-
-	client.Transport = transport.NewTransportWithFallbackHeaders(client.Transport, http.Header{
-		"Content-Type": []string{"application/json"},
-	})
+		Signing: &httpsig.ClientOpts{
+			KeyID: algorithm.KeyID(),
+			Tag:   "foo",
+			Alg:   algorithm,
+			OnDeriveSigningString: func(ctx context.Context, stringToSign string) {
+				slog.Debug("signing string", "string", stringToSign)
+			},
+		},
+	}).Client()
 
 	{
 		res, err := client.Post(addr, "application/json", nil)
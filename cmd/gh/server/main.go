@@ -6,12 +6,14 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/common-fate/httpsig"
-	"github.com/common-fate/httpsig/inmemory"
 	"github.com/micahhausler/httpsig-scratch/attributes"
 	"github.com/micahhausler/httpsig-scratch/cmd"
 	"github.com/micahhausler/httpsig-scratch/gh"
+	"github.com/micahhausler/httpsig-scratch/noncestore"
+	"github.com/micahhausler/httpsig-scratch/routeverify"
 	flag "github.com/spf13/pflag"
 )
 
@@ -36,20 +38,28 @@ func main() {
 
 	mux := http.NewServeMux()
 
-	verifier := httpsig.Middleware(httpsig.MiddlewareOpts{
-		NonceStorage: inmemory.NewNonceStorage(),
+	// Requests without a body, like GETs, have no content worth signing
+	verifier, err := routeverify.Middleware(routeverify.Opts{
+		NonceStorage: noncestore.NonceStorage(noncestore.NewMemoryStore(noncestore.MemoryOpts{}), time.Minute),
 		KeyDirectory: keyDir,
 		Tag:          "foo",
 		Scheme:       "http",
 		Authority:    addr,
+		Routes: []routeverify.Route{
+			{Pattern: "GET /", RequiredComponents: []string{"@method", "@target-uri"}},
+			{Pattern: "/", RequiredComponents: httpsig.DefaultCoveredComponents()},
+		},
 		OnValidationError: func(ctx context.Context, err error) {
 			slog.Error("validation error", "error", err)
 		},
-
 		OnDeriveSigningString: func(ctx context.Context, stringToSign string) {
 			slog.Debug("string to sign", "string", stringToSign)
 		},
 	})
+	if err != nil {
+		slog.Error("failed to create verifier", "error", err)
+		os.Exit(1)
+	}
 
 	mux.Handle("/", verifier(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rawAttribute := httpsig.AttributesFromContext(r.Context())
@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/micahhausler/httpsig-scratch/noncestore"
+)
+
+// NewNonceStore returns a nonce store in Redis if redisAddr is set, with the
+// password in the NONCE_REDIS_PASSWORD environment variable, or else in the
+// file at path if it is set, or else in memory
+func NewNonceStore(path, redisAddr string) (noncestore.Store, error) {
+	if redisAddr != "" {
+		return noncestore.NewRedisStore(noncestore.RedisOpts{
+			Addr:     redisAddr,
+			Password: os.Getenv("NONCE_REDIS_PASSWORD"),
+		}), nil
+	}
+	if path != "" {
+		return noncestore.NewFileStore(path)
+	}
+	return noncestore.NewMemoryStore(noncestore.MemoryOpts{}), nil
+}
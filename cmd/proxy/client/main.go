@@ -2,15 +2,17 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/common-fate/httpsig"
-	"github.com/common-fate/httpsig/signer"
 	"github.com/micahhausler/httpsig-scratch/gh"
+	"github.com/micahhausler/httpsig-scratch/respsig"
 	"github.com/micahhausler/httpsig-scratch/transport"
 	authenticationv1 "k8s.io/api/authentication/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -24,6 +26,8 @@ import (
 func main() {
 	keyFile := flag.String("key", "", "path to GitHub private key")
 	kubeConfig := flag.String("kubeconfig", "./kubeconfig", "path to kubeconfig")
+	maxClockSkew := flag.Duration("max-clock-skew", 30*time.Second, "warn if the local clock is further than this from the proxy's")
+	serverUsernames := flag.String("server-usernames", "", "comma separated GitHub usernames whose keys sign the proxy's responses. If set, responses without a valid signature are rejected")
 	klog.InitFlags(flag.CommandLine)
 	flag.Parse()
 
@@ -44,47 +48,57 @@ func main() {
 	// strip out any auth from kubeconfig
 	config = rest.AnonymousClientConfig(config)
 
-	baseTransport := http.DefaultTransport.(*http.Transport)
-	baseTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-
-	tport := &signer.Transport{
-		KeyID: algorithm.KeyID(),
-		Tag:   "foo",
-		Alg:   algorithm,
-		// CoveredComponents: []string{
-		// 	"@method", "@target-uri", "content-type", "content-length", "content-digest",
-		// 	"user-agent", "accept",
-		// },
-		OnDeriveSigningString: func(ctx context.Context, stringToSign string) {
-			klog.V(4).InfoS("signing string", "string", stringToSign)
-		},
-		BaseTransport: transport.NewTransportWithFallbackHeaders(baseTransport, http.Header{
-			"Content-Type": []string{"application/json"},
-		}),
+	// the proxy's self-signed certificate isn't in the Makefile's kubeconfig
+	if len(config.CAData) == 0 && config.CAFile == "" {
+		config.Insecure = true
 	}
 
-	config.Transport = tport
-
-	// have to set both a client and override the transport, need to debug this and only do one
-	client := httpsig.NewClient(httpsig.ClientOpts{
-		KeyID: algorithm.KeyID(),
-		Tag:   "foo",
-		Alg:   algorithm,
-		// TODO: Alter for GET requests that don't have content-type/content-length/content-digest
-		// CoveredComponents: []string{
-		// 	"@method", "@target-uri", "content-type", "content-length", "content-digest",
-		// 	"user-agent", "accept",
-		// },
-		OnDeriveSigningString: func(ctx context.Context, stringToSign string) {
-			klog.V(4).InfoS("signing string", "string", stringToSign)
+	// warn about a skewed clock once, rather than on every response
+	var warnSkew sync.Once
+	// sign requests after client-go has set up its transport
+	builder := &transport.Builder{
+		FallbackHeaders: http.Header{"Content-Type": []string{"application/json"}},
+		ContentDigest:   true,
+		AcceptSignature: true,
+		Retry:           &transport.RetryPolicy{},
+		ClockSkew: &transport.ClockSkewOpts{
+			OnSkew: func(skew time.Duration) {
+				if skew > *maxClockSkew || skew < -*maxClockSkew {
+					warnSkew.Do(func() {
+						klog.Warningf("local clock is %s off from the proxy's, signatures are adjusted", skew)
+					})
+				}
+			},
 		},
-	})
-	client.Transport = transport.NewTransportWithFallbackHeaders(client.Transport, http.Header{
-		"Content-Type": []string{"application/json"},
-	})
+		Signing: &httpsig.ClientOpts{
+			KeyID: algorithm.KeyID(),
+			Tag:   "foo",
+			Alg:   algorithm,
+			OnDeriveSigningString: func(ctx context.Context, stringToSign string) {
+				klog.V(4).InfoS("signing string", "string", stringToSign)
+			},
+		},
+	}
+	config.WrapTransport = builder.Wrap
+	if *serverUsernames != "" {
+		serverKeys, err := gh.NewGitHubKeyDirectory(strings.Split(*serverUsernames, ","))
+		if err != nil {
+			klog.Fatal("failed to get server keys ", err)
+		}
+		// verify responses to the signed requests
+		config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+			return builder.Wrap(&respsig.Transport{
+				Base:         rt,
+				KeyDirectory: serverKeys,
+				Tag:          "foo",
+				OnDeriveSigningString: func(ctx context.Context, stringToSign string) {
+					klog.V(4).InfoS("response signing string", "string", stringToSign)
+				},
+			})
+		}
+	}
 
-	// clientset, err := kubernetes.NewForConfig(config)
-	clientset, err := kubernetes.NewForConfigAndClient(config, client)
+	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		klog.Fatal("failed to read kubeconfig ", err)
 	}
@@ -9,12 +9,17 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"time"
 
 	"github.com/common-fate/httpsig"
-	"github.com/common-fate/httpsig/inmemory"
 	"github.com/common-fate/httpsig/sigset"
 	"github.com/micahhausler/httpsig-scratch/attributes"
+	"github.com/micahhausler/httpsig-scratch/cmd"
 	"github.com/micahhausler/httpsig-scratch/gh"
+	"github.com/micahhausler/httpsig-scratch/noncestore"
+	"github.com/micahhausler/httpsig-scratch/respsig"
+	"github.com/micahhausler/httpsig-scratch/routeverify"
+	"github.com/micahhausler/httpsig-scratch/streamdigest"
 	flag "github.com/spf13/pflag"
 )
 
@@ -34,6 +39,11 @@ func main() {
 	clientCert := flag.String("client-cert", "mount/client.pem", "path to client certificate to connect to backed")
 	clientKey := flag.String("client-key", "mount/client.key", "path to client key to connect to backend")
 	usernames := flag.StringSlice("usernames", []string{"micahhausler"}, "usernames to allow")
+	nonceFile := flag.String("nonce-file", "", "path to a file to persist signature nonces in, so replays are rejected across restarts. If empty, nonces are kept in memory")
+	nonceRedisAddr := flag.String("nonce-redis-addr", "", "host:port of a Redis server to share signature nonces in, between replicas. Takes precedence over --nonce-file. The password is read from $NONCE_REDIS_PASSWORD")
+	allowMissingNonce := flag.Bool("allow-missing-nonce", false, "accept GET requests signed without a nonce, for clients that only send a created time. A signature is rejected if it is used twice")
+	maxBodyBytes := flag.Int64("max-body-bytes", 10<<20, "largest request body to accept. Bodies are spooled to a temp file and checked against their Content-Digest before they are proxied")
+	responseSigningKey := flag.String("response-signing-key", "", "path to an SSH private key to sign responses with. Responses are buffered to sign them, so watches, followed logs, and upgraded connections are passed through unsigned")
 
 	flag.Parse()
 
@@ -73,13 +83,29 @@ func main() {
 		os.Exit(1)
 	}
 
+	nonces, err := cmd.NewNonceStore(*nonceFile, *nonceRedisAddr)
+	if err != nil {
+		slog.Error("failed to create nonce store", "error", err)
+		os.Exit(1)
+	}
+
 	mux := http.NewServeMux()
-	verifier := httpsig.Middleware(httpsig.MiddlewareOpts{
-		NonceStorage: inmemory.NewNonceStorage(),
+	// Requests without a body, like GETs, have no content worth signing
+	verifier, err := routeverify.Middleware(routeverify.Opts{
+		NonceStorage: noncestore.NonceStorage(nonces, time.Minute),
+		ReplayStore:  nonces,
 		KeyDirectory: keyDir,
 		Tag:          "foo",
 		Scheme:       "https",
 		Authority:    addr,
+		// bodies are checked against their digest before they are proxied
+		// to the API server
+		WantContentDigest: []string{streamdigest.SHA512, streamdigest.SHA256},
+		MaxBodyBytes:      *maxBodyBytes,
+		Routes: []routeverify.Route{
+			{Pattern: "GET /", RequiredComponents: []string{"@method", "@target-uri"}, ReplayGuard: *allowMissingNonce},
+			{Pattern: "/", RequiredComponents: httpsig.DefaultCoveredComponents()},
+		},
 		OnValidationError: func(ctx context.Context, err error) {
 			slog.Error("validation error", "error", err)
 		},
@@ -87,6 +113,10 @@ func main() {
 			slog.Debug("string to sign", "string", stringToSign)
 		},
 	})
+	if err != nil {
+		slog.Error("failed to create verifier", "error", err)
+		os.Exit(1)
+	}
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		slog.Info("Handling request", "client", r.RemoteAddr, "url", r.URL.String(), "headers", r.Header)
@@ -123,8 +153,36 @@ func main() {
 		handler.ServeHTTP(w, r)
 	})
 
+	var handler http.Handler = mux
+	if *responseSigningKey != "" {
+		keyData, err := os.ReadFile(*responseSigningKey)
+		if err != nil {
+			slog.Error("failed to read response signing key", "error", err)
+			os.Exit(1)
+		}
+		algorithm, err := gh.NewGHSigner(keyData)
+		if err != nil {
+			slog.Error("failed to create response signer", "error", err)
+			os.Exit(1)
+		}
+		handler = respsig.Middleware(respsig.SignerOpts{
+			KeyID:     algorithm.KeyID(),
+			Tag:       "foo",
+			Alg:       algorithm,
+			Headers:   []string{"Content-Type"},
+			Scheme:    "https",
+			Authority: addr,
+			OnSigningError: func(ctx context.Context, err error) {
+				slog.Error("failed to sign response", "error", err)
+			},
+			OnDeriveSigningString: func(ctx context.Context, stringToSign string) {
+				slog.Debug("response string to sign", "string", stringToSign)
+			},
+		})(mux)
+	}
+
 	slog.Info("starting server", "address", addr)
-	err = http.ListenAndServeTLS(addr, *serverCert, *serverKey, mux)
+	err = http.ListenAndServeTLS(addr, *serverCert, *serverKey, handler)
 	if err != nil {
 		slog.Error("failed to start server", "error", err)
 		os.Exit(1)
@@ -3,7 +3,9 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/ecdh"
 	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/json"
@@ -27,25 +29,17 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-type headerRoundTripper struct {
-	transport http.RoundTripper
-	header    http.Header
-}
-
-func (h *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	for key, values := range h.header {
-		for _, value := range values {
-			req.Header.Add(key, value)
-		}
-	}
-	return h.transport.RoundTrip(req)
-}
-
 func main() {
 	keyAlgo := flag.String("key-algo", "", "key algo to use. Use either `ecdsa-p256-sha256`, `hmac-sha256`, or `rsa-pss-sha512`")
 	keyPath := flag.String("key", "", "path to signing key. Only used for public keys")
 	host := flag.String("host", "localhost", "host to connect to")
 	port := flag.Int("port", 9091, "port to connect to")
+	bearerToken := flag.String("bearer-token", "", "bearer token to authenticate to the session token endpoints with")
+	scopeMethods := flag.StringSlice("scope-methods", nil, "HTTP methods to restrict the session token to")
+	scopePaths := flag.StringSlice("scope-paths", nil, "path prefixes or patterns to restrict the session token to")
+	scopeMaxBodyBytes := flag.Int64("scope-max-body-bytes", 0, "largest request body to restrict the session token to")
+	refreshSessionToken := flag.Bool("refresh-session-token", false, "refresh the session token at /session-token/refresh before sending the request")
+	sealedCredentials := flag.Bool("sealed-credentials", true, "request HMAC secret keys sealed to an ephemeral X25519 key")
 	logLevel := cmd.LevelFlag(slog.LevelInfo)
 	flag.Var(&logLevel, "log-level", "log level")
 	flag.Parse()
@@ -56,6 +50,22 @@ func main() {
 	})))
 	addr := fmt.Sprintf("http://%s:%d", *host, *port)
 
+	// the session token endpoints identify the user from the bearer token
+	authHeader := http.Header{}
+	if *bearerToken != "" {
+		authHeader.Set("Authorization", "Bearer "+*bearerToken)
+	}
+	authClient := (&transport.Builder{Headers: authHeader}).Client()
+
+	var scopes []session.Scope
+	if len(*scopeMethods) > 0 || len(*scopePaths) > 0 || *scopeMaxBodyBytes > 0 {
+		scopes = []session.Scope{{
+			Methods:      *scopeMethods,
+			Paths:        *scopePaths,
+			MaxBodyBytes: *scopeMaxBodyBytes,
+		}}
+	}
+
 	var (
 		algorithm    signer.Algorithm
 		username     string
@@ -92,11 +102,21 @@ func main() {
 	case "hmac-sha256":
 		username = "bob"
 		// For HMAC creds, we ask the server for a key and keyid
-		credRequest := &session.CredentialRequest{UserInfo: session.User{Username: username}}
+		credRequest := &session.CredentialRequest{UserInfo: session.User{Username: username}, Scopes: scopes}
+		var ephemeralKey *ecdh.PrivateKey
+		if *sealedCredentials {
+			key, err := ecdh.X25519().GenerateKey(rand.Reader)
+			if err != nil {
+				slog.Error("failed to generate ephemeral key", "error", err)
+				os.Exit(1)
+			}
+			ephemeralKey = key
+			credRequest.EphemeralPublicKey = key.PublicKey().Bytes()
+		}
 		slog.Info("Getting HMAC credentials", "request", credRequest)
 		buf := &bytes.Buffer{}
 		json.NewEncoder(buf).Encode(credRequest)
-		sessionTokenResp, err := http.Post(addr+"/hmac-credentials", "application/json", buf)
+		sessionTokenResp, err := authClient.Post(addr+"/hmac-credentials", "application/json", buf)
 		if err != nil {
 			slog.Error("failed to get credentials", "error", err)
 			os.Exit(1)
@@ -113,8 +133,16 @@ func main() {
 			os.Exit(1)
 		}
 
+		slog.Info("Got HMAC credentials from server", "token_id", resp.TokenID)
 		keyID = resp.KeyID
 		keyBytes = []byte(resp.SecretKey)
+		if ephemeralKey != nil {
+			keyBytes, err = session.OpenSecret(ephemeralKey, resp.SealedSecretKey, []byte(resp.KeyID))
+			if err != nil {
+				slog.Error("failed to open sealed secret key", "error", err)
+				os.Exit(1)
+			}
+		}
 		sessionToken = string(resp.SessionToken)
 		algorithm = alg_hmac.NewHMAC(keyBytes)
 
@@ -160,13 +188,26 @@ func main() {
 			UserInfo: session.User{
 				Username: username,
 			},
+			Scopes: scopes,
 		}
 		buf := &bytes.Buffer{}
 
 		slog.Info("Creating session token for key", "request", encRequest)
 		// ignore encoding err for now
 		json.NewEncoder(buf).Encode(encRequest)
-		sessionTokenResp, err := http.Post(addr+"/session-token", "application/json", buf)
+		// sign the registration with the key being registered to prove possession of it
+		registrationClient := (&transport.Builder{
+			Headers: authHeader,
+			Signing: &httpsig.ClientOpts{
+				KeyID: keyID,
+				Tag:   session.ProofOfPossessionTag,
+				Alg:   algorithm,
+				OnDeriveSigningString: func(ctx context.Context, stringToSign string) {
+					slog.Debug("registration signing string", "string", stringToSign)
+				},
+			},
+		}).Client()
+		sessionTokenResp, err := registrationClient.Post(addr+"/session-token", "application/json", buf)
 		if err != nil {
 			slog.Error("failed to get session token", "error", err)
 			os.Exit(1)
@@ -182,37 +223,52 @@ func main() {
 			slog.Error("error getting session token", "error", resp.Error)
 			os.Exit(1)
 		}
-		slog.Info("Got encrypted session token from server")
+		slog.Info("Got encrypted session token from server", "token_id", resp.TokenID)
 		sessionToken = string(resp.SessionToken)
 	}
 
-	client := httpsig.NewClient(httpsig.ClientOpts{
-		KeyID: keyID,
-		Tag:   "foo",
-		Alg:   algorithm,
-		CoveredComponents: []string{
-			"@method", "@target-uri", "content-type", "content-length", "content-digest", "x-session-token",
-		},
-		OnDeriveSigningString: func(ctx context.Context, stringToSign string) {
-			slog.Debug("signing string", "string", stringToSign)
-		},
-	})
-	client.Transport = transport.NewTransportWithFallbackHeaders(client.Transport, http.Header{
-		"Content-Type": []string{"application/json"},
-	})
-
-	headers := http.Header{
-		"x-session-token": []string{sessionToken},
-	}
-	existingTransport := client.Transport
-	if existingTransport == nil {
-		existingTransport = http.DefaultTransport
+	// newClient returns a client that signs requests carrying the session token
+	newClient := func(sessionToken string) *http.Client {
+		return (&transport.Builder{
+			FallbackHeaders: http.Header{"Content-Type": []string{"application/json"}},
+			Headers:         http.Header{"x-session-token": []string{sessionToken}},
+			ContentDigest:   true,
+			Signing: &httpsig.ClientOpts{
+				KeyID: keyID,
+				Tag:   "foo",
+				Alg:   algorithm,
+				CoveredComponents: []string{
+					"@method", "@target-uri", "content-type", "content-length", "content-digest", "x-session-token",
+				},
+				OnDeriveSigningString: func(ctx context.Context, stringToSign string) {
+					slog.Debug("signing string", "string", stringToSign)
+				},
+			},
+		}).Client()
 	}
-	client.Transport = &headerRoundTripper{
-		transport: existingTransport,
-		header:    headers,
+
+	if *refreshSessionToken {
+		refreshResp, err := newClient(sessionToken).Post(addr+"/session-token/refresh", "application/json", nil)
+		if err != nil {
+			slog.Error("failed to refresh session token", "error", err)
+			os.Exit(1)
+		}
+		resp := &session.EncryptionResponse{}
+		err = json.NewDecoder(refreshResp.Body).Decode(resp)
+		if err != nil {
+			slog.Error("failed to decode response", "error", err)
+			os.Exit(1)
+		}
+		refreshResp.Body.Close()
+		if resp.Error != "" {
+			slog.Error("error refreshing session token", "error", resp.Error)
+			os.Exit(1)
+		}
+		slog.Info("Refreshed session token", "token_id", resp.TokenID, "expires_at", resp.ExpiresAt)
+		sessionToken = string(resp.SessionToken)
 	}
 
+	client := newClient(sessionToken)
 	res, err := client.Post(addr, "application/json", nil)
 	if err != nil {
 		slog.Error("failed to send request", "error", err)
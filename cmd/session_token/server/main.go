@@ -3,25 +3,60 @@ package main
 import (
 	"context"
 	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"expvar"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/common-fate/httpsig"
-	"github.com/common-fate/httpsig/inmemory"
-	"github.com/common-fate/httpsig/sigparams"
-	"github.com/common-fate/httpsig/verifier"
 	"github.com/micahhausler/httpsig-scratch/cmd"
+	"github.com/micahhausler/httpsig-scratch/gh"
+	"github.com/micahhausler/httpsig-scratch/noncestore"
+	"github.com/micahhausler/httpsig-scratch/routeverify"
 	"github.com/micahhausler/httpsig-scratch/session"
 	"github.com/micahhausler/httpsig-scratch/session/block"
+	"github.com/micahhausler/httpsig-scratch/session/envelope"
+	"github.com/micahhausler/httpsig-scratch/session/kms"
+	"github.com/micahhausler/httpsig-scratch/session/kms/fake"
+	"github.com/micahhausler/httpsig-scratch/session/reference"
+	"github.com/micahhausler/httpsig-scratch/session/signed"
 	flag "github.com/spf13/pflag"
 )
 
 func main() {
 	port := flag.Int("port", 9091, "port to listen on")
 	sessionTokenEncryptionKeyFile := flag.String("session-token-encryption-key", "", "path to session token encryption key")
+	sessionTokenKeyringFile := flag.String("session-token-keyring", "", "path to a JSON session token keyring. Takes precedence over --session-token-encryption-key")
+	sessionTokenSigningKeyringFile := flag.String("session-token-signing-keyring", "", "path to a JSON keyring of Ed25519 or ECDSA keys to sign session tokens with, instead of encrypting them. If --session-token-encryption-key is also set, signed tokens are also encrypted with it. Public keys are served at /.well-known/jwks.json")
+	sessionTokenKMS := flag.String("session-token-kms", "", "encrypt session tokens with data keys wrapped by a KMS key, as `fake:<key id>`. The in-process fake KMS uses --session-token-encryption-key as its master key, for local demos")
+	sessionTokenMode := flag.String("session-token-mode", "self-contained", "kind of session tokens to issue, either `self-contained` or `reference`. Reference tokens are short handles to records kept by the server, and self-contained tokens are still accepted")
+	sessionTokenReferenceFile := flag.String("session-token-reference-file", "", "path to a file to persist reference session tokens in. If empty, they are kept in memory")
+	sessionTokenCodec := flag.String("session-token-codec", "json", "session token payload encoding, either `json` or `cbor`")
+	sessionTokenLegacyUntil := flag.String("session-token-legacy-until", "", "RFC 3339 time after which session tokens in the legacy base64 JSON format are rejected. Legacy tokens aren't bound to an audience, and until then they're accepted whatever --audience is. If empty, they're always accepted")
+	revocationFile := flag.String("revocation-file", "", "path to a file to persist session token revocations in. If empty, revocations are kept in memory")
+	nonceFile := flag.String("nonce-file", "", "path to a file to persist signature nonces in, so replays are rejected across restarts. If empty, nonces are kept in memory")
+	nonceRedisAddr := flag.String("nonce-redis-addr", "", "host:port of a Redis server to share signature nonces in, between replicas. Takes precedence over --nonce-file. The password is read from $NONCE_REDIS_PASSWORD")
+	adminPort := flag.Int("admin-port", 9092, "port to serve the admin API on")
+	keyringReloadInterval := flag.Duration("session-token-keyring-reload-interval", time.Second*30, "how often to check the session token keyring for changes")
+	audience := flag.String("audience", "", "audience session tokens are bound to. Defaults to the server's authority")
+	tokenSourceFlag := flag.String("session-token-source", "header:x-session-token", "where to read session tokens from, one of `header:<name>`, `cookie:<name>`, or `query:<name>`")
+	purpose := flag.String("session-token-purpose", "", "optional purpose session tokens are bound to")
+	htpasswdFile := flag.String("htpasswd", "", "path to an htpasswd file of users allowed to request session tokens with basic auth")
+	tokenFile := flag.String("token-file", "", "path to a static token CSV file (`token,username`) of users allowed to request session tokens")
+	githubUsers := flag.StringSlice("github-users", nil, "GitHub users allowed to request session tokens by signing with their GitHub SSH keys, using the `github` tag")
+	tlsCert := flag.String("tls-cert", "", "path to a TLS certificate to serve with")
+	tlsKey := flag.String("tls-key", "", "path to the TLS certificate's private key")
+	requireSealedCredentials := flag.Bool("require-sealed-credentials", false, "reject HMAC credential requests that don't send an ephemeral X25519 key to seal the secret key to")
+	tokenLifetime := flag.Duration("session-token-lifetime", time.Hour, "how long session tokens are valid for. Zero issues tokens that never expire")
+	refreshGracePeriod := flag.Duration("session-token-refresh-grace-period", time.Minute*15, "how long after a session token expires it can still be refreshed at /session-token/refresh")
+	clientCA := flag.String("client-ca", "", "path to a CA bundle for TLS client certificates allowed to request session tokens. Requires --tls-cert")
 	logLevel := cmd.LevelFlag(slog.LevelInfo)
 	flag.Var(&logLevel, "log-level", "log level")
 	flag.Parse()
@@ -30,72 +65,214 @@ func main() {
 		AddSource: slog.Level(logLevel) == slog.LevelDebug,
 	})))
 	addr := fmt.Sprintf("localhost:%d", *port)
+	adminAddr := fmt.Sprintf("localhost:%d", *adminPort)
+	if *audience == "" {
+		*audience = addr
+	}
+	scheme := "http"
+	if *tlsCert != "" {
+		scheme = "https"
+	}
 
-	aesKey, err := os.ReadFile(*sessionTokenEncryptionKeyFile)
+	tokenSource, err := session.ParseTokenSource(*tokenSourceFlag)
 	if err != nil {
-		slog.Error("failed to read session token encryption key file", "error", err)
+		slog.Error("invalid session token source", "error", err)
 		os.Exit(1)
 	}
-	if len(aesKey) < 32 {
-		slog.Error("session token encryption key is too short")
+
+	codec, err := envelope.ParseCodec(*sessionTokenCodec)
+	if err != nil {
+		slog.Error("invalid session token codec", "error", err)
 		os.Exit(1)
 	}
-	if len(aesKey) > 32 {
-		slog.Warn("session token encryption key is too long, using first 32 bytes")
+	var legacyUntil time.Time
+	if *sessionTokenLegacyUntil != "" {
+		legacyUntil, err = time.Parse(time.RFC3339, *sessionTokenLegacyUntil)
+		if err != nil {
+			slog.Error("invalid session token legacy cutoff", "error", err)
+			os.Exit(1)
+		}
 	}
-	cipher, err := aes.NewCipher(aesKey[:32])
-	if err != nil {
-		slog.Error("failed to create AES cipher", "error", err)
+
+	var (
+		sessionTokenEncrypterDecrypter session.EncrypterDecrypter
+		signingKeyring                 *signed.Keyring
+	)
+	if *sessionTokenSigningKeyringFile != "" {
+		signingKeyring, err = signed.LoadKeyringFile(*sessionTokenSigningKeyringFile)
+		if err != nil {
+			slog.Error("failed to load session token signing keyring", "error", err)
+			os.Exit(1)
+		}
+		go signingKeyring.WatchFile(context.Background(), *sessionTokenSigningKeyringFile, *keyringReloadInterval)
+		issuer := signed.NewIssuer(signingKeyring)
+		issuer.Codec = codec
+		if *sessionTokenEncryptionKeyFile != "" {
+			issuer.Encryption, err = readAESKeyFile(*sessionTokenEncryptionKeyFile)
+			if err != nil {
+				slog.Error("failed to read session token encryption key file", "error", err)
+				os.Exit(1)
+			}
+		}
+		sessionTokenEncrypterDecrypter = issuer
+	} else if *sessionTokenKMS != "" {
+		kmsEncrypterDecrypter, err := newKMSEncrypterDecrypter(*sessionTokenKMS, *sessionTokenEncryptionKeyFile)
+		if err != nil {
+			slog.Error("failed to configure session token KMS", "error", err)
+			os.Exit(1)
+		}
+		kmsEncrypterDecrypter.Codec = codec
+		sessionTokenEncrypterDecrypter = kmsEncrypterDecrypter
+	} else if *sessionTokenKeyringFile != "" {
+		keyring, err := block.LoadKeyringFile(*sessionTokenKeyringFile)
+		if err != nil {
+			slog.Error("failed to load session token keyring", "error", err)
+			os.Exit(1)
+		}
+		go keyring.WatchFile(context.Background(), *sessionTokenKeyringFile, *keyringReloadInterval)
+		keyringEncrypterDecrypter := block.NewKeyringSessionEncrypterDecrypter(keyring)
+		keyringEncrypterDecrypter.Codec = codec
+		keyringEncrypterDecrypter.LegacyUntil = legacyUntil
+		sessionTokenEncrypterDecrypter = keyringEncrypterDecrypter
+	} else {
+		aesBlock, err := readAESKeyFile(*sessionTokenEncryptionKeyFile)
+		if err != nil {
+			slog.Error("failed to read session token encryption key file", "error", err)
+			os.Exit(1)
+		}
+		blockEncrypterDecrypter := block.NewBlockSessionEncrypterDecrypter(aesBlock)
+		blockEncrypterDecrypter.Codec = codec
+		blockEncrypterDecrypter.LegacyUntil = legacyUntil
+		sessionTokenEncrypterDecrypter = blockEncrypterDecrypter
+	}
+
+	// reference tokens are issued instead of self-contained tokens, but
+	// both are accepted
+	var (
+		sessionTokenEncrypter session.Encrypter = sessionTokenEncrypterDecrypter
+		sessionTokenDecrypter session.Decrypter = sessionTokenEncrypterDecrypter
+	)
+	switch *sessionTokenMode {
+	case "self-contained":
+	case "reference":
+		referenceStore := reference.NewMemoryStore()
+		if *sessionTokenReferenceFile != "" {
+			referenceStore, err = reference.NewFileStore(*sessionTokenReferenceFile)
+			if err != nil {
+				slog.Error("failed to load session token reference file", "error", err)
+				os.Exit(1)
+			}
+		}
+		references := reference.NewEncrypterDecrypter(referenceStore)
+		if *tokenLifetime > 0 {
+			references.TTL = *tokenLifetime + *refreshGracePeriod
+		}
+		sessionTokenEncrypter = references
+		sessionTokenDecrypter = &reference.RoutingDecrypter{
+			References:    references,
+			SelfContained: sessionTokenEncrypterDecrypter,
+		}
+	default:
+		slog.Error("invalid session token mode", "mode", *sessionTokenMode)
 		os.Exit(1)
 	}
-	sessionTokenEncrypterDecrypter := block.NewBlockSessionEncrypterDecrypter(cipher)
 
 	// TODO: create a session token handler on an alternate port?
 	// Just using an alternate unauthenticated path for now
-	encService := session.NewEncryptionService(sessionTokenEncrypterDecrypter)
+	encService := session.NewEncryptionService(sessionTokenEncrypter)
+	encService.Audience = *audience
+	encService.Purpose = *purpose
+	nonces, err := cmd.NewNonceStore(*nonceFile, *nonceRedisAddr)
+	if err != nil {
+		slog.Error("failed to create nonce store", "error", err)
+		os.Exit(1)
+	}
+	authenticators, err := newAuthenticators(*htpasswdFile, *tokenFile, *githubUsers, *clientCA != "", scheme, addr, nonces)
+	if err != nil {
+		slog.Error("failed to configure authentication", "error", err)
+		os.Exit(1)
+	}
+	encService.Authenticator = authenticators
+	encService.RequireSealedCredentials = *requireSealedCredentials
+	encService.TokenLifetime = *tokenLifetime
+	encService.ProofOfPossession = &session.ProofOfPossession{
+		Scheme:       scheme,
+		Authority:    addr,
+		NonceStorage: noncestore.NonceStorage(nonces, time.Minute),
+	}
+
+	revocationStore := session.NewInMemoryRevocationStore()
+	if *revocationFile != "" {
+		// token IDs are kept until every token refreshed from them has
+		// expired, and forever if tokens never expire
+		var retention time.Duration
+		if *tokenLifetime > 0 {
+			retention = *tokenLifetime + *refreshGracePeriod
+		}
+		revocationStore, err = session.NewFileRevocationStore(*revocationFile, retention)
+		if err != nil {
+			slog.Error("failed to load revocation file", "error", err)
+			os.Exit(1)
+		}
+	}
 
-	var keyDir verifier.KeyDirectory
-	decService := session.NewDecryptionService(sessionTokenEncrypterDecrypter, "x-session-token")
-	keyDir = decService
+	decService := session.NewDecryptionService(sessionTokenDecrypter, "")
+	decService.TokenSource = tokenSource
+	decService.Tag = "foo"
+	decService.RevocationStore = revocationStore
+	decService.Audience = *audience
+	decService.Purpose = *purpose
+	keyDir := session.NewRequestKeyDirectoryAdapter(decService)
+	encService.Refresh = &session.TokenRefresh{
+		Decryption:   decService,
+		GracePeriod:  *refreshGracePeriod,
+		Scheme:       scheme,
+		Authority:    addr,
+		NonceStorage: noncestore.NonceStorage(nonces, time.Minute),
+	}
 
 	mux := http.NewServeMux()
 
-	verifier := httpsig.Middleware(httpsig.MiddlewareOpts{
-		NonceStorage: inmemory.NewNonceStorage(),
+	// Requests without a body, like GETs, have no content worth signing
+	bodyComponents := []string{"@method", "@target-uri", "content-type", "content-length", "content-digest"}
+	verifier, err := routeverify.Middleware(routeverify.Opts{
+		NonceStorage: noncestore.NonceStorage(nonces, time.Minute*20),
 		KeyDirectory: keyDir,
 		Tag:          "foo",
-		Scheme:       "http",
+		Scheme:       scheme,
 		Authority:    addr,
+		MaxAge:       time.Minute * 5,
+		MaxClockSkew: time.Minute * 15,
+		// the session token's component is checked by the DecryptionService
+		Routes: []routeverify.Route{
+			{Pattern: "GET /", RequiredComponents: []string{"@method", "@target-uri"}},
+			{Pattern: "/", RequiredComponents: bodyComponents},
+		},
 		OnValidationError: func(ctx context.Context, err error) {
 			slog.Error("validation error", "error", err)
 		},
-		Validation: &sigparams.ValidateOpts{
-			ForbidClientSideAlg: false,
-			BeforeDuration:      time.Minute * 5,
-			AfterDuration:       time.Minute * 15,
-			RequiredCoveredComponents: map[string]bool{
-				"@method":         true,
-				"@target-uri":     true,
-				"content-type":    true,
-				"content-length":  true,
-				"content-digest":  true,
-				"x-session-token": true,
-			},
-		},
-
 		OnDeriveSigningString: func(ctx context.Context, stringToSign string) {
 			slog.Debug("string to sign", "string", stringToSign)
 		},
 	})
+	if err != nil {
+		slog.Error("failed to create verifier", "error", err)
+		os.Exit(1)
+	}
 
-	sessionTokenDecryptingMiddleware := decService.GetSessionTokenDecryptingMiddleware()
+	requestMiddleware := keyDir.Middleware()
 
 	mux.Handle("/session-token", encService.SessionTokenHandler())
+	mux.Handle("/session-token/refresh", encService.RefreshHandler())
 	mux.Handle("/hmac-credentials", encService.NewCredentialHandler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	if signingKeyring != nil {
+		mux.Handle("/.well-known/jwks.json", signed.JWKSHandler(signingKeyring))
+	}
 	mux.Handle("/",
-		sessionTokenDecryptingMiddleware(
+		requestMiddleware(
 			verifier(
-				http.Handler(
+				session.ScopeMiddleware(
 					http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 						rawAttribute := httpsig.AttributesFromContext(r.Context())
 						if rawAttribute == nil {
@@ -121,10 +298,135 @@ func main() {
 			)),
 	)
 
-	slog.Info("starting server", "address", addr)
-	err = http.ListenAndServe(addr, mux)
+	// The admin API is unauthenticated, so only serve it on a separate
+	// localhost listener
+	revService := session.NewRevocationService(revocationStore)
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/admin/revoke/token", revService.RevokeTokenHandler())
+	adminMux.Handle("/admin/revoke/user", revService.RevokeUserHandler())
+	adminMux.Handle("/admin/revoke/issued-before", revService.RevokeIssuedBeforeHandler())
+	go func() {
+		slog.Info("starting admin server", "address", adminAddr)
+		err := http.ListenAndServe(adminAddr, adminMux)
+		if err != nil {
+			slog.Error("failed to start admin server", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	slog.Info("starting server", "address", addr, "scheme", scheme)
+	if *tlsCert != "" {
+		if *clientCA != "" {
+			server.TLSConfig, err = clientCATLSConfig(*clientCA)
+			if err != nil {
+				slog.Error("failed to load client CA", "error", err)
+				os.Exit(1)
+			}
+		}
+		err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = server.ListenAndServe()
+	}
 	if err != nil {
 		slog.Error("failed to start server", "error", err)
 		os.Exit(1)
 	}
 }
+
+// newAuthenticators returns the authenticators for the session token
+// issuance endpoints. At least one must be configured.
+func newAuthenticators(htpasswdFile, tokenFile string, githubUsers []string, clientCerts bool, scheme, addr string, nonces noncestore.Store) (session.Authenticators, error) {
+	authenticators := session.Authenticators{}
+	if htpasswdFile != "" {
+		auth, err := session.LoadHtpasswdFile(htpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, auth)
+	}
+	if tokenFile != "" {
+		auth, err := session.LoadStaticTokenFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, auth)
+	}
+	if clientCerts {
+		authenticators = append(authenticators, &session.ClientCertAuthenticator{})
+	}
+	if len(githubUsers) > 0 {
+		keyDir, err := gh.NewGitHubKeyDirectory(githubUsers)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, &session.SignatureAuthenticator{
+			KeyDirectory: keyDir,
+			Tag:          "github",
+			Scheme:       scheme,
+			Authority:    addr,
+			NonceStorage: noncestore.NonceStorage(nonces, time.Minute),
+		})
+	}
+	if len(authenticators) == 0 {
+		return nil, errors.New("no authentication configured, set --htpasswd, --token-file, --client-ca, or --github-users")
+	}
+	return authenticators, nil
+}
+
+// clientCATLSConfig returns a TLS config that verifies client certificates,
+// if given, against the CA bundle
+func clientCATLSConfig(path string) (*tls.Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
+}
+
+// readAESKeyFile reads a 32 byte AES key. Longer keys are truncated.
+func readAESKeyFile(path string) (cipher.Block, error) {
+	aesKey, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(aesKey) < 32 {
+		return nil, errors.New("session token encryption key is too short")
+	}
+	if len(aesKey) > 32 {
+		slog.Warn("session token encryption key is too long, using first 32 bytes")
+	}
+	return aes.NewCipher(aesKey[:32])
+}
+
+// newKMSEncrypterDecrypter returns a KMS session token encrypter for a
+// `provider:<key id>` flag. Only the in-process fake KMS is supported, with
+// the AES key file as the master key.
+func newKMSEncrypterDecrypter(flagValue, keyFile string) (*kms.EncrypterDecrypter, error) {
+	provider, keyID, ok := strings.Cut(flagValue, ":")
+	if !ok || keyID == "" {
+		return nil, fmt.Errorf("invalid KMS %q, expected provider:<key id>", flagValue)
+	}
+	if provider != "fake" {
+		return nil, fmt.Errorf("unsupported KMS provider %q", provider)
+	}
+	masterKey, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fake KMS master key: %w", err)
+	}
+	if len(masterKey) < 32 {
+		return nil, errors.New("fake KMS master key is too short")
+	}
+	fakeKMS, err := fake.New(map[string][]byte{keyID: masterKey[:32]})
+	if err != nil {
+		return nil, err
+	}
+	return kms.NewEncrypterDecrypter(fakeKMS, keyID), nil
+}
@@ -51,7 +51,7 @@ func (d *GitHubKeyDirectory) GetKey(ctx context.Context, kid string, clientSpeci
 			}
 			for _, alg := range keyAlgos {
 				if alg.Type() == clientSpecifiedAlg {
-					algos = append(algos, keyAlgos...)
+					algos = append(algos, alg)
 				}
 			}
 		}
@@ -9,11 +9,9 @@ import (
 	"log/slog"
 	"os"
 
-	"github.com/common-fate/httpsig/alg_ecdsa"
-	"github.com/common-fate/httpsig/alg_ed25519"
-	"github.com/common-fate/httpsig/alg_rsa"
 	"github.com/common-fate/httpsig/verifier"
 	"github.com/micahhausler/httpsig-scratch/attributes"
+	"github.com/micahhausler/httpsig-scratch/keyalg"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -25,34 +23,43 @@ func init() {
 	slog.SetDefault(jsonLogger)
 }
 
+// ConvertSSHPublicKeyToRSAPublicKey returns the RSA public key of an SSH
+// public key.
+//
+// Deprecated: use keyalg.ParseSSHPublicKey, which supports every key type.
 func ConvertSSHPublicKeyToRSAPublicKey(sshPubKey ssh.PublicKey) (*rsa.PublicKey, error) {
-	// Check if the ssh.PublicKey is of type *ssh.CryptoPublicKey
-	if cryptoPubKey, ok := sshPubKey.(ssh.CryptoPublicKey); ok {
-		// Extract the underlying public key
-		if rsaPubKey, ok := cryptoPubKey.CryptoPublicKey().(*rsa.PublicKey); ok {
+	pk, err := keyalg.ParseSSHPublicKey(sshPubKey)
+	if err == nil {
+		if rsaPubKey, ok := pk.(*rsa.PublicKey); ok {
 			return rsaPubKey, nil
 		}
 	}
 	return nil, fmt.Errorf("not an RSA public key")
 }
 
+// ConvertSSHPublicKeyToECDSAPublicKey returns the ECDSA public key of an SSH
+// public key.
+//
+// Deprecated: use keyalg.ParseSSHPublicKey, which supports every key type.
 func ConvertSSHPublicKeyToECDSAPublicKey(sshPubKey ssh.PublicKey) (*ecdsa.PublicKey, error) {
-	// Check if the ssh.PublicKey is of type *ssh.CryptoPublicKey
-	if cryptoPubKey, ok := sshPubKey.(ssh.CryptoPublicKey); ok {
-		// Extract the underlying public key
-		if ecdsaPubKey, ok := cryptoPubKey.CryptoPublicKey().(*ecdsa.PublicKey); ok {
+	pk, err := keyalg.ParseSSHPublicKey(sshPubKey)
+	if err == nil {
+		if ecdsaPubKey, ok := pk.(*ecdsa.PublicKey); ok {
 			return ecdsaPubKey, nil
 		}
 	}
 	return nil, fmt.Errorf("not an ECDSA public key")
 }
 
+// ConvertSSHPublicKeyToED25519PublicKey returns the Ed25519 public key of an
+// SSH public key.
+//
+// Deprecated: use keyalg.ParseSSHPublicKey, which supports every key type.
 func ConvertSSHPublicKeyToED25519PublicKey(sshPubKey ssh.PublicKey) (*ed25519.PublicKey, error) {
-	// Check if the ssh.PublicKey is of type *ssh.CryptoPublicKey
-	if cryptoPubKey, ok := sshPubKey.(ssh.CryptoPublicKey); ok {
-		// Extract the underlying public key
-		if ecdsaPubKey, ok := cryptoPubKey.CryptoPublicKey().(ed25519.PublicKey); ok {
-			return &ecdsaPubKey, nil
+	pk, err := keyalg.ParseSSHPublicKey(sshPubKey)
+	if err == nil {
+		if ed25519PubKey, ok := pk.(ed25519.PublicKey); ok {
+			return &ed25519PubKey, nil
 		}
 	}
 	return nil, fmt.Errorf("not an ed25519 public key")
@@ -87,53 +94,28 @@ func addKeys(k keysForUsers, username string, keys [][]byte) error {
 			continue
 		}
 
-		switch pubKey.Type() {
-		case ssh.KeyAlgoRSA:
-			rsaPk, err := ConvertSSHPublicKeyToRSAPublicKey(pubKey)
-			if err != nil {
-				slog.Debug("invalid rsa ssh key", "key", key, "username", username, "error", err)
-				continue
-			}
-			algos = append(algos, alg_rsa.RSAPSS512{
-				PublicKey: rsaPk,
-				Attrs:     attributes.User{Username: username},
-			})
-		case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoSKECDSA256:
-			ecdsaPk, err := ConvertSSHPublicKeyToECDSAPublicKey(pubKey)
-			if err != nil {
-				slog.Debug("invalid ecdsa ssh key", "key", key, "username", username, "error", err)
-				continue
-			}
-			switch ecdsaPk.Curve.Params().Name {
-			case "P-256":
-				algos = append(algos, alg_ecdsa.P256{
-					PublicKey: ecdsaPk,
-					Attrs:     attributes.User{Username: username},
-				})
-			case "P-384":
-				algos = append(algos, alg_ecdsa.P384{
-					PublicKey: ecdsaPk,
-					Attrs:     attributes.User{Username: username},
-				})
-			default:
-				slog.Debug("unsupported ecdsa curve", "curve", ecdsaPk.Curve.Params().Name, "username", username)
+		cryptoPk, err := keyalg.ParseSSHPublicKey(pubKey)
+		if err != nil {
+			slog.Debug("key type not implemented", "keyType", pubKey.Type(), "username", username, "error", err)
+			continue
+		}
+		for _, name := range keyalg.AlgorithmsForKey(cryptoPk) {
+			// GitHub SSH RSA keys are only used for RSA-PSS
+			if name == keyalg.RSAPKCS1SHA256 {
 				continue
 			}
-		case ssh.KeyAlgoED25519, ssh.KeyAlgoSKED25519:
-			ed25519Pk, err := ConvertSSHPublicKeyToED25519PublicKey(pubKey)
+			alg, _ := keyalg.Lookup(name)
+			algo, err := alg.NewVerifier(cryptoPk, attributes.User{Username: username})
 			if err != nil {
-				slog.Debug("invalid ed25519 ssh key", "key", key, "username", username, "error", err)
+				slog.Debug("invalid ssh key", "key", key, "username", username, "alg", name, "error", err)
 				continue
 			}
-			algos = append(algos, alg_ed25519.Ed25519{
-				PublicKey: *ed25519Pk,
-				Attrs:     attributes.User{Username: username},
-			})
-		default:
+			algos = append(algos, algo)
+		}
+		if len(algos) == 0 {
 			slog.Debug("key type not implemented", "keyType", pubKey.Type(), "username", username)
 			continue
 		}
-
 		slog.Debug("adding key for user", "username", username, "kid", kid, "type", pubKey.Type(), "key", string(key))
 		keyMap[kid] = algos
 	}
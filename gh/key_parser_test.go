@@ -184,3 +184,50 @@ func TestAddKeys(t *testing.T) {
 	}
 
 }
+
+func TestConvertSSHPublicKey(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	ecdsaSSHKey, err := ssh.NewPublicKey(&ecdsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("error creating ssh key: %v", err)
+	}
+	ed25519Pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	ed25519SSHKey, err := ssh.NewPublicKey(ed25519Pub)
+	if err != nil {
+		t.Fatalf("error creating ssh key: %v", err)
+	}
+
+	gotECDSA, err := ConvertSSHPublicKeyToECDSAPublicKey(ecdsaSSHKey)
+	if err != nil {
+		t.Fatalf("failed to convert ECDSA key: %v", err)
+	}
+	if !gotECDSA.Equal(&ecdsaKey.PublicKey) {
+		t.Errorf("expected the ECDSA public key")
+	}
+	gotED25519, err := ConvertSSHPublicKeyToED25519PublicKey(ed25519SSHKey)
+	if err != nil {
+		t.Fatalf("failed to convert ed25519 key: %v", err)
+	}
+	if !gotED25519.Equal(ed25519Pub) {
+		t.Errorf("expected the ed25519 public key")
+	}
+
+	_, err = ConvertSSHPublicKeyToRSAPublicKey(ecdsaSSHKey)
+	if err == nil || err.Error() != "not an RSA public key" {
+		t.Errorf("expected not an RSA public key, got %v", err)
+	}
+	_, err = ConvertSSHPublicKeyToECDSAPublicKey(ed25519SSHKey)
+	if err == nil || err.Error() != "not an ECDSA public key" {
+		t.Errorf("expected not an ECDSA public key, got %v", err)
+	}
+	_, err = ConvertSSHPublicKeyToED25519PublicKey(ecdsaSSHKey)
+	if err == nil || err.Error() != "not an ed25519 public key" {
+		t.Errorf("expected not an ed25519 public key, got %v", err)
+	}
+}
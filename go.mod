@@ -4,6 +4,8 @@ go 1.23.1
 
 require (
 	github.com/common-fate/httpsig v0.2.0
+	github.com/dunglas/httpsfv v1.0.2
+	github.com/fxamacker/cbor/v2 v2.7.0
 	github.com/spf13/pflag v1.0.5
 	golang.org/x/crypto v0.27.0
 	k8s.io/api v0.31.1
@@ -15,9 +17,7 @@ require (
 
 require (
 	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
-	github.com/dunglas/httpsfv v1.0.2 // indirect
 	github.com/emicklei/go-restful/v3 v3.11.0 // indirect
-	github.com/fxamacker/cbor/v2 v2.7.0 // indirect
 	github.com/go-logr/logr v1.4.2 // indirect
 	github.com/go-openapi/jsonpointer v0.19.6 // indirect
 	github.com/go-openapi/jsonreference v0.20.2 // indirect
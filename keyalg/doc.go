@@ -0,0 +1,9 @@
+/*
+Package keyalg is a registry of RFC 9421 HTTP message signature algorithms.
+Each algorithm maps its name to a parser for its key material and a
+constructor for its verifier.Algorithm, so that key directories don't each
+carry their own mapping from key types to algorithms.
+
+Public keys can be PEM, DER, SSH authorized key, or JWK encoded.
+*/
+package keyalg
@@ -0,0 +1,196 @@
+package keyalg
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"slices"
+	"testing"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/signer"
+	"golang.org/x/crypto/ssh"
+)
+
+func encodings(t *testing.T, pub crypto.PublicKey) map[string][]byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("failed to create ssh key: %v", err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	var jwk map[string]string
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		jwk = map[string]string{"kty": "RSA", "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		jwk = map[string]string{"kty": "EC", "crv": k.Curve.Params().Name, "x": b64(k.X.Bytes()), "y": b64(k.Y.Bytes())}
+	case ed25519.PublicKey:
+		jwk = map[string]string{"kty": "OKP", "crv": "Ed25519", "x": b64(k)}
+	}
+	jwkData, err := json.Marshal(jwk)
+	if err != nil {
+		t.Fatalf("failed to marshal jwk: %v", err)
+	}
+	return map[string][]byte{
+		"pem": pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+		"der": der,
+		"ssh": ssh.MarshalAuthorizedKey(sshPub),
+		"jwk": jwkData,
+		// the session client labels PKIX keys by key type
+		"mislabeled pem": pem.EncodeToMemory(&pem.Block{Type: "ECDSA PUBLIC KEY", Bytes: der}),
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	cases := []struct {
+		alg    string
+		signer crypto.Signer
+	}{
+		{RSAPSSSHA512, rsaKey},
+		{RSAPKCS1SHA256, rsaKey},
+		{ECDSAP256SHA256, p256Key},
+		{ECDSAP384SHA384, p384Key},
+		{Ed25519, edKey},
+	}
+	for _, tc := range cases {
+		for encoding, data := range encodings(t, tc.signer.Public()) {
+			t.Run(tc.alg+"/"+encoding, func(t *testing.T) {
+				v, err := NewVerifier(tc.alg, data, "attrs")
+				if err != nil {
+					t.Fatalf("failed to create verifier: %v", err)
+				}
+				if v.Type() != tc.alg {
+					t.Errorf("expected type %s, got %s", tc.alg, v.Type())
+				}
+				if got := v.(httpsig.Attributer).Attributes(); got != "attrs" {
+					t.Errorf("expected attributes attrs, got %v", got)
+				}
+			})
+		}
+	}
+
+	t.Run("hmac", func(t *testing.T) {
+		v, err := NewVerifier(HMACSHA256, []byte("secret"), nil)
+		if err != nil {
+			t.Fatalf("failed to create verifier: %v", err)
+		}
+		sig, err := v.(signer.Algorithm).Sign(context.Background(), "base")
+		if err != nil {
+			t.Fatalf("failed to sign: %v", err)
+		}
+		if err := v.Verify(context.Background(), "base", sig); err != nil {
+			t.Errorf("failed to verify: %v", err)
+		}
+	})
+}
+
+func TestParseKeyMismatch(t *testing.T) {
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	pemKey := encodings(t, &p256Key.PublicKey)["pem"]
+
+	for _, alg := range []string{RSAPSSSHA512, ECDSAP384SHA384, Ed25519, "unknown"} {
+		if _, err := ParseKey(alg, pemKey); err == nil {
+			t.Errorf("expected P-256 key to be rejected for %s", alg)
+		}
+	}
+	if _, err := ParseKey(ECDSAP256SHA256, []byte("not a key")); err == nil {
+		t.Error("expected invalid key to be rejected")
+	}
+	if _, err := ParsePublicKey([]byte(`{"kty":"oct","k":"c2VjcmV0"}`)); err == nil {
+		t.Error("expected symmetric JWK to be rejected as a public key")
+	}
+}
+
+func TestAlgorithmsForKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	got := AlgorithmsForKey(&rsaKey.PublicKey)
+	want := []string{RSAPSSSHA512, RSAPKCS1SHA256}
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestMarshalJWK(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	keys := map[string]crypto.PublicKey{
+		"rsa":     &rsaKey.PublicKey,
+		"p256":    &p256Key.PublicKey,
+		"p384":    &p384Key.PublicKey,
+		"ed25519": edKey,
+	}
+	for name, key := range keys {
+		t.Run(name, func(t *testing.T) {
+			jwk, err := MarshalJWK(key)
+			if err != nil {
+				t.Fatalf("failed to marshal jwk: %v", err)
+			}
+			data, err := json.Marshal(jwk)
+			if err != nil {
+				t.Fatalf("failed to marshal jwk: %v", err)
+			}
+			got, err := ParsePublicKey(data)
+			if err != nil {
+				t.Fatalf("failed to parse jwk: %v", err)
+			}
+			if !got.(interface{ Equal(crypto.PublicKey) bool }).Equal(key) {
+				t.Errorf("expected parsed key to equal the original")
+			}
+		})
+	}
+	if _, err := MarshalJWK(HMACKey("secret")); err == nil {
+		t.Errorf("expected error marshaling a symmetric key")
+	}
+}
@@ -0,0 +1,75 @@
+package keyalg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ParsePublicKey parses an asymmetric public key that is PEM encoded (a key
+// or CERTIFICATE), DER encoded (PKIX or PKCS #1), an SSH authorized key, or
+// a JWK.
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, errors.New("empty public key")
+	}
+	if isJWK(data) {
+		key, err := parseJWK(data)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := key.(HMACKey); ok {
+			return nil, errors.New("JWK is a symmetric key, not a public key")
+		}
+		return key, nil
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		return parsePEMBlock(block)
+	}
+	if pub, _, _, _, err := ssh.ParseAuthorizedKey(data); err == nil {
+		return ParseSSHPublicKey(pub)
+	}
+	return parseDER(data)
+}
+
+// parsePEMBlock parses a certificate, or a PKIX or PKCS #1 key. Other block
+// types aren't trusted to distinguish key encodings, since clients label PKIX
+// keys as "RSA PUBLIC KEY" or "ECDSA PUBLIC KEY".
+func parsePEMBlock(block *pem.Block) (crypto.PublicKey, error) {
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	default:
+		return parseDER(block.Bytes)
+	}
+}
+
+func parseDER(der []byte) (crypto.PublicKey, error) {
+	if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+		return pub, nil
+	}
+	if pub, err := x509.ParsePKCS1PublicKey(der); err == nil {
+		return pub, nil
+	}
+	return nil, errors.New("failed to parse public key as PEM, DER, SSH, or JWK")
+}
+
+// ParseSSHPublicKey returns the crypto.PublicKey of an SSH public key,
+// including security key (sk-) types
+func ParseSSHPublicKey(pub ssh.PublicKey) (crypto.PublicKey, error) {
+	cryptoPub, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported SSH key type %q", pub.Type())
+	}
+	return cryptoPub.CryptoPublicKey(), nil
+}
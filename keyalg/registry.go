@@ -0,0 +1,194 @@
+package keyalg
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+	"sort"
+
+	"github.com/common-fate/httpsig/alg_ecdsa"
+	"github.com/common-fate/httpsig/alg_ed25519"
+	"github.com/common-fate/httpsig/alg_hmac"
+	"github.com/common-fate/httpsig/alg_rsa"
+	"github.com/common-fate/httpsig/verifier"
+)
+
+// Algorithm names from the HTTP Signature Algorithms registry
+const (
+	RSAPSSSHA512    = "rsa-pss-sha512"
+	RSAPKCS1SHA256  = "rsa-v1_5-sha256"
+	ECDSAP256SHA256 = "ecdsa-p256-sha256"
+	ECDSAP384SHA384 = "ecdsa-p384-sha384"
+	Ed25519         = "ed25519"
+	HMACSHA256      = "hmac-sha256"
+)
+
+// Algorithm describes how to use key material with a signature algorithm
+type Algorithm struct {
+	// Name is the algorithm's name in the HTTP Signature Algorithms registry
+	Name string
+
+	// ParseKey parses encoded key material for the algorithm
+	ParseKey func(data []byte) (crypto.PublicKey, error)
+
+	// Supports returns true if the parsed key can be used with the algorithm
+	Supports func(key crypto.PublicKey) bool
+
+	// NewVerifier returns a verifier for the key with the attributes, which
+	// are returned from its Attributes() method
+	NewVerifier func(key crypto.PublicKey, attributes any) (verifier.Algorithm, error)
+}
+
+var registry = map[string]*Algorithm{}
+
+// Register adds an algorithm to the registry, replacing any existing
+// algorithm with the same name
+func Register(alg *Algorithm) {
+	registry[alg.Name] = alg
+}
+
+// Lookup returns the registered algorithm with the name
+func Lookup(name string) (*Algorithm, bool) {
+	alg, ok := registry[name]
+	return alg, ok
+}
+
+// Names returns the names of all registered algorithms, sorted
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseKey parses key material for the named algorithm, returning an error
+// if the algorithm is unknown or the key can't be used with it
+func ParseKey(name string, data []byte) (crypto.PublicKey, error) {
+	alg, ok := Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", name)
+	}
+	key, err := alg.ParseKey(data)
+	if err != nil {
+		return nil, err
+	}
+	if !alg.Supports(key) {
+		return nil, fmt.Errorf("%T key can't be used with algorithm %q", key, name)
+	}
+	return key, nil
+}
+
+// NewVerifier parses key material and returns a verifier for the named
+// algorithm with the attributes
+func NewVerifier(name string, data []byte, attributes any) (verifier.Algorithm, error) {
+	key, err := ParseKey(name, data)
+	if err != nil {
+		return nil, err
+	}
+	alg, _ := Lookup(name)
+	return alg.NewVerifier(key, attributes)
+}
+
+// AlgorithmsForKey returns the names of the registered algorithms that
+// support the parsed key, sorted
+func AlgorithmsForKey(key crypto.PublicKey) []string {
+	names := []string{}
+	for _, name := range Names() {
+		if registry[name].Supports(key) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func isRSA(key crypto.PublicKey) bool {
+	_, ok := key.(*rsa.PublicKey)
+	return ok
+}
+
+func isECDSACurve(curve string) func(crypto.PublicKey) bool {
+	return func(key crypto.PublicKey) bool {
+		k, ok := key.(*ecdsa.PublicKey)
+		return ok && k.Curve.Params().Name == curve
+	}
+}
+
+func isEd25519(key crypto.PublicKey) bool {
+	_, ok := key.(ed25519.PublicKey)
+	return ok
+}
+
+// HMACKey is a shared secret. It is a distinct type so that secrets aren't
+// mistaken for asymmetric public keys.
+type HMACKey []byte
+
+func isHMAC(key crypto.PublicKey) bool {
+	_, ok := key.(HMACKey)
+	return ok
+}
+
+// parseHMACKey returns the raw secret, or the secret in an "oct" JWK
+func parseHMACKey(data []byte) (crypto.PublicKey, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty HMAC key")
+	}
+	if isJWK(data) {
+		return parseJWK(data)
+	}
+	return HMACKey(data), nil
+}
+
+func init() {
+	Register(&Algorithm{
+		Name:     RSAPSSSHA512,
+		ParseKey: ParsePublicKey,
+		Supports: isRSA,
+		NewVerifier: func(key crypto.PublicKey, attributes any) (verifier.Algorithm, error) {
+			return &alg_rsa.RSAPSS512{PublicKey: key.(*rsa.PublicKey), Attrs: attributes}, nil
+		},
+	})
+	Register(&Algorithm{
+		Name:     RSAPKCS1SHA256,
+		ParseKey: ParsePublicKey,
+		Supports: isRSA,
+		NewVerifier: func(key crypto.PublicKey, attributes any) (verifier.Algorithm, error) {
+			return &alg_rsa.RSAPKCS256{PublicKey: key.(*rsa.PublicKey), Attrs: attributes}, nil
+		},
+	})
+	Register(&Algorithm{
+		Name:     ECDSAP256SHA256,
+		ParseKey: ParsePublicKey,
+		Supports: isECDSACurve("P-256"),
+		NewVerifier: func(key crypto.PublicKey, attributes any) (verifier.Algorithm, error) {
+			return &alg_ecdsa.P256{PublicKey: key.(*ecdsa.PublicKey), Attrs: attributes}, nil
+		},
+	})
+	Register(&Algorithm{
+		Name:     ECDSAP384SHA384,
+		ParseKey: ParsePublicKey,
+		Supports: isECDSACurve("P-384"),
+		NewVerifier: func(key crypto.PublicKey, attributes any) (verifier.Algorithm, error) {
+			return &alg_ecdsa.P384{PublicKey: key.(*ecdsa.PublicKey), Attrs: attributes}, nil
+		},
+	})
+	Register(&Algorithm{
+		Name:     Ed25519,
+		ParseKey: ParsePublicKey,
+		Supports: isEd25519,
+		NewVerifier: func(key crypto.PublicKey, attributes any) (verifier.Algorithm, error) {
+			return &alg_ed25519.Ed25519{PublicKey: key.(ed25519.PublicKey), Attrs: attributes}, nil
+		},
+	})
+	Register(&Algorithm{
+		Name:     HMACSHA256,
+		ParseKey: parseHMACKey,
+		Supports: isHMAC,
+		NewVerifier: func(key crypto.PublicKey, attributes any) (verifier.Algorithm, error) {
+			return alg_hmac.NewHMACWithAttributes(key.(HMACKey), attributes), nil
+		},
+	})
+}
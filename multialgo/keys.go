@@ -0,0 +1,37 @@
+package multialgo
+
+import (
+	"fmt"
+
+	"github.com/common-fate/httpsig/verifier"
+	"github.com/micahhausler/httpsig-scratch/keyalg"
+)
+
+// Key is encoded key material and the algorithm it is used with
+type Key struct {
+	// Alg is the algorithm name, such as "ecdsa-p256-sha256"
+	Alg string
+	// PublicKey is a PEM, DER, SSH, or JWK public key, or an HMAC secret
+	PublicKey []byte
+	// Attributes are returned by the key's Attributes() method
+	Attributes any
+}
+
+// NewMultiAlgoAttributerDirectoryFromKeys parses the keys, indexed by key
+// ID, with the keyalg registry and returns an in-memory KeyDirectory
+// supporting httpsig.Attributer.
+func NewMultiAlgoAttributerDirectoryFromKeys(keys map[string]Key) (verifier.KeyDirectory, error) {
+	algos := map[string]AttributerAlgo{}
+	for kid, key := range keys {
+		algo, err := keyalg.NewVerifier(key.Alg, key.PublicKey, key.Attributes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", kid, err)
+		}
+		attributerAlgo, ok := algo.(AttributerAlgo)
+		if !ok {
+			return nil, fmt.Errorf("key %q algorithm %q does not support attributes", kid, key.Alg)
+		}
+		algos[kid] = attributerAlgo
+	}
+	return NewMultiAlgoAttributerDirectory(algos), nil
+}
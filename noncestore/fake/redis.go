@@ -0,0 +1,277 @@
+// Package fake is an in-process Redis server for tests and local demos. It
+// speaks enough of the Redis protocol for noncestore.NewRedisStore: PING,
+// AUTH, GET, DEL, and SET with the NX, PX, and EX options. Keys are held in
+// memory.
+package fake
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redis is a fake Redis server listening on localhost
+type Redis struct {
+	listener net.Listener
+	password string
+
+	mu    sync.Mutex
+	keys  map[string]entry
+	calls map[string]int
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+}
+
+type entry struct {
+	value  string
+	expiry time.Time
+}
+
+// NewRedis starts a fake Redis on a random localhost port. If password is
+// set, connections must authenticate with it.
+func NewRedis(password string) (*Redis, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	r := &Redis{
+		listener: listener,
+		password: password,
+		keys:     map[string]entry{},
+		calls:    map[string]int{},
+		conns:    map[net.Conn]bool{},
+	}
+	r.wg.Add(1)
+	go r.serve()
+	return r, nil
+}
+
+// Addr returns the host:port the server listens on
+func (r *Redis) Addr() string {
+	return r.listener.Addr().String()
+}
+
+// Close stops the server, and closes its connections
+func (r *Redis) Close() error {
+	err := r.listener.Close()
+	r.mu.Lock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	return err
+}
+
+// Calls returns the number of times a command, such as "SET", was called
+func (r *Redis) Calls(command string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls[command]
+}
+
+// TTL returns how long until the key expires, or false if it isn't set or
+// doesn't expire
+func (r *Redis) TTL(key string) (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.get(key)
+	if !ok || e.expiry.IsZero() {
+		return 0, false
+	}
+	return time.Until(e.expiry), true
+}
+
+func (r *Redis) serve() {
+	defer r.wg.Done()
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.conns[conn] = true
+		r.mu.Unlock()
+		r.wg.Add(1)
+		go r.serveConn(conn)
+	}
+}
+
+func (r *Redis) serveConn(conn net.Conn) {
+	defer r.wg.Done()
+	defer func() {
+		r.mu.Lock()
+		delete(r.conns, conn)
+		r.mu.Unlock()
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	authenticated := r.password == ""
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				_, _ = conn.Write([]byte("-ERR " + err.Error() + "\r\n"))
+			}
+			return
+		}
+		var reply string
+		switch {
+		case len(args) == 0:
+			reply = "-ERR empty command\r\n"
+		case strings.EqualFold(args[0], "AUTH"):
+			authenticated = len(args) == 2 && args[1] == r.password
+			reply = "+OK\r\n"
+			if !authenticated {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = r.exec(args)
+		}
+		_, err = conn.Write([]byte(reply))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// exec runs a command, and returns its encoded reply
+func (r *Redis) exec(args []string) string {
+	command := strings.ToUpper(args[0])
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls[command]++
+	switch command {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		if len(args) != 2 {
+			return wrongArgs(command)
+		}
+		e, ok := r.get(args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(e.value)
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := r.get(key); ok {
+				delete(r.keys, key)
+				deleted++
+			}
+		}
+		return ":" + strconv.Itoa(deleted) + "\r\n"
+	case "SET":
+		return r.set(args)
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+// set runs `SET key value [NX] [PX milliseconds | EX seconds]`. The caller
+// must hold the lock.
+func (r *Redis) set(args []string) string {
+	if len(args) < 3 {
+		return wrongArgs("SET")
+	}
+	e := entry{value: args[2]}
+	nx := false
+	for i := 3; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); option {
+		case "NX":
+			nx = true
+		case "PX", "EX":
+			if i+1 >= len(args) {
+				return "-ERR syntax error\r\n"
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || n <= 0 {
+				return "-ERR invalid expire time in 'set' command\r\n"
+			}
+			unit := time.Millisecond
+			if option == "EX" {
+				unit = time.Second
+			}
+			e.expiry = time.Now().Add(time.Duration(n) * unit)
+		default:
+			return "-ERR syntax error\r\n"
+		}
+	}
+	if _, ok := r.get(args[1]); ok && nx {
+		return "$-1\r\n"
+	}
+	r.keys[args[1]] = e
+	return "+OK\r\n"
+}
+
+// get returns the key's entry if it hasn't expired. The caller must hold
+// the lock.
+func (r *Redis) get(key string) (entry, bool) {
+	e, ok := r.keys[key]
+	if ok && !e.expiry.IsZero() && !e.expiry.After(time.Now()) {
+		delete(r.keys, key)
+		return entry{}, false
+	}
+	return e, ok
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("Protocol error: expected '*'")
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return nil, errors.New("Protocol error: invalid multibulk length")
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err = readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errors.New("Protocol error: expected '$'")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, errors.New("Protocol error: invalid bulk length")
+		}
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func wrongArgs(command string) string {
+	return fmt.Sprintf("-ERR wrong number of arguments for '%s' command\r\n", strings.ToLower(command))
+}
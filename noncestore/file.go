@@ -0,0 +1,178 @@
+package noncestore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type fileStore struct {
+	mu     sync.Mutex
+	path   string
+	memory *memoryStore
+	// appended is the number of keys appended to the file since it was
+	// compacted, when it had live keys
+	appended int
+	live     int
+}
+
+// minCompact is the fewest appended keys the file is compacted at
+const minCompact = 1024
+
+// NewFileStore returns a Store that holds keys in memory, and appends them
+// to the file at path, so they survive restarts. Unexpired keys are loaded
+// from the file if it exists, and the file is compacted to drop expired
+// keys as it grows.
+//
+// Each key is synced to disk before CheckAndSet returns, so a crash can't
+// forget a key that was accepted, and keys are recorded one at a time.
+func NewFileStore(path string) (Store, error) {
+	s := &fileStore{
+		path:   path,
+		memory: NewMemoryStore(MemoryOpts{}).(*memoryStore),
+	}
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	err = s.compact()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+var _ Store = &fileStore{}
+
+// load reads the unexpired keys in the file
+func (s *fileStore) load() error {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	now := time.Now()
+	// keys are short hashes, but lines aren't limited in length, so a file
+	// written before keys were hashed still loads
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		text, err := r.ReadString('\n')
+		if errors.Is(err, io.EOF) && text == "" {
+			return nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		key, expiry, err := parseEntry(strings.TrimSuffix(text, "\n"))
+		if err != nil {
+			return fmt.Errorf("failed to parse nonce file %s line %d: %w", s.path, line, err)
+		}
+		_, _ = s.memory.shardFor(key).checkAndSet(key, expiry, now, 0)
+	}
+}
+
+func (s *fileStore) CheckAndSet(ctx context.Context, key string, expiry time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen, err := s.memory.CheckAndSet(ctx, key, expiry)
+	if seen || err != nil {
+		return seen, err
+	}
+	err = s.append(key, expiry)
+	if err != nil {
+		return false, fmt.Errorf("failed to record nonce: %w", err)
+	}
+	s.appended++
+	if s.appended >= max(s.live, minCompact) {
+		// the key is recorded either way, so a failed compaction is
+		// retried after the next key
+		_ = s.compact()
+	}
+	return false, nil
+}
+
+// append adds the key to the file, and syncs it. The caller must hold the
+// lock.
+func (s *fileStore) append(key string, expiry time.Time) error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(formatEntry(key, expiry))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// compact writes the unexpired keys to a temporary file and renames it over
+// the file, so a crash never leaves a partially written file. The caller
+// must hold the lock, or be the constructor.
+func (s *fileStore) compact() error {
+	entries := s.memory.entries(time.Now())
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for key, expiry := range entries {
+		_, err = w.WriteString(formatEntry(key, expiry))
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		return err
+	}
+	s.appended, s.live = 0, len(entries)
+	return nil
+}
+
+// formatEntry returns a line of the file: the key's expiry in Unix
+// nanoseconds, and the quoted key
+func formatEntry(key string, expiry time.Time) string {
+	return strconv.FormatInt(expiry.UnixNano(), 10) + " " + strconv.Quote(key) + "\n"
+}
+
+func parseEntry(line string) (string, time.Time, error) {
+	expiryValue, quoted, ok := strings.Cut(line, " ")
+	if !ok {
+		return "", time.Time{}, errors.New("missing key")
+	}
+	expiry, err := strconv.ParseInt(expiryValue, 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid expiry: %w", err)
+	}
+	key, err := strconv.Unquote(quoted)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid key: %w", err)
+	}
+	return key, time.Unix(0, expiry), nil
+}
@@ -0,0 +1,118 @@
+package noncestore
+
+import (
+	"context"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// MemoryOpts configures an in-memory Store
+type MemoryOpts struct {
+	// Shards is the number of independently locked shards keys are spread
+	// over, so concurrent requests don't contend on one lock. Defaults to
+	// 16.
+	Shards int
+
+	// MaxKeys, if set, is the most unexpired keys the store holds. Once it
+	// is full, CheckAndSet returns ErrFull until keys expire. If keys are
+	// recorded before requests are authenticated, as NonceStorage is by
+	// the common-fate/httpsig verifier, unauthenticated traffic can fill it.
+	MaxKeys int
+}
+
+type memoryStore struct {
+	seed    maphash.Seed
+	shards  []*memoryShard
+	maxKeys int
+}
+
+type memoryShard struct {
+	mu   sync.Mutex
+	keys map[string]time.Time
+	// sweepAt is the number of keys at which expired keys are next swept
+	sweepAt int
+}
+
+// minSweep is the fewest keys a shard sweeps expired keys at
+const minSweep = 64
+
+// NewMemoryStore returns a Store that holds keys in memory. Expired keys
+// are swept from a shard as it grows, so memory is bounded by the keys
+// recorded in a validity window rather than by all traffic. The keys don't
+// survive a restart.
+func NewMemoryStore(opts MemoryOpts) Store {
+	shards := opts.Shards
+	if shards <= 0 {
+		shards = 16
+	}
+	s := &memoryStore{
+		seed:   maphash.MakeSeed(),
+		shards: make([]*memoryShard, shards),
+	}
+	if opts.MaxKeys > 0 {
+		s.maxKeys = max(opts.MaxKeys/shards, 1)
+	}
+	for i := range s.shards {
+		s.shards[i] = &memoryShard{keys: map[string]time.Time{}, sweepAt: minSweep}
+	}
+	return s
+}
+
+var _ Store = &memoryStore{}
+
+func (s *memoryStore) CheckAndSet(ctx context.Context, key string, expiry time.Time) (bool, error) {
+	return s.shardFor(key).checkAndSet(key, expiry, time.Now(), s.maxKeys)
+}
+
+func (s *memoryStore) shardFor(key string) *memoryShard {
+	return s.shards[maphash.String(s.seed, key)%uint64(len(s.shards))]
+}
+
+func (s *memoryShard) checkAndSet(key string, expiry, now time.Time, maxKeys int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.keys[key]; ok && existing.After(now) {
+		return true, nil
+	}
+	if !expiry.After(now) {
+		// a signature that has expired isn't accepted, so there's nothing
+		// to record
+		return false, nil
+	}
+	if len(s.keys) >= s.sweepAt || (maxKeys > 0 && len(s.keys) >= maxKeys) {
+		s.sweep(now)
+	}
+	if maxKeys > 0 && len(s.keys) >= maxKeys {
+		return false, ErrFull
+	}
+	s.keys[key] = expiry
+	return false, nil
+}
+
+// sweep deletes expired keys. The caller must hold the lock.
+func (s *memoryShard) sweep(now time.Time) {
+	for key, expiry := range s.keys {
+		if !expiry.After(now) {
+			delete(s.keys, key)
+		}
+	}
+	// sweep again once the live keys double, so sweeping stays amortized
+	// constant time per key
+	s.sweepAt = max(2*len(s.keys), minSweep)
+}
+
+// entries returns the unexpired keys and their expiries
+func (s *memoryStore) entries(now time.Time) map[string]time.Time {
+	entries := map[string]time.Time{}
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		for key, expiry := range shard.keys {
+			if expiry.After(now) {
+				entries[key] = expiry
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return entries
+}
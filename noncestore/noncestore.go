@@ -0,0 +1,130 @@
+/*
+Package noncestore records the nonces of verified signatures, and other keys
+a server must only accept once, until the signatures they came with stop
+being accepted.
+
+The common-fate/httpsig inmemory.NewNonceStorage() keeps every nonce forever,
+so memory grows with traffic, and forgets them all on restart, so a captured
+request can be replayed after one. A Store records each key with an expiry,
+the end of its signature's validity window, after which a replay would be
+rejected for its created time anyway:
+
+  - NewMemoryStore is a sharded in-memory Store that drops expired keys
+  - NewFileStore also appends keys to a file, so they survive restarts
+  - NewRedisStore records keys in Redis, or another server speaking its
+    protocol, so replicas of a server share them
+
+NonceStorage adapts a Store to the verifier.NonceStorage interface. The
+verifier doesn't pass the signature's validity window to it, so the
+routeverify middleware puts it in the request context with WithExpiry.
+
+Signatures from clients that don't send a nonce can be recorded by the hash
+of their key ID and signature base instead, with SignatureKey, in the same
+Store.
+*/
+package noncestore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/common-fate/httpsig/verifier"
+)
+
+// Store records keys until they expire
+type Store interface {
+	// CheckAndSet records the key until expiry, and returns true if it was
+	// already recorded and hasn't expired. It checks and records the key
+	// atomically, so of several concurrent calls with the same key, only
+	// one returns false.
+	CheckAndSet(ctx context.Context, key string, expiry time.Time) (bool, error)
+}
+
+// ErrFull is returned when a Store can't record any more keys. Stores fail
+// closed rather than forgetting keys that haven't expired.
+var ErrFull = errors.New("nonce store is full")
+
+type expiryKey struct{}
+
+// WithExpiry returns a context carrying when the signature being verified
+// stops being accepted, so NonceStorage records its nonce until then
+func WithExpiry(ctx context.Context, expiry time.Time) context.Context {
+	return context.WithValue(ctx, expiryKey{}, expiry)
+}
+
+// ExpiryFromContext returns the expiry set by WithExpiry, or false if it
+// wasn't set
+func ExpiryFromContext(ctx context.Context) (time.Time, bool) {
+	expiry, ok := ctx.Value(expiryKey{}).(time.Time)
+	return expiry, ok
+}
+
+// NoncePrefix and SignaturePrefix prefix nonces and signature hashes in a
+// Store, so they can share it
+const (
+	NoncePrefix     = "nonce:"
+	SignaturePrefix = "signature:"
+)
+
+// MaxNonceLength is the longest nonce NonceStorage accepts. Nonces are
+// usually 32 random bytes, encoded in under 64 characters.
+const MaxNonceLength = 256
+
+// ErrNonceTooLong is returned for nonces longer than MaxNonceLength
+var ErrNonceTooLong = fmt.Errorf("nonce is longer than %d bytes", MaxNonceLength)
+
+// NonceKey returns the key recording a nonce: the SHA-256 hash of its value,
+// so keys have a fixed length however long the nonce is
+func NonceKey(nonce string) string {
+	return NoncePrefix + hashKey([]byte(nonce))
+}
+
+// SignatureKey returns the key recording a signature without a nonce: the
+// SHA-256 hash of its key ID and signature base. Every valid signature over
+// the same content has the same key, so a signature can't be replayed by
+// re-encoding it, such as by flipping the S value of an ECDSA signature.
+func SignatureKey(keyID, base string) string {
+	content := binary.AppendUvarint(nil, uint64(len(keyID)))
+	content = append(content, keyID...)
+	content = append(content, base...)
+	return SignaturePrefix + hashKey(content)
+}
+
+func hashKey(value []byte) string {
+	sum := sha256.Sum256(value)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+type nonceStorage struct {
+	store Store
+	ttl   time.Duration
+}
+
+// NonceStorage returns a verifier.NonceStorage that records nonces in the
+// store until the expiry in the context, or for ttl if the context has none.
+// The ttl should be at least the verifier's maximum signature age, plus its
+// allowed clock skew. Nonces longer than MaxNonceLength are rejected.
+//
+// The common-fate/httpsig verifier checks the nonce before it verifies the
+// signature, so unauthenticated requests can record nonces too, and fill a
+// store with MaxKeys until they expire. The routeverify middleware only
+// checks nonces once the signature is verified.
+func NonceStorage(store Store, ttl time.Duration) verifier.NonceStorage {
+	return &nonceStorage{store: store, ttl: ttl}
+}
+
+func (n *nonceStorage) Seen(ctx context.Context, nonce string) (bool, error) {
+	if len(nonce) > MaxNonceLength {
+		return false, ErrNonceTooLong
+	}
+	expiry, ok := ExpiryFromContext(ctx)
+	if !ok {
+		expiry = time.Now().Add(n.ttl)
+	}
+	return n.store.CheckAndSet(ctx, NonceKey(nonce), expiry)
+}
@@ -0,0 +1,248 @@
+package noncestore_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micahhausler/httpsig-scratch/noncestore"
+	"github.com/micahhausler/httpsig-scratch/noncestore/fake"
+)
+
+func newRedisStore(t *testing.T) noncestore.Store {
+	server, err := fake.NewRedis("secret")
+	if err != nil {
+		t.Fatalf("failed to start fake redis: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return noncestore.NewRedisStore(noncestore.RedisOpts{Addr: server.Addr(), Password: "secret"})
+}
+
+func newFileStore(t *testing.T) noncestore.Store {
+	store, err := noncestore.NewFileStore(filepath.Join(t.TempDir(), "nonces"))
+	if err != nil {
+		t.Fatalf("failed to create file store: %v", err)
+	}
+	return store
+}
+
+var stores = map[string]func(t *testing.T) noncestore.Store{
+	"memory": func(t *testing.T) noncestore.Store { return noncestore.NewMemoryStore(noncestore.MemoryOpts{}) },
+	"file":   newFileStore,
+	"redis":  newRedisStore,
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			expiry := time.Now().Add(time.Minute)
+			for i, want := range []bool{false, true, true} {
+				seen, err := store.CheckAndSet(ctx, "a", expiry)
+				if err != nil {
+					t.Fatalf("failed to check key: %v", err)
+				}
+				if seen != want {
+					t.Errorf("call %d: expected seen %t, got %t", i, want, seen)
+				}
+			}
+			if seen, err := store.CheckAndSet(ctx, "b", expiry); seen || err != nil {
+				t.Errorf("expected another key not to be seen, got %t: %v", seen, err)
+			}
+
+			// expired keys are forgotten
+			if seen, err := store.CheckAndSet(ctx, "c", time.Now().Add(50*time.Millisecond)); seen || err != nil {
+				t.Fatalf("expected a new key not to be seen, got %t: %v", seen, err)
+			}
+			time.Sleep(100 * time.Millisecond)
+			if seen, err := store.CheckAndSet(ctx, "c", expiry); seen || err != nil {
+				t.Errorf("expected an expired key not to be seen, got %t: %v", seen, err)
+			}
+			if seen, err := store.CheckAndSet(ctx, "c", expiry); !seen || err != nil {
+				t.Errorf("expected a key recorded again to be seen, got %t: %v", seen, err)
+			}
+
+			// of concurrent calls with the same key, only one sees it as new
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			unseen := 0
+			for range 20 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					seen, err := store.CheckAndSet(ctx, "d", expiry)
+					if err != nil {
+						t.Errorf("failed to check key: %v", err)
+					}
+					if !seen {
+						mu.Lock()
+						unseen++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			if unseen != 1 {
+				t.Errorf("expected one concurrent call to see the key as new, got %d", unseen)
+			}
+		})
+	}
+}
+
+func TestNonceStorage(t *testing.T) {
+	server, err := fake.NewRedis("")
+	if err != nil {
+		t.Fatalf("failed to start fake redis: %v", err)
+	}
+	defer server.Close()
+	storage := noncestore.NonceStorage(noncestore.NewRedisStore(noncestore.RedisOpts{Addr: server.Addr()}), time.Hour)
+
+	cases := []struct {
+		name    string
+		ctx     context.Context
+		nonce   string
+		wantTTL time.Duration
+	}{
+		{
+			name:    "expiry from the context",
+			ctx:     noncestore.WithExpiry(context.Background(), time.Now().Add(time.Minute)),
+			nonce:   "abc",
+			wantTTL: time.Minute,
+		},
+		{
+			name:    "default ttl",
+			ctx:     context.Background(),
+			nonce:   "def",
+			wantTTL: time.Hour,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for i, want := range []bool{false, true} {
+				seen, err := storage.Seen(tc.ctx, tc.nonce)
+				if err != nil || seen != want {
+					t.Fatalf("call %d: expected seen %t, got %t: %v", i, want, seen, err)
+				}
+			}
+			ttl, ok := server.TTL("httpsig:" + noncestore.NonceKey(tc.nonce))
+			if !ok || ttl > tc.wantTTL || ttl < tc.wantTTL-5*time.Second {
+				t.Errorf("expected a ttl of about %s, got %s", tc.wantTTL, ttl)
+			}
+		})
+	}
+}
+
+func TestNonceStorageLongNonce(t *testing.T) {
+	store := noncestore.NewMemoryStore(noncestore.MemoryOpts{})
+	storage := noncestore.NonceStorage(store, time.Minute)
+	nonce := strings.Repeat("a", noncestore.MaxNonceLength+1)
+	if _, err := storage.Seen(context.Background(), nonce); !errors.Is(err, noncestore.ErrNonceTooLong) {
+		t.Errorf("expected ErrNonceTooLong, got %v", err)
+	}
+	if seen, err := storage.Seen(context.Background(), nonce[1:]); seen || err != nil {
+		t.Errorf("expected a nonce of the maximum length to be accepted, got %t: %v", seen, err)
+	}
+	if key := noncestore.NonceKey(nonce); len(key) > 64 {
+		t.Errorf("expected a fixed length key, got %d bytes", len(key))
+	}
+}
+
+func TestFileStoreRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "nonces")
+	store, err := noncestore.NewFileStore(path)
+	if err != nil {
+		t.Fatalf("failed to create file store: %v", err)
+	}
+	if _, err := store.CheckAndSet(ctx, "kept", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("failed to check key: %v", err)
+	}
+	if _, err := store.CheckAndSet(ctx, "expired", time.Now().Add(50*time.Millisecond)); err != nil {
+		t.Fatalf("failed to check key: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	restarted, err := noncestore.NewFileStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen file store: %v", err)
+	}
+	if seen, err := restarted.CheckAndSet(ctx, "kept", time.Now().Add(time.Minute)); !seen || err != nil {
+		t.Errorf("expected a key to survive a restart, got %t: %v", seen, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if strings.Contains(string(data), `"expired"`) {
+		t.Errorf("expected expired keys to be compacted away, got %s", data)
+	}
+
+	// lines longer than bufio.Scanner's limit still load
+	long := fmt.Sprintf("%d %q\n", time.Now().Add(time.Minute).UnixNano(), strings.Repeat("a", 100<<10))
+	if err := os.WriteFile(path, []byte(long), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if _, err := noncestore.NewFileStore(path); err != nil {
+		t.Errorf("failed to load a file with a long line: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("not a nonce\n"), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if _, err := noncestore.NewFileStore(path); err == nil {
+		t.Error("expected error for a malformed file, got none")
+	}
+}
+
+func TestMemoryStoreMaxKeys(t *testing.T) {
+	ctx := context.Background()
+	store := noncestore.NewMemoryStore(noncestore.MemoryOpts{Shards: 1, MaxKeys: 2})
+	for _, key := range []string{"a", "b"} {
+		if _, err := store.CheckAndSet(ctx, key, time.Now().Add(time.Minute)); err != nil {
+			t.Fatalf("failed to check key: %v", err)
+		}
+	}
+	if _, err := store.CheckAndSet(ctx, "c", time.Now().Add(time.Minute)); !errors.Is(err, noncestore.ErrFull) {
+		t.Errorf("expected ErrFull, got %v", err)
+	}
+	if seen, err := store.CheckAndSet(ctx, "a", time.Now().Add(time.Minute)); !seen || err != nil {
+		t.Errorf("expected a recorded key to be seen when full, got %t: %v", seen, err)
+	}
+}
+
+func TestRedisStoreWrongPassword(t *testing.T) {
+	server, err := fake.NewRedis("secret")
+	if err != nil {
+		t.Fatalf("failed to start fake redis: %v", err)
+	}
+	defer server.Close()
+	store := noncestore.NewRedisStore(noncestore.RedisOpts{Addr: server.Addr(), Password: "wrong"})
+	if _, err := store.CheckAndSet(context.Background(), "a", time.Now().Add(time.Minute)); err == nil {
+		t.Error("expected error for a wrong password, got none")
+	}
+	if server.Calls("SET") != 0 {
+		t.Errorf("expected no SET calls, got %d", server.Calls("SET"))
+	}
+}
+
+func TestSignatureKey(t *testing.T) {
+	key := noncestore.SignatureKey("kid-1", "base")
+	if !strings.HasPrefix(key, noncestore.SignaturePrefix) || strings.Contains(key, "base") {
+		t.Errorf("expected a prefixed hash of the signature base, got %s", key)
+	}
+	if key != noncestore.SignatureKey("kid-1", "base") {
+		t.Error("expected the key to be the same for a signature base")
+	}
+	for _, other := range [][2]string{{"kid-2", "base"}, {"kid-1", "other"}, {"kid-1b", "ase"}} {
+		if key == noncestore.SignatureKey(other[0], other[1]) {
+			t.Errorf("expected the key to differ for %q", other)
+		}
+	}
+}
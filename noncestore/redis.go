@@ -0,0 +1,220 @@
+package noncestore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RedisOpts configures a Store in Redis, or another server speaking its
+// protocol
+type RedisOpts struct {
+	// Addr is the server's host:port
+	Addr string
+
+	// Password, if set, authenticates each connection with AUTH
+	Password string
+
+	// KeyPrefix is prepended to keys, so the store can share a database.
+	// Defaults to `httpsig:`.
+	KeyPrefix string
+
+	// Timeout bounds dialing and each command, unless the context's
+	// deadline is sooner. Defaults to 5 seconds.
+	Timeout time.Duration
+
+	// MaxIdleConns is the number of connections kept open between
+	// commands. Defaults to 4.
+	MaxIdleConns int
+}
+
+type redisStore struct {
+	opts RedisOpts
+	idle chan *redisConn
+}
+
+// NewRedisStore returns a Store that records keys in Redis with `SET NX PX`,
+// so several replicas of a server share them. Keys expire in Redis at their
+// expiry, measured by the Redis server's clock.
+func NewRedisStore(opts RedisOpts) Store {
+	if opts.KeyPrefix == "" {
+		opts.KeyPrefix = "httpsig:"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.MaxIdleConns <= 0 {
+		opts.MaxIdleConns = 4
+	}
+	return &redisStore{opts: opts, idle: make(chan *redisConn, opts.MaxIdleConns)}
+}
+
+var _ Store = &redisStore{}
+
+func (s *redisStore) CheckAndSet(ctx context.Context, key string, expiry time.Time) (bool, error) {
+	ttl := time.Until(expiry).Milliseconds()
+	if ttl <= 0 {
+		return false, nil
+	}
+	reply, err := s.do(ctx, "SET", s.opts.KeyPrefix+key, "1", "NX", "PX", strconv.FormatInt(ttl, 10))
+	if err != nil {
+		return false, fmt.Errorf("failed to record nonce in redis: %w", err)
+	}
+	// SET NX replies nil if the key was already set
+	return reply == nil, nil
+}
+
+// do sends a command, and returns its reply
+func (s *redisStore) do(ctx context.Context, args ...string) (any, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.setDeadline(ctx, s.opts.Timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply, err := conn.do(args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// the connection is in an unknown state
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case s.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+// conn returns an idle connection, or dials a new one
+func (s *redisStore) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-s.idle:
+		return conn, nil
+	default:
+	}
+	dialer := &net.Dialer{Timeout: s.opts.Timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", s.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: netConn, r: bufio.NewReader(netConn)}
+	if s.opts.Password != "" {
+		err = conn.setDeadline(ctx, s.opts.Timeout)
+		if err == nil {
+			_, err = conn.do("AUTH", s.opts.Password)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to authenticate: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// redisError is an error reply
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// redisConn is a connection speaking RESP, the Redis serialization protocol
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *redisConn) setDeadline(ctx context.Context, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	return c.SetDeadline(deadline)
+}
+
+// do writes a command as an array of bulk strings, and reads its reply
+func (c *redisConn) do(args ...string) (any, error) {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	_, err := c.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+// readReply reads a RESP reply: a simple string or integer, a bulk string as
+// a []byte, an array as a []any, nil for a null reply, or an error reply as
+// an error
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("invalid bulk string length %q", line[1:])
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("invalid array length %q", line[1:])
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		values := make([]any, n)
+		for i := range values {
+			values[i], err = readReply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", line[0])
+}
+
+// readLine reads a line ending in CRLF, without it
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("line doesn't end in CRLF")
+	}
+	return line[:len(line)-2], nil
+}
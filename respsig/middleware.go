@@ -0,0 +1,217 @@
+package respsig
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/common-fate/httpsig/contentdigest"
+	"github.com/common-fate/httpsig/signer"
+	"github.com/dunglas/httpsfv"
+	"github.com/micahhausler/httpsig-scratch/streamdigest"
+)
+
+// SignerOpts configures response signing
+type SignerOpts struct {
+	// KeyID, Tag, and Alg are the signature's key ID, tag, and algorithm
+	KeyID string
+	Tag   string
+	Alg   signer.Algorithm
+
+	// Headers of the response to cover, if they are set
+	Headers []string
+
+	// Scheme and Authority are the URL scheme and authority clients send
+	// requests to, to derive the request's `@target-uri`
+	Scheme    string
+	Authority string
+
+	// OnSigningError, if set, is called when a response can't be signed
+	OnSigningError func(ctx context.Context, err error)
+
+	// OnDeriveSigningString is a hook to log the string to sign
+	OnDeriveSigningString func(ctx context.Context, stringToSign string)
+
+	// Unsigned returns true for requests whose responses are passed through
+	// unsigned, because they can't be buffered. Defaults to Streaming.
+	Unsigned func(r *http.Request) bool
+}
+
+// Streaming returns true for requests whose responses stream until the
+// client disconnects: Kubernetes watches (`watch=true`), followed logs
+// (`follow=true`), and upgraded connections such as exec and port-forward.
+// Clients must not expect these responses to be signed.
+func Streaming(r *http.Request) bool {
+	if r.Header.Get("Upgrade") != "" {
+		return true
+	}
+	query := r.URL.Query()
+	for _, name := range []string{"watch", "follow"} {
+		if v, err := strconv.ParseBool(query.Get(name)); err == nil && v {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware returns a middleware that signs responses. The response is
+// buffered to set its Content-Digest header before the signature, so
+// responses to requests that SignerOpts.Unsigned matches, which never end,
+// aren't signed. The digest uses the algorithm the request's
+// Want-Content-Digest header prefers, or the signing algorithm's digester.
+// If the response can't be signed, a 500 Internal Server Error is sent
+// instead.
+func Middleware(opts SignerOpts) func(next http.Handler) http.Handler {
+	digester := opts.Alg.ContentDigest()
+	unsigned := opts.Unsigned
+	if unsigned == nil {
+		unsigned = Streaming
+	}
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if unsigned(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			bw := &bufferedWriter{ResponseWriter: w}
+			next.ServeHTTP(bw, r)
+			if bw.status == 0 {
+				bw.status = http.StatusOK
+			}
+			err := opts.sign(r, bw.status, w.Header(), bw.body.Bytes(), digester)
+			if err != nil {
+				if opts.OnSigningError != nil {
+					opts.OnSigningError(r.Context(), err)
+				}
+				for key := range w.Header() {
+					w.Header().Del(key)
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+				return
+			}
+			w.WriteHeader(bw.status)
+			_, _ = w.Write(bw.body.Bytes())
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// sign sets the response's Content-Digest and signature headers
+func (opts SignerOpts) sign(r *http.Request, status int, header http.Header, body []byte, digester contentdigest.Digester) error {
+	contentDigest, err := digest(digester, body)
+	if alg, ok := streamdigest.Preferred(r.Header.Values("Want-Content-Digest")); ok {
+		var d streamdigest.Digest
+		d, _, err = streamdigest.Compute(bytes.NewReader(body), alg)
+		contentDigest = d.String()
+	}
+	if err != nil {
+		return err
+	}
+	header.Set("Content-Digest", contentDigest)
+	if r.Method != http.MethodHead && status != http.StatusNoContent && status != http.StatusNotModified {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	p := params{
+		Components: []Component{{Name: "@status"}},
+		KeyID:      opts.KeyID,
+		Alg:        opts.Alg.Type(),
+		Tag:        opts.Tag,
+		Created:    time.Now(),
+	}
+	for _, name := range opts.Headers {
+		name = strings.ToLower(name)
+		if name != "content-digest" && len(header.Values(name)) > 0 {
+			p.Components = append(p.Components, Component{Name: name})
+		}
+	}
+	p.Components = append(p.Components, Component{Name: "content-digest"}, Req("@method"), Req("@target-uri"))
+	if len(r.Header.Values("Signature")) > 0 {
+		p.Components = append(p.Components, Req("signature"))
+	}
+
+	target, err := url.Parse(opts.Scheme + "://" + opts.Authority + r.URL.RequestURI())
+	if err != nil {
+		return fmt.Errorf("failed to derive target URI: %w", err)
+	}
+	m := message{
+		status:    status,
+		header:    header,
+		method:    r.Method,
+		targetURI: targetURI(target),
+		reqHeader: r.Header,
+	}
+	base, err := m.base(p)
+	if err != nil {
+		return err
+	}
+	if opts.OnDeriveSigningString != nil {
+		opts.OnDeriveSigningString(r.Context(), base)
+	}
+	sig, err := opts.Alg.Sign(r.Context(), base)
+	if err != nil {
+		return fmt.Errorf("failed to sign response: %w", err)
+	}
+
+	input := httpsfv.NewDictionary()
+	input.Add(Label, p.sfv())
+	inputValue, err := httpsfv.Marshal(input)
+	if err != nil {
+		return err
+	}
+	signature := httpsfv.NewDictionary()
+	signature.Add(Label, httpsfv.NewItem(sig))
+	signatureValue, err := httpsfv.Marshal(signature)
+	if err != nil {
+		return err
+	}
+	header.Set("Signature-Input", inputValue)
+	header.Set("Signature", signatureValue)
+	return nil
+}
+
+// digest returns the RFC 9530 Content-Digest of the body
+func digest(digester contentdigest.Digester, body []byte) (string, error) {
+	if digester.HashFunc == nil || digester.Key == "" {
+		return "", errors.New("invalid content digester")
+	}
+	h := digester.HashFunc()
+	h.Write(body)
+	dict := httpsfv.NewDictionary()
+	dict.Add(digester.Key, httpsfv.NewItem(h.Sum(nil)))
+	return httpsfv.Marshal(dict)
+}
+
+// bufferedWriter buffers the response's status and body. Headers are set
+// on the underlying writer, which doesn't send them until WriteHeader is
+// called.
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(code int) {
+	// informational responses aren't signed
+	if code >= 100 && code < 200 {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
@@ -0,0 +1,256 @@
+/*
+Package respsig signs HTTP responses, and verifies their signatures, as
+described in RFC 9421 section 2.4. A response signature covers the response's
+status, headers, and content digest, as well as components of the request it
+answers, marked with the `req` parameter:
+
+	"@status": 200
+	"content-type": application/json
+	"content-digest": sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:
+	"@method";req: POST
+	"@target-uri";req: https://localhost:9091/apis/authentication.k8s.io/v1/selfsubjectreviews
+	"signature";req: sig1=:MEYCIQDu...:
+	"@signature-params": ("@status" "content-type" "content-digest" "@method";req "@target-uri";req "signature";req);keyid="...";alg="ecdsa-p256-sha256";tag="foo";created=1727886509
+
+Covering the request's signature binds the response to that request, and its
+nonce, so a response can't be replayed to answer another request.
+
+The common-fate/httpsig library only signs requests, and its signature base
+can't represent the `req` parameter, so this package builds its own.
+*/
+package respsig
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dunglas/httpsfv"
+)
+
+// Label of the response signature in the Signature-Input and Signature
+// fields
+const Label = "sig1"
+
+// ErrInvalidSignature is returned when a response's signature is missing or
+// invalid
+var ErrInvalidSignature = errors.New("invalid response signature")
+
+// Component is a covered component of a response signature
+type Component struct {
+	// Name is a lowercase header name, or a derived component like
+	// `@status` or `@method`
+	Name string
+
+	// Req is true for components of the request the response answers
+	Req bool
+}
+
+// Req returns the component of the request with the name
+func Req(name string) Component {
+	return Component{Name: name, Req: true}
+}
+
+// String returns the component identifier, such as `"@method";req`
+func (c Component) String() string {
+	s, err := httpsfv.Marshal(c.item())
+	if err != nil {
+		return strconv.Quote(c.Name)
+	}
+	return s
+}
+
+func (c Component) item() httpsfv.Item {
+	item := httpsfv.NewItem(c.Name)
+	if c.Req {
+		item.Params.Add("req", true)
+	}
+	return item
+}
+
+// DefaultRequiredComponents are the components a response signature must
+// cover: the status and content digest of the response, and the method,
+// target URI and signature of the request
+func DefaultRequiredComponents() []Component {
+	return []Component{
+		{Name: "@status"},
+		{Name: "content-digest"},
+		Req("@method"),
+		Req("@target-uri"),
+		Req("signature"),
+	}
+}
+
+// params are a response signature's parameters
+type params struct {
+	Components []Component
+	KeyID      string
+	Alg        string
+	Tag        string
+	Created    time.Time
+}
+
+func (p params) sfv() httpsfv.InnerList {
+	list := httpsfv.InnerList{
+		Items:  make([]httpsfv.Item, len(p.Components)),
+		Params: httpsfv.NewParams(),
+	}
+	for i, c := range p.Components {
+		list.Items[i] = c.item()
+	}
+	if p.KeyID != "" {
+		list.Params.Add("keyid", p.KeyID)
+	}
+	if p.Alg != "" {
+		list.Params.Add("alg", p.Alg)
+	}
+	if p.Tag != "" {
+		list.Params.Add("tag", p.Tag)
+	}
+	if !p.Created.IsZero() {
+		list.Params.Add("created", p.Created.Unix())
+	}
+	return list
+}
+
+func parseParams(list httpsfv.InnerList) (*params, error) {
+	p := &params{Components: make([]Component, len(list.Items))}
+	for i, item := range list.Items {
+		name, ok := item.Value.(string)
+		if !ok {
+			return nil, errors.New("covered component is not a string")
+		}
+		p.Components[i].Name = name
+		if req, ok := item.Params.Get("req"); ok {
+			p.Components[i].Req, _ = req.(bool)
+		}
+	}
+	for _, s := range []struct {
+		key   string
+		value *string
+	}{{"keyid", &p.KeyID}, {"alg", &p.Alg}, {"tag", &p.Tag}} {
+		v, ok := list.Params.Get(s.key)
+		if !ok {
+			continue
+		}
+		if *s.value, ok = v.(string); !ok {
+			return nil, fmt.Errorf("%s is not a string", s.key)
+		}
+	}
+	if v, ok := list.Params.Get("created"); ok {
+		created, ok := v.(int64)
+		if !ok {
+			return nil, errors.New("created is not an integer")
+		}
+		p.Created = time.Unix(created, 0)
+	}
+	return p, nil
+}
+
+// message is a response, and the request it answers, as the signature base
+// sees them
+type message struct {
+	status    int
+	header    http.Header
+	method    string
+	targetURI *url.URL
+	reqHeader http.Header
+}
+
+// base returns the signature base of the message
+func (m message) base(p params) (string, error) {
+	var b strings.Builder
+	seen := map[Component]bool{}
+	for _, c := range p.Components {
+		if seen[c] {
+			return "", fmt.Errorf("component %s is covered more than once", c)
+		}
+		seen[c] = true
+		value, err := m.value(c)
+		if err != nil {
+			return "", fmt.Errorf("component %s: %w", c, err)
+		}
+		b.WriteString(c.String())
+		b.WriteString(": ")
+		b.WriteString(value)
+		b.WriteString("\n")
+	}
+	signatureParams, err := httpsfv.Marshal(p.sfv())
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal signature params: %w", err)
+	}
+	b.WriteString(`"@signature-params": `)
+	b.WriteString(signatureParams)
+	return b.String(), nil
+}
+
+func (m message) value(c Component) (string, error) {
+	if c.Name != strings.ToLower(c.Name) {
+		return "", errors.New("component name must be lowercase")
+	}
+	if !c.Req {
+		switch c.Name {
+		case "@status":
+			return strconv.Itoa(m.status), nil
+		case "@signature-params":
+			return "", errors.New("@signature-params can't be covered")
+		}
+		if strings.HasPrefix(c.Name, "@") {
+			return "", errors.New("unknown response component")
+		}
+		return headerValue(m.header, c.Name)
+	}
+	switch c.Name {
+	case "@method":
+		return m.method, nil
+	case "@target-uri":
+		return m.targetURI.String(), nil
+	case "@authority":
+		return m.targetURI.Host, nil
+	case "@scheme":
+		return m.targetURI.Scheme, nil
+	case "@path":
+		return m.targetURI.EscapedPath(), nil
+	case "@query":
+		return "?" + m.targetURI.RawQuery, nil
+	}
+	if strings.HasPrefix(c.Name, "@") {
+		return "", errors.New("unknown request component")
+	}
+	return headerValue(m.reqHeader, c.Name)
+}
+
+// headerValue returns the canonical value of a header, with each value's
+// lines trimmed and joined
+func headerValue(header http.Header, name string) (string, error) {
+	values := header.Values(name)
+	if len(values) == 0 {
+		return "", errors.New("header is not present")
+	}
+	canonical := make([]string, len(values))
+	for i, value := range values {
+		lines := []string{}
+		for _, line := range strings.Split(value, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		canonical[i] = strings.Join(lines, " ")
+	}
+	return strings.Join(canonical, ", "), nil
+}
+
+// targetURI returns a copy of the URL, with an empty path as `/`
+func targetURI(u *url.URL) *url.URL {
+	u2 := *u
+	u2.Fragment = ""
+	u2.RawFragment = ""
+	if u2.Path == "" {
+		u2.Path = "/"
+	}
+	return &u2
+}
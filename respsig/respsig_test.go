@@ -0,0 +1,237 @@
+package respsig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/common-fate/httpsig/alg_ecdsa"
+	"github.com/common-fate/httpsig/alg_hmac"
+	"github.com/common-fate/httpsig/signer"
+)
+
+func TestComponentString(t *testing.T) {
+	cases := []struct {
+		component Component
+		want      string
+	}{
+		{component: Component{Name: "@status"}, want: `"@status"`},
+		{component: Req("@method"), want: `"@method";req`},
+	}
+	for _, tc := range cases {
+		if got := tc.component.String(); got != tc.want {
+			t.Errorf("expected %s, got %s", tc.want, got)
+		}
+	}
+}
+
+func TestSignatureBase(t *testing.T) {
+	target, err := url.Parse("https://example.com/foo?param=value")
+	if err != nil {
+		t.Fatalf("failed to parse URL: %v", err)
+	}
+	m := message{
+		status:    200,
+		header:    http.Header{"Content-Type": []string{"application/json"}, "Content-Digest": []string{"sha-256=:abc=:"}},
+		method:    http.MethodPost,
+		targetURI: target,
+		reqHeader: http.Header{"Signature": []string{"sig1=:def=:"}},
+	}
+	got, err := m.base(params{
+		Components: []Component{
+			{Name: "@status"}, {Name: "content-type"}, {Name: "content-digest"},
+			Req("@method"), Req("@target-uri"), Req("@path"), Req("signature"),
+		},
+		KeyID: "server",
+		Tag:   "foo",
+	})
+	if err != nil {
+		t.Fatalf("failed to derive base: %v", err)
+	}
+	want := `"@status": 200
+"content-type": application/json
+"content-digest": sha-256=:abc=:
+"@method";req: POST
+"@target-uri";req: https://example.com/foo?param=value
+"@path";req: /foo
+"signature";req: sig1=:def=:
+"@signature-params": ("@status" "content-type" "content-digest" "@method";req "@target-uri";req "@path";req "signature";req);keyid="server";tag="foo"`
+	if got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+
+	if _, err := m.base(params{Components: []Component{Req("x-missing")}}); err == nil {
+		t.Error("expected error for a missing header, got none")
+	}
+}
+
+func TestMiddlewareTransport(t *testing.T) {
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(nil)
+	authority := server.Listener.Addr().String()
+	sign := Middleware(SignerOpts{
+		KeyID:     "server",
+		Tag:       "foo",
+		Alg:       alg_ecdsa.NewP256Signer(serverKey),
+		Headers:   []string{"Content-Type"},
+		Scheme:    "http",
+		Authority: authority,
+	})
+	handler := sign(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("hello " + r.URL.Path))
+	}))
+	// the last signed response, to replay for another request
+	var last *httptest.ResponseRecorder
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		switch r.URL.Path {
+		case "/replay":
+			rec = last
+		case "/tamper":
+			handler.ServeHTTP(rec, r)
+			rec.Body.Reset()
+			rec.Body.WriteString("goodbye")
+		case "/unsigned":
+			rec.WriteHeader(http.StatusOK)
+		default:
+			handler.ServeHTTP(rec, r)
+		}
+		last = rec
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		_, _ = w.Write(rec.Body.Bytes())
+	})
+	server.Start()
+	defer server.Close()
+
+	newClient := func(key *ecdsa.PublicKey) *http.Client {
+		return &http.Client{Transport: &signer.Transport{
+			KeyID:             "client",
+			Tag:               "foo",
+			Alg:               alg_hmac.NewHMAC([]byte("0123456789abcdef0123456789abcdef")),
+			CoveredComponents: []string{"@method", "@target-uri"},
+			BaseTransport: &Transport{
+				KeyDirectory: alg_ecdsa.StaticKeyDirectory{Key: key},
+				Tag:          "foo",
+			},
+		}}
+	}
+
+	cases := []struct {
+		name    string
+		path    string
+		key     *ecdsa.PublicKey
+		want    string
+		wantErr bool
+	}{
+		{name: "valid", path: "/hello", key: &serverKey.PublicKey, want: "hello /hello"},
+		{name: "replayed for another request", path: "/replay", key: &serverKey.PublicKey, wantErr: true},
+		{name: "another key", path: "/hello", key: &otherKey.PublicKey, wantErr: true},
+		{name: "tampered body", path: "/tamper", key: &serverKey.PublicKey, wantErr: true},
+		{name: "unsigned", path: "/unsigned", key: &serverKey.PublicKey, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := newClient(tc.key).Get(server.URL + tc.path)
+			if tc.wantErr {
+				if !errors.Is(err, ErrInvalidSignature) {
+					t.Fatalf("expected ErrInvalidSignature, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatalf("failed to read body: %v", err)
+			}
+			if res.StatusCode != http.StatusCreated || string(body) != tc.want {
+				t.Errorf("expected 201 %q, got %d %q", tc.want, res.StatusCode, body)
+			}
+			if !strings.Contains(res.Header.Get("Signature-Input"), `"signature";req`) {
+				t.Errorf("expected the response to cover the request's signature, got %s", res.Header.Get("Signature-Input"))
+			}
+		})
+	}
+
+	// watches aren't signed, so they aren't verified
+	res, err := newClient(&serverKey.PublicKey).Get(server.URL + "/unsigned?watch=true")
+	if err != nil {
+		t.Fatalf("expected an unsigned watch to be returned, got %v", err)
+	}
+	res.Body.Close()
+}
+
+func TestMiddlewareStreaming(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	sign := Middleware(SignerOpts{
+		KeyID:     "server",
+		Tag:       "foo",
+		Alg:       alg_ecdsa.NewP256Signer(key),
+		Scheme:    "http",
+		Authority: "example.com",
+	})
+	// a streaming response is flushed as it's written, so it must reach
+	// the handler unbuffered
+	var flushable bool
+	handler := sign(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, flushable = w.(http.Flusher)
+		_, _ = w.Write([]byte("event"))
+	}))
+
+	cases := []struct {
+		name       string
+		target     string
+		upgrade    string
+		wantSigned bool
+	}{
+		{name: "list", target: "/api/v1/pods", wantSigned: true},
+		{name: "watch", target: "/api/v1/pods?watch=true"},
+		{name: "watch disabled", target: "/api/v1/pods?watch=false", wantSigned: true},
+		{name: "follow logs", target: "/api/v1/namespaces/default/pods/a/log?follow=1"},
+		{name: "upgrade", target: "/api/v1/namespaces/default/pods/a/exec", upgrade: "websocket"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.upgrade != "" {
+				req.Header.Set("Upgrade", tc.upgrade)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if signed := rec.Header().Get("Signature") != ""; signed != tc.wantSigned {
+				t.Errorf("expected signed %t, got %t", tc.wantSigned, signed)
+			}
+			if flushable == tc.wantSigned {
+				t.Errorf("expected flushable %t, got %t", !tc.wantSigned, flushable)
+			}
+			if rec.Body.String() != "event" {
+				t.Errorf("expected body %q, got %q", "event", rec.Body.String())
+			}
+		})
+	}
+}
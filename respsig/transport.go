@@ -0,0 +1,221 @@
+package respsig
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/common-fate/httpsig/verifier"
+	"github.com/dunglas/httpsfv"
+	"github.com/micahhausler/httpsig-scratch/streamdigest"
+)
+
+// Transport is an http.RoundTripper that verifies response signatures. It
+// fails closed: a response without a valid signature, or whose body doesn't
+// match its Content-Digest, is returned as an error wrapping
+// ErrInvalidSignature, and its body is closed.
+//
+// Requests must be signed before they reach the Transport, so it can check
+// that the response covers the request's signature. Use it as a
+// transport.Builder's Base.
+type Transport struct {
+	// Base sends requests. If nil, http.DefaultTransport is used.
+	Base http.RoundTripper
+
+	// KeyDirectory looks up the server's signing key
+	KeyDirectory verifier.KeyDirectory
+
+	// Tag, if set, is the tag the response signature must have
+	Tag string
+
+	// RequiredComponents must be covered by the response signature.
+	// Defaults to DefaultRequiredComponents().
+	RequiredComponents []Component
+
+	// MaxAge is how far a signature's created time can be from now.
+	// Defaults to five minutes.
+	MaxAge time.Duration
+
+	// MaxBytes is the largest response body that is read to check its
+	// digest. Defaults to 10MB.
+	MaxBytes int64
+
+	// OnDeriveSigningString is a hook to log the signature base
+	OnDeriveSigningString func(ctx context.Context, stringToSign string)
+
+	// Unverified returns true for requests whose responses are returned
+	// without verifying them, because the server doesn't sign them.
+	// Defaults to Streaming, matching the Middleware's default.
+	Unverified func(r *http.Request) bool
+}
+
+var _ http.RoundTripper = &Transport{}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	unverified := t.Unverified
+	if unverified == nil {
+		unverified = Streaming
+	}
+	if unverified(req) {
+		return base.RoundTrip(req)
+	}
+	// http.Transport transparently decompresses responses it asked to be
+	// compressed, so the body wouldn't match the signed digest
+	if req.Header.Get("Accept-Encoding") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+	res, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	err = t.verify(req, res)
+	if err != nil {
+		res.Body.Close()
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+	return res, nil
+}
+
+// verify checks the response's signature and digest, and replaces its body
+// with the digested one
+func (t *Transport) verify(req *http.Request, res *http.Response) error {
+	p, sig, err := t.find(res)
+	if err != nil {
+		return err
+	}
+	required := t.RequiredComponents
+	if required == nil {
+		required = DefaultRequiredComponents()
+	}
+	for _, c := range required {
+		if !slices.Contains(p.Components, c) {
+			return fmt.Errorf("required component %s was not covered", c)
+		}
+	}
+
+	maxAge := t.MaxAge
+	if maxAge <= 0 {
+		maxAge = 5 * time.Minute
+	}
+	if p.Created.IsZero() {
+		return errors.New("signature has no created time")
+	}
+	if age := time.Since(p.Created); age > maxAge || age < -maxAge {
+		return fmt.Errorf("signature was created at %s, more than %s from now", p.Created.Format(time.RFC3339), maxAge)
+	}
+
+	alg, err := t.KeyDirectory.GetKey(req.Context(), p.KeyID, p.Alg)
+	if err != nil {
+		return fmt.Errorf("failed to get key %q: %w", p.KeyID, err)
+	}
+	if p.Alg != "" && p.Alg != alg.Type() {
+		return fmt.Errorf("signature algorithm %q doesn't match the key's %q", p.Alg, alg.Type())
+	}
+	m := message{
+		status:    res.StatusCode,
+		header:    res.Header,
+		method:    req.Method,
+		targetURI: targetURI(req.URL),
+		reqHeader: req.Header,
+	}
+	sigBase, err := m.base(*p)
+	if err != nil {
+		return err
+	}
+	if t.OnDeriveSigningString != nil {
+		t.OnDeriveSigningString(req.Context(), sigBase)
+	}
+	err = alg.Verify(req.Context(), sigBase, sig)
+	if err != nil {
+		return err
+	}
+	return t.verifyDigest(res)
+}
+
+// find returns the parameters and value of the response's signature with
+// the Transport's tag
+func (t *Transport) find(res *http.Response) (*params, []byte, error) {
+	inputs, err := httpsfv.UnmarshalDictionary(res.Header.Values("Signature-Input"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Signature-Input header is malformed: %w", err)
+	}
+	signatures, err := httpsfv.UnmarshalDictionary(res.Header.Values("Signature"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Signature header is malformed: %w", err)
+	}
+	for _, label := range inputs.Names() {
+		member, _ := inputs.Get(label)
+		list, ok := member.(httpsfv.InnerList)
+		if !ok {
+			return nil, nil, fmt.Errorf("signature input %q is not an inner list", label)
+		}
+		p, err := parseParams(list)
+		if err != nil {
+			return nil, nil, fmt.Errorf("signature input %q: %w", label, err)
+		}
+		if t.Tag != "" && p.Tag != t.Tag {
+			continue
+		}
+		member, ok = signatures.Get(label)
+		if !ok {
+			return nil, nil, fmt.Errorf("signature input %q has no signature", label)
+		}
+		item, ok := member.(httpsfv.Item)
+		if !ok {
+			return nil, nil, fmt.Errorf("signature %q is not an item", label)
+		}
+		sig, ok := item.Value.([]byte)
+		if !ok {
+			return nil, nil, fmt.Errorf("signature %q is not a byte sequence", label)
+		}
+		return p, sig, nil
+	}
+	return nil, nil, errors.New("response is not signed")
+}
+
+// verifyDigest reads the response body, and checks it matches every
+// supported digest in the Content-Digest header
+func (t *Transport) verifyDigest(res *http.Response) error {
+	digests, err := streamdigest.Parse(res.Header.Values("Content-Digest"))
+	if err != nil {
+		return err
+	}
+	if len(digests) == 0 {
+		return errors.New("response has no supported content digest")
+	}
+	maxBytes := t.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = 10 << 20
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxBytes+1))
+	res.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	if int64(len(body)) > maxBytes {
+		return fmt.Errorf("response body is larger than %d bytes", maxBytes)
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	for _, d := range digests {
+		got, _, err := streamdigest.Compute(bytes.NewReader(body), d.Algorithm)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare(got.Sum, d.Sum) != 1 {
+			return fmt.Errorf("response body doesn't match its %s content digest", d.Algorithm)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package routeverify
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/contentdigest"
+	"github.com/common-fate/httpsig/verifier"
+	"github.com/micahhausler/httpsig-scratch/streamdigest"
+)
+
+// streamedBody is a request body hidden from the verifier, to be checked
+// against its Content-Digest header before the handler reads it
+type streamedBody struct {
+	body   io.ReadCloser
+	digest streamdigest.Digest
+}
+
+type streamedBodyKey struct{}
+
+// hideBody returns the request with its body hidden from the verifier, if
+// its signature covers a Content-Digest header with a supported algorithm,
+// so the verifier doesn't read the body into memory to digest it.
+func (opts Opts) hideBody(r *http.Request, covered []string) (*http.Request, error) {
+	if !slices.Contains(covered, "content-digest") || r.Body == nil || r.Body == http.NoBody {
+		return r, nil
+	}
+	values := r.Header.Values("Content-Digest")
+	if len(values) == 0 {
+		return r, nil
+	}
+	digests, err := streamdigest.Parse(values)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.WantContentDigest) > 0 {
+		digests = slices.DeleteFunc(digests, func(d streamdigest.Digest) bool {
+			return !slices.Contains(opts.WantContentDigest, d.Algorithm)
+		})
+		slices.SortStableFunc(digests, func(a, b streamdigest.Digest) int {
+			return slices.Index(opts.WantContentDigest, a.Algorithm) - slices.Index(opts.WantContentDigest, b.Algorithm)
+		})
+	}
+	if len(digests) == 0 {
+		return nil, errors.New("Content-Digest header has no supported digest")
+	}
+	ctx := context.WithValue(r.Context(), streamedBodyKey{}, &streamedBody{body: r.Body, digest: digests[0]})
+	r2 := r.WithContext(ctx)
+	r2.Body = http.NoBody
+	return r2, nil
+}
+
+// restoreBody returns the verified request with its hidden body, once the
+// whole body has been spooled to a temp file and matches its digest, so the
+// handler never reads content that doesn't match. The caller closes the
+// body, which removes the file.
+func (opts Opts) restoreBody(r *http.Request) (*http.Request, error) {
+	hidden, ok := r.Context().Value(streamedBodyKey{}).(*streamedBody)
+	// the verifier replaces bodies the signature doesn't cover
+	if !ok || r.Body != http.NoBody {
+		return r, nil
+	}
+	maxBytes := opts.MaxBodyBytes
+	if maxBytes <= 0 {
+		maxBytes = 10 << 20
+	}
+	body, err := streamdigest.Verify(hidden.body, hidden.digest, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	r2 := r.WithContext(r.Context())
+	r2.Body = body
+	return r2, nil
+}
+
+// digestKeyDirectory returns keys that derive the `content-digest`
+// component from the Content-Digest header of requests with hidden bodies
+type digestKeyDirectory struct {
+	verifier.KeyDirectory
+}
+
+func (d *digestKeyDirectory) GetKey(ctx context.Context, kid string, clientSpecifiedAlg string) (verifier.Algorithm, error) {
+	alg, err := d.KeyDirectory.GetKey(ctx, kid, clientSpecifiedAlg)
+	if err != nil {
+		return nil, err
+	}
+	hidden, ok := ctx.Value(streamedBodyKey{}).(*streamedBody)
+	if !ok {
+		return alg, nil
+	}
+	return &digestedAlgorithm{Algorithm: alg, digester: hidden.digest.Digester()}, nil
+}
+
+// digestedAlgorithm is a verifying algorithm with a precomputed content
+// digest
+type digestedAlgorithm struct {
+	verifier.Algorithm
+	digester contentdigest.Digester
+}
+
+func (a *digestedAlgorithm) ContentDigest() contentdigest.Digester {
+	return a.digester
+}
+
+func (a *digestedAlgorithm) Attributes() any {
+	if attr, ok := a.Algorithm.(httpsig.Attributer); ok {
+		return attr.Attributes()
+	}
+	return nil
+}
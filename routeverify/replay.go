@@ -0,0 +1,83 @@
+package routeverify
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/micahhausler/httpsig-scratch/noncestore"
+)
+
+// ErrReplayed is returned when a signature's nonce, or a signature without a
+// nonce, has already been accepted
+var ErrReplayed = errors.New("signature has already been used")
+
+// replayCheck is how to check a signature isn't replayed once it is
+// verified: by its nonce, or, if guard is set, by the key recording a
+// signature without one
+type replayCheck struct {
+	nonce    string
+	guard    bool
+	keyID    string
+	guardKey string
+	expiry   time.Time
+}
+
+type replayCheckKey struct{}
+
+// guardSignatureBase returns an OnDeriveSigningString hook that sets the
+// guardKey of a guarded signature from its signature base, which every valid
+// signature over the same content shares, before calling hook
+func guardSignatureBase(hook func(ctx context.Context, stringToSign string)) func(ctx context.Context, stringToSign string) {
+	return func(ctx context.Context, stringToSign string) {
+		if check, ok := ctx.Value(replayCheckKey{}).(*replayCheck); ok && check.guard {
+			check.guardKey = noncestore.SignatureKey(check.keyID, stringToSign)
+		}
+		if hook != nil {
+			hook(ctx, stringToSign)
+		}
+	}
+}
+
+// verifiedNonceStorage leaves nonces unchecked by the verifier, which checks
+// them before it verifies the signature, so checkReplay records them once
+// the signature is verified. Otherwise unauthenticated requests could fill
+// the nonce storage.
+type verifiedNonceStorage struct{}
+
+func (verifiedNonceStorage) Seen(ctx context.Context, nonce string) (bool, error) {
+	return false, nil
+}
+
+// checkReplay records the verified request's nonce in the NonceStorage, or
+// its signature in the ReplayStore if it has no nonce and its route has a
+// ReplayGuard, and rejects it if it was already recorded. It returns false
+// if the request was rejected.
+func checkReplay(w http.ResponseWriter, r *http.Request, opts Opts) bool {
+	check, ok := r.Context().Value(replayCheckKey{}).(*replayCheck)
+	if !ok {
+		return true
+	}
+	var (
+		seen bool
+		err  error
+	)
+	switch {
+	case check.nonce != "":
+		seen, err = opts.NonceStorage.Seen(r.Context(), check.nonce)
+	case check.guard && check.guardKey == "":
+		err = errors.New("signature base wasn't derived")
+	case check.guard:
+		seen, err = opts.ReplayStore.CheckAndSet(r.Context(), check.guardKey, check.expiry)
+	}
+	if err != nil {
+		reject(w, r, opts, err, "")
+		return false
+	}
+	if seen {
+		reject(w, r, opts, ErrReplayed, ErrReplayed.Error())
+		return false
+	}
+	return true
+}
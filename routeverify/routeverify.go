@@ -0,0 +1,396 @@
+/*
+Package routeverify verifies HTTP message signatures with requirements that
+depend on the route. A GET without a body doesn't need to cover a content
+digest, while a POST to the same server should.
+
+Routes are matched with Go 1.22 http.ServeMux patterns, such as `GET /` or
+`POST /api/{name}`, so the most specific route applies. Before verifying a
+signature, the route's required components are checked, and a signature
+that doesn't cover them is rejected with a response naming the missing
+components.
+
+Requests that fail verification get a 401 with an Accept-Signature field
+describing the signature the route requires, so a client can sign the request
+again to satisfy it.
+
+Signatures must have a nonce, unless their route has a ReplayGuard, which
+rejects a signature without one if its value was already accepted. Nonces are
+only recorded once the signature is verified, so unauthenticated requests
+can't fill the nonce storage.
+*/
+package routeverify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/sigparams"
+	"github.com/common-fate/httpsig/sigset"
+	"github.com/common-fate/httpsig/verifier"
+	"github.com/micahhausler/httpsig-scratch/acceptsig"
+	"github.com/micahhausler/httpsig-scratch/noncestore"
+	"github.com/micahhausler/httpsig-scratch/streamdigest"
+)
+
+// Route is the signature policy for requests matching a pattern
+type Route struct {
+	// Pattern is an http.ServeMux pattern, such as `GET /` or `POST /api/`
+	Pattern string
+
+	// Tag is the tag of the signature to verify, defaults to the Opts' Tag
+	Tag string
+
+	// RequiredComponents must be covered by the signature
+	RequiredComponents []string
+
+	// Algorithms the signing key can use. If empty, any algorithm the
+	// KeyDirectory supports is allowed.
+	Algorithms []string
+
+	// MaxAge is how long after it is created a signature is valid,
+	// defaults to the Opts' MaxAge
+	MaxAge time.Duration
+
+	// ReplayGuard accepts signatures without a nonce, for clients that only
+	// send a created time. Such a signature is recorded in the Opts'
+	// ReplayStore by the hash of its key ID and signature base, which every
+	// valid signature over the same request shares, until it is older than
+	// MaxAge, and rejected if it is used again. Signatures with a nonce are
+	// still checked with NonceStorage.
+	//
+	// Two requests with the same covered components in the same second have
+	// the same signature base, so the second is rejected as a replay.
+	ReplayGuard bool
+}
+
+// Opts configures the verifier. Requests that match none of the Routes are
+// rejected.
+type Opts struct {
+	Routes []Route
+
+	// NonceStorage checks that signatures aren't replayed, once they are
+	// verified. The request context carries when the signature stops being
+	// accepted, for noncestore.NonceStorage to record the nonce until then.
+	NonceStorage verifier.NonceStorage
+
+	// ReplayStore records signatures without a nonce on routes with a
+	// ReplayGuard. It can be the store NonceStorage uses. Defaults to an
+	// in-memory store.
+	ReplayStore noncestore.Store
+
+	// KeyDirectory looks up the signing key for a key ID
+	KeyDirectory verifier.KeyDirectory
+
+	// Tag is the default tag of the signature to verify
+	Tag string
+
+	// Scheme and Authority are the expected URL scheme and authority of
+	// requests
+	Scheme    string
+	Authority string
+
+	// MaxAge is the default for how long after it is created a signature is
+	// valid. Defaults to one minute.
+	MaxAge time.Duration
+
+	// MaxClockSkew is how far in the future a signature's created time can
+	// be, to allow for clients with fast clocks
+	MaxClockSkew time.Duration
+
+	// WantContentDigest are the Content-Digest algorithms the server
+	// accepts, most preferred first, and sends in a Want-Content-Digest
+	// field with 401 responses. If empty, any algorithm streamdigest
+	// supports is accepted.
+	WantContentDigest []string
+
+	// MaxBodyBytes is the largest request body whose Content-Digest is
+	// checked by spooling it to a temp file before the handler reads it.
+	// Larger bodies are rejected with 413 Request Entity Too Large.
+	// Defaults to 10MB.
+	MaxBodyBytes int64
+
+	// OnValidationError, if set, is called when a request is rejected
+	OnValidationError func(ctx context.Context, err error)
+
+	// OnDeriveSigningString is a hook to log the string to sign
+	OnDeriveSigningString func(ctx context.Context, stringToSign string)
+}
+
+// MissingComponentsError is returned when a signature doesn't cover the
+// components its route requires
+type MissingComponentsError struct {
+	Pattern string
+	Missing []string
+}
+
+func (e *MissingComponentsError) Error() string {
+	return fmt.Sprintf("signature does not cover components required by %q: %s", e.Pattern, strings.Join(e.Missing, ", "))
+}
+
+// ErrNoRoute is returned for requests that match none of the routes
+var ErrNoRoute = errors.New("no signature policy for the request's route")
+
+// routeHandler marks the route a pattern belongs to in the route mux
+type routeHandler int
+
+func (routeHandler) ServeHTTP(http.ResponseWriter, *http.Request) {}
+
+// Middleware returns a middleware that verifies each request's signature
+// with the requirements of its route, and adds the key's attributes to the
+// request context like httpsig.Middleware. It returns an error for invalid
+// or conflicting patterns.
+func Middleware(opts Opts) (func(next http.Handler) http.Handler, error) {
+	routes := http.NewServeMux()
+	for i, route := range opts.Routes {
+		err := handlePattern(routes, route.Pattern, routeHandler(i))
+		if err != nil {
+			return nil, err
+		}
+	}
+	maxAge := opts.MaxAge
+	if maxAge <= 0 {
+		maxAge = time.Minute
+	}
+	if opts.ReplayStore == nil && slices.ContainsFunc(opts.Routes, func(r Route) bool { return r.ReplayGuard }) {
+		opts.ReplayStore = noncestore.NewMemoryStore(noncestore.MemoryOpts{})
+	}
+
+	return func(next http.Handler) http.Handler {
+		handlers := make([]http.Handler, len(opts.Routes))
+		for i, route := range opts.Routes {
+			handlers[i] = routeMiddleware(opts, route, maxAge)(next)
+		}
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			h, _ := routes.Handler(r)
+			i, ok := h.(routeHandler)
+			if !ok {
+				reject(w, r, opts, ErrNoRoute, "")
+				return
+			}
+			handlers[i].ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}, nil
+}
+
+// handlePattern registers a pattern, returning an error rather than
+// panicking if it is invalid or conflicts with another
+func handlePattern(mux *http.ServeMux, pattern string, h http.Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid route %q: %v", pattern, r)
+		}
+	}()
+	mux.Handle(pattern, h)
+	return nil
+}
+
+// routeMiddleware checks the route's required components, then verifies the
+// signature with httpsig.Middleware, which sets the key's attributes
+func routeMiddleware(opts Opts, route Route, maxAge time.Duration) func(next http.Handler) http.Handler {
+	tag := route.Tag
+	if tag == "" {
+		tag = opts.Tag
+	}
+	if route.MaxAge > 0 {
+		maxAge = route.MaxAge
+	}
+	required := map[string]bool{}
+	for _, c := range route.RequiredComponents {
+		required[c] = true
+	}
+	keyDir := opts.KeyDirectory
+	if len(route.Algorithms) > 0 {
+		keyDir = &algorithmKeyDirectory{KeyDirectory: keyDir, algorithms: route.Algorithms}
+	}
+	keyDir = &digestKeyDirectory{KeyDirectory: keyDir}
+	verify := httpsig.Middleware(httpsig.MiddlewareOpts{
+		NonceStorage: verifiedNonceStorage{},
+		KeyDirectory: keyDir,
+		Tag:          tag,
+		Scheme:       opts.Scheme,
+		Authority:    opts.Authority,
+		Validation: &sigparams.ValidateOpts{
+			BeforeDuration:            maxAge,
+			AfterDuration:             opts.MaxClockSkew,
+			RequiredCoveredComponents: required,
+			RequireNonce:              !route.ReplayGuard,
+		},
+		OnValidationError:     opts.OnValidationError,
+		OnDeriveSigningString: guardSignatureBase(opts.OnDeriveSigningString),
+	})
+
+	want := ""
+	if len(opts.WantContentDigest) > 0 {
+		want = streamdigest.Want(opts.WantContentDigest...)
+	}
+	accept := acceptSignature(route, tag, want)
+
+	return func(next http.Handler) http.Handler {
+		// the verifier passes the writer it's given on to the next handler,
+		// so unwrap it once the request is verified
+		verified := verify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if aw, ok := w.(*acceptSignatureWriter); ok {
+				w = aw.ResponseWriter
+			}
+			restored, err := opts.restoreBody(r)
+			if errors.Is(err, streamdigest.ErrTooLarge) {
+				if opts.OnValidationError != nil {
+					opts.OnValidationError(r.Context(), err)
+				}
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				reject(w, r, opts, err, err.Error())
+				return
+			}
+			r = restored
+			defer r.Body.Close()
+			if !checkReplay(w, r, opts) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			set, err := sigset.Unmarshal(r)
+			if err != nil {
+				accept(w)
+				reject(w, r, opts, fmt.Errorf("invalid signature: %w", err), "")
+				return
+			}
+			msg, err := set.Find(tag)
+			if err != nil {
+				accept(w)
+				reject(w, r, opts, err, "")
+				return
+			}
+			missing := []string{}
+			for _, c := range route.RequiredComponents {
+				if !slices.Contains(msg.Input.CoveredComponents, c) {
+					missing = append(missing, c)
+				}
+			}
+			if len(missing) > 0 {
+				err := &MissingComponentsError{Pattern: route.Pattern, Missing: missing}
+				accept(w)
+				reject(w, r, opts, err, err.Error())
+				return
+			}
+			r, err = opts.hideBody(r, msg.Input.CoveredComponents)
+			if err != nil {
+				accept(w)
+				reject(w, r, opts, err, err.Error())
+				return
+			}
+			// the signature is only accepted until it's older than maxAge,
+			// so its nonce only needs to be recorded until then
+			expiry := msg.Input.Created.Add(maxAge)
+			ctx := noncestore.WithExpiry(r.Context(), expiry)
+			check := &replayCheck{
+				nonce:  msg.Input.Nonce,
+				guard:  route.ReplayGuard && msg.Input.Nonce == "",
+				keyID:  msg.Input.KeyID,
+				expiry: expiry,
+			}
+			ctx = context.WithValue(ctx, replayCheckKey{}, check)
+			r = r.WithContext(ctx)
+			verified.ServeHTTP(&acceptSignatureWriter{ResponseWriter: w, accept: accept}, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// acceptSignature returns a function that sets the Accept-Signature header
+// for the route, with one member per allowed algorithm, and the
+// Want-Content-Digest header if want is set. It doesn't request a nonce,
+// since the verifier doesn't record the nonces it issues: the client picks a
+// fresh one, which NonceStorage checks.
+func acceptSignature(route Route, tag string, want string) func(w http.ResponseWriter) {
+	requests := []acceptsig.Request{}
+	for _, alg := range route.Algorithms {
+		requests = append(requests, acceptsig.Request{Alg: alg})
+	}
+	if len(requests) == 0 {
+		requests = append(requests, acceptsig.Request{})
+	}
+	for i := range requests {
+		requests[i].CoveredComponents = route.RequiredComponents
+		requests[i].Tag = tag
+		requests[i].Created = true
+	}
+	value, err := acceptsig.Marshal(requests)
+	return func(w http.ResponseWriter) {
+		if want != "" {
+			w.Header().Set("Want-Content-Digest", want)
+		}
+		if err != nil {
+			return
+		}
+		w.Header().Set(acceptsig.HeaderName, value)
+	}
+}
+
+// acceptSignatureWriter sets the Accept-Signature header if the verifier
+// responds with 401 Unauthorized
+type acceptSignatureWriter struct {
+	http.ResponseWriter
+	accept      func(w http.ResponseWriter)
+	wroteHeader bool
+}
+
+func (w *acceptSignatureWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code == http.StatusUnauthorized {
+		w.accept(w.ResponseWriter)
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *acceptSignatureWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// reject responds with 401 Unauthorized, and the detail if it's safe to
+// share with the client
+func reject(w http.ResponseWriter, r *http.Request, opts Opts, err error, detail string) {
+	if opts.OnValidationError != nil {
+		opts.OnValidationError(r.Context(), err)
+	}
+	body := http.StatusText(http.StatusUnauthorized)
+	if detail != "" {
+		body += ": " + detail
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	_, _ = w.Write([]byte(body))
+}
+
+// algorithmKeyDirectory only returns keys that use one of the algorithms
+type algorithmKeyDirectory struct {
+	verifier.KeyDirectory
+	algorithms []string
+}
+
+func (d *algorithmKeyDirectory) GetKey(ctx context.Context, kid string, clientSpecifiedAlg string) (verifier.Algorithm, error) {
+	if clientSpecifiedAlg != "" && !slices.Contains(d.algorithms, clientSpecifiedAlg) {
+		return nil, fmt.Errorf("algorithm %q is not allowed", clientSpecifiedAlg)
+	}
+	alg, err := d.KeyDirectory.GetKey(ctx, kid, clientSpecifiedAlg)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(d.algorithms, alg.Type()) {
+		return nil, fmt.Errorf("algorithm %q is not allowed", alg.Type())
+	}
+	return alg, nil
+}
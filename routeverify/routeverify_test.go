@@ -0,0 +1,548 @@
+package routeverify
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/alg_ecdsa"
+	"github.com/common-fate/httpsig/alg_hmac"
+	"github.com/common-fate/httpsig/inmemory"
+	"github.com/common-fate/httpsig/signer"
+	"github.com/common-fate/httpsig/verifier"
+	"github.com/micahhausler/httpsig-scratch/streamdigest"
+)
+
+type hmacKeyDirectory struct {
+	secret []byte
+}
+
+func (d hmacKeyDirectory) GetKey(ctx context.Context, kid string, _ string) (verifier.Algorithm, error) {
+	alg := alg_hmac.NewHMAC(d.secret)
+	alg.Attrs = kid
+	return alg, nil
+}
+
+func TestMiddleware(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	server := httptest.NewUnstartedServer(nil)
+	serverURL, err := url.Parse("http://" + server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+	var validationErr error
+	middleware, err := Middleware(Opts{
+		NonceStorage: inmemory.NewNonceStorage(),
+		KeyDirectory: hmacKeyDirectory{secret: secret},
+		Tag:          "foo",
+		Scheme:       "http",
+		Authority:    serverURL.Host,
+		OnValidationError: func(ctx context.Context, err error) {
+			validationErr = err
+		},
+		Routes: []Route{
+			{Pattern: "GET /", RequiredComponents: []string{"@method", "@target-uri"}},
+			{Pattern: "/", RequiredComponents: []string{"@method", "@target-uri", "content-length", "content-digest"}},
+			{Pattern: "GET /admin/", RequiredComponents: []string{"@method"}, Algorithms: []string{alg_ecdsa.P256_SHA256}},
+			{Pattern: "GET /other/", Tag: "bar", RequiredComponents: []string{"@method"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	server.Config.Handler = middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if httpsig.AttributesFromContext(r.Context()) == nil {
+			t.Error("expected attributes in the request context")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.Start()
+	defer server.Close()
+
+	client := httpsig.NewClient(httpsig.ClientOpts{
+		KeyID:             "kid-1",
+		Tag:               "foo",
+		Alg:               alg_hmac.NewHMAC(secret),
+		CoveredComponents: []string{"@method", "@target-uri"},
+	})
+
+	cases := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+		wantErr    bool
+		wantAccept string
+	}{
+		{
+			name:       "get without digest",
+			method:     http.MethodGet,
+			path:       "/",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "post without digest",
+			method:     http.MethodPost,
+			path:       "/",
+			body:       "{}",
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "content-length, content-digest",
+			wantErr:    true,
+			wantAccept: `sig1=("@method" "@target-uri" "content-length" "content-digest");tag="foo";created`,
+		},
+		{
+			name:       "algorithm not allowed",
+			method:     http.MethodGet,
+			path:       "/admin/users",
+			wantStatus: http.StatusUnauthorized,
+			wantErr:    true,
+			wantAccept: `sig1=("@method");alg="ecdsa-p256-sha256";tag="foo";created`,
+		},
+		{
+			name:       "route tag",
+			method:     http.MethodGet,
+			path:       "/other/",
+			wantStatus: http.StatusUnauthorized,
+			wantErr:    true,
+			wantAccept: `sig1=("@method");tag="bar";created`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			validationErr = nil
+			req, err := http.NewRequest(tc.method, server.URL+tc.path, strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			if res.StatusCode != tc.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tc.wantStatus, res.StatusCode, body)
+			}
+			if !strings.Contains(string(body), tc.wantBody) {
+				t.Errorf("expected body to contain %q, got %q", tc.wantBody, body)
+			}
+			accept := res.Header.Get("Accept-Signature")
+			if tc.wantAccept == "" && accept != "" {
+				t.Errorf("expected no Accept-Signature header, got %s", accept)
+			}
+			if accept != tc.wantAccept {
+				t.Errorf("expected Accept-Signature header %s, got %s", tc.wantAccept, accept)
+			}
+			if (validationErr != nil) != tc.wantErr {
+				t.Errorf("expected validation error %t, got %v", tc.wantErr, validationErr)
+			}
+		})
+	}
+
+	var missingErr *MissingComponentsError
+	req, err := http.NewRequest(http.MethodPut, server.URL+"/", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	res.Body.Close()
+	if !errors.As(validationErr, &missingErr) || missingErr.Pattern != "/" {
+		t.Errorf("expected a MissingComponentsError for route \"/\", got %v", validationErr)
+	}
+}
+
+func TestMiddlewareNoRoute(t *testing.T) {
+	middleware, err := Middleware(Opts{
+		KeyDirectory: hmacKeyDirectory{},
+		Routes:       []Route{{Pattern: "GET /api/"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected the request to be rejected")
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", w.Code)
+	}
+}
+
+func TestMiddlewareInvalidRoutes(t *testing.T) {
+	cases := []struct {
+		name   string
+		routes []Route
+	}{
+		{name: "invalid pattern", routes: []Route{{Pattern: "GET"}}},
+		{name: "duplicate pattern", routes: []Route{{Pattern: "/"}, {Pattern: "/"}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Middleware(Opts{Routes: tc.routes})
+			if err == nil {
+				t.Error("expected error, got none")
+			}
+		})
+	}
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestMiddlewareStreamedBody(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	// the verified requests are proxied to a backend, which must only see
+	// bodies that match their digest
+	var received []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("backend failed to read body: %v", err)
+		}
+		received = append(received, string(body))
+		_, _ = w.Write(body)
+	}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatalf("failed to parse backend URL: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(nil)
+	serverURL, err := url.Parse("http://" + server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+	var validationErr error
+	middleware, err := Middleware(Opts{
+		NonceStorage: inmemory.NewNonceStorage(),
+		KeyDirectory: hmacKeyDirectory{secret: secret},
+		Tag:          "foo",
+		Scheme:       "http",
+		Authority:    serverURL.Host,
+		MaxBodyBytes: 8,
+		Routes: []Route{
+			{Pattern: "/", RequiredComponents: []string{"@method", "@target-uri", "content-length", "content-digest"}},
+		},
+		OnValidationError: func(ctx context.Context, err error) {
+			validationErr = err
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	server.Config.Handler = middleware(httputil.NewSingleHostReverseProxy(backendURL))
+	server.Start()
+	defer server.Close()
+
+	// the client signs the digest of the content, then sends the body
+	newClient := func(content, sent string) *http.Client {
+		digest, _, err := streamdigest.Compute(strings.NewReader(content), streamdigest.SHA256)
+		if err != nil {
+			t.Fatalf("failed to compute digest: %v", err)
+		}
+		return &http.Client{Transport: &signer.Transport{
+			KeyID:             "kid-1",
+			Tag:               "foo",
+			Alg:               alg_hmac.NewHMAC(secret),
+			CoveredComponents: []string{"@method", "@target-uri", "content-length", "content-digest"},
+			BaseTransport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				req.Header.Set("Content-Digest", digest.String())
+				req.Body = io.NopCloser(strings.NewReader(sent))
+				return http.DefaultTransport.RoundTrip(req)
+			}),
+		}}
+	}
+
+	cases := []struct {
+		name         string
+		content      string
+		sent         string
+		wantStatus   int
+		wantErr      error
+		wantReceived []string
+	}{
+		{name: "matching body", content: "hello", sent: "hello", wantStatus: http.StatusOK, wantReceived: []string{"hello"}},
+		{name: "tampered body", content: "hello", sent: "jello", wantStatus: http.StatusUnauthorized, wantErr: streamdigest.ErrMismatch},
+		{name: "too large", content: "hello world", sent: "hello world", wantStatus: http.StatusRequestEntityTooLarge, wantErr: streamdigest.ErrTooLarge},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			received, validationErr = nil, nil
+			res, err := newClient(tc.content, tc.sent).Post(server.URL, "text/plain", strings.NewReader(tc.content))
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tc.wantStatus {
+				t.Errorf("expected status %d, got %d", tc.wantStatus, res.StatusCode)
+			}
+			if !errors.Is(validationErr, tc.wantErr) {
+				t.Errorf("expected validation error %v, got %v", tc.wantErr, validationErr)
+			}
+			if !slices.Equal(received, tc.wantReceived) {
+				t.Errorf("expected the backend to receive %q, got %q", tc.wantReceived, received)
+			}
+		})
+	}
+}
+
+func TestMiddlewareNonceAfterVerification(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	server := httptest.NewUnstartedServer(nil)
+	serverURL, err := url.Parse("http://" + server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+	var validationErr error
+	middleware, err := Middleware(Opts{
+		NonceStorage: inmemory.NewNonceStorage(),
+		KeyDirectory: hmacKeyDirectory{secret: secret},
+		Tag:          "foo",
+		Scheme:       "http",
+		Authority:    serverURL.Host,
+		OnValidationError: func(ctx context.Context, err error) {
+			validationErr = err
+		},
+		Routes: []Route{
+			{Pattern: "GET /", RequiredComponents: []string{"@method", "@target-uri"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	server.Config.Handler = middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.Start()
+	defer server.Close()
+
+	newClient := func(secret []byte) *http.Client {
+		return &http.Client{Transport: &signer.Transport{
+			KeyID:             "kid-1",
+			Tag:               "foo",
+			Alg:               alg_hmac.NewHMAC(secret),
+			CoveredComponents: []string{"@method", "@target-uri"},
+			GetNonce:          func() (string, error) { return "nonce-1", nil },
+		}}
+	}
+
+	cases := []struct {
+		name       string
+		secret     []byte
+		wantStatus int
+		wantErr    error
+	}{
+		// a forged signature can't use up a client's nonce
+		{name: "forged signature", secret: []byte("not the secret"), wantStatus: http.StatusUnauthorized},
+		{name: "valid signature", secret: secret, wantStatus: http.StatusOK},
+		{name: "replayed nonce", secret: secret, wantStatus: http.StatusUnauthorized, wantErr: ErrReplayed},
+	}
+	for _, tc := range cases {
+		validationErr = nil
+		res, err := newClient(tc.secret).Get(server.URL + "/a")
+		if err != nil {
+			t.Fatalf("%s: failed to send request: %v", tc.name, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tc.wantStatus {
+			t.Fatalf("%s: expected status %d, got %d: %v", tc.name, tc.wantStatus, res.StatusCode, validationErr)
+		}
+		if tc.wantErr != nil && !errors.Is(validationErr, tc.wantErr) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.wantErr, validationErr)
+		}
+	}
+}
+
+func TestMiddlewareReplayGuard(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	server := httptest.NewUnstartedServer(nil)
+	serverURL, err := url.Parse("http://" + server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+	var validationErr error
+	middleware, err := Middleware(Opts{
+		NonceStorage: inmemory.NewNonceStorage(),
+		KeyDirectory: hmacKeyDirectory{secret: secret},
+		Tag:          "foo",
+		Scheme:       "http",
+		Authority:    serverURL.Host,
+		OnValidationError: func(ctx context.Context, err error) {
+			validationErr = err
+		},
+		Routes: []Route{
+			{Pattern: "GET /guarded/", RequiredComponents: []string{"@method", "@target-uri"}, ReplayGuard: true},
+			{Pattern: "GET /", RequiredComponents: []string{"@method", "@target-uri"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	server.Config.Handler = middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.Start()
+	defer server.Close()
+
+	// the signed requests are captured, to replay them
+	var sent *http.Request
+	newClient := func(nonce string) *http.Client {
+		return &http.Client{Transport: &signer.Transport{
+			KeyID:             "kid-1",
+			Tag:               "foo",
+			Alg:               alg_hmac.NewHMAC(secret),
+			CoveredComponents: []string{"@method", "@target-uri"},
+			GetNonce:          func() (string, error) { return nonce, nil },
+			BaseTransport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				sent = req
+				return http.DefaultTransport.RoundTrip(req)
+			}),
+		}}
+	}
+
+	cases := []struct {
+		name       string
+		path       string
+		nonce      string
+		wantStatus int
+		wantErr    error
+	}{
+		{name: "without a nonce", path: "/guarded/a", wantStatus: http.StatusOK},
+		{name: "with a nonce", path: "/guarded/b", nonce: "nonce-1", wantStatus: http.StatusOK},
+		{name: "unguarded route without a nonce", path: "/c", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			validationErr = nil
+			res, err := newClient(tc.nonce).Get(server.URL + tc.path)
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tc.wantStatus {
+				t.Fatalf("expected status %d, got %d: %v", tc.wantStatus, res.StatusCode, validationErr)
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+
+			// replaying the signed request is rejected
+			res, err = http.DefaultTransport.RoundTrip(sent.Clone(context.Background()))
+			if err != nil {
+				t.Fatalf("failed to replay request: %v", err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode != http.StatusUnauthorized {
+				t.Errorf("expected replay to be rejected, got %d: %s", res.StatusCode, body)
+			}
+			if !errors.Is(validationErr, ErrReplayed) {
+				t.Errorf("expected ErrReplayed, got %v", validationErr)
+			}
+		})
+	}
+
+}
+
+func TestMiddlewareReplayGuardFlippedSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	server := httptest.NewUnstartedServer(nil)
+	serverURL, err := url.Parse("http://" + server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+	var validationErr error
+	middleware, err := Middleware(Opts{
+		NonceStorage: inmemory.NewNonceStorage(),
+		KeyDirectory: alg_ecdsa.StaticKeyDirectory{Key: &key.PublicKey},
+		Tag:          "foo",
+		Scheme:       "http",
+		Authority:    serverURL.Host,
+		OnValidationError: func(ctx context.Context, err error) {
+			validationErr = err
+		},
+		Routes: []Route{
+			{Pattern: "GET /", RequiredComponents: []string{"@method", "@target-uri"}, ReplayGuard: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	server.Config.Handler = middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.Start()
+	defer server.Close()
+
+	var sent *http.Request
+	client := &http.Client{Transport: &signer.Transport{
+		KeyID:             "kid-1",
+		Tag:               "foo",
+		Alg:               alg_ecdsa.NewP256Signer(key),
+		CoveredComponents: []string{"@method", "@target-uri"},
+		GetNonce:          func() (string, error) { return "", nil },
+		BaseTransport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			sent = req
+			return http.DefaultTransport.RoundTrip(req)
+		}),
+	}}
+	res, err := client.Get(server.URL + "/a")
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %v", res.StatusCode, validationErr)
+	}
+
+	// (r, n-s) is also a valid signature over the same content
+	value := sent.Header.Get("Signature")
+	encoded := strings.TrimSuffix(strings.TrimPrefix(value, "sig1=:"), ":")
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sig) != 64 {
+		t.Fatalf("failed to decode signature %q: %v", value, err)
+	}
+	s := new(big.Int).SetBytes(sig[32:])
+	s.Sub(elliptic.P256().Params().N, s)
+	flipped := append([]byte(nil), sig[:32]...)
+	flipped = append(flipped, s.FillBytes(make([]byte, 32))...)
+
+	replay := sent.Clone(context.Background())
+	replay.Header.Set("Signature", "sig1=:"+base64.StdEncoding.EncodeToString(flipped)+":")
+	validationErr = nil
+	res, err = http.DefaultTransport.RoundTrip(replay)
+	if err != nil {
+		t.Fatalf("failed to replay request: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized || !errors.Is(validationErr, ErrReplayed) {
+		t.Errorf("expected the flipped signature to be rejected as a replay, got %d: %v", res.StatusCode, validationErr)
+	}
+}
@@ -0,0 +1,36 @@
+package session
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+)
+
+// ClientCertAuthenticator authenticates TLS client certificates. The server's
+// tls.Config must verify client certificates against the trusted CAs, such
+// as with tls.VerifyClientCertIfGiven, since only verified chains are used.
+type ClientCertAuthenticator struct {
+	// Username returns the username for a verified client certificate.
+	// Defaults to the subject's common name.
+	Username func(cert *x509.Certificate) string
+}
+
+var _ Authenticator = &ClientCertAuthenticator{}
+
+func (a *ClientCertAuthenticator) Authenticate(r *http.Request) (*User, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, ErrNoCredentials
+	}
+	if len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, errors.New("client certificate was not verified")
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	username := leaf.Subject.CommonName
+	if a.Username != nil {
+		username = a.Username(leaf)
+	}
+	if username == "" {
+		return nil, errors.New("client certificate has no username")
+	}
+	return &User{Username: username}, nil
+}
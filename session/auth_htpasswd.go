@@ -0,0 +1,79 @@
+package session
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HtpasswdAuthenticator authenticates HTTP basic auth credentials against
+// an htpasswd file. Only bcrypt and {SHA} password hashes are supported.
+type HtpasswdAuthenticator struct {
+	hashes map[string]string
+}
+
+var _ Authenticator = &HtpasswdAuthenticator{}
+
+// NewHtpasswdAuthenticator parses htpasswd formatted `username:hash` lines
+func NewHtpasswdAuthenticator(r io.Reader) (*HtpasswdAuthenticator, error) {
+	hashes := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("invalid htpasswd entry on line %d", lineNum)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("unsupported password hash for %q on line %d, use bcrypt or {SHA}", username, lineNum)
+		}
+		hashes[username] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &HtpasswdAuthenticator{hashes: hashes}, nil
+}
+
+// LoadHtpasswdFile reads an htpasswd file
+func LoadHtpasswdFile(path string) (*HtpasswdAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewHtpasswdAuthenticator(f)
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(r *http.Request) (*User, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	hash, ok := a.hashes[username]
+	if !ok || !checkHtpasswdHash(hash, password) {
+		return nil, errors.New("invalid username or password")
+	}
+	return &User{Username: username}, nil
+}
+
+func checkHtpasswdHash(hash, password string) bool {
+	if sha, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		sum := sha1.Sum([]byte(password))
+		want := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(sha), []byte(want)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
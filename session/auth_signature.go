@@ -0,0 +1,96 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/sigparams"
+	"github.com/common-fate/httpsig/sigset"
+	"github.com/common-fate/httpsig/verifier"
+	"github.com/micahhausler/httpsig-scratch/attributes"
+)
+
+// SignatureAuthenticator authenticates requests carrying an HTTP message
+// signature from a key in an existing KeyDirectory, such as a
+// gh.GitHubKeyDirectory. The username comes from the key's attributes.
+type SignatureAuthenticator struct {
+	// KeyDirectory looks up the signing keys, which must implement
+	// httpsig.Attributer
+	KeyDirectory verifier.KeyDirectory
+
+	// Tag is the tag of the authenticating signature. It should differ
+	// from the ProofOfPossession tag.
+	Tag string
+
+	// Scheme and Authority are the expected URL scheme and authority
+	Scheme    string
+	Authority string
+
+	// NonceStorage checks that signatures aren't replayed
+	NonceStorage verifier.NonceStorage
+
+	// Validation overrides the signature validation options. If nil,
+	// httpsig.DefaultValidationOpts() is used.
+	Validation *sigparams.ValidateOpts
+}
+
+var _ Authenticator = &SignatureAuthenticator{}
+
+func (a *SignatureAuthenticator) Authenticate(r *http.Request) (*User, error) {
+	set, err := sigset.Unmarshal(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := set.Find(a.Tag); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoCredentials, err)
+	}
+
+	v := verifier.Verifier{
+		NonceStorage: a.NonceStorage,
+		KeyDirectory: a.KeyDirectory,
+		Tag:          a.Tag,
+		Scheme:       a.Scheme,
+		Authority:    a.Authority,
+		Validation:   httpsig.DefaultValidationOpts(),
+	}
+	if a.Validation != nil {
+		v.Validation = *a.Validation
+	}
+	// the verifier consumes the body to check its digest, and replaces it
+	// with a buffered copy, so the handler can still read it
+	_, key, err := v.Parse(nil, r, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	attributer, ok := key.(httpsig.Attributer)
+	if !ok {
+		return nil, errors.New("signing key has no attributes")
+	}
+	username, err := usernameFromAttributes(attributer.Attributes())
+	if err != nil {
+		return nil, err
+	}
+	return &User{Username: username}, nil
+}
+
+// usernameFromAttributes returns the username in a key's attributes
+func usernameFromAttributes(attrs any) (string, error) {
+	switch v := attrs.(type) {
+	case attributes.User:
+		return v.Username, nil
+	case *attributes.User:
+		return v.Username, nil
+	case User:
+		return v.Username, nil
+	case *User:
+		return v.Username, nil
+	}
+	tokenAttrs, err := ParseTokenAttributes(attrs)
+	if err != nil {
+		return "", fmt.Errorf("unsupported key attributes %T: %w", attrs, err)
+	}
+	return tokenAttrs.Username, nil
+}
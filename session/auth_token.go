@@ -0,0 +1,78 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// StaticTokenAuthenticator authenticates bearer tokens from a fixed set,
+// like the Kubernetes static token file.
+type StaticTokenAuthenticator struct {
+	// users is indexed by the SHA-256 of the token, so lookups don't
+	// compare secrets directly
+	users map[[sha256.Size]byte]User
+}
+
+var _ Authenticator = &StaticTokenAuthenticator{}
+
+// NewStaticTokenAuthenticator returns an authenticator for the tokens,
+// indexed by token
+func NewStaticTokenAuthenticator(tokens map[string]User) *StaticTokenAuthenticator {
+	users := map[[sha256.Size]byte]User{}
+	for token, user := range tokens {
+		users[sha256.Sum256([]byte(token))] = user
+	}
+	return &StaticTokenAuthenticator{users: users}
+}
+
+// NewStaticTokenAuthenticatorFromCSV parses a Kubernetes style static token
+// file with `token,username[,uid[,"group1,group2"]]` lines. Only the token
+// and username are used.
+func NewStaticTokenAuthenticatorFromCSV(r io.Reader) (*StaticTokenAuthenticator, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid token file: %w", err)
+	}
+	tokens := map[string]User{}
+	for i, record := range records {
+		if len(record) < 2 || record[0] == "" || record[1] == "" {
+			return nil, fmt.Errorf("invalid token file entry %d, expected token,username", i+1)
+		}
+		if _, ok := tokens[record[0]]; ok {
+			return nil, fmt.Errorf("duplicate token in token file entry %d", i+1)
+		}
+		tokens[record[0]] = User{Username: record[1]}
+	}
+	return NewStaticTokenAuthenticator(tokens), nil
+}
+
+// LoadStaticTokenFile reads a Kubernetes style static token CSV file
+func LoadStaticTokenFile(path string) (*StaticTokenAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewStaticTokenAuthenticatorFromCSV(f)
+}
+
+func (a *StaticTokenAuthenticator) Authenticate(r *http.Request) (*User, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	user, ok := a.users[sha256.Sum256([]byte(strings.TrimSpace(token)))]
+	if !ok {
+		return nil, errors.New("invalid bearer token")
+	}
+	return &user, nil
+}
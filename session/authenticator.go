@@ -0,0 +1,52 @@
+package session
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrNoCredentials is returned by an Authenticator when the request doesn't
+// carry the kind of credentials it checks
+var ErrNoCredentials = errors.New("no credentials in request")
+
+// Authenticator authenticates the caller of a token issuance endpoint. The
+// returned User is the only source of a session token's UserInfo.
+type Authenticator interface {
+	// Authenticate returns the authenticated user, ErrNoCredentials if
+	// the request doesn't carry the authenticator's kind of credentials, or
+	// another error if the credentials are invalid
+	Authenticate(r *http.Request) (*User, error)
+}
+
+// Authenticators tries each Authenticator in order, and returns the user
+// from the first one the request carries credentials for
+type Authenticators []Authenticator
+
+var _ Authenticator = Authenticators{}
+
+func (a Authenticators) Authenticate(r *http.Request) (*User, error) {
+	for _, auth := range a {
+		user, err := auth.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return user, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// authenticate returns the authenticated user for a token issuance request.
+// Requests are rejected if no Authenticator is configured.
+func (e *EncryptionService) authenticate(r *http.Request) (*User, error) {
+	if e.Authenticator == nil {
+		return nil, errors.New("no authenticator configured")
+	}
+	user, err := e.Authenticator.Authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.Username == "" {
+		return nil, errors.New("authenticator returned no username")
+	}
+	return user, nil
+}
@@ -0,0 +1,287 @@
+package session
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/alg_ecdsa"
+	"github.com/common-fate/httpsig/inmemory"
+	"github.com/micahhausler/httpsig-scratch/attributes"
+	"github.com/micahhausler/httpsig-scratch/multialgo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// staticAuthenticator authenticates every request as the user
+type staticAuthenticator User
+
+func (a staticAuthenticator) Authenticate(r *http.Request) (*User, error) {
+	return &User{Username: a.Username}, nil
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("alice-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	shaSum := sha1.Sum([]byte("bob-password"))
+	htpasswd := fmt.Sprintf("# users\nalice:%s\nbob:{SHA}%s\n", bcryptHash, base64.StdEncoding.EncodeToString(shaSum[:]))
+	auth, err := NewHtpasswdAuthenticator(strings.NewReader(htpasswd))
+	if err != nil {
+		t.Fatalf("failed to parse htpasswd: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		username string
+		password string
+		noAuth   bool
+		want     string
+		wantErr  error
+	}{
+		{name: "bcrypt", username: "alice", password: "alice-password", want: "alice"},
+		{name: "sha", username: "bob", password: "bob-password", want: "bob"},
+		{name: "wrong password", username: "alice", password: "bob-password", wantErr: errors.New("")},
+		{name: "unknown user", username: "eve", password: "alice-password", wantErr: errors.New("")},
+		{name: "no credentials", noAuth: true, wantErr: ErrNoCredentials},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/session-token", nil)
+			if !tc.noAuth {
+				r.SetBasicAuth(tc.username, tc.password)
+			}
+			user, err := auth.Authenticate(r)
+			if tc.wantErr != nil {
+				if err == nil {
+					t.Fatalf("expected error, got user %v", user)
+				}
+				if errors.Is(tc.wantErr, ErrNoCredentials) && !errors.Is(err, ErrNoCredentials) {
+					t.Fatalf("expected ErrNoCredentials, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if user.Username != tc.want {
+				t.Errorf("expected user %s, got %s", tc.want, user.Username)
+			}
+		})
+	}
+
+	if _, err := NewHtpasswdAuthenticator(strings.NewReader("carol:$apr1$salt$hash\n")); err == nil {
+		t.Error("expected unsupported hash to be rejected")
+	}
+}
+
+func TestStaticTokenAuthenticator(t *testing.T) {
+	auth, err := NewStaticTokenAuthenticatorFromCSV(strings.NewReader("alice-token,alice,1001,\"admins,devs\"\nbob-token,bob\n"))
+	if err != nil {
+		t.Fatalf("failed to parse token file: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/session-token", nil)
+	if _, err := auth.Authenticate(r); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected ErrNoCredentials, got %v", err)
+	}
+	r.Header.Set("Authorization", "Bearer alice-token")
+	user, err := auth.Authenticate(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if user.Username != "alice" {
+		t.Errorf("expected alice, got %s", user.Username)
+	}
+	r.Header.Set("Authorization", "Bearer eve-token")
+	if _, err := auth.Authenticate(r); err == nil || errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected invalid token error, got %v", err)
+	}
+
+	if _, err := NewStaticTokenAuthenticatorFromCSV(strings.NewReader("token-only\n")); err == nil {
+		t.Error("expected entry without a username to be rejected")
+	}
+}
+
+func TestClientCertAuthenticator(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "alice"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+
+	auth := &ClientCertAuthenticator{}
+	r := httptest.NewRequest(http.MethodPost, "/session-token", nil)
+	if _, err := auth.Authenticate(r); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected ErrNoCredentials, got %v", err)
+	}
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if _, err := auth.Authenticate(r); err == nil {
+		t.Fatal("expected unverified certificate to be rejected")
+	}
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	user, err := auth.Authenticate(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if user.Username != "alice" {
+		t.Errorf("expected alice, got %s", user.Username)
+	}
+}
+
+func TestSignatureAuthenticator(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	keyDir := multialgo.NewMultiAlgoAttributerDirectory(map[string]multialgo.AttributerAlgo{
+		"alice-key": &alg_ecdsa.P256{PublicKey: &key.PublicKey, Attrs: attributes.User{Username: "alice"}},
+	})
+
+	var gotUser *User
+	var gotErr error
+	var gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := &bytes.Buffer{}
+		gotUser, gotErr = (Authenticators{
+			&StaticTokenAuthenticator{},
+			&SignatureAuthenticator{
+				KeyDirectory: keyDir,
+				Tag:          "github",
+				Scheme:       "http",
+				Authority:    r.Host,
+				NonceStorage: inmemory.NewNonceStorage(),
+			},
+		}).Authenticate(r)
+		buf.ReadFrom(r.Body)
+		gotBody = buf.String()
+	}))
+	defer server.Close()
+
+	client := httpsig.NewClient(httpsig.ClientOpts{
+		KeyID: "alice-key",
+		Tag:   "github",
+		Alg:   alg_ecdsa.NewP256Signer(key),
+	})
+	body, err := json.Marshal(&EncryptionRequest{KeyID: "kid-1"})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %v", err)
+	}
+	resp, err := client.Post(server.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to post: %v", err)
+	}
+	resp.Body.Close()
+	if gotErr != nil {
+		t.Fatalf("unexpected error: %v", gotErr)
+	}
+	if gotUser.Username != "alice" {
+		t.Errorf("expected alice, got %s", gotUser.Username)
+	}
+	if gotBody != string(body) {
+		t.Errorf("expected body to be readable after authentication, got %q", gotBody)
+	}
+
+	resp, err = http.Post(server.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to post: %v", err)
+	}
+	resp.Body.Close()
+	if !errors.Is(gotErr, ErrNoCredentials) {
+		t.Errorf("expected ErrNoCredentials for unsigned request, got %v", gotErr)
+	}
+}
+
+func TestHandlersUseAuthenticatedUser(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	encRequest, err := json.Marshal(&EncryptionRequest{
+		KeyID:     "kid-1",
+		Alg:       "ecdsa-p256-sha256",
+		PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		UserInfo:  User{Username: "mallory"},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %v", err)
+	}
+	credRequest, err := json.Marshal(&CredentialRequest{UserInfo: User{Username: "mallory"}})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %v", err)
+	}
+
+	encrypter := &staticEncrypter{}
+	svc := NewEncryptionService(encrypter)
+	handlers := map[string]struct {
+		handler http.Handler
+		body    []byte
+	}{
+		"session token": {svc.SessionTokenHandler(), encRequest},
+		"credentials":   {svc.NewCredentialHandler(), credRequest},
+	}
+	for name, h := range handlers {
+		t.Run(name, func(t *testing.T) {
+			svc.Authenticator = nil
+			w := httptest.NewRecorder()
+			h.handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(h.body)))
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("expected status %d without an authenticator, got %d", http.StatusUnauthorized, w.Code)
+			}
+
+			svc.Authenticator = NewStaticTokenAuthenticator(map[string]User{"alice-token": {Username: "alice"}})
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(h.body))
+			w = httptest.NewRecorder()
+			h.handler.ServeHTTP(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("expected status %d without credentials, got %d", http.StatusUnauthorized, w.Code)
+			}
+
+			encrypter.attributes = nil
+			r = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(h.body))
+			r.Header.Set("Authorization", "Bearer alice-token")
+			w = httptest.NewRecorder()
+			h.handler.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			attrs, ok := encrypter.attributes.(*TokenAttributes)
+			if !ok || attrs.Username != "alice" {
+				t.Errorf("expected token for authenticated user alice, got %#v", encrypter.attributes)
+			}
+		})
+	}
+}
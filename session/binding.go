@@ -0,0 +1,57 @@
+package session
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrBindingMismatch is wrapped by the errors of Decrypters that support
+// bindings when a token fails to authenticate with the Binding in the
+// context, such as a token minted for another audience
+var ErrBindingMismatch = errors.New("session token binding doesn't match")
+
+// Binding restricts where a session token can be used. Encrypters that
+// support bindings authenticate it as AEAD additional data, so a token
+// minted for one audience fails to decrypt for any other, even when both
+// services share the same encryption key.
+type Binding struct {
+	// Audience is the service the token is intended for, such as the
+	// server's authority or a configured service name
+	Audience string
+	// Purpose optionally narrows the token to a particular use
+	Purpose string
+}
+
+// IsZero returns true if the binding has no audience or purpose
+func (b Binding) IsZero() bool {
+	return b.Audience == "" && b.Purpose == ""
+}
+
+// AdditionalData returns the canonical serialization of the binding for use
+// as AEAD additional data. The zero Binding returns nil.
+func (b Binding) AdditionalData() []byte {
+	if b.IsZero() {
+		return nil
+	}
+	ad := []byte("binding")
+	ad = binary.AppendUvarint(ad, uint64(len(b.Audience)))
+	ad = append(ad, b.Audience...)
+	ad = binary.AppendUvarint(ad, uint64(len(b.Purpose)))
+	ad = append(ad, b.Purpose...)
+	return ad
+}
+
+type bindingContextKey struct{}
+
+// WithBinding returns a context carrying the binding. EncryptionService and
+// DecryptionService set this before calling their Encrypter or Decrypter.
+func WithBinding(ctx context.Context, b Binding) context.Context {
+	return context.WithValue(ctx, bindingContextKey{}, b)
+}
+
+// BindingFromContext returns the binding in the context, or the zero Binding
+func BindingFromContext(ctx context.Context) Binding {
+	b, _ := ctx.Value(bindingContextKey{}).(Binding)
+	return b
+}
@@ -0,0 +1,63 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// bindingDecrypter only decrypts tokens when the context has the expected binding
+type bindingDecrypter struct {
+	staticDecrypter
+	binding Binding
+}
+
+func (d bindingDecrypter) DecryptPublicKey(ctx context.Context, content []byte) (string, string, []byte, any, error) {
+	if BindingFromContext(ctx) != d.binding {
+		return "", "", nil, nil, fmt.Errorf("%w: message authentication failed", ErrBindingMismatch)
+	}
+	return d.staticDecrypter.DecryptPublicKey(ctx, content)
+}
+
+// failingDecrypter fails to decrypt every token with err
+type failingDecrypter struct {
+	err error
+}
+
+func (d failingDecrypter) DecryptPublicKey(ctx context.Context, content []byte) (string, string, []byte, any, error) {
+	return "", "", nil, nil, d.err
+}
+
+func TestDecryptionServiceAudience(t *testing.T) {
+	dec := bindingDecrypter{
+		staticDecrypter: staticDecrypter{keyID: "kid-1", alg: "hmac-sha256", publicKey: []byte("secret")},
+		binding:         Binding{Audience: "api.example.com"},
+	}
+	r := newSignedRequest(t, "x-session-token")
+
+	svc := NewDecryptionService(dec, "")
+	svc.Audience = "api.example.com"
+	if _, err := svc.GetRequestKey(r, "kid-1", "hmac-sha256"); err != nil {
+		t.Fatalf("unexpected error for matching audience: %v", err)
+	}
+
+	svc.Audience = "other.example.com"
+	_, err := svc.GetRequestKey(r, "kid-1", "hmac-sha256")
+	if err == nil {
+		t.Fatal("expected token for another audience to be rejected")
+	}
+	if !strings.Contains(err.Error(), "other.example.com") {
+		t.Errorf("expected error to name the audience, got %v", err)
+	}
+
+	// other failures aren't blamed on the audience
+	malformed := errors.New("malformed session token")
+	svc = NewDecryptionService(failingDecrypter{err: malformed}, "")
+	svc.Audience = "api.example.com"
+	_, err = svc.GetRequestKey(r, "kid-1", "hmac-sha256")
+	if !errors.Is(err, malformed) || strings.Contains(err.Error(), "audience") {
+		t.Errorf("expected the decryption error, got %v", err)
+	}
+}
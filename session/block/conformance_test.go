@@ -0,0 +1,76 @@
+package block
+
+import (
+	"crypto/aes"
+	"testing"
+
+	"github.com/micahhausler/httpsig-scratch/session"
+	"github.com/micahhausler/httpsig-scratch/session/envelope"
+	"github.com/micahhausler/httpsig-scratch/session/sessiontest"
+)
+
+func newTestBlockEncrypterDecrypter(t testing.TB) session.EncrypterDecrypter {
+	key := make([]byte, 32)
+	copy(key, t.Name())
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+	return NewBlockSessionEncrypterDecrypter(block)
+}
+
+func newTestKeyringEncrypterDecrypter(codec envelope.Codec) func(t testing.TB) session.EncrypterDecrypter {
+	return func(t testing.TB) session.EncrypterDecrypter {
+		key := make([]byte, 32)
+		copy(key, t.Name())
+		keyring, err := NewKeyring("primary", map[string][]byte{"primary": key})
+		if err != nil {
+			t.Fatalf("failed to create keyring: %v", err)
+		}
+		ed := NewKeyringSessionEncrypterDecrypter(keyring)
+		ed.Codec = codec
+		return ed
+	}
+}
+
+func TestBlockConformance(t *testing.T) {
+	sessiontest.Run(t, sessiontest.Options{
+		New: newTestBlockEncrypterDecrypter,
+		NewOtherKey: func(t testing.TB) session.EncrypterDecrypter {
+			block, err := aes.NewCipher(newTestKey(t))
+			if err != nil {
+				t.Fatalf("failed to create cipher: %v", err)
+			}
+			return NewBlockSessionEncrypterDecrypter(block)
+		},
+	})
+}
+
+func TestKeyringConformance(t *testing.T) {
+	for _, codec := range []envelope.Codec{envelope.CodecJSON, envelope.CodecCBOR} {
+		t.Run(codec.String(), func(t *testing.T) {
+			sessiontest.Run(t, sessiontest.Options{
+				New: newTestKeyringEncrypterDecrypter(codec),
+				NewOtherKey: func(t testing.TB) session.EncrypterDecrypter {
+					keyring, err := NewKeyring("primary", map[string][]byte{"primary": newTestKey(t)})
+					if err != nil {
+						t.Fatalf("failed to create keyring: %v", err)
+					}
+					return NewKeyringSessionEncrypterDecrypter(keyring)
+				},
+			})
+		})
+	}
+}
+
+func FuzzBlockDecryptPublicKey(f *testing.F) {
+	sessiontest.FuzzDecrypt(f, newTestBlockEncrypterDecrypter)
+}
+
+func FuzzKeyringDecryptPublicKey(f *testing.F) {
+	sessiontest.FuzzDecrypt(f, newTestKeyringEncrypterDecrypter(envelope.CodecCBOR))
+}
+
+func FuzzKeyringRoundTrip(f *testing.F) {
+	sessiontest.FuzzRoundTrip(f, newTestKeyringEncrypterDecrypter(envelope.CodecCBOR))
+}
@@ -3,14 +3,27 @@ package block
 import (
 	"context"
 	"crypto/cipher"
-	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"expvar"
+	"fmt"
+	"time"
 
 	"github.com/micahhausler/httpsig-scratch/session"
+	"github.com/micahhausler/httpsig-scratch/session/envelope"
+	"github.com/micahhausler/httpsig-scratch/session/internal/aead"
 )
 
-// SessionToken is an internal format that for serializing sesion token information for encryption
+// LegacyFormatDecryptions counts session tokens decrypted from the legacy
+// base64 JSON format. It is published with expvar as
+// "session_token_legacy_format_decryptions", and once it stops increasing
+// the legacy format is no longer in use.
+var LegacyFormatDecryptions = expvar.NewInt("session_token_legacy_format_decryptions")
+
+// SessionToken is the legacy format for serializing session token
+// information for encryption. New tokens use envelope.Payload, and
+// SessionToken is only used to decrypt tokens issued before the envelope
+// format.
 type SessionToken struct {
 	KeyID      string `json:"key_id"`
 	Alg        string `json:"alg"`
@@ -20,63 +33,125 @@ type SessionToken struct {
 
 type BlockEncrypterDecrypter struct {
 	block cipher.Block
+
+	// Codec is the payload serialization for new tokens, defaults to envelope.CodecJSON
+	Codec envelope.Codec
+
+	// LegacyUntil, if set, ends the migration from the legacy format, and
+	// legacy tokens are rejected after it. Legacy tokens aren't bound, so
+	// until then they're accepted whatever session.Binding is required.
+	LegacyUntil time.Time
 }
 
-func NewBlockSessionEncrypterDecrypter(block cipher.Block) session.EncrypterDecrypter {
-	return &BlockEncrypterDecrypter{block: block}
+var _ session.EncrypterDecrypter = &BlockEncrypterDecrypter{}
+
+func NewBlockSessionEncrypterDecrypter(block cipher.Block) *BlockEncrypterDecrypter {
+	return &BlockEncrypterDecrypter{block: block, Codec: envelope.CodecJSON}
 }
 
+// EncryptPublicKey encrypts the public key and attributes into a session
+// token, bound to the session.Binding in the context.
 func (e *BlockEncrypterDecrypter) EncryptPublicKey(ctx context.Context, keyID, alg string, publicKey []byte, attributes any) ([]byte, error) {
-
-	st := &SessionToken{
+	return sealEnvelope(e.block, e.Codec, "", session.BindingFromContext(ctx), &envelope.Payload{
 		KeyID:      keyID,
 		Alg:        alg,
-		PublicKey:  publicKey,
+		PublicKey:  envelope.CompactPublicKey(publicKey),
 		Attributes: attributes,
+	})
+}
+
+// DecryptPublicKey decrypts a session token, which must be bound to the
+// session.Binding in the context, unless it's a legacy token accepted until
+// LegacyUntil.
+func (e *BlockEncrypterDecrypter) DecryptPublicKey(ctx context.Context, content []byte) (keyID, alg string, publicKey []byte, attributes any, err error) {
+	binding := session.BindingFromContext(ctx)
+	var p *envelope.Payload
+	env, err := envelope.Decode(content)
+	if err == nil {
+		p, err = openEnvelope(e.block, env, binding)
 	}
-	plaintext, err := json.Marshal(st)
 	if err != nil {
-		return nil, err
+		if !acceptsLegacy(e.LegacyUntil) {
+			return "", "", nil, nil, err
+		}
+		var legacyErr error
+		p, legacyErr = e.decryptLegacy(content)
+		if legacyErr != nil {
+			return "", "", nil, nil, err
+		}
 	}
+	return p.KeyID, p.Alg, p.PublicKey, p.Attributes, nil
+}
+
+// acceptsLegacy returns true if legacy tokens are still accepted, until the
+// time if it isn't zero
+func acceptsLegacy(until time.Time) bool {
+	return until.IsZero() || time.Now().Before(until)
+}
 
-	gcm, err := cipher.NewGCM(e.block)
+// decryptLegacy decrypts a token issued before the envelope format, which
+// is the standard base64 encoding of the nonce and ciphertext of a JSON
+// SessionToken
+func (e *BlockEncrypterDecrypter) decryptLegacy(content []byte) (*envelope.Payload, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(string(content))
 	if err != nil {
 		return nil, err
 	}
-
-	nonce := make([]byte, gcm.NonceSize())
-	_, err = rand.Read(nonce)
+	plaintext, err := aead.Open(e.block, ciphertext, nil)
 	if err != nil {
 		return nil, err
 	}
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-
-	resp := base64.StdEncoding.EncodeToString(ciphertext)
-	return []byte(resp), nil
+	return parseLegacySessionToken(plaintext)
 }
 
-func (e *BlockEncrypterDecrypter) DecryptPublicKey(ctx context.Context, content []byte) (keyID, alg string, publicKey []byte, attributes any, err error) {
-	ciphertext, err := base64.StdEncoding.DecodeString(string(content))
+func parseLegacySessionToken(plaintext []byte) (*envelope.Payload, error) {
+	st := &SessionToken{}
+	err := json.Unmarshal(plaintext, st)
 	if err != nil {
-		return "", "", nil, nil, err
+		return nil, err
 	}
+	LegacyFormatDecryptions.Add(1)
+	return &envelope.Payload{
+		KeyID:      st.KeyID,
+		Alg:        st.Alg,
+		PublicKey:  st.PublicKey,
+		Attributes: st.Attributes,
+	}, nil
+}
 
-	gcm, err := cipher.NewGCM(e.block)
+// sealEnvelope serializes and encrypts the payload, authenticating the
+// envelope header and binding as additional data, and returns the encoded
+// envelope
+func sealEnvelope(block cipher.Block, codec envelope.Codec, kid string, binding session.Binding, p *envelope.Payload) ([]byte, error) {
+	if codec == 0 {
+		codec = envelope.CodecJSON
+	}
+	plaintext, err := envelope.MarshalPayload(codec, p)
 	if err != nil {
-		return "", "", nil, nil, err
+		return nil, err
 	}
+	env := envelope.New(codec, kid, nil)
+	header, err := env.Header()
+	if err != nil {
+		return nil, err
+	}
+	env.Body, err = aead.Seal(block, plaintext, append(header, binding.AdditionalData()...))
+	if err != nil {
+		return nil, err
+	}
+	return env.Encode()
+}
 
-	nonceSize := gcm.NonceSize()
-	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-
-	plaintext, err := gcm.Open(nil, []byte(nonce), []byte(ciphertext), nil)
+// openEnvelope decrypts and parses the payload of an envelope. Decryption
+// fails if the envelope wasn't sealed with the same binding.
+func openEnvelope(block cipher.Block, env *envelope.Envelope, binding session.Binding) (*envelope.Payload, error) {
+	header, err := env.Header()
 	if err != nil {
-		return "", "", nil, nil, err
+		return nil, err
 	}
-	st := &SessionToken{}
-	err = json.Unmarshal(plaintext, st)
+	plaintext, err := aead.Open(block, env.Body, append(header, binding.AdditionalData()...))
 	if err != nil {
-		return "", "", nil, nil, err
+		return nil, fmt.Errorf("%w: %w", session.ErrBindingMismatch, err)
 	}
-	return st.KeyID, st.Alg, st.PublicKey, st.Attributes, nil
+	return envelope.UnmarshalPayload(env.Codec, plaintext)
 }
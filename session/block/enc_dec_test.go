@@ -1,10 +1,20 @@
 package block
 
 import (
+	"bytes"
 	"context"
 	"crypto/aes"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"testing"
+	"time"
+
+	"github.com/micahhausler/httpsig-scratch/session"
+	"github.com/micahhausler/httpsig-scratch/session/envelope"
+	"github.com/micahhausler/httpsig-scratch/session/internal/aead"
 )
 
 func TestEncryptDecrypt(t *testing.T) {
@@ -57,3 +67,176 @@ func TestEncryptDecrypt(t *testing.T) {
 		})
 	}
 }
+
+func TestEncryptDecryptCodecs(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatalf("failed to read rand: %v", err)
+	}
+	cipher, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+	der := []byte{0x30, 0x59, 0x30, 0x13}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	for _, codec := range []envelope.Codec{envelope.CodecJSON, envelope.CodecCBOR} {
+		t.Run(codec.String(), func(t *testing.T) {
+			enc := NewBlockSessionEncrypterDecrypter(cipher)
+			enc.Codec = codec
+
+			token, err := enc.EncryptPublicKey(context.Background(), "kid1", "alg1", pemKey, map[string]interface{}{"username": "alice"})
+			if err != nil {
+				t.Fatalf("failed to encrypt: %v", err)
+			}
+			env, err := envelope.Decode(token)
+			if err != nil {
+				t.Fatalf("expected an envelope: %v", err)
+			}
+			if env.Codec != codec {
+				t.Fatalf("expected codec %s, got %s", codec, env.Codec)
+			}
+
+			_, _, gotPubKey, gotAttrs, err := enc.DecryptPublicKey(context.Background(), token)
+			if err != nil {
+				t.Fatalf("failed to decrypt: %v", err)
+			}
+			if !bytes.Equal(gotPubKey, der) {
+				t.Fatalf("expected DER public key %x, got %x", der, gotPubKey)
+			}
+			if gotAttrs.(map[string]interface{})["username"] != "alice" {
+				t.Fatalf("expected username alice, got %v", gotAttrs)
+			}
+		})
+	}
+}
+
+func TestDecryptLegacyFormat(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatalf("failed to read rand: %v", err)
+	}
+	cipher, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+	pemKey := []byte("-----BEGIN PUBLIC KEY-----")
+	plaintext, err := json.Marshal(&SessionToken{KeyID: "kid1", Alg: "alg1", PublicKey: pemKey})
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	ciphertext, err := aead.Seal(cipher, plaintext, nil)
+	if err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+	legacyToken := []byte(base64.StdEncoding.EncodeToString(ciphertext))
+
+	before := LegacyFormatDecryptions.Value()
+	gotKid, _, gotPubKey, _, err := NewBlockSessionEncrypterDecrypter(cipher).DecryptPublicKey(context.Background(), legacyToken)
+	if err != nil {
+		t.Fatalf("failed to decrypt legacy token: %v", err)
+	}
+	if gotKid != "kid1" || !bytes.Equal(gotPubKey, pemKey) {
+		t.Fatalf("unexpected legacy token contents %s %s", gotKid, gotPubKey)
+	}
+	if got := LegacyFormatDecryptions.Value() - before; got != 1 {
+		t.Fatalf("expected 1 legacy decryption, got %d", got)
+	}
+
+	// legacy tokens aren't bound, but are accepted at any audience until
+	// the migration ends
+	bound := session.WithBinding(context.Background(), session.Binding{Audience: "api.example.com"})
+	keyring, err := NewKeyring("k1", map[string][]byte{"k1": key})
+	if err != nil {
+		t.Fatalf("failed to create keyring: %v", err)
+	}
+	blockEnc := NewBlockSessionEncrypterDecrypter(cipher)
+	keyringEnc := NewKeyringSessionEncrypterDecrypter(keyring)
+	cases := []struct {
+		name        string
+		legacyUntil time.Time
+		wantErr     bool
+	}{
+		{name: "no cutoff"},
+		{name: "before the cutoff", legacyUntil: time.Now().Add(time.Hour)},
+		{name: "after the cutoff", legacyUntil: time.Now().Add(-time.Hour), wantErr: true},
+	}
+	for _, tc := range cases {
+		blockEnc.LegacyUntil, keyringEnc.LegacyUntil = tc.legacyUntil, tc.legacyUntil
+		for name, enc := range map[string]session.EncrypterDecrypter{"block": blockEnc, "keyring": keyringEnc} {
+			t.Run(name+"/"+tc.name, func(t *testing.T) {
+				gotKid, _, _, _, err := enc.DecryptPublicKey(bound, legacyToken)
+				if tc.wantErr {
+					if err == nil {
+						t.Fatal("expected the legacy token to be rejected")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("failed to decrypt legacy token with an audience: %v", err)
+				}
+				if gotKid != "kid1" {
+					t.Fatalf("expected kid %s, got %s", "kid1", gotKid)
+				}
+			})
+		}
+	}
+}
+
+func TestEncryptDecryptBinding(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatalf("failed to read rand: %v", err)
+	}
+	cipher, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+	keyring, err := NewKeyring("k1", map[string][]byte{"k1": key})
+	if err != nil {
+		t.Fatalf("failed to create keyring: %v", err)
+	}
+
+	issued := session.Binding{Audience: "api.example.com", Purpose: "signing"}
+	cases := []struct {
+		name    string
+		binding session.Binding
+		wantErr bool
+	}{
+		{"matching binding", issued, false},
+		{"different audience", session.Binding{Audience: "other.example.com", Purpose: "signing"}, true},
+		{"different purpose", session.Binding{Audience: "api.example.com", Purpose: "admin"}, true},
+		{"no binding", session.Binding{}, true},
+	}
+	encs := map[string]session.EncrypterDecrypter{
+		"block":   NewBlockSessionEncrypterDecrypter(cipher),
+		"keyring": NewKeyringSessionEncrypterDecrypter(keyring),
+	}
+	for name, enc := range encs {
+		token, err := enc.EncryptPublicKey(session.WithBinding(context.Background(), issued), "kid1", "alg1", []byte("key"), nil)
+		if err != nil {
+			t.Fatalf("failed to encrypt: %v", err)
+		}
+		for _, tc := range cases {
+			t.Run(name+"/"+tc.name, func(t *testing.T) {
+				ctx := session.WithBinding(context.Background(), tc.binding)
+				gotKid, _, _, _, err := enc.DecryptPublicKey(ctx, token)
+				if tc.wantErr {
+					if !errors.Is(err, session.ErrBindingMismatch) {
+						t.Fatalf("expected ErrBindingMismatch, got %v", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("failed to decrypt: %v", err)
+				}
+				if gotKid != "kid1" {
+					t.Fatalf("expected kid %s, got %s", "kid1", gotKid)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package block
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/micahhausler/httpsig-scratch/session/internal/keyring"
+)
+
+// KeyringFile is the on-disk JSON format of a Keyring.
+//
+//	{
+//	  "primary": "2024-10",
+//	  "keys": [
+//	    {"id": "2024-10", "key": "<base64 encoded 32 byte AES key>"},
+//	    {"id": "2024-09", "key": "<base64 encoded 32 byte AES key>"}
+//	  ]
+//	}
+type KeyringFile struct {
+	Primary string       `json:"primary"`
+	Keys    []KeyringKey `json:"keys"`
+}
+
+// KeyringKey is a single AES key in a KeyringFile
+type KeyringKey struct {
+	ID  string `json:"id"`
+	Key []byte `json:"key"`
+}
+
+// Keyring is a set of AES keys indexed by key ID. New session tokens are
+// encrypted with the primary key, and tokens can be decrypted with any key
+// still present in the keyring.
+//
+// A Keyring is safe for concurrent use, and its keys can be replaced at
+// runtime with Set or WatchFile.
+type Keyring struct {
+	blocks keyring.Keyring[cipher.Block]
+}
+
+// NewKeyring returns a Keyring for the given AES keys. The primary key ID
+// must be present in keys.
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{}
+	if err := k.Set(primary, keys); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// LoadKeyringFile reads a KeyringFile from disk and returns a Keyring
+func LoadKeyringFile(path string) (*Keyring, error) {
+	primary, keys, err := readKeyringFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyring(primary, keys)
+}
+
+func readKeyringFile(path string) (string, map[string][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	kf := &KeyringFile{}
+	if err := json.Unmarshal(data, kf); err != nil {
+		return "", nil, fmt.Errorf("failed to parse keyring file: %w", err)
+	}
+	keys := map[string][]byte{}
+	for _, key := range kf.Keys {
+		if _, ok := keys[key.ID]; ok {
+			return "", nil, fmt.Errorf("duplicate key id %q in keyring file", key.ID)
+		}
+		keys[key.ID] = key.Key
+	}
+	return kf.Primary, keys, nil
+}
+
+// Set atomically replaces the keys in the keyring
+func (k *Keyring) Set(primary string, keys map[string][]byte) error {
+	blocks := map[string]cipher.Block{}
+	for id, key := range keys {
+		if len(key) != 32 {
+			return fmt.Errorf("key %q must be 32 bytes, got %d", id, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		blocks[id] = block
+	}
+	return k.blocks.Set(primary, blocks)
+}
+
+// Primary returns the primary key ID and cipher
+func (k *Keyring) Primary() (string, cipher.Block) {
+	return k.blocks.Primary()
+}
+
+// Get returns the cipher for a key ID, and whether that key is the primary
+func (k *Keyring) Get(id string) (block cipher.Block, primary bool, ok bool) {
+	return k.blocks.Get(id)
+}
+
+// KeyIDs returns all key IDs in the keyring, sorted
+func (k *Keyring) KeyIDs() []string {
+	return k.blocks.KeyIDs()
+}
+
+// WatchFile polls a KeyringFile for changes every interval and reloads the
+// keyring when the file's modification time changes. If the file can't be
+// loaded, the error is logged and the existing keys stay in place.
+//
+// WatchFile blocks until the context is cancelled.
+func (k *Keyring) WatchFile(ctx context.Context, path string, interval time.Duration) {
+	k.blocks.WatchFile(ctx, path, interval, "keyring", func(path string) error {
+		primary, keys, err := readKeyringFile(path)
+		if err != nil {
+			return err
+		}
+		return k.Set(primary, keys)
+	})
+}
@@ -0,0 +1,165 @@
+package block
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/micahhausler/httpsig-scratch/session"
+	"github.com/micahhausler/httpsig-scratch/session/envelope"
+	"github.com/micahhausler/httpsig-scratch/session/internal/aead"
+)
+
+// NonPrimaryKeyDecryptions counts session tokens decrypted with a key other
+// than the keyring's primary key, indexed by key ID. It is published with
+// expvar as "session_token_non_primary_key_decryptions".
+//
+// A count that stays above zero after a rotation means tokens encrypted with
+// an older key are still in use, and that key shouldn't be removed yet.
+var NonPrimaryKeyDecryptions = expvar.NewMap("session_token_non_primary_key_decryptions")
+
+// KeyringEncrypterDecrypter encrypts session tokens with the primary key of
+// a Keyring, and decrypts them with whichever key in the keyring they were
+// encrypted with. The key ID is carried in the envelope header.
+type KeyringEncrypterDecrypter struct {
+	keyring *Keyring
+
+	// Codec is the payload serialization for new tokens, defaults to envelope.CodecJSON
+	Codec envelope.Codec
+
+	// LegacyUntil, if set, ends the migration from the legacy format, and
+	// legacy tokens are rejected after it. Legacy tokens aren't bound, so
+	// until then they're accepted whatever session.Binding is required.
+	LegacyUntil time.Time
+}
+
+var _ session.EncrypterDecrypter = &KeyringEncrypterDecrypter{}
+
+// NewKeyringSessionEncrypterDecrypter returns a session.EncrypterDecrypter
+// backed by the keyring.
+func NewKeyringSessionEncrypterDecrypter(keyring *Keyring) *KeyringEncrypterDecrypter {
+	return &KeyringEncrypterDecrypter{keyring: keyring, Codec: envelope.CodecJSON}
+}
+
+// EncryptPublicKey encrypts the public key and attributes into a session
+// token with the primary key, bound to the session.Binding in the context.
+func (e *KeyringEncrypterDecrypter) EncryptPublicKey(ctx context.Context, keyID, alg string, publicKey []byte, attributes any) ([]byte, error) {
+	primary, block := e.keyring.Primary()
+	if block == nil {
+		return nil, errors.New("keyring has no primary key")
+	}
+	return sealEnvelope(block, e.Codec, primary, session.BindingFromContext(ctx), &envelope.Payload{
+		KeyID:      keyID,
+		Alg:        alg,
+		PublicKey:  envelope.CompactPublicKey(publicKey),
+		Attributes: attributes,
+	})
+}
+
+// DecryptPublicKey decrypts a session token, which must be bound to the
+// session.Binding in the context, unless it's a legacy token accepted until
+// LegacyUntil.
+func (e *KeyringEncrypterDecrypter) DecryptPublicKey(ctx context.Context, content []byte) (keyID, alg string, publicKey []byte, attributes any, err error) {
+	binding := session.BindingFromContext(ctx)
+	var p *envelope.Payload
+	env, err := envelope.Decode(content)
+	if err == nil {
+		p, err = e.openEnvelope(env, binding)
+	}
+	if err != nil {
+		if !acceptsLegacy(e.LegacyUntil) {
+			return "", "", nil, nil, err
+		}
+		var legacyErr error
+		p, legacyErr = e.decryptLegacy(content)
+		if legacyErr != nil {
+			return "", "", nil, nil, err
+		}
+	}
+	return p.KeyID, p.Alg, p.PublicKey, p.Attributes, nil
+}
+
+func (e *KeyringEncrypterDecrypter) openEnvelope(env *envelope.Envelope, binding session.Binding) (*envelope.Payload, error) {
+	if env.KeyID == "" {
+		return e.openWithAnyKey(func(block cipher.Block) (*envelope.Payload, error) {
+			return openEnvelope(block, env, binding)
+		})
+	}
+
+	block, primary, ok := e.keyring.Get(env.KeyID)
+	if !ok {
+		return nil, fmt.Errorf("session token key %q not found in keyring", env.KeyID)
+	}
+	p, err := openEnvelope(block, env, binding)
+	if err != nil {
+		return nil, err
+	}
+	if !primary {
+		NonPrimaryKeyDecryptions.Add(env.KeyID, 1)
+	}
+	return p, nil
+}
+
+// decryptLegacy decrypts tokens issued before the envelope format, which
+// are the standard base64 encoding of either
+//
+//	key ID length (1 byte) | key ID | nonce | ciphertext
+//
+// with the key ID as additional data, or the nonce and ciphertext alone from
+// BlockEncrypterDecrypter. The plaintext is a JSON SessionToken.
+func (e *KeyringEncrypterDecrypter) decryptLegacy(content []byte) (*envelope.Payload, error) {
+	data, err := base64.StdEncoding.DecodeString(string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > 0 {
+		kidLen := int(data[0])
+		if len(data) > 1+kidLen {
+			kid := string(data[1 : 1+kidLen])
+			if block, primary, ok := e.keyring.Get(kid); ok {
+				plaintext, err := aead.Open(block, data[1+kidLen:], []byte(kid))
+				if err == nil {
+					if !primary {
+						NonPrimaryKeyDecryptions.Add(kid, 1)
+					}
+					return parseLegacySessionToken(plaintext)
+				}
+			}
+		}
+	}
+
+	return e.openWithAnyKey(func(block cipher.Block) (*envelope.Payload, error) {
+		plaintext, err := aead.Open(block, data, nil)
+		if err != nil {
+			return nil, err
+		}
+		return parseLegacySessionToken(plaintext)
+	})
+}
+
+// openWithAnyKey tries each key in the keyring for tokens that don't carry
+// a key ID, such as those created by BlockEncrypterDecrypter. This lets a
+// server move from a single key to a keyring without invalidating
+// outstanding tokens.
+func (e *KeyringEncrypterDecrypter) openWithAnyKey(openFn func(cipher.Block) (*envelope.Payload, error)) (*envelope.Payload, error) {
+	for _, kid := range e.keyring.KeyIDs() {
+		block, primary, ok := e.keyring.Get(kid)
+		if !ok {
+			continue
+		}
+		p, err := openFn(block)
+		if err != nil {
+			continue
+		}
+		if !primary {
+			NonPrimaryKeyDecryptions.Add(kid, 1)
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("no key in keyring could decrypt session token")
+}
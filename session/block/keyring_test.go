@@ -0,0 +1,183 @@
+package block
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/micahhausler/httpsig-scratch/session/internal/aead"
+)
+
+func newTestKey(t testing.TB) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatalf("failed to read rand: %v", err)
+	}
+	return key
+}
+
+func nonPrimaryCount(kid string) int64 {
+	v, ok := NonPrimaryKeyDecryptions.Get(kid).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+func TestKeyringRotation(t *testing.T) {
+	oldKey := newTestKey(t)
+	newKey := newTestKey(t)
+
+	keyring, err := NewKeyring("old", map[string][]byte{"old": oldKey})
+	if err != nil {
+		t.Fatalf("failed to create keyring: %v", err)
+	}
+	enc := NewKeyringSessionEncrypterDecrypter(keyring)
+
+	oldToken, err := enc.EncryptPublicKey(context.Background(), "kid1", "alg1", []byte("key"), nil)
+	if err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+
+	// rotate: new key is primary, old key is still accepted
+	err = keyring.Set("new", map[string][]byte{"old": oldKey, "new": newKey})
+	if err != nil {
+		t.Fatalf("failed to rotate keyring: %v", err)
+	}
+	newToken, err := enc.EncryptPublicKey(context.Background(), "kid2", "alg1", []byte("key"), nil)
+	if err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+
+	before := nonPrimaryCount("old")
+	gotKid, _, _, _, err := enc.DecryptPublicKey(context.Background(), oldToken)
+	if err != nil {
+		t.Fatalf("failed to decrypt token from old key: %v", err)
+	}
+	if gotKid != "kid1" {
+		t.Fatalf("expected kid %s, got %s", "kid1", gotKid)
+	}
+	if got := nonPrimaryCount("old") - before; got != 1 {
+		t.Fatalf("expected 1 non-primary decryption, got %d", got)
+	}
+
+	gotKid, _, _, _, err = enc.DecryptPublicKey(context.Background(), newToken)
+	if err != nil {
+		t.Fatalf("failed to decrypt token from new key: %v", err)
+	}
+	if gotKid != "kid2" {
+		t.Fatalf("expected kid %s, got %s", "kid2", gotKid)
+	}
+
+	// retire the old key
+	err = keyring.Set("new", map[string][]byte{"new": newKey})
+	if err != nil {
+		t.Fatalf("failed to rotate keyring: %v", err)
+	}
+	_, _, _, _, err = enc.DecryptPublicKey(context.Background(), oldToken)
+	if err == nil {
+		t.Fatal("expected error decrypting token with retired key, got none")
+	}
+}
+
+func TestKeyringDecryptsBlockTokens(t *testing.T) {
+	key := newTestKey(t)
+	cipher, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+	legacyToken, err := NewBlockSessionEncrypterDecrypter(cipher).EncryptPublicKey(context.Background(), "kid1", "alg1", []byte("key"), nil)
+	if err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+
+	keyring, err := NewKeyring("new", map[string][]byte{"legacy": key, "new": newTestKey(t)})
+	if err != nil {
+		t.Fatalf("failed to create keyring: %v", err)
+	}
+	gotKid, _, _, _, err := NewKeyringSessionEncrypterDecrypter(keyring).DecryptPublicKey(context.Background(), legacyToken)
+	if err != nil {
+		t.Fatalf("failed to decrypt: %v", err)
+	}
+	if gotKid != "kid1" {
+		t.Fatalf("expected kid %s, got %s", "kid1", gotKid)
+	}
+}
+
+func TestKeyringDecryptsLegacyKeyringTokens(t *testing.T) {
+	key := newTestKey(t)
+	keyring, err := NewKeyring("old", map[string][]byte{"old": key, "new": newTestKey(t)})
+	if err != nil {
+		t.Fatalf("failed to create keyring: %v", err)
+	}
+	block, _, _ := keyring.Get("old")
+
+	plaintext, err := json.Marshal(&SessionToken{KeyID: "kid1", Alg: "alg1"})
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	ciphertext, err := aead.Seal(block, plaintext, []byte("old"))
+	if err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+	legacyToken := base64.StdEncoding.EncodeToString(append([]byte{3, 'o', 'l', 'd'}, ciphertext...))
+
+	gotKid, _, _, _, err := NewKeyringSessionEncrypterDecrypter(keyring).DecryptPublicKey(context.Background(), []byte(legacyToken))
+	if err != nil {
+		t.Fatalf("failed to decrypt: %v", err)
+	}
+	if gotKid != "kid1" {
+		t.Fatalf("expected kid %s, got %s", "kid1", gotKid)
+	}
+}
+
+func TestKeyringWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	writeKeyring := func(kf KeyringFile, modTime time.Time) {
+		data, err := json.Marshal(kf)
+		if err != nil {
+			t.Fatalf("failed to marshal keyring: %v", err)
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("failed to write keyring: %v", err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("failed to set keyring mod time: %v", err)
+		}
+	}
+	now := time.Now()
+	oldKey := KeyringKey{ID: "old", Key: newTestKey(t)}
+	newKey := KeyringKey{ID: "new", Key: newTestKey(t)}
+	writeKeyring(KeyringFile{Primary: "old", Keys: []KeyringKey{oldKey}}, now.Add(-time.Minute))
+
+	keyring, err := LoadKeyringFile(path)
+	if err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go keyring.WatchFile(ctx, path, 10*time.Millisecond)
+
+	writeKeyring(KeyringFile{Primary: "new", Keys: []KeyringKey{oldKey, newKey}}, now)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if primary, _ := keyring.Primary(); primary == "new" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("keyring was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
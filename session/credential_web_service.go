@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"log/slog"
 	"net/http"
+	"time"
 )
 
 func createCredentials() (string, string, error) {
@@ -30,21 +31,33 @@ func createCredentials() (string, string, error) {
 }
 
 type CredentialRequest struct {
+	// UserInfo is ignored, the token's user comes from the EncryptionService's Authenticator
 	UserInfo User `json:"user_info"`
+
+	// EphemeralPublicKey is an optional X25519 public key. If set, the secret
+	// key is returned sealed to it in SealedSecretKey rather than in
+	// plaintext.
+	EphemeralPublicKey []byte `json:"ephemeral_public_key,omitempty"`
+
+	// Scopes optionally restrict the requests the session token authorizes
+	Scopes []Scope `json:"scopes,omitempty"`
 }
 
 type CredentialResponse struct {
-	KeyID        string `json:"key_id,omitempty"`
-	SecretKey    string `json:"secret_key,omitempty"`
-	SessionToken []byte `json:"session_token,omitempty"`
-	Error        string `json:"error,omitempty"`
+	KeyID     string `json:"key_id,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+	// SealedSecretKey is the secret key sealed to the request's
+	// EphemeralPublicKey, with the KeyID as additional data
+	SealedSecretKey *SealedSecret `json:"sealed_secret_key,omitempty"`
+	SessionToken    []byte        `json:"session_token,omitempty"`
+	TokenID         string        `json:"token_id,omitempty"`
+	ExpiresAt       *time.Time    `json:"expires_at,omitempty"`
+	Error           string        `json:"error,omitempty"`
 }
 
-// NewCredentialHandler returns an HTTP Handler that creates a session token for an EncryptionRequest.
-// Authenication should be handled outside this handler.
-//
-// To inject attributes into a session token, add it to the request's context,
-// and specify the context key in the SessionTokenHandler method.
+// NewCredentialHandler returns an HTTP Handler that creates HMAC credentials
+// and a session token for them. The caller is authenticated with the
+// service's Authenticator, which is the only source of the token's user.
 func (e *EncryptionService) NewCredentialHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -59,9 +72,18 @@ func (e *EncryptionService) NewCredentialHandler() http.Handler {
 			return
 		}
 
+		user, err := e.authenticate(r)
+		if err != nil {
+			slog.Error("failed to authenticate token request", "remote_addr", r.RemoteAddr, "error", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			resp.Error = "unauthorized"
+			enc.Encode(resp)
+			return
+		}
+
 		request := &CredentialRequest{}
 		defer r.Body.Close()
-		err := json.NewDecoder(r.Body).Decode(request)
+		err = json.NewDecoder(r.Body).Decode(request)
 		if err != nil {
 			slog.Error("failed to decode request", "error", err)
 			resp.Error = "invalid request"
@@ -69,6 +91,21 @@ func (e *EncryptionService) NewCredentialHandler() http.Handler {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		err = validateScopes(request.Scopes)
+		if err != nil {
+			slog.Error("invalid session token scopes", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			resp.Error = err.Error()
+			enc.Encode(resp)
+			return
+		}
+		if len(request.EphemeralPublicKey) == 0 && e.RequireSealedCredentials {
+			slog.Error("credential request has no ephemeral public key", "remote_addr", r.RemoteAddr)
+			w.WriteHeader(http.StatusBadRequest)
+			resp.Error = "ephemeral_public_key is required"
+			enc.Encode(resp)
+			return
+		}
 
 		kid, secretKey, err := createCredentials()
 		if err != nil {
@@ -79,14 +116,35 @@ func (e *EncryptionService) NewCredentialHandler() http.Handler {
 			return
 		}
 		resp.KeyID = kid
-		resp.SecretKey = secretKey
+		if len(request.EphemeralPublicKey) > 0 {
+			resp.SealedSecretKey, err = SealSecret(request.EphemeralPublicKey, []byte(secretKey), []byte(kid))
+			if err != nil {
+				slog.Error("failed to seal secret key", "error", err)
+				w.WriteHeader(http.StatusBadRequest)
+				resp = &CredentialResponse{Error: "invalid ephemeral_public_key"}
+				enc.Encode(resp)
+				return
+			}
+		} else {
+			resp.SecretKey = secretKey
+		}
+
+		attrs, err := newTokenAttributes(*user, e.TokenLifetime)
+		if err != nil {
+			slog.Error("failed to create token attributes", "error", err)
+			resp.Error = "internal server error"
+			enc.Encode(resp)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		attrs.Scopes = request.Scopes
 
 		sessionToken, err := e.encrypter.EncryptPublicKey(
-			r.Context(),
+			e.bindingContext(r.Context()),
 			kid,
 			"hmac-sha256",
 			[]byte(secretKey),
-			request.UserInfo,
+			attrs,
 		)
 		if err != nil {
 			slog.Error("failed to encrypt token key", "error", err)
@@ -96,6 +154,8 @@ func (e *EncryptionService) NewCredentialHandler() http.Handler {
 			return
 		}
 		resp.SessionToken = sessionToken
+		resp.TokenID = attrs.TokenID
+		resp.ExpiresAt = attrs.expiresAt()
 		err = enc.Encode(resp)
 		if err != nil {
 			slog.Error("failed to encode response", "error", err)
@@ -103,6 +163,6 @@ func (e *EncryptionService) NewCredentialHandler() http.Handler {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		slog.Info("Created HMAC credentials", "method", r.Method, "url", r.URL.String(), "remote_addr", r.RemoteAddr, "user", request.UserInfo.Username)
+		slog.Info("Created HMAC credentials", "method", r.Method, "url", r.URL.String(), "remote_addr", r.RemoteAddr, "user", user.Username, "token_id", attrs.TokenID, "sealed", resp.SealedSecretKey != nil)
 	})
 }
@@ -0,0 +1,12 @@
+/*
+Package envelope defines the versioned binary session token envelope, and the
+compact payload serialized inside it.
+
+An encoded token is the unpadded base64url encoding of:
+
+	version (1 byte) | codec (1 byte) | key ID length (1 byte) | key ID | body
+
+The header (everything before the body) is intended to be authenticated as
+AEAD additional data by encrypters, so the key ID and codec can't be altered.
+*/
+package envelope
@@ -0,0 +1,98 @@
+package envelope
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Version1 is the current envelope version
+const Version1 byte = 1
+
+// headerSize is the size of the fixed part of the header: version, codec and key ID length
+const headerSize = 3
+
+// Envelope is a versioned session token container. The Body is opaque to
+// the envelope, and is usually a nonce and AEAD ciphertext of a Payload.
+type Envelope struct {
+	Version byte
+	Codec   Codec
+	KeyID   string
+	Body    []byte
+}
+
+// New returns a Version1 envelope
+func New(codec Codec, keyID string, body []byte) *Envelope {
+	return &Envelope{
+		Version: Version1,
+		Codec:   codec,
+		KeyID:   keyID,
+		Body:    body,
+	}
+}
+
+// Header returns the serialized envelope header, which precedes the body.
+func (e *Envelope) Header() ([]byte, error) {
+	if len(e.KeyID) > 255 {
+		return nil, fmt.Errorf("key id is %d bytes, maximum is 255", len(e.KeyID))
+	}
+	header := make([]byte, 0, headerSize+len(e.KeyID))
+	header = append(header, e.Version, byte(e.Codec), byte(len(e.KeyID)))
+	header = append(header, e.KeyID...)
+	return header, nil
+}
+
+func (e *Envelope) MarshalBinary() ([]byte, error) {
+	header, err := e.Header()
+	if err != nil {
+		return nil, err
+	}
+	return append(header, e.Body...), nil
+}
+
+func (e *Envelope) UnmarshalBinary(data []byte) error {
+	if len(data) < headerSize {
+		return errors.New("envelope too short")
+	}
+	version, codec, kidLen := data[0], Codec(data[1]), int(data[2])
+	if version != Version1 {
+		return fmt.Errorf("unsupported envelope version %d", version)
+	}
+	if !codec.valid() {
+		return fmt.Errorf("unsupported envelope codec %d", codec)
+	}
+	if len(data) < headerSize+kidLen {
+		return errors.New("envelope too short for key id")
+	}
+	e.Version = version
+	e.Codec = codec
+	e.KeyID = string(data[headerSize : headerSize+kidLen])
+	e.Body = data[headerSize+kidLen:]
+	return nil
+}
+
+// Encode returns the unpadded base64url encoding of the envelope
+func (e *Envelope) Encode() ([]byte, error) {
+	data, err := e.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]byte, base64.RawURLEncoding.EncodedLen(len(data)))
+	base64.RawURLEncoding.Encode(resp, data)
+	return resp, nil
+}
+
+// Decode parses an encoded envelope
+func Decode(content []byte) (*Envelope, error) {
+	data := make([]byte, base64.RawURLEncoding.DecodedLen(len(content)))
+	n, err := base64.RawURLEncoding.Decode(data, content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envelope encoding: %w", err)
+	}
+	e := &Envelope{}
+	err = e.UnmarshalBinary(data[:n])
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
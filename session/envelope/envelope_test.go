@@ -0,0 +1,127 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	cases := []struct {
+		name    string
+		env     *Envelope
+		wantErr bool
+	}{
+		{
+			name: "json with key id",
+			env:  New(CodecJSON, "2024-10", []byte("body")),
+		},
+		{
+			name: "cbor without key id",
+			env:  New(CodecCBOR, "", []byte("body")),
+		},
+		{
+			name:    "key id too long",
+			env:     New(CodecCBOR, string(make([]byte, 256)), []byte("body")),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			encoded, err := tc.env.Encode()
+			if err != nil {
+				if !tc.wantErr {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if tc.wantErr {
+				t.Fatal("expected error, got none")
+			}
+			if bytes.ContainsAny(encoded, "+/=") {
+				t.Errorf("expected unpadded base64url encoding, got %s", encoded)
+			}
+			got, err := Decode(encoded)
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			if got.Version != tc.env.Version || got.Codec != tc.env.Codec || got.KeyID != tc.env.KeyID || !bytes.Equal(got.Body, tc.env.Body) {
+				t.Errorf("expected %#v, got %#v", tc.env, got)
+			}
+		})
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"unknown version", []byte{2, byte(CodecJSON), 0}},
+		{"unknown codec", []byte{Version1, 9, 0}},
+		{"truncated key id", []byte{Version1, byte(CodecJSON), 5, 'a'}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &Envelope{}
+			if err := e.UnmarshalBinary(tc.data); err == nil {
+				t.Errorf("expected error, got %#v", e)
+			}
+		})
+	}
+}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	issuedAt := time.Date(2024, 10, 2, 15, 0, 0, 0, time.UTC)
+
+	for _, codec := range []Codec{CodecJSON, CodecCBOR} {
+		t.Run(codec.String(), func(t *testing.T) {
+			p := &Payload{
+				KeyID:     "kid-123",
+				Alg:       "ecdsa-p256-sha256",
+				PublicKey: CompactPublicKey(pemKey),
+				Attributes: map[string]interface{}{
+					"username":  "alice",
+					"issued_at": issuedAt,
+				},
+			}
+			data, err := MarshalPayload(codec, p)
+			if err != nil {
+				t.Fatalf("failed to marshal: %v", err)
+			}
+			got, err := UnmarshalPayload(codec, data)
+			if err != nil {
+				t.Fatalf("failed to unmarshal: %v", err)
+			}
+			if got.KeyID != p.KeyID || got.Alg != p.Alg || !bytes.Equal(got.PublicKey, der) {
+				t.Errorf("expected %#v, got %#v", p, got)
+			}
+			attrs, ok := got.Attributes.(map[string]interface{})
+			if !ok {
+				t.Fatalf("expected map attributes, got %T", got.Attributes)
+			}
+			if attrs["username"] != "alice" {
+				t.Errorf("expected username alice, got %v", attrs["username"])
+			}
+			if attrs["issued_at"] != issuedAt.Format(time.RFC3339Nano) {
+				t.Errorf("expected issued_at %s, got %v", issuedAt.Format(time.RFC3339Nano), attrs["issued_at"])
+			}
+		})
+	}
+}
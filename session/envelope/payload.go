@@ -0,0 +1,115 @@
+package envelope
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Codec identifies how a Payload is serialized
+type Codec byte
+
+const (
+	CodecJSON Codec = 1
+	CodecCBOR Codec = 2
+)
+
+func (c Codec) valid() bool {
+	return c == CodecJSON || c == CodecCBOR
+}
+
+func (c Codec) String() string {
+	switch c {
+	case CodecJSON:
+		return "json"
+	case CodecCBOR:
+		return "cbor"
+	default:
+		return fmt.Sprintf("codec(%d)", byte(c))
+	}
+}
+
+// ParseCodec returns the Codec for a name, either `json` or `cbor`
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "json":
+		return CodecJSON, nil
+	case "cbor":
+		return CodecCBOR, nil
+	default:
+		return 0, fmt.Errorf("unknown codec %q", name)
+	}
+}
+
+// Payload is the compact serialization of a session token. Field names are
+// kept short for JSON, and CBOR uses integer keys.
+type Payload struct {
+	KeyID      string `json:"k" cbor:"1,keyasint"`
+	Alg        string `json:"a" cbor:"2,keyasint"`
+	PublicKey  []byte `json:"p" cbor:"3,keyasint"`
+	Attributes any    `json:"t,omitempty" cbor:"4,keyasint,omitempty"`
+}
+
+var (
+	cborEncMode cbor.EncMode
+	cborDecMode cbor.DecMode
+)
+
+func init() {
+	var err error
+	// Times are encoded as RFC3339 strings, so decoded attributes look
+	// the same as they would from JSON
+	cborEncMode, err = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	cborDecMode, err = cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// MarshalPayload serializes a payload with the given codec
+func MarshalPayload(codec Codec, p *Payload) ([]byte, error) {
+	switch codec {
+	case CodecJSON:
+		return json.Marshal(p)
+	case CodecCBOR:
+		return cborEncMode.Marshal(p)
+	default:
+		return nil, fmt.Errorf("unsupported codec %s", codec)
+	}
+}
+
+// UnmarshalPayload parses a payload serialized with the given codec
+func UnmarshalPayload(codec Codec, data []byte) (*Payload, error) {
+	p := &Payload{}
+	var err error
+	switch codec {
+	case CodecJSON:
+		err = json.Unmarshal(data, p)
+	case CodecCBOR:
+		err = cborDecMode.Unmarshal(data, p)
+	default:
+		return nil, fmt.Errorf("unsupported codec %s", codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// CompactPublicKey returns the DER bytes of a PEM encoded public key.
+// Keys that aren't PEM encoded, like HMAC secrets, are returned as is.
+func CompactPublicKey(publicKey []byte) []byte {
+	block, _ := pem.Decode(publicKey)
+	if block == nil {
+		return publicKey
+	}
+	return block.Bytes
+}
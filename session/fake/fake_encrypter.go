@@ -1,10 +1,14 @@
+// Package fake is a session.EncrypterDecrypter for tests that only encodes
+// session tokens. Tokens are neither encrypted nor authenticated, so it must
+// never be used to issue real tokens.
 package fake
 
 import (
 	"context"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+
+	"github.com/micahhausler/httpsig-scratch/session"
 )
 
 type SessionToken struct {
@@ -16,23 +20,13 @@ type SessionToken struct {
 
 type FakeEncrypterDecrypter struct{}
 
-func (e *FakeEncrypterDecrypter) EncryptPublicKey(ctx context.Context, keyID, alg string, publicKey, attributes any) ([]byte, error) {
-	var err error
-	kPbytes := []byte{}
-	switch alg {
-	case "ed25519", "rsa-pss-sha512", "rsa-v1_5-sha256", "ecdsa-p256-sha256", "ecdsa-p384-sha384":
-		kPbytes, err = x509.MarshalPKIXPublicKey(publicKey)
-		if err != nil {
-			return nil, err
-		}
-	case "hmac-sha256":
-		kPbytes = publicKey.([]byte)
-	}
+var _ session.EncrypterDecrypter = &FakeEncrypterDecrypter{}
 
+func (e *FakeEncrypterDecrypter) EncryptPublicKey(ctx context.Context, keyID, alg string, publicKey []byte, attributes any) ([]byte, error) {
 	st := &SessionToken{
 		KeyID:      keyID,
 		Alg:        alg,
-		PublicKey:  kPbytes,
+		PublicKey:  publicKey,
 		Attributes: attributes,
 	}
 	data, err := json.Marshal(st)
@@ -43,7 +37,7 @@ func (e *FakeEncrypterDecrypter) EncryptPublicKey(ctx context.Context, keyID, al
 	return []byte(resp), nil
 }
 
-func (d *FakeEncrypterDecrypter) DecryptPublicKey(ctx context.Context, content []byte) (keyID, alg string, publicKey, attributes any, err error) {
+func (d *FakeEncrypterDecrypter) DecryptPublicKey(ctx context.Context, content []byte) (keyID, alg string, publicKey []byte, attributes any, err error) {
 	decoded, err := base64.StdEncoding.DecodeString(string(content))
 	if err != nil {
 		return "", "", nil, nil, err
@@ -53,16 +47,5 @@ func (d *FakeEncrypterDecrypter) DecryptPublicKey(ctx context.Context, content [
 	if err != nil {
 		return "", "", nil, nil, err
 	}
-	var kP any
-	switch st.Alg {
-	case "ed25519", "rsa-pss-sha512", "rsa-v1_5-sha256", "ecdsa-p256-sha256", "ecdsa-p384-sha384":
-		kP, err = x509.ParsePKIXPublicKey(st.PublicKey)
-		if err != nil {
-			return "", "", nil, nil, err
-		}
-	case "hmac-sha256":
-		kP = st.PublicKey
-	}
-
-	return st.KeyID, st.Alg, kP, st.Attributes, nil
+	return st.KeyID, st.Alg, st.PublicKey, st.Attributes, nil
 }
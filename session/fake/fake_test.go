@@ -0,0 +1,27 @@
+package fake
+
+import (
+	"testing"
+
+	"github.com/micahhausler/httpsig-scratch/session"
+	"github.com/micahhausler/httpsig-scratch/session/sessiontest"
+)
+
+func newFake(t testing.TB) session.EncrypterDecrypter {
+	return &FakeEncrypterDecrypter{}
+}
+
+func TestConformance(t *testing.T) {
+	sessiontest.Run(t, sessiontest.Options{
+		New:             newFake,
+		Unauthenticated: true,
+	})
+}
+
+func FuzzDecryptPublicKey(f *testing.F) {
+	sessiontest.FuzzDecrypt(f, newFake)
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	sessiontest.FuzzRoundTrip(f, newFake)
+}
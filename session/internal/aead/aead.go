@@ -0,0 +1,41 @@
+// Package aead encrypts session tokens with AES-GCM, for the block and signed
+// session token formats.
+package aead
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+// Seal encrypts plaintext with AES-GCM, returning the nonce followed by the
+// ciphertext
+func Seal(block cipher.Block, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// Open decrypts the output of Seal
+func Open(block cipher.Block, ciphertext, additionalData []byte) ([]byte, error) {
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(ciphertext) < nonceSize+gcm.Overhead() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
@@ -0,0 +1,124 @@
+// Package keyring holds the key rotation shared by the block and signed
+// session token keyrings: a set of keys indexed by key ID with a primary
+// key, which can be replaced at runtime.
+package keyring
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Keyring is a set of keys indexed by key ID. It is safe for concurrent use.
+type Keyring[K any] struct {
+	mu      sync.RWMutex
+	primary string
+	keys    map[string]K
+}
+
+// Set atomically replaces the keys in the keyring. The primary key ID must
+// be present in keys, and key IDs must be 1 to 255 bytes.
+func (k *Keyring[K]) Set(primary string, keys map[string]K) error {
+	if primary == "" {
+		return errors.New("primary key id is required")
+	}
+	if _, ok := keys[primary]; !ok {
+		return fmt.Errorf("primary key %q not found in keyring", primary)
+	}
+	for id := range keys {
+		if id == "" {
+			return errors.New("key id must not be empty")
+		}
+		if len(id) > 255 {
+			return fmt.Errorf("key id %q is longer than 255 bytes", id)
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.primary = primary
+	k.keys = keys
+	return nil
+}
+
+// Primary returns the primary key ID and key
+func (k *Keyring[K]) Primary() (string, K) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.primary, k.keys[k.primary]
+}
+
+// Get returns the key for a key ID, and whether that key is the primary
+func (k *Keyring[K]) Get(id string) (key K, primary bool, ok bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok = k.keys[id]
+	return key, id == k.primary, ok
+}
+
+// KeyIDs returns all key IDs in the keyring, sorted
+func (k *Keyring[K]) KeyIDs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Keys returns a copy of the keys, indexed by key ID
+func (k *Keyring[K]) Keys() map[string]K {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := make(map[string]K, len(k.keys))
+	for id, key := range k.keys {
+		keys[id] = key
+	}
+	return keys
+}
+
+// WatchFile polls a keyring file for changes every interval and calls load
+// when the file's modification time changes. If load fails, the error is
+// logged and the existing keys stay in place. The name describes the keyring
+// in log messages.
+//
+// WatchFile blocks until the context is cancelled.
+func (k *Keyring[K]) WatchFile(ctx context.Context, path string, interval time.Duration, name string, load func(path string) error) {
+	// lastMod starts at zero so the first tick always reloads, picking up
+	// any change made between loading the keyring and calling WatchFile.
+	var lastMod time.Time
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			slog.Error("failed to stat "+name+" file", "path", path, "error", err)
+			continue
+		}
+		if fi.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = fi.ModTime()
+
+		if err := load(path); err != nil {
+			slog.Error("failed to reload "+name+" file", "path", path, "error", err)
+			continue
+		}
+		k.mu.RLock()
+		primary, count := k.primary, len(k.keys)
+		k.mu.RUnlock()
+		slog.Info("reloaded "+name, "path", path, "primary", primary, "count", count)
+	}
+}
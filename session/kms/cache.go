@@ -0,0 +1,107 @@
+package kms
+
+import (
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"sync"
+	"time"
+)
+
+// CachePolicy limits how long and how often an unwrapped data key is used
+// before going back to the KMS
+type CachePolicy struct {
+	// TTL is how long a data key is cached. Defaults to five minutes.
+	TTL time.Duration
+
+	// MaxUses is how many tokens a cached data key encrypts or decrypts.
+	// Defaults to 100,000.
+	MaxUses int
+
+	// MaxEntries is how many unwrapped data keys are cached for decryption.
+	// Defaults to 1,000.
+	MaxEntries int
+}
+
+func (p CachePolicy) withDefaults() CachePolicy {
+	if p.TTL <= 0 {
+		p.TTL = 5 * time.Minute
+	}
+	if p.MaxUses <= 0 {
+		p.MaxUses = 100_000
+	}
+	if p.MaxEntries <= 0 {
+		p.MaxEntries = 1_000
+	}
+	return p
+}
+
+// dataKey is an unwrapped data key
+type dataKey struct {
+	wrapped []byte
+	block   cipher.Block
+	expires time.Time
+	uses    int
+}
+
+func newDataKey(plaintext, wrapped []byte, expires time.Time) (*dataKey, error) {
+	block, err := aes.NewCipher(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{wrapped: wrapped, block: block, expires: expires}, nil
+}
+
+// use records a use of the key, and returns false if the key is expired or used up
+func (k *dataKey) use(now time.Time, maxUses int) bool {
+	if !now.Before(k.expires) || k.uses >= maxUses {
+		return false
+	}
+	k.uses++
+	return true
+}
+
+// dataKeyCache is a least recently used cache of unwrapped data keys,
+// indexed by wrapped data key
+type dataKeyCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newDataKeyCache() *dataKeyCache {
+	return &dataKeyCache{entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// get returns the unwrapped data key if it's cached and usable
+func (c *dataKeyCache) get(wrapped []byte, now time.Time, policy CachePolicy) (cipher.Block, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[string(wrapped)]
+	if !ok {
+		return nil, false
+	}
+	key := elem.Value.(*dataKey)
+	if !key.use(now, policy.MaxUses) {
+		c.order.Remove(elem)
+		delete(c.entries, string(wrapped))
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return key.block, true
+}
+
+// add caches a data key, evicting the least recently used key if the cache is full
+func (c *dataKeyCache) add(key *dataKey, policy CachePolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[string(key.wrapped)]; ok {
+		c.order.Remove(elem)
+	}
+	c.entries[string(key.wrapped)] = c.order.PushFront(key)
+	for c.order.Len() > policy.MaxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, string(oldest.Value.(*dataKey).wrapped))
+	}
+}
@@ -0,0 +1,37 @@
+package kms_test
+
+import (
+	"testing"
+
+	"github.com/micahhausler/httpsig-scratch/session"
+	"github.com/micahhausler/httpsig-scratch/session/kms"
+	"github.com/micahhausler/httpsig-scratch/session/kms/fake"
+	"github.com/micahhausler/httpsig-scratch/session/sessiontest"
+)
+
+func newTestEncrypterDecrypter(masterKey string) func(t testing.TB) session.EncrypterDecrypter {
+	return func(t testing.TB) session.EncrypterDecrypter {
+		key := make([]byte, 32)
+		copy(key, masterKey)
+		k, err := fake.New(map[string][]byte{"key-1": key})
+		if err != nil {
+			t.Fatalf("failed to create fake KMS: %v", err)
+		}
+		return kms.NewEncrypterDecrypter(k, "key-1")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	sessiontest.Run(t, sessiontest.Options{
+		New:         newTestEncrypterDecrypter("master"),
+		NewOtherKey: newTestEncrypterDecrypter("other master"),
+	})
+}
+
+func FuzzDecryptPublicKey(f *testing.F) {
+	sessiontest.FuzzDecrypt(f, newTestEncrypterDecrypter("master"))
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	sessiontest.FuzzRoundTrip(f, newTestEncrypterDecrypter("master"))
+}
@@ -0,0 +1,199 @@
+package kms
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/micahhausler/httpsig-scratch/session"
+	"github.com/micahhausler/httpsig-scratch/session/envelope"
+)
+
+// Calls counts KMS calls made for session tokens, indexed by operation. It is
+// published with expvar as "session_token_kms_calls". Comparing it to the
+// number of tokens issued and verified shows how well data keys are cached.
+var Calls = expvar.NewMap("session_token_kms_calls")
+
+// EncrypterDecrypter encrypts session tokens with data keys wrapped by a KMS
+// key, and decrypts tokens whose data keys the KMS can unwrap.
+type EncrypterDecrypter struct {
+	kms   KMS
+	keyID string
+
+	// Codec is the payload serialization for new tokens, defaults to envelope.CodecJSON
+	Codec envelope.Codec
+
+	// Cache limits how long and how often unwrapped data keys are reused
+	Cache CachePolicy
+
+	mu      sync.Mutex
+	current *dataKey
+	cache   *dataKeyCache
+	now     func() time.Time
+}
+
+var _ session.EncrypterDecrypter = &EncrypterDecrypter{}
+
+// NewEncrypterDecrypter returns a session.EncrypterDecrypter that wraps data
+// keys with the KMS key
+func NewEncrypterDecrypter(kms KMS, keyID string) *EncrypterDecrypter {
+	return &EncrypterDecrypter{
+		kms:   kms,
+		keyID: keyID,
+		Codec: envelope.CodecJSON,
+		cache: newDataKeyCache(),
+	}
+}
+
+func (e *EncrypterDecrypter) timeNow() time.Time {
+	if e.now != nil {
+		return e.now()
+	}
+	return time.Now()
+}
+
+// EncryptPublicKey encrypts the public key and attributes into a session
+// token, bound to the session.Binding in the context.
+func (e *EncrypterDecrypter) EncryptPublicKey(ctx context.Context, keyID, alg string, publicKey []byte, attributes any) ([]byte, error) {
+	key, err := e.encryptionKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	codec := e.Codec
+	if codec == 0 {
+		codec = envelope.CodecJSON
+	}
+	plaintext, err := envelope.MarshalPayload(codec, &envelope.Payload{
+		KeyID:      keyID,
+		Alg:        alg,
+		PublicKey:  envelope.CompactPublicKey(publicKey),
+		Attributes: attributes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	env := envelope.New(codec, e.keyID, nil)
+	header, err := env.Header()
+	if err != nil {
+		return nil, err
+	}
+	aesgcm, err := cipher.NewGCM(key.block)
+	if err != nil {
+		return nil, err
+	}
+	body := binary.AppendUvarint(nil, uint64(len(key.wrapped)))
+	body = append(body, key.wrapped...)
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	body = append(body, nonce...)
+	additionalData := append(header, session.BindingFromContext(ctx).AdditionalData()...)
+	env.Body = aesgcm.Seal(body, nonce, plaintext, additionalData)
+	return env.Encode()
+}
+
+// encryptionKey returns the current data key, generating a new one when the
+// current key is expired or used up
+func (e *EncrypterDecrypter) encryptionKey(ctx context.Context) (*dataKey, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	policy := e.Cache.withDefaults()
+	now := e.timeNow()
+	if e.current != nil && e.current.use(now, policy.MaxUses) {
+		return e.current, nil
+	}
+	Calls.Add("GenerateDataKey", 1)
+	plaintext, wrapped, err := e.kms.GenerateDataKey(ctx, e.keyID, encryptionContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	key, err := newDataKey(plaintext, wrapped, now.Add(policy.TTL))
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %w", err)
+	}
+	key.uses = 1
+	e.current = key
+	// cache the key for decryption too, so tokens this process issued
+	// decrypt without a KMS call
+	e.cache.add(&dataKey{wrapped: key.wrapped, block: key.block, expires: key.expires}, policy)
+	return key, nil
+}
+
+// DecryptPublicKey decrypts a session token, which must be bound to the
+// session.Binding in the context.
+func (e *EncrypterDecrypter) DecryptPublicKey(ctx context.Context, content []byte) (keyID, alg string, publicKey []byte, attributes any, err error) {
+	p, err := e.decrypt(ctx, content)
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	return p.KeyID, p.Alg, p.PublicKey, p.Attributes, nil
+}
+
+func (e *EncrypterDecrypter) decrypt(ctx context.Context, content []byte) (*envelope.Payload, error) {
+	env, err := envelope.Decode(content)
+	if err != nil {
+		return nil, err
+	}
+	if env.KeyID != e.keyID {
+		return nil, fmt.Errorf("session token KMS key %q doesn't match %q", env.KeyID, e.keyID)
+	}
+	header, err := env.Header()
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedLen, n := binary.Uvarint(env.Body)
+	if n <= 0 || wrappedLen == 0 || wrappedLen > uint64(len(env.Body)-n) {
+		return nil, errors.New("invalid KMS session token body")
+	}
+	wrapped := env.Body[n : n+int(wrappedLen)]
+	ciphertext := env.Body[n+int(wrappedLen):]
+
+	block, err := e.decryptionKey(ctx, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aesgcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:aesgcm.NonceSize()], ciphertext[aesgcm.NonceSize():]
+	additionalData := append(header, session.BindingFromContext(ctx).AdditionalData()...)
+	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", session.ErrBindingMismatch, err)
+	}
+	return envelope.UnmarshalPayload(env.Codec, plaintext)
+}
+
+// decryptionKey returns the unwrapped data key, from the cache if possible
+func (e *EncrypterDecrypter) decryptionKey(ctx context.Context, wrapped []byte) (cipher.Block, error) {
+	policy := e.Cache.withDefaults()
+	now := e.timeNow()
+	if block, ok := e.cache.get(wrapped, now, policy); ok {
+		return block, nil
+	}
+	Calls.Add("Decrypt", 1)
+	plaintext, err := e.kms.Decrypt(ctx, wrapped, encryptionContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	key, err := newDataKey(plaintext, append([]byte(nil), wrapped...), now.Add(policy.TTL))
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %w", err)
+	}
+	key.uses = 1
+	e.cache.add(key, policy)
+	return key.block, nil
+}
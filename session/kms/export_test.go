@@ -0,0 +1,8 @@
+package kms
+
+import "time"
+
+// SetNow overrides the clock used for data key expiry
+func SetNow(e *EncrypterDecrypter, now func() time.Time) {
+	e.now = now
+}
@@ -0,0 +1,135 @@
+// Package fake is an in-process kms.KMS for tests and local demos. Its keys
+// are plain AES keys in memory, so it provides none of the protection of a
+// real key management service.
+package fake
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/micahhausler/httpsig-scratch/session/kms"
+)
+
+// KMS wraps data keys with AES-GCM master keys indexed by key ID. Like AWS
+// KMS, the wrapped data key carries the ID of the key that wrapped it, and
+// the encryption context is authenticated.
+type KMS struct {
+	mu      sync.Mutex
+	keys    map[string]cipher.AEAD
+	calls   map[string]int
+	failing error
+}
+
+var _ kms.KMS = &KMS{}
+
+// New returns a fake KMS with the 32 byte AES master keys, indexed by key ID
+func New(keys map[string][]byte) (*KMS, error) {
+	k := &KMS{keys: map[string]cipher.AEAD{}, calls: map[string]int{}}
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes, got %d", id, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aesgcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aesgcm
+	}
+	return k, nil
+}
+
+// Calls returns the number of calls made to an operation, either
+// "GenerateDataKey" or "Decrypt"
+func (k *KMS) Calls(operation string) int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.calls[operation]
+}
+
+// SetError makes every call fail with err, or succeed again if err is nil,
+// to simulate an unavailable KMS
+func (k *KMS) SetError(err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.failing = err
+}
+
+func (k *KMS) GenerateDataKey(ctx context.Context, keyID string, encryptionContext map[string]string) (plaintext, ciphertext []byte, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.calls["GenerateDataKey"]++
+	if k.failing != nil {
+		return nil, nil, k.failing
+	}
+	aesgcm, ok := k.keys[keyID]
+	if !ok {
+		return nil, nil, fmt.Errorf("KMS key %q not found", keyID)
+	}
+	plaintext = make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, plaintext); err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	ciphertext = append([]byte{byte(len(keyID))}, keyID...)
+	ciphertext = append(ciphertext, nonce...)
+	ciphertext = aesgcm.Seal(ciphertext, nonce, plaintext, canonicalContext(encryptionContext))
+	return plaintext, ciphertext, nil
+}
+
+func (k *KMS) Decrypt(ctx context.Context, ciphertext []byte, encryptionContext map[string]string) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.calls["Decrypt"]++
+	if k.failing != nil {
+		return nil, k.failing
+	}
+	if len(ciphertext) == 0 || len(ciphertext) < 1+int(ciphertext[0]) {
+		return nil, errors.New("invalid ciphertext")
+	}
+	keyID := string(ciphertext[1 : 1+int(ciphertext[0])])
+	aesgcm, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("KMS key %q not found", keyID)
+	}
+	ciphertext = ciphertext[1+len(keyID):]
+	if len(ciphertext) < aesgcm.NonceSize() {
+		return nil, errors.New("invalid ciphertext")
+	}
+	nonce, ciphertext := ciphertext[:aesgcm.NonceSize()], ciphertext[aesgcm.NonceSize():]
+	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, canonicalContext(encryptionContext))
+	if err != nil {
+		return nil, errors.New("invalid ciphertext or encryption context")
+	}
+	return plaintext, nil
+}
+
+// canonicalContext serializes an encryption context in sorted key order
+func canonicalContext(encryptionContext map[string]string) []byte {
+	keys := make([]string, 0, len(encryptionContext))
+	for key := range encryptionContext {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var data []byte
+	for _, key := range keys {
+		data = fmt.Appendf(data, "%d:%s%d:%s", len(key), key, len(encryptionContext[key]), encryptionContext[key])
+	}
+	return data
+}
@@ -0,0 +1,39 @@
+/*
+Package kms implements session token envelope encryption with a key
+management service.
+
+Each token is encrypted with AES-GCM under a data key generated by the KMS,
+and the data key is stored in the token wrapped by the KMS key. Unwrapped
+data keys are cached with a TTL and a maximum use count, so most tokens are
+encrypted and decrypted without a KMS call.
+
+The KMS interface follows the AWS KMS GenerateDataKey and Decrypt operations,
+so an AWS KMS client only needs a small adapter. The fake package has an
+in-process implementation for tests and local demos.
+
+An encoded token is a session token envelope with the KMS key ID in the
+header, and a body of
+
+	wrapped data key length (uvarint) | wrapped data key | nonce | ciphertext
+
+The envelope header and session.Binding are authenticated as additional data.
+*/
+package kms
+
+import "context"
+
+// KMS wraps and unwraps data keys with a key held by a key management service
+type KMS interface {
+	// GenerateDataKey returns a new 32 byte data key, and the data key
+	// encrypted under the KMS key with the encryption context
+	GenerateDataKey(ctx context.Context, keyID string, encryptionContext map[string]string) (plaintext, ciphertext []byte, err error)
+
+	// Decrypt returns the data key encrypted in the ciphertext, which must
+	// have been encrypted with the same encryption context
+	Decrypt(ctx context.Context, ciphertext []byte, encryptionContext map[string]string) (plaintext []byte, err error)
+}
+
+// encryptionContext is the KMS encryption context for session token data
+// keys. Data keys are shared by many tokens, so it can't include anything
+// specific to one token.
+var encryptionContext = map[string]string{"purpose": "httpsig-scratch session token"}
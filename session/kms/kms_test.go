@@ -0,0 +1,153 @@
+package kms_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/micahhausler/httpsig-scratch/session"
+	"github.com/micahhausler/httpsig-scratch/session/envelope"
+	"github.com/micahhausler/httpsig-scratch/session/kms"
+	"github.com/micahhausler/httpsig-scratch/session/kms/fake"
+)
+
+func newFakeKMS(t *testing.T) *fake.KMS {
+	t.Helper()
+	k, err := fake.New(map[string][]byte{
+		"key-1": make([]byte, 32),
+		"key-2": []byte("0123456789abcdef0123456789abcdef"),
+	})
+	if err != nil {
+		t.Fatalf("failed to create fake KMS: %v", err)
+	}
+	return k
+}
+
+func TestEncrypterDecrypter(t *testing.T) {
+	bound := session.WithBinding(context.Background(), session.Binding{Audience: "example.com"})
+	for _, codec := range []envelope.Codec{envelope.CodecJSON, envelope.CodecCBOR} {
+		t.Run(codec.String(), func(t *testing.T) {
+			fakeKMS := newFakeKMS(t)
+			issuer := kms.NewEncrypterDecrypter(fakeKMS, "key-1")
+			issuer.Codec = codec
+			token, err := issuer.EncryptPublicKey(bound, "client-key", "hmac-sha256", []byte("secret"), map[string]interface{}{"username": "alice"})
+			if err != nil {
+				t.Fatalf("failed to encrypt token: %v", err)
+			}
+
+			// a separate verifier has to unwrap the data key
+			verifier := kms.NewEncrypterDecrypter(fakeKMS, "key-1")
+			for name, d := range map[string]session.Decrypter{"issuer": issuer, "verifier": verifier} {
+				kid, alg, pub, attrs, err := d.DecryptPublicKey(bound, token)
+				if err != nil {
+					t.Fatalf("%s failed to decrypt token: %v", name, err)
+				}
+				if kid != "client-key" || alg != "hmac-sha256" || string(pub) != "secret" {
+					t.Errorf("%s got unexpected payload %q %q %q", name, kid, alg, pub)
+				}
+				if attrs.(map[string]interface{})["username"] != "alice" {
+					t.Errorf("%s got unexpected attributes %#v", name, attrs)
+				}
+			}
+			if got := fakeKMS.Calls("Decrypt"); got != 1 {
+				t.Errorf("expected 1 KMS decrypt call, got %d", got)
+			}
+
+			if _, _, _, _, err := verifier.DecryptPublicKey(context.Background(), token); err == nil {
+				t.Errorf("expected token without binding to fail")
+			}
+			otherKey := kms.NewEncrypterDecrypter(fakeKMS, "key-2")
+			if _, _, _, _, err := otherKey.DecryptPublicKey(bound, token); err == nil {
+				t.Errorf("expected token for another KMS key to fail")
+			}
+		})
+	}
+}
+
+func TestDataKeyCache(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	cases := []struct {
+		name         string
+		policy       kms.CachePolicy
+		tokens       int
+		advance      time.Duration
+		wantGenerate int
+		wantDecrypt  int
+	}{
+		{
+			name:         "cached",
+			tokens:       10,
+			wantGenerate: 1,
+			wantDecrypt:  1,
+		},
+		{
+			name:         "max uses",
+			policy:       kms.CachePolicy{MaxUses: 3},
+			tokens:       10,
+			wantGenerate: 4,
+			wantDecrypt:  4,
+		},
+		{
+			name:         "ttl",
+			policy:       kms.CachePolicy{TTL: time.Minute},
+			tokens:       3,
+			advance:      time.Minute,
+			wantGenerate: 3,
+			wantDecrypt:  3,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeKMS := newFakeKMS(t)
+			issuer := kms.NewEncrypterDecrypter(fakeKMS, "key-1")
+			issuer.Cache = tc.policy
+			kms.SetNow(issuer, clock)
+			verifier := kms.NewEncrypterDecrypter(fakeKMS, "key-1")
+			verifier.Cache = tc.policy
+			kms.SetNow(verifier, clock)
+
+			for i := 0; i < tc.tokens; i++ {
+				token, err := issuer.EncryptPublicKey(context.Background(), "kid", "hmac-sha256", []byte("secret"), nil)
+				if err != nil {
+					t.Fatalf("failed to encrypt token: %v", err)
+				}
+				if _, _, _, _, err := verifier.DecryptPublicKey(context.Background(), token); err != nil {
+					t.Fatalf("failed to decrypt token: %v", err)
+				}
+				now = now.Add(tc.advance)
+			}
+			if got := fakeKMS.Calls("GenerateDataKey"); got != tc.wantGenerate {
+				t.Errorf("expected %d GenerateDataKey calls, got %d", tc.wantGenerate, got)
+			}
+			if got := fakeKMS.Calls("Decrypt"); got != tc.wantDecrypt {
+				t.Errorf("expected %d Decrypt calls, got %d", tc.wantDecrypt, got)
+			}
+		})
+	}
+}
+
+func TestKMSUnavailable(t *testing.T) {
+	fakeKMS := newFakeKMS(t)
+	issuer := kms.NewEncrypterDecrypter(fakeKMS, "key-1")
+	token, err := issuer.EncryptPublicKey(context.Background(), "kid", "hmac-sha256", []byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("failed to encrypt token: %v", err)
+	}
+
+	unavailable := errors.New("unavailable")
+	fakeKMS.SetError(unavailable)
+	// cached data keys keep working while the KMS is unavailable
+	if _, err := issuer.EncryptPublicKey(context.Background(), "kid", "hmac-sha256", []byte("secret"), nil); err != nil {
+		t.Errorf("expected cached data key to encrypt: %v", err)
+	}
+	if _, _, _, _, err := issuer.DecryptPublicKey(context.Background(), token); err != nil {
+		t.Errorf("expected cached data key to decrypt: %v", err)
+	}
+	verifier := kms.NewEncrypterDecrypter(fakeKMS, "key-1")
+	if _, _, _, _, err := verifier.DecryptPublicKey(context.Background(), token); !errors.Is(err, unavailable) {
+		t.Errorf("expected KMS error, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/sigparams"
+	"github.com/common-fate/httpsig/verifier"
+	"github.com/micahhausler/httpsig-scratch/keyalg"
+)
+
+// ProofOfPossessionTag is the default signature tag for session token
+// registration requests
+const ProofOfPossessionTag = "session-token-registration"
+
+// ProofOfPossession configures verification that a session token
+// registration request is signed with the private key being registered, so
+// callers can't register someone else's public key.
+type ProofOfPossession struct {
+	// Tag is the tag of the registration signature, defaults to ProofOfPossessionTag
+	Tag string
+
+	// Scheme and Authority are the expected URL scheme and authority of
+	// registration requests
+	Scheme    string
+	Authority string
+
+	// NonceStorage checks that registration signatures aren't replayed
+	NonceStorage verifier.NonceStorage
+
+	// Validation overrides the signature validation options. If nil,
+	// httpsig.DefaultValidationOpts() is used, which covers the body's
+	// Content-Digest.
+	Validation *sigparams.ValidateOpts
+}
+
+// verify checks that the request is signed with the key in the
+// EncryptionRequest. The request's body must be readable again.
+func (p *ProofOfPossession) verify(w http.ResponseWriter, r *http.Request, request *EncryptionRequest) error {
+	tag := p.Tag
+	if tag == "" {
+		tag = ProofOfPossessionTag
+	}
+	v := verifier.Verifier{
+		NonceStorage: p.NonceStorage,
+		KeyDirectory: &registrationKeyDirectory{
+			keyID:     request.KeyID,
+			alg:       request.Alg,
+			publicKey: []byte(request.PublicKey),
+		},
+		Tag:        tag,
+		Scheme:     p.Scheme,
+		Authority:  p.Authority,
+		Validation: httpsig.DefaultValidationOpts(),
+	}
+	if p.Validation != nil {
+		v.Validation = *p.Validation
+	}
+	_, _, err := v.Parse(w, r, time.Now())
+	return err
+}
+
+// registrationKeyDirectory returns the key submitted for registration
+type registrationKeyDirectory struct {
+	keyID     string
+	alg       string
+	publicKey []byte
+}
+
+func (d *registrationKeyDirectory) GetKey(ctx context.Context, kid string, clientSpecifiedAlg string) (verifier.Algorithm, error) {
+	if kid != d.keyID {
+		return nil, fmt.Errorf("registration signed with key %q, not the registered key %q", kid, d.keyID)
+	}
+	if clientSpecifiedAlg != "" && clientSpecifiedAlg != d.alg {
+		return nil, fmt.Errorf("registration signed with algorithm %q, not the registered algorithm %q", clientSpecifiedAlg, d.alg)
+	}
+	return keyalg.NewVerifier(d.alg, d.publicKey, nil)
+}
@@ -0,0 +1,27 @@
+package reference
+
+import (
+	"testing"
+
+	"github.com/micahhausler/httpsig-scratch/session"
+	"github.com/micahhausler/httpsig-scratch/session/sessiontest"
+)
+
+func newTestEncrypterDecrypter(t testing.TB) session.EncrypterDecrypter {
+	return NewEncrypterDecrypter(NewMemoryStore())
+}
+
+func TestConformance(t *testing.T) {
+	sessiontest.Run(t, sessiontest.Options{
+		New:         newTestEncrypterDecrypter,
+		NewOtherKey: newTestEncrypterDecrypter,
+	})
+}
+
+func FuzzDecryptPublicKey(f *testing.F) {
+	sessiontest.FuzzDecrypt(f, newTestEncrypterDecrypter)
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	sessiontest.FuzzRoundTrip(f, newTestEncrypterDecrypter)
+}
@@ -0,0 +1,100 @@
+package reference
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type fileStore struct {
+	mu      sync.RWMutex
+	path    string
+	records *records
+}
+
+// NewFileStore returns a Store that persists records as JSON to the file at
+// path, so reference tokens survive restarts. Existing records are loaded
+// from the file if it exists.
+//
+// The file holds the tokens' key material, including HMAC secrets, so it
+// must be as protected as an encryption key. It is rewritten on every
+// change, so it suits demos and small deployments rather than high volume
+// token issuance.
+func NewFileStore(path string) (Store, error) {
+	s := &fileStore{
+		path:    path,
+		records: newRecords(),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, s.records)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse session token reference file %s: %w", path, err)
+	}
+	if s.records.Records == nil {
+		s.records.Records = map[string]*Record{}
+	}
+	return s, nil
+}
+
+var _ Store = &fileStore{}
+
+// save writes the records to a temporary file and renames it over the
+// store's file, so a crash never leaves a partially written file. The caller
+// must hold the write lock.
+func (s *fileStore) save() error {
+	data, err := json.Marshal(s.records)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *fileStore) Put(ctx context.Context, id string, record *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records.prune(time.Now())
+	s.records.Records[id] = record
+	return s.save()
+}
+
+func (s *fileStore) Get(ctx context.Context, id string) (*Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.records.get(id, time.Now())
+}
+
+func (s *fileStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records.Records[id]; !ok {
+		return nil
+	}
+	delete(s.records.Records, id)
+	return s.save()
+}
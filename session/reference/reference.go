@@ -0,0 +1,149 @@
+/*
+Package reference implements reference session tokens, which are short
+random handles to key material and attributes kept in a server-side Store.
+
+Unlike self-contained tokens, a reference token stays the same small size
+regardless of the key, and is revoked as soon as its record is deleted. The
+cost is a Store lookup for every request, and a Store shared by every server
+that verifies the tokens.
+
+A reference token is
+
+	ref.<base64url of 32 random bytes>
+
+The prefix can't appear in a self-contained token's base64url envelope, so
+RoutingDecrypter can serve both kinds behind the same DecryptionService.
+*/
+package reference
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micahhausler/httpsig-scratch/session"
+)
+
+// Prefix starts every reference session token
+const Prefix = "ref."
+
+// referenceSize is the number of random bytes in a reference
+const referenceSize = 32
+
+// IsReference returns true if the session token is a reference token
+func IsReference(token []byte) bool {
+	return bytes.HasPrefix(token, []byte(Prefix))
+}
+
+// EncrypterDecrypter issues reference session tokens, storing their key
+// material and attributes in a Store
+type EncrypterDecrypter struct {
+	store Store
+
+	// TTL is how long records are kept. If zero, records are kept until
+	// they are revoked.
+	TTL time.Duration
+}
+
+var _ session.EncrypterDecrypter = &EncrypterDecrypter{}
+
+// NewEncrypterDecrypter returns a session.EncrypterDecrypter that keeps
+// session tokens in the store
+func NewEncrypterDecrypter(store Store) *EncrypterDecrypter {
+	return &EncrypterDecrypter{store: store}
+}
+
+// recordID returns the ID a reference is stored under
+func recordID(reference []byte) string {
+	sum := sha256.Sum256(reference)
+	return hex.EncodeToString(sum[:])
+}
+
+// EncryptPublicKey stores the public key and attributes, bound to the
+// session.Binding in the context, and returns a new reference to them
+func (e *EncrypterDecrypter) EncryptPublicKey(ctx context.Context, keyID, alg string, publicKey []byte, attributes any) ([]byte, error) {
+	attributeData, err := json.Marshal(attributes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal session token attributes: %w", err)
+	}
+	random := make([]byte, referenceSize)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	reference := []byte(Prefix + base64.RawURLEncoding.EncodeToString(random))
+
+	now := time.Now().UTC()
+	record := &Record{
+		KeyID:      keyID,
+		Alg:        alg,
+		PublicKey:  publicKey,
+		Attributes: attributeData,
+		Binding:    session.BindingFromContext(ctx).AdditionalData(),
+		CreatedAt:  now,
+	}
+	if e.TTL > 0 {
+		record.ExpiresAt = now.Add(e.TTL)
+	}
+	err = e.store.Put(ctx, recordID(reference), record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store session token: %w", err)
+	}
+	return reference, nil
+}
+
+// DecryptPublicKey looks up a reference session token, which must be bound
+// to the session.Binding in the context
+func (e *EncrypterDecrypter) DecryptPublicKey(ctx context.Context, content []byte) (keyID, alg string, publicKey []byte, attributes any, err error) {
+	if !IsReference(content) {
+		return "", "", nil, nil, errors.New("not a reference session token")
+	}
+	record, err := e.store.Get(ctx, recordID(content))
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	binding := session.BindingFromContext(ctx).AdditionalData()
+	if subtle.ConstantTimeCompare(binding, record.Binding) != 1 {
+		return "", "", nil, nil, session.ErrBindingMismatch
+	}
+	if len(record.Attributes) > 0 {
+		err = json.Unmarshal(record.Attributes, &attributes)
+		if err != nil {
+			return "", "", nil, nil, fmt.Errorf("invalid session token attributes: %w", err)
+		}
+	}
+	return record.KeyID, record.Alg, record.PublicKey, attributes, nil
+}
+
+// Revoke deletes a reference session token's record, so it immediately
+// stops decrypting
+func (e *EncrypterDecrypter) Revoke(ctx context.Context, reference []byte) error {
+	if !IsReference(reference) {
+		return errors.New("not a reference session token")
+	}
+	return e.store.Delete(ctx, recordID(reference))
+}
+
+// RoutingDecrypter decrypts reference session tokens with References, and
+// all other session tokens with SelfContained, so both kinds of token can
+// be verified by the same DecryptionService
+type RoutingDecrypter struct {
+	References    session.Decrypter
+	SelfContained session.Decrypter
+}
+
+var _ session.Decrypter = &RoutingDecrypter{}
+
+func (d *RoutingDecrypter) DecryptPublicKey(ctx context.Context, content []byte) (keyID, alg string, publicKey []byte, attributes any, err error) {
+	if IsReference(content) {
+		return d.References.DecryptPublicKey(ctx, content)
+	}
+	return d.SelfContained.DecryptPublicKey(ctx, content)
+}
@@ -0,0 +1,142 @@
+package reference
+
+import (
+	"context"
+	"crypto/aes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/micahhausler/httpsig-scratch/session"
+	"github.com/micahhausler/httpsig-scratch/session/block"
+)
+
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T, path string) Store{
+		"memory": func(t *testing.T, path string) Store {
+			return NewMemoryStore()
+		},
+		"file": func(t *testing.T, path string) Store {
+			store, err := NewFileStore(path)
+			if err != nil {
+				t.Fatalf("failed to create file store: %v", err)
+			}
+			return store
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			path := filepath.Join(t.TempDir(), "references.json")
+			store := newStore(t, path)
+
+			now := time.Now().UTC()
+			records := map[string]*Record{
+				"live":    {KeyID: "kid-1", Alg: "hmac-sha256", PublicKey: []byte("secret"), CreatedAt: now},
+				"expired": {KeyID: "kid-2", Alg: "hmac-sha256", PublicKey: []byte("secret"), CreatedAt: now, ExpiresAt: now.Add(-time.Second)},
+				"deleted": {KeyID: "kid-3", Alg: "hmac-sha256", PublicKey: []byte("secret"), CreatedAt: now},
+			}
+			for id, record := range records {
+				if err := store.Put(ctx, id, record); err != nil {
+					t.Fatalf("failed to put %s: %v", id, err)
+				}
+			}
+			if err := store.Delete(ctx, "deleted"); err != nil {
+				t.Fatalf("failed to delete: %v", err)
+			}
+			if err := store.Delete(ctx, "unknown"); err != nil {
+				t.Fatalf("failed to delete unknown record: %v", err)
+			}
+
+			record, err := store.Get(ctx, "live")
+			if err != nil {
+				t.Fatalf("failed to get record: %v", err)
+			}
+			if record.KeyID != "kid-1" {
+				t.Errorf("got unexpected record %+v", record)
+			}
+			for _, id := range []string{"expired", "deleted", "unknown"} {
+				if _, err := store.Get(ctx, id); !errors.Is(err, ErrNotFound) {
+					t.Errorf("expected ErrNotFound for %s, got %v", id, err)
+				}
+			}
+
+			if name != "file" {
+				return
+			}
+			reopened := newStore(t, path)
+			if _, err := reopened.Get(ctx, "live"); err != nil {
+				t.Errorf("expected record to persist across restarts: %v", err)
+			}
+			if _, err := reopened.Get(ctx, "deleted"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("expected deletion to persist across restarts, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	ctx := context.Background()
+	ed := NewEncrypterDecrypter(NewMemoryStore())
+	token, err := ed.EncryptPublicKey(ctx, "kid-1", "hmac-sha256", []byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+	if _, _, _, _, err := ed.DecryptPublicKey(ctx, token); err != nil {
+		t.Fatalf("failed to decrypt token: %v", err)
+	}
+	if err := ed.Revoke(ctx, token); err != nil {
+		t.Fatalf("failed to revoke token: %v", err)
+	}
+	if _, _, _, _, err := ed.DecryptPublicKey(ctx, token); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected revoked token to be not found, got %v", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	ctx := context.Background()
+	ed := NewEncrypterDecrypter(NewMemoryStore())
+	ed.TTL = time.Nanosecond
+	token, err := ed.EncryptPublicKey(ctx, "kid-1", "hmac-sha256", []byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, _, _, _, err := ed.DecryptPublicKey(ctx, token); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected expired token to be not found, got %v", err)
+	}
+}
+
+func TestRoutingDecrypter(t *testing.T) {
+	bound := session.WithBinding(context.Background(), session.Binding{Audience: "example.com"})
+	aesBlock, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+	selfContained := block.NewBlockSessionEncrypterDecrypter(aesBlock)
+	references := NewEncrypterDecrypter(NewMemoryStore())
+	router := &RoutingDecrypter{References: references, SelfContained: selfContained}
+
+	for name, e := range map[string]session.Encrypter{"self-contained": selfContained, "reference": references} {
+		t.Run(name, func(t *testing.T) {
+			token, err := e.EncryptPublicKey(bound, "kid-1", "hmac-sha256", []byte("secret"), map[string]interface{}{"username": "alice"})
+			if err != nil {
+				t.Fatalf("failed to issue token: %v", err)
+			}
+			if IsReference(token) != (name == "reference") {
+				t.Errorf("unexpected IsReference for %s token %q", name, token)
+			}
+			keyID, _, publicKey, attributes, err := router.DecryptPublicKey(bound, token)
+			if err != nil {
+				t.Fatalf("failed to decrypt token: %v", err)
+			}
+			if keyID != "kid-1" || string(publicKey) != "secret" || attributes.(map[string]interface{})["username"] != "alice" {
+				t.Errorf("got unexpected token %q %q %v", keyID, publicKey, attributes)
+			}
+			if _, _, _, _, err := router.DecryptPublicKey(context.Background(), token); err == nil {
+				t.Errorf("expected token without binding to fail")
+			}
+		})
+	}
+}
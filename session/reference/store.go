@@ -0,0 +1,117 @@
+package reference
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by a Store for unknown, deleted, or expired records
+var ErrNotFound = errors.New("session token reference not found")
+
+// Record is the key material and attributes of a reference session token
+type Record struct {
+	KeyID      string          `json:"key_id"`
+	Alg        string          `json:"alg"`
+	PublicKey  []byte          `json:"public_key"`
+	Attributes json.RawMessage `json:"attributes,omitempty"`
+
+	// Binding is the session.Binding's additional data the token was
+	// issued with, which must match when it is looked up
+	Binding []byte `json:"binding,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is when the record can be removed. A zero ExpiresAt never
+	// expires.
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+func (r *Record) expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt)
+}
+
+// Store stores reference session token records. Records are indexed by a
+// hash of the reference, never the reference itself, so a copy of the store
+// can't be used to present tokens.
+type Store interface {
+	// Put stores a record
+	Put(ctx context.Context, id string, record *Record) error
+	// Get returns a record, or ErrNotFound
+	Get(ctx context.Context, id string) (*Record, error)
+	// Delete removes a record, revoking its token. Deleting an unknown
+	// record is not an error.
+	Delete(ctx context.Context, id string) error
+}
+
+// pruneInterval is how often stores remove expired records
+const pruneInterval = time.Minute
+
+// records is a set of records that removes expired records
+type records struct {
+	Records   map[string]*Record `json:"records"`
+	lastPrune time.Time
+}
+
+func newRecords() *records {
+	return &records{Records: map[string]*Record{}}
+}
+
+// get returns a record if it exists and hasn't expired
+func (r *records) get(id string, now time.Time) (*Record, error) {
+	record, ok := r.Records[id]
+	if !ok || record.expired(now) {
+		return nil, ErrNotFound
+	}
+	return record, nil
+}
+
+// prune removes expired records at most once per pruneInterval, and
+// returns true if it checked
+func (r *records) prune(now time.Time) bool {
+	if now.Sub(r.lastPrune) < pruneInterval {
+		return false
+	}
+	r.lastPrune = now
+	for id, record := range r.Records {
+		if record.expired(now) {
+			delete(r.Records, id)
+		}
+	}
+	return true
+}
+
+type memoryStore struct {
+	mu      sync.RWMutex
+	records *records
+}
+
+// NewMemoryStore returns a Store that keeps records in memory. Records are
+// lost when the process exits.
+func NewMemoryStore() Store {
+	return &memoryStore{records: newRecords()}
+}
+
+var _ Store = &memoryStore{}
+
+func (s *memoryStore) Put(ctx context.Context, id string, record *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records.prune(time.Now())
+	s.records.Records[id] = record
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (*Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.records.get(id, time.Now())
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records.Records, id)
+	return nil
+}
@@ -0,0 +1,179 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/sigparams"
+	"github.com/common-fate/httpsig/verifier"
+	"github.com/micahhausler/httpsig-scratch/keyalg"
+)
+
+// maxTokenLineage limits how many times a session token can be refreshed,
+// since every refresh adds its parent's token ID to the new token
+const maxTokenLineage = 64
+
+// TokenRefresh configures EncryptionService.RefreshHandler, which reissues a
+// session token to a request signed with the token's key. The new token has
+// the same key, user, and scopes, a new token ID and expiry, and records the
+// token it was refreshed from so revoking the parent revokes it too.
+type TokenRefresh struct {
+	// Decryption reads and decrypts the session token being refreshed, and
+	// checks that it hasn't been revoked
+	Decryption *DecryptionService
+
+	// GracePeriod is how long after a session token expires it can still be
+	// refreshed
+	GracePeriod time.Duration
+
+	// Tag is the tag of the refresh request's signature, defaults to the
+	// Decryption service's Tag
+	Tag string
+
+	// Scheme and Authority are the expected URL scheme and authority of
+	// refresh requests
+	Scheme    string
+	Authority string
+
+	// NonceStorage checks that refresh signatures aren't replayed
+	NonceStorage verifier.NonceStorage
+
+	// Validation overrides the signature validation options. If nil,
+	// httpsig.DefaultValidationOpts() is used.
+	Validation *sigparams.ValidateOpts
+}
+
+// verify checks that the request is signed with the key in its session
+// token, and returns the token
+func (t *TokenRefresh) verify(w http.ResponseWriter, r *http.Request) (*requestToken, error) {
+	tag := t.Tag
+	if tag == "" {
+		tag = t.Decryption.Tag
+	}
+	keyDir := &refreshKeyDirectory{refresh: t, r: r}
+	v := verifier.Verifier{
+		NonceStorage: t.NonceStorage,
+		KeyDirectory: keyDir,
+		Tag:          tag,
+		Scheme:       t.Scheme,
+		Authority:    t.Authority,
+		Validation:   httpsig.DefaultValidationOpts(),
+	}
+	if t.Validation != nil {
+		v.Validation = *t.Validation
+	}
+	_, _, err := v.Parse(w, r, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if keyDir.token == nil {
+		return nil, errors.New("no session token was verified")
+	}
+	return keyDir.token, nil
+}
+
+// refreshKeyDirectory returns the key in the request's session token,
+// accepting tokens within the refresh grace period, and records the token
+type refreshKeyDirectory struct {
+	refresh *TokenRefresh
+	r       *http.Request
+	token   *requestToken
+}
+
+func (d *refreshKeyDirectory) GetKey(ctx context.Context, kid string, clientSpecifiedAlg string) (verifier.Algorithm, error) {
+	tok, err := d.refresh.Decryption.requestToken(d.r.WithContext(ctx), kid, clientSpecifiedAlg, d.refresh.GracePeriod)
+	if err != nil {
+		return nil, err
+	}
+	d.token = tok
+	return keyalg.NewVerifier(tok.alg, tok.publicKey, tok.rawAttributes)
+}
+
+// RefreshHandler returns an HTTP Handler that reissues the session token of
+// a request signed with the token's key. The token must be unexpired, or
+// expired within the Refresh grace period, and neither it nor any token it
+// was refreshed from can be revoked. The new token is returned in an
+// EncryptionResponse.
+func (e *EncryptionService) RefreshHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		resp := &EncryptionResponse{}
+		enc := json.NewEncoder(w)
+
+		if r.Method != http.MethodPost {
+			slog.Error("invalid method", "method", r.Method)
+			w.WriteHeader(http.StatusBadRequest)
+			resp.Error = "invalid method"
+			enc.Encode(resp)
+			return
+		}
+		if e.Refresh == nil || e.Refresh.Decryption == nil {
+			w.WriteHeader(http.StatusNotFound)
+			resp.Error = "session token refresh is not enabled"
+			enc.Encode(resp)
+			return
+		}
+
+		tok, err := e.Refresh.verify(w, r)
+		if err != nil {
+			slog.Error("failed to verify session token refresh request", "remote_addr", r.RemoteAddr, "error", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			resp.Error = "unauthorized"
+			enc.Encode(resp)
+			return
+		}
+		parent := tok.attributes
+		lineage := parent.ParentTokenIDs
+		if parent.TokenID != "" {
+			lineage = append([]string{parent.TokenID}, lineage...)
+		}
+		if len(lineage) > maxTokenLineage {
+			slog.Info("rejected session token refresh", "token_id", parent.TokenID, "username", parent.Username, "refreshes", len(parent.ParentTokenIDs))
+			w.WriteHeader(http.StatusForbidden)
+			resp.Error = "session token has been refreshed too many times, request a new one"
+			enc.Encode(resp)
+			return
+		}
+
+		attrs, err := newTokenAttributes(parent.User, e.TokenLifetime)
+		if err != nil {
+			slog.Error("failed to create token attributes", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			resp.Error = "internal server error"
+			enc.Encode(resp)
+			return
+		}
+		attrs.ProofOfPossession = parent.ProofOfPossession
+		attrs.Scopes = parent.Scopes
+		attrs.ParentTokenIDs = lineage
+
+		sessionToken, err := e.encrypter.EncryptPublicKey(
+			e.bindingContext(r.Context()),
+			tok.keyID,
+			tok.alg,
+			tok.publicKey,
+			attrs,
+		)
+		if err != nil {
+			slog.Error("failed to encrypt public key", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			resp.Error = "internal server error"
+			enc.Encode(resp)
+			return
+		}
+		resp.SessionToken = sessionToken
+		resp.TokenID = attrs.TokenID
+		resp.ExpiresAt = attrs.expiresAt()
+		err = enc.Encode(resp)
+		if err != nil {
+			slog.Error("failed to encode response", "error", err)
+			return
+		}
+		slog.Info("Refreshed session token", "remote_addr", r.RemoteAddr, "token_id", attrs.TokenID, "parent_token_id", parent.TokenID, "username", attrs.Username)
+	})
+}
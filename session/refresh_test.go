@@ -0,0 +1,223 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/alg_hmac"
+	"github.com/common-fate/httpsig/inmemory"
+)
+
+// memoryEncrypterDecrypter keeps session tokens in memory, and returns
+// attributes as maps like decrypters of JSON session tokens do
+type memoryEncrypterDecrypter struct {
+	mu     sync.Mutex
+	tokens map[string][]byte
+}
+
+type memoryToken struct {
+	KeyID      string `json:"key_id"`
+	Alg        string `json:"alg"`
+	PublicKey  []byte `json:"public_key"`
+	Attributes any    `json:"attributes"`
+}
+
+func (m *memoryEncrypterDecrypter) EncryptPublicKey(ctx context.Context, keyID, alg string, publicKey []byte, attributes any) ([]byte, error) {
+	data, err := json.Marshal(&memoryToken{KeyID: keyID, Alg: alg, PublicKey: publicKey, Attributes: attributes})
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tokens == nil {
+		m.tokens = map[string][]byte{}
+	}
+	token := fmt.Sprintf("token-%d", len(m.tokens))
+	m.tokens[token] = data
+	return []byte(token), nil
+}
+
+func (m *memoryEncrypterDecrypter) DecryptPublicKey(ctx context.Context, content []byte) (string, string, []byte, any, error) {
+	m.mu.Lock()
+	data, ok := m.tokens[string(content)]
+	m.mu.Unlock()
+	if !ok {
+		return "", "", nil, nil, fmt.Errorf("unknown session token")
+	}
+	tok := &memoryToken{}
+	if err := json.Unmarshal(data, tok); err != nil {
+		return "", "", nil, nil, err
+	}
+	return tok.KeyID, tok.Alg, tok.PublicKey, tok.Attributes, nil
+}
+
+func TestRefreshHandler(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Now().UTC().Truncate(time.Second)
+	tokens := &memoryEncrypterDecrypter{}
+	store := NewInMemoryRevocationStore()
+
+	decService := NewDecryptionService(tokens, "")
+	decService.Tag = "foo"
+	decService.RevocationStore = store
+	encService := NewEncryptionService(tokens)
+	encService.TokenLifetime = time.Hour
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+	encService.Refresh = &TokenRefresh{
+		Decryption:   decService,
+		GracePeriod:  10 * time.Minute,
+		Scheme:       "http",
+		Authority:    serverURL.Host,
+		NonceStorage: inmemory.NewNonceStorage(),
+	}
+	mux.Handle("/session-token/refresh", encService.RefreshHandler())
+
+	issue := func(t *testing.T, attrs *TokenAttributes) string {
+		t.Helper()
+		token, err := tokens.EncryptPublicKey(context.Background(), "kid-1", "hmac-sha256", secret, attrs)
+		if err != nil {
+			t.Fatalf("failed to issue token: %v", err)
+		}
+		return string(token)
+	}
+	refresh := func(t *testing.T, token string, key []byte) (int, *EncryptionResponse) {
+		t.Helper()
+		client := httpsig.NewClient(httpsig.ClientOpts{
+			KeyID: "kid-1",
+			Tag:   "foo",
+			Alg:   alg_hmac.NewHMAC(key),
+			CoveredComponents: []string{
+				"@method", "@target-uri", "content-type", "content-length", "content-digest", "x-session-token",
+			},
+		})
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/session-token/refresh", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("x-session-token", token)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to send request: %v", err)
+		}
+		defer res.Body.Close()
+		resp := &EncryptionResponse{}
+		if err := json.NewDecoder(res.Body).Decode(resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return res.StatusCode, resp
+	}
+	attrsFor := func(tokenID string, expiresAt time.Time) *TokenAttributes {
+		return &TokenAttributes{
+			User:      User{Username: "alice"},
+			TokenID:   tokenID,
+			IssuedAt:  now.Add(-2 * time.Hour),
+			ExpiresAt: expiresAt,
+			Scopes:    []Scope{{Methods: []string{http.MethodGet}}},
+		}
+	}
+
+	cases := []struct {
+		name       string
+		attrs      *TokenAttributes
+		key        []byte
+		wantStatus int
+	}{
+		{"valid", attrsFor("tok-valid", now.Add(time.Minute)), secret, http.StatusOK},
+		{"never expires", attrsFor("tok-forever", time.Time{}), secret, http.StatusOK},
+		{"within grace period", attrsFor("tok-grace", now.Add(-5*time.Minute)), secret, http.StatusOK},
+		{"past grace period", attrsFor("tok-expired", now.Add(-15*time.Minute)), secret, http.StatusUnauthorized},
+		{"signed with another key", attrsFor("tok-other", now.Add(time.Minute)), []byte("another secret key"), http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			status, resp := refresh(t, issue(t, tc.attrs), tc.key)
+			if status != tc.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tc.wantStatus, status, resp.Error)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			_, _, _, attributes, err := tokens.DecryptPublicKey(context.Background(), resp.SessionToken)
+			if err != nil {
+				t.Fatalf("failed to decrypt refreshed token: %v", err)
+			}
+			attrs, err := ParseTokenAttributes(attributes)
+			if err != nil {
+				t.Fatalf("failed to parse attributes: %v", err)
+			}
+			if attrs.Username != "alice" || len(attrs.Scopes) != 1 || attrs.TokenID != resp.TokenID {
+				t.Errorf("unexpected refreshed attributes %+v", attrs)
+			}
+			if len(attrs.ParentTokenIDs) != 1 || attrs.ParentTokenIDs[0] != tc.attrs.TokenID {
+				t.Errorf("expected parent token %q, got %v", tc.attrs.TokenID, attrs.ParentTokenIDs)
+			}
+			if resp.ExpiresAt == nil || !attrs.ExpiresAt.Equal(*resp.ExpiresAt) || attrs.ExpiresAt.Before(now.Add(59*time.Minute)) {
+				t.Errorf("expected a new expiry an hour from now, got %v", resp.ExpiresAt)
+			}
+		})
+	}
+
+	t.Run("revoked parent", func(t *testing.T) {
+		_, first := refresh(t, issue(t, attrsFor("tok-root", now.Add(time.Minute))), secret)
+		_, second := refresh(t, string(first.SessionToken), secret)
+		if second.Error != "" {
+			t.Fatalf("failed to refresh twice: %s", second.Error)
+		}
+		if err := store.RevokeToken(context.Background(), "tok-root"); err != nil {
+			t.Fatalf("failed to revoke: %v", err)
+		}
+		if status, _ := refresh(t, string(second.SessionToken), secret); status != http.StatusUnauthorized {
+			t.Errorf("expected refresh of a revoked lineage to fail, got status %d", status)
+		}
+	})
+}
+
+func TestDecryptionServiceRejectsExpiredTokens(t *testing.T) {
+	cases := []struct {
+		name      string
+		expiresAt time.Time
+		wantErr   bool
+	}{
+		{"unexpired", time.Now().Add(time.Minute), false},
+		{"never expires", time.Time{}, false},
+		{"expired", time.Now().Add(-time.Second), true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			attributes := map[string]interface{}{"username": "alice"}
+			if !tc.expiresAt.IsZero() {
+				attributes["expires_at"] = tc.expiresAt.Format(time.RFC3339Nano)
+			}
+			svc := NewDecryptionService(staticDecrypter{
+				keyID:      "kid-1",
+				alg:        "hmac-sha256",
+				publicKey:  []byte("secret"),
+				attributes: attributes,
+			}, "")
+			_, err := svc.GetRequestKey(newSignedRequest(t, "x-session-token"), "kid-1", "hmac-sha256")
+			if tc.wantErr && err == nil {
+				t.Fatal("expected error, got none")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
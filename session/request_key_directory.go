@@ -0,0 +1,51 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/common-fate/httpsig/verifier"
+)
+
+// RequestKeyDirectory looks up a signing key with access to the request
+// being verified, such as to read a session token from it.
+type RequestKeyDirectory interface {
+	GetRequestKey(r *http.Request, kid string, clientSpecifiedAlg string) (verifier.Algorithm, error)
+}
+
+type requestContextKey struct{}
+
+// RequestKeyDirectoryAdapter adapts a RequestKeyDirectory to a
+// verifier.KeyDirectory. The verifier only passes the request's context to
+// GetKey, so Middleware must wrap the verifying middleware to make the
+// request available.
+type RequestKeyDirectoryAdapter struct {
+	Directory RequestKeyDirectory
+}
+
+var _ verifier.KeyDirectory = &RequestKeyDirectoryAdapter{}
+
+func NewRequestKeyDirectoryAdapter(directory RequestKeyDirectory) *RequestKeyDirectoryAdapter {
+	return &RequestKeyDirectoryAdapter{Directory: directory}
+}
+
+// Middleware records the request so GetKey can pass it to the directory
+func (a *RequestKeyDirectoryAdapter) Middleware() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), requestContextKey{}, r)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func (a *RequestKeyDirectoryAdapter) GetKey(ctx context.Context, kid string, clientSpecifiedAlg string) (verifier.Algorithm, error) {
+	r, ok := ctx.Value(requestContextKey{}).(*http.Request)
+	if !ok {
+		return nil, errors.New("no request in context, RequestKeyDirectoryAdapter.Middleware must wrap the verifier")
+	}
+	// use the verifier's context, which may carry more than the recorded request's
+	return a.Directory.GetRequestKey(r.WithContext(ctx), kid, clientSpecifiedAlg)
+}
@@ -0,0 +1,111 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newSignedRequest returns a request carrying the session token "token" in
+// the x-session-token header, cookie, and query parameter, with a "foo"
+// tagged signature covering the given components. The signature value isn't
+// valid, but DecryptionService only inspects the signature's inputs.
+func newSignedRequest(t *testing.T, covered ...string) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/?session_token=token", nil)
+	r.Header.Set("x-session-token", "token")
+	r.AddCookie(&http.Cookie{Name: "session_token", Value: "token"})
+
+	components := []string{}
+	for _, c := range covered {
+		components = append(components, fmt.Sprintf("%q", c))
+	}
+	r.Header.Set("Signature-Input", fmt.Sprintf(`sig1=(%s);keyid="kid-1";tag="foo"`, strings.Join(components, " ")))
+	r.Header.Set("Signature", "sig1=:AAAA:")
+	return r
+}
+
+func TestDecryptionServiceTokenSources(t *testing.T) {
+	dec := staticDecrypter{keyID: "kid-1", alg: "hmac-sha256", publicKey: []byte("secret")}
+	cases := []struct {
+		name    string
+		source  string
+		covered []string
+		wantErr bool
+	}{
+		{"header", "header:x-session-token", []string{"@method", "x-session-token"}, false},
+		{"header not covered", "header:x-session-token", []string{"@method"}, true},
+		{"header missing", "header:x-other-token", []string{"x-other-token"}, true},
+		{"cookie", "cookie:session_token", []string{"cookie"}, false},
+		{"cookie not covered", "cookie:session_token", []string{"x-session-token"}, true},
+		{"query", "query:session_token", []string{"@target-uri"}, false},
+		{"query not covered", "query:session_token", []string{"@method"}, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			source, err := ParseTokenSource(tc.source)
+			if err != nil {
+				t.Fatalf("failed to parse token source: %v", err)
+			}
+			svc := NewDecryptionService(dec, "")
+			svc.TokenSource = source
+			svc.Tag = "foo"
+
+			_, err = svc.GetRequestKey(newSignedRequest(t, tc.covered...), "kid-1", "hmac-sha256")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseTokenSourceInvalid(t *testing.T) {
+	for _, s := range []string{"", "header", "header:", "body:token"} {
+		if _, err := ParseTokenSource(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
+
+func TestRequestKeyDirectoryAdapter(t *testing.T) {
+	svc := NewDecryptionService(staticDecrypter{keyID: "kid-1", alg: "hmac-sha256", publicKey: []byte("secret")}, "")
+	adapter := NewRequestKeyDirectoryAdapter(svc)
+
+	if _, err := adapter.GetKey(context.Background(), "kid-1", "hmac-sha256"); err == nil {
+		t.Fatal("expected error without the adapter's middleware")
+	}
+
+	var gotErr error
+	handler := adapter.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, gotErr = adapter.GetKey(r.Context(), "kid-1", "hmac-sha256")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), newSignedRequest(t, "x-session-token"))
+	if gotErr != nil {
+		t.Fatalf("unexpected error: %v", gotErr)
+	}
+
+	r := newSignedRequest(t, "x-session-token")
+	r.Header.Del("x-session-token")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if !errors.Is(gotErr, ErrNoSessionToken) {
+		t.Fatalf("expected ErrNoSessionToken, got %v", gotErr)
+	}
+}
+
+func TestDecryptionServiceAttributes(t *testing.T) {
+	svc := NewDecryptionService(staticDecrypter{attributes: map[string]interface{}{"username": "alice"}}, "")
+	attrs, ok := svc.Attributes(newSignedRequest(t)).(map[string]interface{})
+	if !ok || attrs["username"] != "alice" {
+		t.Fatalf("expected attributes for alice, got %v", attrs)
+	}
+}
@@ -0,0 +1,137 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RevocationStore records revoked session tokens.
+//
+// A token can be revoked by its token ID, all of a user's tokens issued
+// before a given time can be revoked, and all tokens issued before a given
+// time can be revoked.
+type RevocationStore interface {
+	// RevokeToken revokes a single token by its token ID, and any tokens
+	// refreshed from it
+	RevokeToken(ctx context.Context, tokenID string) error
+	// RevokeUser revokes all tokens for a username issued before issuedBefore
+	RevokeUser(ctx context.Context, username string, issuedBefore time.Time) error
+	// RevokeIssuedBefore revokes all tokens issued before issuedBefore
+	RevokeIssuedBefore(ctx context.Context, issuedBefore time.Time) error
+	// IsRevoked returns true if the token with the given attributes has been revoked
+	IsRevoked(ctx context.Context, attrs *TokenAttributes) (bool, error)
+}
+
+// revocationState is the set of revocations, and the serialized format of
+// the file-backed RevocationStore
+type revocationState struct {
+	// Tokens maps revoked token IDs to the time they were revoked
+	Tokens map[string]time.Time `json:"tokens"`
+	// Users maps usernames to the time before which their tokens are revoked
+	Users map[string]time.Time `json:"users"`
+	// IssuedBefore revokes all tokens issued before it
+	IssuedBefore time.Time `json:"issued_before,omitempty"`
+}
+
+func newRevocationState() *revocationState {
+	return &revocationState{
+		Tokens: map[string]time.Time{},
+		Users:  map[string]time.Time{},
+	}
+}
+
+func (s *revocationState) revokeUser(username string, issuedBefore time.Time) {
+	// never move a user's cutoff backwards
+	if existing, ok := s.Users[username]; ok && existing.After(issuedBefore) {
+		return
+	}
+	s.Users[username] = issuedBefore
+}
+
+func (s *revocationState) revokeIssuedBefore(issuedBefore time.Time) {
+	if s.IssuedBefore.After(issuedBefore) {
+		return
+	}
+	s.IssuedBefore = issuedBefore
+}
+
+// revokedByCutoff returns true if a token issued at issuedAt is revoked by
+// the cutoff. TokenAttributes.IssuedAt is truncated to the second, so the
+// cutoff is too, and a token issued in the same second as the cutoff is
+// revoked: it may have been issued before it.
+func revokedByCutoff(issuedAt, cutoff time.Time) bool {
+	return !issuedAt.Truncate(time.Second).After(cutoff.Truncate(time.Second))
+}
+
+// prune drops token IDs revoked more than retention before now, once every
+// token that could carry them has expired. A zero retention keeps them.
+func (s *revocationState) prune(now time.Time, retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	for tokenID, revokedAt := range s.Tokens {
+		if now.Sub(revokedAt) > retention {
+			delete(s.Tokens, tokenID)
+		}
+	}
+}
+
+func (s *revocationState) isRevoked(attrs *TokenAttributes) bool {
+	// a refreshed token is revoked along with any of its parents
+	for _, tokenID := range append([]string{attrs.TokenID}, attrs.ParentTokenIDs...) {
+		if tokenID == "" {
+			continue
+		}
+		if _, ok := s.Tokens[tokenID]; ok {
+			return true
+		}
+	}
+	if revokedByCutoff(attrs.IssuedAt, s.IssuedBefore) {
+		return true
+	}
+	if cutoff, ok := s.Users[attrs.Username]; ok && revokedByCutoff(attrs.IssuedAt, cutoff) {
+		return true
+	}
+	return false
+}
+
+type inMemoryRevocationStore struct {
+	mu    sync.RWMutex
+	state *revocationState
+}
+
+// NewInMemoryRevocationStore returns a RevocationStore that keeps
+// revocations in memory. Revocations are lost when the process exits.
+func NewInMemoryRevocationStore() RevocationStore {
+	return &inMemoryRevocationStore{state: newRevocationState()}
+}
+
+var _ RevocationStore = &inMemoryRevocationStore{}
+
+func (s *inMemoryRevocationStore) RevokeToken(ctx context.Context, tokenID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Tokens[tokenID] = time.Now().UTC()
+	return nil
+}
+
+func (s *inMemoryRevocationStore) RevokeUser(ctx context.Context, username string, issuedBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.revokeUser(username, issuedBefore)
+	return nil
+}
+
+func (s *inMemoryRevocationStore) RevokeIssuedBefore(ctx context.Context, issuedBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.revokeIssuedBefore(issuedBefore)
+	return nil
+}
+
+func (s *inMemoryRevocationStore) IsRevoked(ctx context.Context, attrs *TokenAttributes) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state.isRevoked(attrs), nil
+}
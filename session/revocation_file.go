@@ -0,0 +1,115 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type fileRevocationStore struct {
+	mu        sync.RWMutex
+	path      string
+	retention time.Duration
+	state     *revocationState
+}
+
+// NewFileRevocationStore returns a RevocationStore that persists
+// revocations as JSON to the file at path, so they survive restarts.
+// Existing revocations are loaded from the file if it exists.
+//
+// Revoked token IDs are dropped from the file retention after they were
+// revoked. It should be at least the token lifetime plus the refresh grace
+// period, after which every token carrying the ID, including tokens
+// refreshed from it before it was revoked, has expired. A zero retention
+// keeps them forever, for tokens that never expire.
+//
+// The file is rewritten on every revocation, which is fine for the
+// occasional admin action but not for high volume revocation.
+func NewFileRevocationStore(path string, retention time.Duration) (RevocationStore, error) {
+	s := &fileRevocationStore{
+		path:      path,
+		retention: retention,
+		state:     newRevocationState(),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, s.state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse revocation file %s: %w", path, err)
+	}
+	if s.state.Tokens == nil {
+		s.state.Tokens = map[string]time.Time{}
+	}
+	if s.state.Users == nil {
+		s.state.Users = map[string]time.Time{}
+	}
+	s.state.prune(time.Now(), retention)
+	return s, nil
+}
+
+var _ RevocationStore = &fileRevocationStore{}
+
+// save writes the state to a temporary file and renames it over the
+// revocation file, so a crash never leaves a partially written file.
+// The caller must hold the write lock.
+func (s *fileRevocationStore) save() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *fileRevocationStore) RevokeToken(ctx context.Context, tokenID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	s.state.prune(now, s.retention)
+	s.state.Tokens[tokenID] = now
+	return s.save()
+}
+
+func (s *fileRevocationStore) RevokeUser(ctx context.Context, username string, issuedBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.revokeUser(username, issuedBefore)
+	return s.save()
+}
+
+func (s *fileRevocationStore) RevokeIssuedBefore(ctx context.Context, issuedBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.revokeIssuedBefore(issuedBefore)
+	return s.save()
+}
+
+func (s *fileRevocationStore) IsRevoked(ctx context.Context, attrs *TokenAttributes) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state.isRevoked(attrs), nil
+}
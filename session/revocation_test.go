@@ -0,0 +1,216 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// staticDecrypter returns the same key and attributes for every token
+type staticDecrypter struct {
+	keyID, alg string
+	publicKey  []byte
+	attributes any
+}
+
+func (d staticDecrypter) DecryptPublicKey(ctx context.Context, content []byte) (string, string, []byte, any, error) {
+	return d.keyID, d.alg, d.publicKey, d.attributes, nil
+}
+
+func TestRevocationStores(t *testing.T) {
+	now := time.Now().UTC()
+
+	stores := map[string]func(t *testing.T) RevocationStore{
+		"in-memory": func(t *testing.T) RevocationStore {
+			return NewInMemoryRevocationStore()
+		},
+		"file": func(t *testing.T) RevocationStore {
+			store, err := NewFileRevocationStore(filepath.Join(t.TempDir(), "revocations.json"), time.Hour)
+			if err != nil {
+				t.Fatalf("failed to create file revocation store: %v", err)
+			}
+			return store
+		},
+	}
+
+	cases := []struct {
+		name   string
+		revoke func(ctx context.Context, store RevocationStore) error
+		attrs  TokenAttributes
+		want   bool
+	}{
+		{
+			name:   "token id",
+			revoke: func(ctx context.Context, s RevocationStore) error { return s.RevokeToken(ctx, "tok-1") },
+			attrs:  TokenAttributes{User: User{Username: "alice"}, TokenID: "tok-1", IssuedAt: now},
+			want:   true,
+		},
+		{
+			name:   "other token id",
+			revoke: func(ctx context.Context, s RevocationStore) error { return s.RevokeToken(ctx, "tok-1") },
+			attrs:  TokenAttributes{User: User{Username: "alice"}, TokenID: "tok-2", IssuedAt: now},
+			want:   false,
+		},
+		{
+			name:   "parent token id",
+			revoke: func(ctx context.Context, s RevocationStore) error { return s.RevokeToken(ctx, "tok-1") },
+			attrs:  TokenAttributes{User: User{Username: "alice"}, TokenID: "tok-3", ParentTokenIDs: []string{"tok-2", "tok-1"}, IssuedAt: now},
+			want:   true,
+		},
+		{
+			name:   "user before cutoff",
+			revoke: func(ctx context.Context, s RevocationStore) error { return s.RevokeUser(ctx, "alice", now) },
+			attrs:  TokenAttributes{User: User{Username: "alice"}, TokenID: "tok-1", IssuedAt: now.Add(-time.Minute)},
+			want:   true,
+		},
+		{
+			name:   "user after cutoff",
+			revoke: func(ctx context.Context, s RevocationStore) error { return s.RevokeUser(ctx, "alice", now) },
+			attrs:  TokenAttributes{User: User{Username: "alice"}, TokenID: "tok-1", IssuedAt: now.Add(time.Minute)},
+			want:   false,
+		},
+		{
+			name:   "other user",
+			revoke: func(ctx context.Context, s RevocationStore) error { return s.RevokeUser(ctx, "alice", now) },
+			attrs:  TokenAttributes{User: User{Username: "bob"}, TokenID: "tok-1", IssuedAt: now.Add(-time.Minute)},
+			want:   false,
+		},
+		{
+			name:   "issued before",
+			revoke: func(ctx context.Context, s RevocationStore) error { return s.RevokeIssuedBefore(ctx, now) },
+			attrs:  TokenAttributes{User: User{Username: "bob"}, TokenID: "tok-1", IssuedAt: now.Add(-time.Minute)},
+			want:   true,
+		},
+		{
+			name:   "issued after",
+			revoke: func(ctx context.Context, s RevocationStore) error { return s.RevokeIssuedBefore(ctx, now) },
+			attrs:  TokenAttributes{User: User{Username: "bob"}, TokenID: "tok-1", IssuedAt: now.Add(time.Minute)},
+			want:   false,
+		},
+		{
+			// IssuedAt is truncated to the second, so a token issued just
+			// before the revocation may have the same IssuedAt
+			name:   "issued in the same second",
+			revoke: func(ctx context.Context, s RevocationStore) error { return s.RevokeIssuedBefore(ctx, now) },
+			attrs:  TokenAttributes{User: User{Username: "bob"}, TokenID: "tok-1", IssuedAt: now.Truncate(time.Second)},
+			want:   true,
+		},
+		{
+			name:   "user issued in the same second",
+			revoke: func(ctx context.Context, s RevocationStore) error { return s.RevokeUser(ctx, "alice", now) },
+			attrs:  TokenAttributes{User: User{Username: "alice"}, TokenID: "tok-1", IssuedAt: now.Truncate(time.Second)},
+			want:   true,
+		},
+	}
+
+	for storeName, newStore := range stores {
+		for _, tc := range cases {
+			t.Run(storeName+"/"+tc.name, func(t *testing.T) {
+				ctx := context.Background()
+				store := newStore(t)
+				if err := tc.revoke(ctx, store); err != nil {
+					t.Fatalf("failed to revoke: %v", err)
+				}
+				got, err := store.IsRevoked(ctx, &tc.attrs)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if got != tc.want {
+					t.Errorf("expected revoked=%v, got %v", tc.want, got)
+				}
+			})
+		}
+	}
+}
+
+func TestFileRevocationStorePersists(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	store, err := NewFileRevocationStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create file revocation store: %v", err)
+	}
+	if err := store.RevokeToken(ctx, "tok-1"); err != nil {
+		t.Fatalf("failed to revoke: %v", err)
+	}
+
+	reopened, err := NewFileRevocationStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to reopen file revocation store: %v", err)
+	}
+	revoked, err := reopened.IsRevoked(ctx, &TokenAttributes{TokenID: "tok-1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !revoked {
+		t.Error("expected revocation to persist across restarts")
+	}
+}
+
+func TestFileRevocationStorePrunes(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	// tok-1 was revoked long enough ago that every token carrying it has
+	// expired
+	state := newRevocationState()
+	state.Tokens["tok-1"] = time.Now().UTC().Add(-2 * time.Hour)
+	state.Tokens["tok-2"] = time.Now().UTC().Add(-time.Minute)
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatalf("failed to marshal revocations: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write revocations: %v", err)
+	}
+
+	store, err := NewFileRevocationStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create file revocation store: %v", err)
+	}
+	if err := store.RevokeToken(ctx, "tok-3"); err != nil {
+		t.Fatalf("failed to revoke: %v", err)
+	}
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read revocations: %v", err)
+	}
+	saved := newRevocationState()
+	if err := json.Unmarshal(data, saved); err != nil {
+		t.Fatalf("failed to parse revocations: %v", err)
+	}
+	for tokenID, want := range map[string]bool{"tok-1": false, "tok-2": true, "tok-3": true} {
+		if _, ok := saved.Tokens[tokenID]; ok != want {
+			t.Errorf("expected %s recorded %t, got %t", tokenID, want, ok)
+		}
+	}
+}
+
+func TestDecryptionServiceRejectsRevokedTokens(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryRevocationStore()
+	svc := NewDecryptionService(staticDecrypter{
+		keyID:     "kid-1",
+		alg:       "hmac-sha256",
+		publicKey: []byte("secret"),
+		attributes: map[string]interface{}{
+			"username":  "alice",
+			"token_id":  "tok-1",
+			"issued_at": time.Now().UTC().Format(time.RFC3339),
+		},
+	}, "")
+	svc.RevocationStore = store
+	r := newSignedRequest(t, "x-session-token")
+
+	if _, err := svc.GetRequestKey(r, "kid-1", "hmac-sha256"); err != nil {
+		t.Fatalf("unexpected error before revocation: %v", err)
+	}
+	if err := store.RevokeToken(ctx, "tok-1"); err != nil {
+		t.Fatalf("failed to revoke: %v", err)
+	}
+	if _, err := svc.GetRequestKey(r, "kid-1", "hmac-sha256"); err == nil {
+		t.Fatal("expected revoked token to be rejected")
+	}
+}
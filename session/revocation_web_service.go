@@ -0,0 +1,117 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type RevocationRequest struct {
+	TokenID  string `json:"token_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	// IssuedBefore defaults to the current time when revoking by user or issue time
+	IssuedBefore time.Time `json:"issued_before,omitempty"`
+}
+
+type RevocationResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+type RevocationService struct {
+	store RevocationStore
+}
+
+func NewRevocationService(store RevocationStore) *RevocationService {
+	return &RevocationService{store: store}
+}
+
+// RevokeTokenHandler returns an HTTP Handler that revokes a single session
+// token by the `token_id` in a RevocationRequest.
+// Authenication should be handled outside this handler.
+func (s *RevocationService) RevokeTokenHandler() http.Handler {
+	return s.revocationHandler(func(ctx context.Context, request *RevocationRequest) error {
+		if request.TokenID == "" {
+			return errInvalidRevocationRequest
+		}
+		return s.store.RevokeToken(ctx, request.TokenID)
+	})
+}
+
+// RevokeUserHandler returns an HTTP Handler that revokes all of a user's
+// session tokens issued before `issued_before` in a RevocationRequest.
+// Authenication should be handled outside this handler.
+func (s *RevocationService) RevokeUserHandler() http.Handler {
+	return s.revocationHandler(func(ctx context.Context, request *RevocationRequest) error {
+		if request.Username == "" {
+			return errInvalidRevocationRequest
+		}
+		return s.store.RevokeUser(ctx, request.Username, request.IssuedBefore)
+	})
+}
+
+// RevokeIssuedBeforeHandler returns an HTTP Handler that revokes every
+// session token issued before `issued_before` in a RevocationRequest.
+// Authenication should be handled outside this handler.
+func (s *RevocationService) RevokeIssuedBeforeHandler() http.Handler {
+	return s.revocationHandler(func(ctx context.Context, request *RevocationRequest) error {
+		return s.store.RevokeIssuedBefore(ctx, request.IssuedBefore)
+	})
+}
+
+var errInvalidRevocationRequest = errors.New("invalid request")
+
+func (s *RevocationService) revocationHandler(revoke func(context.Context, *RevocationRequest) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		resp := &RevocationResponse{}
+		enc := json.NewEncoder(w)
+
+		if r.Method != http.MethodPost {
+			slog.Error("invalid method", "method", r.Method)
+			resp.Error = "invalid method"
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(resp)
+			return
+		}
+
+		request := &RevocationRequest{}
+		defer r.Body.Close()
+		err := json.NewDecoder(r.Body).Decode(request)
+		if err != nil {
+			slog.Error("failed to decode request", "error", err)
+			resp.Error = "invalid request"
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(resp)
+			return
+		}
+		if request.IssuedBefore.IsZero() {
+			request.IssuedBefore = time.Now().UTC().Truncate(time.Second)
+		}
+
+		err = revoke(r.Context(), request)
+		if errors.Is(err, errInvalidRevocationRequest) {
+			resp.Error = err.Error()
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(resp)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to revoke session tokens", "error", err)
+			resp.Error = "internal server error"
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(resp)
+			return
+		}
+		enc.Encode(resp)
+		slog.Info("Revoked session tokens",
+			"url", r.URL.String(),
+			"remote_addr", r.RemoteAddr,
+			"token_id", request.TokenID,
+			"username", request.Username,
+			"issued_before", request.IssuedBefore,
+		)
+	})
+}
@@ -0,0 +1,165 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/common-fate/httpsig"
+)
+
+// Scope restricts the requests a session token authorizes. A token with
+// several scopes authorizes a request if any one of them allows it, and a
+// token with no scopes authorizes every request.
+type Scope struct {
+	// Methods are the allowed HTTP methods. If empty, any method is allowed.
+	Methods []string `json:"methods,omitempty"`
+
+	// Paths are the allowed URL paths. An entry containing `*`, `?`, or `[`
+	// is a path.Match pattern, and any other entry is a path prefix that
+	// matches whole path segments, so `/ci` allows `/ci` and `/ci/build`
+	// but not `/cia`. If empty, any path is allowed.
+	Paths []string `json:"paths,omitempty"`
+
+	// MaxBodyBytes, if positive, is the largest request body allowed
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+}
+
+// Validate checks that the scope's methods, paths, and body size are well formed
+func (s Scope) Validate() error {
+	for _, method := range s.Methods {
+		if method == "" || method != strings.ToUpper(method) || strings.ContainsAny(method, " \t/") {
+			return fmt.Errorf("invalid scope method %q", method)
+		}
+	}
+	for _, p := range s.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("invalid scope path %q, must start with /", p)
+		}
+		if isPathPattern(p) {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid scope path pattern %q: %w", p, err)
+			}
+		}
+	}
+	if s.MaxBodyBytes < 0 {
+		return fmt.Errorf("invalid scope max_body_bytes %d", s.MaxBodyBytes)
+	}
+	return nil
+}
+
+// allows returns nil if the scope allows the request
+func (s Scope) allows(r *http.Request) error {
+	if len(s.Methods) > 0 && !slices.Contains(s.Methods, r.Method) {
+		return fmt.Errorf("method %s is not allowed", r.Method)
+	}
+	if len(s.Paths) > 0 {
+		requestPath := path.Clean("/" + r.URL.Path)
+		if !slices.ContainsFunc(s.Paths, func(p string) bool { return matchScopePath(p, requestPath) }) {
+			return fmt.Errorf("path %s is not allowed", requestPath)
+		}
+	}
+	if s.MaxBodyBytes > 0 && r.ContentLength > s.MaxBodyBytes {
+		return fmt.Errorf("body of %d bytes is larger than %d", r.ContentLength, s.MaxBodyBytes)
+	}
+	return nil
+}
+
+func isPathPattern(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+func matchScopePath(scopePath, requestPath string) bool {
+	if isPathPattern(scopePath) {
+		ok, _ := path.Match(scopePath, requestPath)
+		return ok
+	}
+	prefix := strings.TrimSuffix(scopePath, "/")
+	if prefix == "" {
+		return true
+	}
+	return requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/")
+}
+
+// validateScopes checks each of a token request's scopes
+func validateScopes(scopes []Scope) error {
+	for i, scope := range scopes {
+		if err := scope.Validate(); err != nil {
+			return fmt.Errorf("scope %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// CheckScopes returns nil if the request is allowed by at least one of the
+// scopes, or if there are no scopes
+func CheckScopes(scopes []Scope, r *http.Request) error {
+	_, err := matchScopes(scopes, r)
+	return err
+}
+
+// matchScopes checks the request against the scopes, and returns the largest
+// body the matching scopes allow, or 0 if it is unlimited
+func matchScopes(scopes []Scope, r *http.Request) (int64, error) {
+	if len(scopes) == 0 {
+		return 0, nil
+	}
+	var (
+		matched, unlimited bool
+		maxBytes           int64
+		errs               []error
+	)
+	for _, scope := range scopes {
+		if err := scope.allows(r); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		matched = true
+		if scope.MaxBodyBytes <= 0 {
+			unlimited = true
+		}
+		maxBytes = max(maxBytes, scope.MaxBodyBytes)
+	}
+	if !matched {
+		return 0, fmt.Errorf("request is outside the session token's scopes: %w", errors.Join(errs...))
+	}
+	if unlimited {
+		return 0, nil
+	}
+	return maxBytes, nil
+}
+
+// ScopeMiddleware enforces session token scopes. It must run after the
+// signature verifier, and reads the token's scopes from the verified key's
+// attributes. Requests without verified attributes are rejected.
+func ScopeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawAttributes := httpsig.AttributesFromContext(r.Context())
+		if rawAttributes == nil {
+			slog.Error("no verified session token attributes", "url", r.URL.String())
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		attrs, err := ParseTokenAttributes(rawAttributes)
+		if err != nil {
+			slog.Error("failed to parse session token attributes", "error", err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		maxBytes, err := matchScopes(attrs.Scopes, r)
+		if err != nil {
+			slog.Info("session token scope denied request", "token_id", attrs.TokenID, "method", r.Method, "url", r.URL.String(), "error", err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		// the content length was checked, but a chunked body has none
+		if maxBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
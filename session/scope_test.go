@@ -0,0 +1,205 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/alg_hmac"
+	"github.com/common-fate/httpsig/inmemory"
+	"github.com/common-fate/httpsig/verifier"
+	"github.com/micahhausler/httpsig-scratch/keyalg"
+)
+
+func TestScopeValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		scope   Scope
+		wantErr bool
+	}{
+		{name: "empty", scope: Scope{}},
+		{name: "valid", scope: Scope{Methods: []string{"GET", "POST"}, Paths: []string{"/ci", "/builds/*/logs"}, MaxBodyBytes: 1024}},
+		{name: "lowercase method", scope: Scope{Methods: []string{"get"}}, wantErr: true},
+		{name: "empty method", scope: Scope{Methods: []string{""}}, wantErr: true},
+		{name: "relative path", scope: Scope{Paths: []string{"ci"}}, wantErr: true},
+		{name: "bad pattern", scope: Scope{Paths: []string{"/ci/["}}, wantErr: true},
+		{name: "negative body", scope: Scope{MaxBodyBytes: -1}, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.scope.Validate()
+			if tc.wantErr && err == nil {
+				t.Fatalf("expected error")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckScopes(t *testing.T) {
+	ci := Scope{Methods: []string{http.MethodGet}, Paths: []string{"/ci"}}
+	upload := Scope{Methods: []string{http.MethodPut}, Paths: []string{"/artifacts/*.tar"}, MaxBodyBytes: 10}
+
+	cases := []struct {
+		name          string
+		scopes        []Scope
+		method        string
+		target        string
+		contentLength int64
+		wantErr       bool
+	}{
+		{name: "unscoped", method: http.MethodDelete, target: "/anything"},
+		{name: "prefix", scopes: []Scope{ci}, method: http.MethodGet, target: "/ci"},
+		{name: "prefix subpath", scopes: []Scope{ci}, method: http.MethodGet, target: "/ci/builds"},
+		{name: "prefix partial segment", scopes: []Scope{ci}, method: http.MethodGet, target: "/cia", wantErr: true},
+		{name: "prefix dot segments", scopes: []Scope{ci}, method: http.MethodGet, target: "/ci/../admin", wantErr: true},
+		{name: "method", scopes: []Scope{ci}, method: http.MethodPost, target: "/ci", wantErr: true},
+		{name: "pattern", scopes: []Scope{upload}, method: http.MethodPut, target: "/artifacts/build.tar", contentLength: 10},
+		{name: "pattern mismatch", scopes: []Scope{upload}, method: http.MethodPut, target: "/artifacts/a/build.tar", wantErr: true},
+		{name: "body too large", scopes: []Scope{upload}, method: http.MethodPut, target: "/artifacts/build.tar", contentLength: 11, wantErr: true},
+		{name: "any scope", scopes: []Scope{ci, upload}, method: http.MethodPut, target: "/artifacts/build.tar"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "http://example.com/", nil)
+			r.URL.Path = tc.target
+			r.ContentLength = tc.contentLength
+			err := CheckScopes(tc.scopes, r)
+			if tc.wantErr && err == nil {
+				t.Fatalf("expected request to be denied")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("expected request to be allowed: %v", err)
+			}
+		})
+	}
+}
+
+// attributeKeyDirectory returns an HMAC key with the given attributes for every key ID
+type attributeKeyDirectory struct {
+	secret     []byte
+	attributes any
+}
+
+func (d attributeKeyDirectory) GetKey(ctx context.Context, kid string, alg string) (verifier.Algorithm, error) {
+	return keyalg.NewVerifier(keyalg.HMACSHA256, d.secret, d.attributes)
+}
+
+func TestScopeMiddleware(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	// decrypted JSON session tokens have map attributes
+	data, err := json.Marshal(&TokenAttributes{
+		User:   User{Username: "ci"},
+		Scopes: []Scope{{Methods: []string{http.MethodPost}, Paths: []string{"/ci"}, MaxBodyBytes: 8}},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal attributes: %v", err)
+	}
+	attributes := map[string]interface{}{}
+	if err := json.Unmarshal(data, &attributes); err != nil {
+		t.Fatalf("failed to unmarshal attributes: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+	verify := httpsig.Middleware(httpsig.MiddlewareOpts{
+		NonceStorage: inmemory.NewNonceStorage(),
+		KeyDirectory: attributeKeyDirectory{secret: secret, attributes: attributes},
+		Tag:          "foo",
+		Scheme:       "http",
+		Authority:    serverURL.Host,
+	})
+	mux.Handle("/", verify(ScopeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))))
+
+	client := httpsig.NewClient(httpsig.ClientOpts{
+		KeyID: "kid-1",
+		Tag:   "foo",
+		Alg:   alg_hmac.NewHMAC(secret),
+	})
+	cases := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{"allowed", http.MethodPost, "/ci/build", "{}", http.StatusOK},
+		{"wrong method", http.MethodPut, "/ci/build", "{}", http.StatusForbidden},
+		{"wrong path", http.MethodPost, "/admin", "{}", http.StatusForbidden},
+		{"body too large", http.MethodPost, "/ci/build", `{"a":"bc"}`, http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, server.URL+tc.path, strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("expected status %d, got %d", tc.wantStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestCredentialHandlerScopes(t *testing.T) {
+	cases := []struct {
+		name       string
+		scopes     []Scope
+		wantStatus int
+	}{
+		{"unscoped", nil, http.StatusOK},
+		{"scoped", []Scope{{Methods: []string{http.MethodGet}, Paths: []string{"/ci"}}}, http.StatusOK},
+		{"invalid", []Scope{{Paths: []string{"ci"}}}, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			encrypter := &staticEncrypter{}
+			svc := NewEncryptionService(encrypter)
+			svc.Authenticator = staticAuthenticator{Username: "alice"}
+			body, err := json.Marshal(&CredentialRequest{Scopes: tc.scopes})
+			if err != nil {
+				t.Fatalf("failed to marshal request: %v", err)
+			}
+			w := httptest.NewRecorder()
+			svc.NewCredentialHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(body))))
+			if w.Code != tc.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tc.wantStatus, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			attrs, ok := encrypter.attributes.(*TokenAttributes)
+			if !ok {
+				t.Fatalf("expected token attributes, got %T", encrypter.attributes)
+			}
+			if len(attrs.Scopes) != len(tc.scopes) {
+				t.Errorf("expected %d scopes in the token, got %#v", len(tc.scopes), attrs.Scopes)
+			}
+		})
+	}
+}
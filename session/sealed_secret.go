@@ -0,0 +1,112 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// sealedSecretInfo is the HKDF info prefix for sealed credential secrets
+const sealedSecretInfo = "httpsig-scratch sealed secret v1"
+
+// SealedSecret is a secret encrypted to a recipient's ephemeral X25519 key.
+//
+// The sender generates its own ephemeral X25519 key, and derives an AES-256-GCM
+// key and nonce with HKDF-SHA256 from the ECDH shared secret. The HKDF info
+// binds both public keys and the additional data, such as the credential's key
+// ID, so a sealed secret can't be moved to a different key ID.
+type SealedSecret struct {
+	// EphemeralPublicKey is the sender's X25519 public key
+	EphemeralPublicKey []byte `json:"ephemeral_public_key"`
+	// Ciphertext is the AES-GCM sealed secret
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// SealSecret encrypts the secret to the recipient's X25519 public key
+func SealSecret(recipientPublicKey, secret, additionalData []byte) (*SealedSecret, error) {
+	recipient, err := ecdh.X25519().NewPublicKey(recipientPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X25519 public key: %w", err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPublicKey := ephemeral.PublicKey().Bytes()
+	aead, nonce, err := sealedSecretAEAD(shared, ephemeralPublicKey, recipient.Bytes(), additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return &SealedSecret{
+		EphemeralPublicKey: ephemeralPublicKey,
+		Ciphertext:         aead.Seal(nil, nonce, secret, additionalData),
+	}, nil
+}
+
+// OpenSecret decrypts a secret sealed to the recipient's private key
+func OpenSecret(recipient *ecdh.PrivateKey, sealed *SealedSecret, additionalData []byte) ([]byte, error) {
+	if sealed == nil {
+		return nil, errors.New("no sealed secret")
+	}
+	if recipient.Curve() != ecdh.X25519() {
+		return nil, errors.New("recipient key is not an X25519 key")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(sealed.EphemeralPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral public key: %w", err)
+	}
+	shared, err := recipient.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aead, nonce, err := sealedSecretAEAD(shared, ephemeral.Bytes(), recipient.PublicKey().Bytes(), additionalData)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := aead.Open(nil, nonce, sealed.Ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sealed secret: %w", err)
+	}
+	return secret, nil
+}
+
+// sealedSecretAEAD derives the AEAD and nonce for a shared secret. Each
+// ephemeral key is used for a single message, so the derived nonce is
+// never reused with the same key.
+func sealedSecretAEAD(shared, ephemeralPublicKey, recipientPublicKey, additionalData []byte) (cipher.AEAD, []byte, error) {
+	info := make([]byte, 0, len(sealedSecretInfo)+len(ephemeralPublicKey)+len(recipientPublicKey)+len(additionalData))
+	info = append(info, sealedSecretInfo...)
+	info = append(info, ephemeralPublicKey...)
+	info = append(info, recipientPublicKey...)
+	info = append(info, additionalData...)
+
+	kdf := hkdf.New(sha256.New, shared, nil, info)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(kdf, nonce); err != nil {
+		return nil, nil, err
+	}
+	return aead, nonce, nil
+}
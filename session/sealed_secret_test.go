@@ -0,0 +1,163 @@
+package session
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSealedSecret(t *testing.T) {
+	recipient, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	secret := []byte("hunter2")
+
+	sealed, err := SealSecret(recipient.PublicKey().Bytes(), secret, []byte("kid-1"))
+	if err != nil {
+		t.Fatalf("failed to seal secret: %v", err)
+	}
+	if bytes.Contains(sealed.Ciphertext, secret) {
+		t.Fatalf("sealed secret contains the plaintext")
+	}
+
+	cases := []struct {
+		name           string
+		recipient      *ecdh.PrivateKey
+		sealed         *SealedSecret
+		additionalData string
+		wantErr        bool
+	}{
+		{name: "valid", recipient: recipient, sealed: sealed, additionalData: "kid-1"},
+		{name: "wrong key ID", recipient: recipient, sealed: sealed, additionalData: "kid-2", wantErr: true},
+		{name: "wrong recipient", recipient: other, sealed: sealed, additionalData: "kid-1", wantErr: true},
+		{
+			name:      "substituted ephemeral key",
+			recipient: recipient,
+			sealed: &SealedSecret{
+				EphemeralPublicKey: other.PublicKey().Bytes(),
+				Ciphertext:         sealed.Ciphertext,
+			},
+			additionalData: "kid-1",
+			wantErr:        true,
+		},
+		{
+			name:      "invalid ephemeral key",
+			recipient: recipient,
+			sealed: &SealedSecret{
+				EphemeralPublicKey: []byte("short"),
+				Ciphertext:         sealed.Ciphertext,
+			},
+			additionalData: "kid-1",
+			wantErr:        true,
+		},
+		{name: "missing", recipient: recipient, additionalData: "kid-1", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := OpenSecret(tc.recipient, tc.sealed, []byte(tc.additionalData))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got secret %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to open secret: %v", err)
+			}
+			if !bytes.Equal(got, secret) {
+				t.Errorf("expected secret %q, got %q", secret, got)
+			}
+		})
+	}
+
+	if _, err := SealSecret([]byte("not a key"), secret, nil); err == nil {
+		t.Errorf("expected error sealing to an invalid public key")
+	}
+}
+
+func TestCredentialHandlerSealsSecret(t *testing.T) {
+	recipient, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	cases := []struct {
+		name       string
+		request    CredentialRequest
+		require    bool
+		wantStatus int
+		wantSealed bool
+	}{
+		{name: "plaintext", wantStatus: http.StatusOK},
+		{
+			name:       "sealed",
+			request:    CredentialRequest{EphemeralPublicKey: recipient.PublicKey().Bytes()},
+			wantStatus: http.StatusOK,
+			wantSealed: true,
+		},
+		{name: "plaintext rejected", require: true, wantStatus: http.StatusBadRequest},
+		{
+			name:       "sealed required",
+			request:    CredentialRequest{EphemeralPublicKey: recipient.PublicKey().Bytes()},
+			require:    true,
+			wantStatus: http.StatusOK,
+			wantSealed: true,
+		},
+		{
+			name:       "invalid ephemeral key",
+			request:    CredentialRequest{EphemeralPublicKey: []byte("short")},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			encrypter := &staticEncrypter{}
+			svc := NewEncryptionService(encrypter)
+			svc.Authenticator = staticAuthenticator{Username: "alice"}
+			svc.RequireSealedCredentials = tc.require
+
+			body, err := json.Marshal(tc.request)
+			if err != nil {
+				t.Fatalf("failed to marshal request: %v", err)
+			}
+			w := httptest.NewRecorder()
+			svc.NewCredentialHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+			if w.Code != tc.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tc.wantStatus, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			resp := &CredentialResponse{}
+			if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if !tc.wantSealed {
+				if resp.SecretKey == "" || resp.SealedSecretKey != nil {
+					t.Fatalf("expected a plaintext secret key, got %#v", resp)
+				}
+				return
+			}
+			if resp.SecretKey != "" {
+				t.Fatalf("expected no plaintext secret key, got %q", resp.SecretKey)
+			}
+			secret, err := OpenSecret(recipient, resp.SealedSecretKey, []byte(resp.KeyID))
+			if err != nil {
+				t.Fatalf("failed to open secret key: %v", err)
+			}
+			if !bytes.Equal(secret, encrypter.publicKey) {
+				t.Errorf("expected sealed secret to match the session token key %q, got %q", encrypter.publicKey, secret)
+			}
+		})
+	}
+}
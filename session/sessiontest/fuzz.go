@@ -0,0 +1,61 @@
+package sessiontest
+
+import (
+	"context"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/micahhausler/httpsig-scratch/session"
+)
+
+// FuzzDecrypt fuzzes DecryptPublicKey with mutations of valid tokens. It
+// fails if decryption panics.
+func FuzzDecrypt(f *testing.F, newED func(t testing.TB) session.EncrypterDecrypter) {
+	ed := newED(f)
+	seeds := []token{
+		{keyID: "kid", alg: "hmac-sha256", publicKey: []byte("secret")},
+		{keyID: "kid", alg: "ecdsa-p256-sha256", publicKey: pemPublicKey(f), attributes: map[string]any{"username": "alice"}},
+	}
+	for _, seed := range seeds {
+		content, err := ed.EncryptPublicKey(context.Background(), seed.keyID, seed.alg, seed.publicKey, seed.attributes)
+		if err != nil {
+			f.Fatalf("failed to encrypt seed token: %v", err)
+		}
+		f.Add(content)
+	}
+	f.Add([]byte{})
+	f.Add([]byte("AQEA"))
+
+	f.Fuzz(func(t *testing.T, content []byte) {
+		ed.DecryptPublicKey(context.Background(), content)
+	})
+}
+
+// FuzzRoundTrip fuzzes the key ID, algorithm, public key, and attributes of a
+// token, and fails if it doesn't decrypt to the same values
+func FuzzRoundTrip(f *testing.F, newED func(t testing.TB) session.EncrypterDecrypter) {
+	ed := newED(f)
+	f.Add("kid", "hmac-sha256", []byte("secret"), "alice")
+	f.Add("", "", []byte{}, "")
+	f.Add("ключ", "ed25519", []byte{0, 0xff}, "Zoë")
+
+	f.Fuzz(func(t *testing.T, keyID, alg string, publicKey []byte, username string) {
+		// JSON payloads replace invalid UTF-8, so it can't round trip
+		if !utf8.ValidString(keyID) || !utf8.ValidString(alg) || !utf8.ValidString(username) {
+			t.Skip()
+		}
+		want := token{keyID: keyID, alg: alg, publicKey: publicKey, attributes: map[string]any{"username": username}}
+		content, err := ed.EncryptPublicKey(context.Background(), keyID, alg, publicKey, want.attributes)
+		if err != nil {
+			// implementations may reject inputs, but must not panic
+			return
+		}
+		keyID, alg, publicKey, attributes, err := ed.DecryptPublicKey(context.Background(), content)
+		if err != nil {
+			t.Fatalf("failed to decrypt token: %v", err)
+		}
+		if err := compare(want, token{keyID, alg, publicKey, attributes}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,358 @@
+/*
+Package sessiontest is a conformance test suite for session.EncrypterDecrypter
+implementations.
+
+An implementation runs the suite from its own tests:
+
+	func TestConformance(t *testing.T) {
+		sessiontest.Run(t, sessiontest.Options{
+			New: func(t testing.TB) session.EncrypterDecrypter { ... },
+		})
+	}
+
+	func FuzzDecryptPublicKey(f *testing.F) {
+		sessiontest.FuzzDecrypt(f, func(t testing.TB) session.EncrypterDecrypter { ... })
+	}
+*/
+package sessiontest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/micahhausler/httpsig-scratch/session"
+)
+
+// Options configures the conformance suite for an implementation
+type Options struct {
+	// New returns the implementation under test
+	New func(t testing.TB) session.EncrypterDecrypter
+
+	// NewOtherKey returns the implementation with a different key, whose
+	// tokens New's implementation must reject. If nil, the wrong key test
+	// is skipped.
+	NewOtherKey func(t testing.TB) session.EncrypterDecrypter
+
+	// Unauthenticated is set for implementations that don't authenticate
+	// tokens, like the fake package. The tampering, truncation, and binding
+	// tests are skipped.
+	Unauthenticated bool
+}
+
+// token is the input and expected output of a round trip
+type token struct {
+	keyID      string
+	alg        string
+	publicKey  []byte
+	attributes any
+}
+
+// Run runs the conformance suite
+func Run(t *testing.T, opts Options) {
+	t.Run("RoundTrip", func(t *testing.T) { testRoundTrip(t, opts) })
+	t.Run("EmptyAttributes", func(t *testing.T) { testEmptyAttributes(t, opts) })
+	t.Run("HugeAttributes", func(t *testing.T) { testHugeAttributes(t, opts) })
+	t.Run("Garbage", func(t *testing.T) { testGarbage(t, opts) })
+	t.Run("WrongKey", func(t *testing.T) {
+		if opts.NewOtherKey == nil {
+			t.Skip("no other key configured")
+		}
+		testWrongKey(t, opts)
+	})
+	t.Run("Tampering", func(t *testing.T) {
+		if opts.Unauthenticated {
+			t.Skip("implementation doesn't authenticate tokens")
+		}
+		testTampering(t, opts)
+	})
+	t.Run("Truncation", func(t *testing.T) {
+		if opts.Unauthenticated {
+			t.Skip("implementation doesn't authenticate tokens")
+		}
+		testTruncation(t, opts)
+	})
+	t.Run("Binding", func(t *testing.T) {
+		if opts.Unauthenticated {
+			t.Skip("implementation doesn't authenticate tokens")
+		}
+		testBinding(t, opts)
+	})
+	t.Run("Concurrency", func(t *testing.T) { testConcurrency(t, opts) })
+}
+
+func pemPublicKey(t testing.TB) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func testRoundTrip(t *testing.T, opts Options) {
+	cases := map[string]token{
+		"pem public key": {
+			keyID:      "kid-1",
+			alg:        "ecdsa-p256-sha256",
+			publicKey:  pemPublicKey(t),
+			attributes: map[string]any{"username": "alice", "token_id": "abc"},
+		},
+		"hmac secret": {
+			keyID:      "kid-2",
+			alg:        "hmac-sha256",
+			publicKey:  []byte("c2VjcmV0IGtleSBieXRlcyBmb3IgdGVzdGluZyE="),
+			attributes: map[string]any{"username": "bob", "groups": []any{"a", "b"}},
+		},
+		"binary key": {
+			keyID:      "kid-3",
+			alg:        "ed25519",
+			publicKey:  []byte{0, 1, 2, 0xfe, 0xff},
+			attributes: map[string]any{"nested": map[string]any{"count": 3}},
+		},
+		"unicode": {
+			keyID:      "ключ",
+			alg:        "ed25519",
+			publicKey:  []byte("key"),
+			attributes: map[string]any{"username": "Zoë 🔑"},
+		},
+	}
+	ed := opts.New(t)
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			roundTrip(t, context.Background(), ed, tc)
+		})
+	}
+}
+
+func testEmptyAttributes(t *testing.T, opts Options) {
+	ed := opts.New(t)
+	roundTrip(t, context.Background(), ed, token{keyID: "kid", alg: "hmac-sha256", publicKey: []byte("secret")})
+	roundTrip(t, context.Background(), ed, token{keyID: "kid", alg: "hmac-sha256", publicKey: []byte("secret"), attributes: map[string]any{}})
+}
+
+func testHugeAttributes(t *testing.T, opts Options) {
+	ed := opts.New(t)
+	roundTrip(t, context.Background(), ed, token{
+		keyID:      "kid",
+		alg:        "hmac-sha256",
+		publicKey:  []byte("secret"),
+		attributes: map[string]any{"blob": strings.Repeat("a", 1<<20)},
+	})
+}
+
+// testGarbage checks that malformed tokens are rejected without panicking
+func testGarbage(t *testing.T, opts Options) {
+	ed := opts.New(t)
+	inputs := [][]byte{
+		nil,
+		{},
+		[]byte("a"),
+		[]byte("AQE"),
+		[]byte("AQEA"),
+		[]byte("not a token"),
+		[]byte("{}"),
+		bytes.Repeat([]byte("A"), 64),
+		bytes.Repeat([]byte{0xff}, 64),
+	}
+	for _, input := range inputs {
+		if _, _, _, _, err := ed.DecryptPublicKey(context.Background(), input); err == nil {
+			t.Errorf("expected error decrypting %q", input)
+		}
+	}
+}
+
+func testWrongKey(t *testing.T, opts Options) {
+	ed, other := opts.New(t), opts.NewOtherKey(t)
+	content, err := other.EncryptPublicKey(context.Background(), "kid", "hmac-sha256", []byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("failed to encrypt token: %v", err)
+	}
+	if _, _, _, _, err := ed.DecryptPublicKey(context.Background(), content); err == nil {
+		t.Fatalf("expected token from another key to fail")
+	}
+}
+
+// testTampering changes each byte of a token. Encodings like base64 can have
+// bits that don't affect the decoded value, so a modified token must either
+// fail or decrypt to the original payload.
+func testTampering(t *testing.T, opts Options) {
+	ed := opts.New(t)
+	want := token{keyID: "kid", alg: "hmac-sha256", publicKey: []byte("secret"), attributes: map[string]any{"username": "alice"}}
+	content, err := ed.EncryptPublicKey(context.Background(), want.keyID, want.alg, want.publicKey, want.attributes)
+	if err != nil {
+		t.Fatalf("failed to encrypt token: %v", err)
+	}
+	for i := range content {
+		tampered := bytes.Clone(content)
+		tampered[i] ^= 0x01
+		keyID, alg, publicKey, attributes, err := ed.DecryptPublicKey(context.Background(), tampered)
+		if err != nil {
+			continue
+		}
+		if err := compare(want, token{keyID, alg, publicKey, attributes}); err != nil {
+			t.Fatalf("token modified at byte %d decrypted to a different payload: %v", i, err)
+		}
+	}
+}
+
+func testTruncation(t *testing.T, opts Options) {
+	ed := opts.New(t)
+	content, err := ed.EncryptPublicKey(context.Background(), "kid", "hmac-sha256", []byte("secret"), map[string]any{"username": "alice"})
+	if err != nil {
+		t.Fatalf("failed to encrypt token: %v", err)
+	}
+	for i := 0; i < len(content); i++ {
+		if _, _, _, _, err := ed.DecryptPublicKey(context.Background(), content[:i]); err == nil {
+			t.Fatalf("expected token truncated to %d of %d bytes to fail", i, len(content))
+		}
+	}
+}
+
+func testBinding(t *testing.T, opts Options) {
+	ed := opts.New(t)
+	bound := session.WithBinding(context.Background(), session.Binding{Audience: "a.example.com", Purpose: "test"})
+	want := token{keyID: "kid", alg: "hmac-sha256", publicKey: []byte("secret"), attributes: map[string]any{"username": "alice"}}
+	roundTrip(t, bound, ed, want)
+
+	content, err := ed.EncryptPublicKey(bound, want.keyID, want.alg, want.publicKey, want.attributes)
+	if err != nil {
+		t.Fatalf("failed to encrypt token: %v", err)
+	}
+	others := map[string]context.Context{
+		"unbound":        context.Background(),
+		"other audience": session.WithBinding(context.Background(), session.Binding{Audience: "b.example.com", Purpose: "test"}),
+		"other purpose":  session.WithBinding(context.Background(), session.Binding{Audience: "a.example.com"}),
+	}
+	for name, ctx := range others {
+		if _, _, _, _, err := ed.DecryptPublicKey(ctx, content); err == nil {
+			t.Errorf("expected bound token to fail with %s context", name)
+		}
+	}
+}
+
+func testConcurrency(t *testing.T, opts Options) {
+	ed := opts.New(t)
+	const workers, iterations = 8, 25
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				want := token{
+					keyID:      fmt.Sprintf("kid-%d-%d", w, i),
+					alg:        "hmac-sha256",
+					publicKey:  []byte(fmt.Sprintf("secret-%d-%d", w, i)),
+					attributes: map[string]any{"worker": w, "iteration": i},
+				}
+				got, err := encryptDecrypt(context.Background(), ed, want)
+				if err == nil {
+					err = compare(want, got)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func roundTrip(t *testing.T, ctx context.Context, ed session.EncrypterDecrypter, want token) {
+	t.Helper()
+	got, err := encryptDecrypt(ctx, ed, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compare(want, got); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func encryptDecrypt(ctx context.Context, ed session.EncrypterDecrypter, want token) (token, error) {
+	content, err := ed.EncryptPublicKey(ctx, want.keyID, want.alg, want.publicKey, want.attributes)
+	if err != nil {
+		return token{}, fmt.Errorf("failed to encrypt token: %w", err)
+	}
+	keyID, alg, publicKey, attributes, err := ed.DecryptPublicKey(ctx, content)
+	if err != nil {
+		return token{}, fmt.Errorf("failed to decrypt token: %w", err)
+	}
+	return token{keyID, alg, publicKey, attributes}, nil
+}
+
+// compare checks a decrypted token against the encrypted one. PEM public
+// keys may be returned as DER, and attributes are compared by their JSON
+// representation, since decrypters return them as generic maps. Empty
+// attributes may be returned as nil.
+func compare(want, got token) error {
+	if got.keyID != want.keyID {
+		return fmt.Errorf("expected key id %q, got %q", want.keyID, got.keyID)
+	}
+	if got.alg != want.alg {
+		return fmt.Errorf("expected alg %q, got %q", want.alg, got.alg)
+	}
+	if !bytes.Equal(got.publicKey, want.publicKey) {
+		block, _ := pem.Decode(want.publicKey)
+		if block == nil || !bytes.Equal(got.publicKey, block.Bytes) {
+			return fmt.Errorf("expected public key %q, got %q", want.publicKey, got.publicKey)
+		}
+	}
+	wantAttrs, err := normalize(want.attributes)
+	if err != nil {
+		return err
+	}
+	gotAttrs, err := normalize(got.attributes)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(wantAttrs, gotAttrs) {
+		return fmt.Errorf("expected attributes %v, got %v", abbreviate(wantAttrs), abbreviate(gotAttrs))
+	}
+	return nil
+}
+
+// normalize returns the attributes as decoded JSON, with empty maps as nil
+func normalize(attributes any) (any, error) {
+	data, err := json.Marshal(attributes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal attributes: %w", err)
+	}
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal attributes: %w", err)
+	}
+	if m, ok := v.(map[string]any); ok && len(m) == 0 {
+		return nil, nil
+	}
+	return v, nil
+}
+
+func abbreviate(v any) string {
+	s := fmt.Sprintf("%v", v)
+	if len(s) > 200 {
+		return s[:200] + "..."
+	}
+	return s
+}
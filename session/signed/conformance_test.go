@@ -0,0 +1,39 @@
+package signed
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/micahhausler/httpsig-scratch/session"
+	"github.com/micahhausler/httpsig-scratch/session/sessiontest"
+)
+
+// newTestIssuer returns an issuer with a deterministic key derived from the
+// seed, so fuzz workers share the same key
+func newTestIssuer(seed string) func(t testing.TB) session.EncrypterDecrypter {
+	return func(t testing.TB) session.EncrypterDecrypter {
+		key := make([]byte, ed25519.SeedSize)
+		copy(key, seed)
+		keyring, err := NewKeyring("primary", map[string]crypto.Signer{"primary": ed25519.NewKeyFromSeed(key)})
+		if err != nil {
+			t.Fatalf("failed to create keyring: %v", err)
+		}
+		return NewIssuer(keyring)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	sessiontest.Run(t, sessiontest.Options{
+		New:         newTestIssuer("issuer"),
+		NewOtherKey: newTestIssuer("other issuer"),
+	})
+}
+
+func FuzzDecryptPublicKey(f *testing.F) {
+	sessiontest.FuzzDecrypt(f, newTestIssuer("issuer"))
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	sessiontest.FuzzRoundTrip(f, newTestIssuer("issuer"))
+}
@@ -0,0 +1,21 @@
+/*
+Package signed implements session tokens that are signed with Ed25519 or ECDSA
+rather than encrypted with a shared AES key. The issuer holds the private
+keys, and verifiers only need the issuer's public keys, which the issuer
+publishes as a JWK set. A verifier can't mint tokens, so a compromised edge
+service can't forge identities.
+
+Tokens use the session token envelope, with the signing key's ID in the
+header. The envelope body is a mode byte followed by either
+
+	payload length (uvarint) | payload | signature
+
+or, if the tokens are also encrypted, the AES-GCM nonce and ciphertext of
+the same bytes. The signature covers the envelope header, the mode, the
+session.Binding additional data, and the payload.
+
+Keys are rotated by adding a new key to the Keyring and making it primary.
+Tokens signed with older keys verify as long as their key stays in the JWK
+set.
+*/
+package signed
@@ -0,0 +1,234 @@
+package signed
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/micahhausler/httpsig-scratch/keyalg"
+)
+
+// KeySet looks up the public key of a session token signing key
+type KeySet interface {
+	PublicKey(ctx context.Context, id string) (crypto.PublicKey, error)
+}
+
+// StaticKeySet is a fixed set of public keys indexed by key ID
+type StaticKeySet map[string]crypto.PublicKey
+
+var _ KeySet = StaticKeySet{}
+
+func (s StaticKeySet) PublicKey(ctx context.Context, id string) (crypto.PublicKey, error) {
+	key, ok := s[id]
+	if !ok {
+		return nil, fmt.Errorf("session token signing key %q not found", id)
+	}
+	return key, nil
+}
+
+// JWKS is an RFC 7517 JSON Web Key set
+type JWKS struct {
+	Keys []keyalg.JWK `json:"keys"`
+}
+
+// NewJWKS returns the JWK set for public keys indexed by key ID, sorted by key ID
+func NewJWKS(keys map[string]crypto.PublicKey) (*JWKS, error) {
+	ids := make([]string, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	set := &JWKS{Keys: make([]keyalg.JWK, 0, len(keys))}
+	for _, id := range ids {
+		jwk, err := keyalg.MarshalJWK(keys[id])
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		jwk.Kid = id
+		jwk.Alg = jwsAlgorithm(keys[id])
+		jwk.Use = "sig"
+		set.Keys = append(set.Keys, *jwk)
+	}
+	return set, nil
+}
+
+// jwsAlgorithm returns the RFC 7518 algorithm name for a signing key
+func jwsAlgorithm(key crypto.PublicKey) string {
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return "EdDSA"
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P384() {
+			return "ES384"
+		}
+		return "ES256"
+	}
+	return ""
+}
+
+// PublicKeys returns the signing keys in the set indexed by key ID. Keys
+// without a key ID, that aren't for signatures, or that aren't Ed25519 or
+// ECDSA keys are skipped.
+func (s *JWKS) PublicKeys() (map[string]crypto.PublicKey, error) {
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range s.Keys {
+		if jwk.Kid == "" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		data, err := json.Marshal(jwk)
+		if err != nil {
+			return nil, err
+		}
+		key, err := keyalg.ParsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWK %q: %w", jwk.Kid, err)
+		}
+		if checkSigningKey(key) != nil {
+			continue
+		}
+		if _, ok := keys[jwk.Kid]; ok {
+			return nil, fmt.Errorf("duplicate key id %q in JWK set", jwk.Kid)
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// JWKSHandler returns an HTTP Handler that serves the keyring's public keys
+// as a JWK set, for verifiers to fetch with a RemoteKeySet
+func JWKSHandler(keyring *Keyring) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		set, err := NewJWKS(keyring.PublicKeys())
+		if err != nil {
+			slog.Error("failed to create JWK set", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		w.Header().Set("Cache-Control", "max-age=300")
+		if err := json.NewEncoder(w).Encode(set); err != nil {
+			slog.Error("failed to encode JWK set", "error", err)
+		}
+	})
+}
+
+// maxJWKSBytes limits the size of a fetched JWK set
+const maxJWKSBytes = 1 << 20
+
+// RemoteKeySet fetches an issuer's public keys from its JWK set URL. Keys are
+// cached for MaxAge, and an unknown key ID triggers a refetch at most once
+// every MinRefreshInterval, so tokens signed with a newly rotated key verify
+// without a restart.
+type RemoteKeySet struct {
+	URL string
+
+	// Client fetches the JWK set, defaults to http.DefaultClient
+	Client *http.Client
+
+	// MinRefreshInterval limits how often an unknown key ID triggers a
+	// refetch. Defaults to one minute.
+	MinRefreshInterval time.Duration
+
+	// MaxAge is how long fetched keys are used before refetching. Defaults
+	// to one hour.
+	MaxAge time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+	attempted time.Time
+	now       func() time.Time
+}
+
+var _ KeySet = &RemoteKeySet{}
+
+// NewRemoteKeySet returns a RemoteKeySet for a JWK set URL
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{URL: url}
+}
+
+func (s *RemoteKeySet) PublicKey(ctx context.Context, id string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.now != nil {
+		now = s.now()
+	}
+	maxAge, minRefresh := s.MaxAge, s.MinRefreshInterval
+	if maxAge <= 0 {
+		maxAge = time.Hour
+	}
+	if minRefresh <= 0 {
+		minRefresh = time.Minute
+	}
+	key, ok := s.keys[id]
+	stale := s.fetched.IsZero() || now.Sub(s.fetched) >= maxAge
+	// failed fetches are throttled too, so an unreachable issuer isn't
+	// fetched on every request
+	canRefresh := s.attempted.IsZero() || now.Sub(s.attempted) >= minRefresh
+	if (stale || !ok) && canRefresh {
+		s.attempted = now
+		keys, err := s.fetch(ctx)
+		if err != nil {
+			// keep using the cached keys if the issuer is unreachable
+			if ok {
+				slog.Error("failed to refresh JWK set", "url", s.URL, "error", err)
+				return key, nil
+			}
+			return nil, fmt.Errorf("failed to fetch JWK set: %w", err)
+		}
+		s.keys = keys
+		s.fetched = now
+		key, ok = s.keys[id]
+	}
+	if !ok {
+		return nil, fmt.Errorf("session token signing key %q not found in JWK set", id)
+	}
+	return key, nil
+}
+
+func (s *RemoteKeySet) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/jwk-set+json, application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes))
+	if err != nil {
+		return nil, err
+	}
+	set := &JWKS{}
+	if err := json.Unmarshal(data, set); err != nil {
+		return nil, fmt.Errorf("invalid JWK set: %w", err)
+	}
+	return set.PublicKeys()
+}
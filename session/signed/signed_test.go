@@ -0,0 +1,235 @@
+package signed
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/micahhausler/httpsig-scratch/session"
+	"github.com/micahhausler/httpsig-scratch/session/envelope"
+)
+
+func generateKeys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return map[string]crypto.Signer{"ed25519": edKey, "p256": p256Key, "p384": p384Key}
+}
+
+func TestIssuerVerifier(t *testing.T) {
+	keys := generateKeys(t)
+	aesBlock, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+	bound := session.WithBinding(context.Background(), session.Binding{Audience: "example.com"})
+
+	for kid := range keys {
+		for _, codec := range []envelope.Codec{envelope.CodecJSON, envelope.CodecCBOR} {
+			for _, encrypted := range []bool{false, true} {
+				name := kid + "/" + codec.String()
+				if encrypted {
+					name += "/encrypted"
+				}
+				t.Run(name, func(t *testing.T) {
+					keyring, err := NewKeyring(kid, keys)
+					if err != nil {
+						t.Fatalf("failed to create keyring: %v", err)
+					}
+					issuer := NewIssuer(keyring)
+					issuer.Codec = codec
+					verifier := NewVerifier(StaticKeySet(keyring.PublicKeys()))
+					if encrypted {
+						issuer.Encryption = aesBlock
+						verifier.Encryption = aesBlock
+					}
+
+					token, err := issuer.EncryptPublicKey(bound, "client-key", "ed25519", []byte("public key"), map[string]interface{}{"username": "alice"})
+					if err != nil {
+						t.Fatalf("failed to sign token: %v", err)
+					}
+					for name, d := range map[string]session.Decrypter{"issuer": issuer, "verifier": verifier} {
+						gotKid, alg, pub, attrs, err := d.DecryptPublicKey(bound, token)
+						if err != nil {
+							t.Fatalf("%s failed to verify token: %v", name, err)
+						}
+						if gotKid != "client-key" || alg != "ed25519" || string(pub) != "public key" {
+							t.Errorf("%s got unexpected payload %q %q %q", name, gotKid, alg, pub)
+						}
+						if attrs.(map[string]interface{})["username"] != "alice" {
+							t.Errorf("%s got unexpected attributes %#v", name, attrs)
+						}
+					}
+
+					if _, _, _, _, err := verifier.DecryptPublicKey(context.Background(), token); err == nil {
+						t.Errorf("expected token without binding to fail")
+					}
+					env, err := envelope.Decode(token)
+					if err != nil {
+						t.Fatalf("failed to decode token: %v", err)
+					}
+					env.Body[len(env.Body)/2] ^= 1
+					tampered, err := env.Encode()
+					if err != nil {
+						t.Fatalf("failed to encode token: %v", err)
+					}
+					if _, _, _, _, err := verifier.DecryptPublicKey(bound, tampered); err == nil {
+						t.Errorf("expected tampered token to fail")
+					}
+					mismatched := NewVerifier(StaticKeySet(keyring.PublicKeys()))
+					if !encrypted {
+						mismatched.Encryption = aesBlock
+					}
+					if _, _, _, _, err := mismatched.DecryptPublicKey(bound, token); err == nil {
+						t.Errorf("expected token to fail with mismatched encryption")
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestVerifierRejectsOtherIssuers(t *testing.T) {
+	keys := generateKeys(t)
+	keyring, err := NewKeyring("ed25519", keys)
+	if err != nil {
+		t.Fatalf("failed to create keyring: %v", err)
+	}
+	other, err := NewKeyring("ed25519", generateKeys(t))
+	if err != nil {
+		t.Fatalf("failed to create keyring: %v", err)
+	}
+	token, err := NewIssuer(other).EncryptPublicKey(context.Background(), "kid", "ed25519", []byte("key"), nil)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	if _, _, _, _, err := NewVerifier(keyring).DecryptPublicKey(context.Background(), token); err == nil {
+		t.Fatalf("expected token from another issuer with the same key id to fail")
+	}
+}
+
+func TestRemoteKeySetRotation(t *testing.T) {
+	keys := generateKeys(t)
+	keyring, err := NewKeyring("ed25519", map[string]crypto.Signer{"ed25519": keys["ed25519"]})
+	if err != nil {
+		t.Fatalf("failed to create keyring: %v", err)
+	}
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		JWKSHandler(keyring).ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	keySet := NewRemoteKeySet(server.URL)
+	keySet.now = func() time.Time { return now }
+	verifier := NewVerifier(keySet)
+	issuer := NewIssuer(keyring)
+
+	oldToken, err := issuer.EncryptPublicKey(context.Background(), "kid", "ed25519", []byte("key"), nil)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	if _, _, _, _, err := verifier.DecryptPublicKey(context.Background(), oldToken); err != nil {
+		t.Fatalf("failed to verify token: %v", err)
+	}
+
+	// rotate to a new primary key, keeping the old key for verification
+	if err := keyring.Set("p256", keys); err != nil {
+		t.Fatalf("failed to rotate keyring: %v", err)
+	}
+	newToken, err := issuer.EncryptPublicKey(context.Background(), "kid", "ed25519", []byte("key"), nil)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	if _, _, _, _, err := verifier.DecryptPublicKey(context.Background(), newToken); err == nil {
+		t.Fatalf("expected unknown key id to wait for the refresh interval")
+	}
+	now = now.Add(time.Minute)
+	for _, token := range [][]byte{oldToken, newToken} {
+		if _, _, _, _, err := verifier.DecryptPublicKey(context.Background(), token); err != nil {
+			t.Fatalf("failed to verify token after rotation: %v", err)
+		}
+	}
+	if fetches != 2 {
+		t.Errorf("expected 2 JWK set fetches, got %d", fetches)
+	}
+}
+
+func TestLoadKeyringFile(t *testing.T) {
+	keys := generateKeys(t)
+	kf := KeyringFile{Primary: "p256"}
+	for _, kid := range []string{"ed25519", "p256"} {
+		der, err := x509.MarshalPKCS8PrivateKey(keys[kid])
+		if err != nil {
+			t.Fatalf("failed to marshal key: %v", err)
+		}
+		kf.Keys = append(kf.Keys, KeyringKey{ID: kid, Key: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))})
+	}
+	sec1, err := x509.MarshalECPrivateKey(keys["p384"].(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	kf.Keys = append(kf.Keys, KeyringKey{ID: "p384", Key: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}))})
+
+	data, err := json.Marshal(kf)
+	if err != nil {
+		t.Fatalf("failed to marshal keyring file: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "signing-keyring.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write keyring file: %v", err)
+	}
+	keyring, err := LoadKeyringFile(path)
+	if err != nil {
+		t.Fatalf("failed to load keyring file: %v", err)
+	}
+	if primary, _ := keyring.Primary(); primary != "p256" {
+		t.Errorf("expected primary p256, got %q", primary)
+	}
+	if ids := keyring.KeyIDs(); len(ids) != 3 {
+		t.Errorf("expected 3 keys, got %v", ids)
+	}
+
+	jwks, err := NewJWKS(keyring.PublicKeys())
+	if err != nil {
+		t.Fatalf("failed to create JWK set: %v", err)
+	}
+	wantAlgs := map[string]string{"ed25519": "EdDSA", "p256": "ES256", "p384": "ES384"}
+	for _, jwk := range jwks.Keys {
+		if jwk.Alg != wantAlgs[jwk.Kid] {
+			t.Errorf("expected %s to have alg %s, got %s", jwk.Kid, wantAlgs[jwk.Kid], jwk.Alg)
+		}
+	}
+	parsed, err := jwks.PublicKeys()
+	if err != nil {
+		t.Fatalf("failed to parse JWK set: %v", err)
+	}
+	if len(parsed) != 3 {
+		t.Errorf("expected 3 keys from JWK set, got %d", len(parsed))
+	}
+}
@@ -0,0 +1,279 @@
+package signed
+
+import (
+	"context"
+	"crypto"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+
+	"github.com/micahhausler/httpsig-scratch/session"
+	"github.com/micahhausler/httpsig-scratch/session/envelope"
+	"github.com/micahhausler/httpsig-scratch/session/internal/aead"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/cryptobyte/asn1"
+)
+
+const (
+	// modeSigned is a signed payload
+	modeSigned byte = 1
+	// modeSignedEncrypted is a signed payload encrypted with AES-GCM
+	modeSignedEncrypted byte = 2
+)
+
+// signatureContext separates session token signatures from other uses of the keys
+const signatureContext = "httpsig-scratch signed session token\x00"
+
+// Issuer signs session tokens with the primary key of a Keyring. It also
+// verifies the tokens it signs, so it can be used as the session server's
+// session.EncrypterDecrypter.
+type Issuer struct {
+	keyring *Keyring
+
+	// Codec is the payload serialization for new tokens, defaults to envelope.CodecJSON
+	Codec envelope.Codec
+
+	// Encryption, if set, encrypts signed tokens with AES-GCM so clients
+	// can't read their attributes. Verifiers need the same key, but it
+	// can't be used to mint tokens.
+	Encryption cipher.Block
+}
+
+var _ session.EncrypterDecrypter = &Issuer{}
+
+// NewIssuer returns an Issuer that signs tokens with the keyring's primary key
+func NewIssuer(keyring *Keyring) *Issuer {
+	return &Issuer{keyring: keyring, Codec: envelope.CodecJSON}
+}
+
+// EncryptPublicKey signs the public key and attributes into a session token
+// with the primary key, bound to the session.Binding in the context.
+func (i *Issuer) EncryptPublicKey(ctx context.Context, keyID, alg string, publicKey []byte, attributes any) ([]byte, error) {
+	kid, signer := i.keyring.Primary()
+	if signer == nil {
+		return nil, errors.New("keyring has no primary key")
+	}
+	codec := i.Codec
+	if codec == 0 {
+		codec = envelope.CodecJSON
+	}
+	payload, err := envelope.MarshalPayload(codec, &envelope.Payload{
+		KeyID:      keyID,
+		Alg:        alg,
+		PublicKey:  envelope.CompactPublicKey(publicKey),
+		Attributes: attributes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mode := modeSigned
+	if i.Encryption != nil {
+		mode = modeSignedEncrypted
+	}
+	env := envelope.New(codec, kid, nil)
+	header, err := env.Header()
+	if err != nil {
+		return nil, err
+	}
+	binding := session.BindingFromContext(ctx).AdditionalData()
+	signature, err := sign(signer, signedContent(header, mode, binding, payload))
+	if err != nil {
+		return nil, err
+	}
+
+	body := binary.AppendUvarint(nil, uint64(len(payload)))
+	body = append(body, payload...)
+	body = append(body, signature...)
+	if i.Encryption != nil {
+		body, err = aead.Seal(i.Encryption, body, append(append(header, mode), binding...))
+		if err != nil {
+			return nil, err
+		}
+	}
+	env.Body = append([]byte{mode}, body...)
+	return env.Encode()
+}
+
+// DecryptPublicKey verifies a session token signed by a key in the keyring,
+// which must be bound to the session.Binding in the context.
+func (i *Issuer) DecryptPublicKey(ctx context.Context, content []byte) (keyID, alg string, publicKey []byte, attributes any, err error) {
+	v := &Verifier{keys: i.keyring, Encryption: i.Encryption}
+	return v.DecryptPublicKey(ctx, content)
+}
+
+// Verifier verifies signed session tokens with the issuer's public keys. It
+// can't sign tokens, so it only implements session.Decrypter.
+type Verifier struct {
+	keys KeySet
+
+	// Encryption is the AES key of an Issuer that encrypts tokens. If set,
+	// only encrypted tokens are accepted, and if nil, only unencrypted ones.
+	Encryption cipher.Block
+}
+
+var _ session.Decrypter = &Verifier{}
+
+// NewVerifier returns a Verifier for tokens signed by keys in the KeySet,
+// such as a RemoteKeySet for the issuer's JWK set.
+func NewVerifier(keys KeySet) *Verifier {
+	return &Verifier{keys: keys}
+}
+
+// DecryptPublicKey verifies a signed session token, which must be bound to
+// the session.Binding in the context.
+func (v *Verifier) DecryptPublicKey(ctx context.Context, content []byte) (keyID, alg string, publicKey []byte, attributes any, err error) {
+	p, err := v.verify(ctx, content)
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	return p.KeyID, p.Alg, p.PublicKey, p.Attributes, nil
+}
+
+func (v *Verifier) verify(ctx context.Context, content []byte) (*envelope.Payload, error) {
+	env, err := envelope.Decode(content)
+	if err != nil {
+		return nil, err
+	}
+	if env.KeyID == "" {
+		return nil, errors.New("signed session token has no key id")
+	}
+	if len(env.Body) == 0 {
+		return nil, errors.New("signed session token has no body")
+	}
+	header, err := env.Header()
+	if err != nil {
+		return nil, err
+	}
+	binding := session.BindingFromContext(ctx).AdditionalData()
+
+	mode, body := env.Body[0], env.Body[1:]
+	switch {
+	case mode == modeSigned && v.Encryption == nil:
+	case mode == modeSignedEncrypted && v.Encryption != nil:
+		body, err = aead.Open(v.Encryption, body, append(append(header, mode), binding...))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", session.ErrBindingMismatch, err)
+		}
+	case mode == modeSigned || mode == modeSignedEncrypted:
+		return nil, errors.New("signed session token encryption doesn't match verifier")
+	default:
+		return nil, fmt.Errorf("unsupported signed session token mode %d", mode)
+	}
+
+	payloadLen, n := binary.Uvarint(body)
+	if n <= 0 || payloadLen > uint64(len(body)-n) {
+		return nil, errors.New("invalid signed session token body")
+	}
+	payload := body[n : n+int(payloadLen)]
+	signature := body[n+int(payloadLen):]
+
+	key, err := v.keys.PublicKey(ctx, env.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(key, signedContent(header, mode, binding, payload), signature); err != nil {
+		return nil, fmt.Errorf("%w: %w", session.ErrBindingMismatch, err)
+	}
+	return envelope.UnmarshalPayload(env.Codec, payload)
+}
+
+// signedContent returns the bytes a token signature covers
+func signedContent(header []byte, mode byte, binding, payload []byte) []byte {
+	content := make([]byte, 0, len(signatureContext)+len(header)+1+2*binary.MaxVarintLen64+len(binding)+len(payload))
+	content = append(content, signatureContext...)
+	content = append(content, header...)
+	content = append(content, mode)
+	content = binary.AppendUvarint(content, uint64(len(binding)))
+	content = append(content, binding...)
+	content = binary.AppendUvarint(content, uint64(len(payload)))
+	return append(content, payload...)
+}
+
+// sign returns an Ed25519 signature, or an ECDSA signature as the fixed size
+// concatenation of r and s
+func sign(signer crypto.Signer, content []byte) ([]byte, error) {
+	switch pub := signer.Public().(type) {
+	case ed25519.PublicKey:
+		return signer.Sign(rand.Reader, content, crypto.Hash(0))
+	case *ecdsa.PublicKey:
+		h, hashFunc := ecdsaHash(pub.Curve)
+		h.Write(content)
+		der, err := signer.Sign(rand.Reader, h.Sum(nil), hashFunc)
+		if err != nil {
+			return nil, err
+		}
+		r, s, err := parseASN1Signature(der)
+		if err != nil {
+			return nil, err
+		}
+		size := curveSize(pub.Curve)
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+		return sig, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", pub)
+	}
+}
+
+func verifySignature(key crypto.PublicKey, content, signature []byte) error {
+	switch pub := key.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, content, signature) {
+			return errors.New("invalid session token signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		size := curveSize(pub.Curve)
+		if len(signature) != 2*size {
+			return errors.New("invalid session token signature")
+		}
+		h, _ := ecdsaHash(pub.Curve)
+		h.Write(content)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, h.Sum(nil), r, s) {
+			return errors.New("invalid session token signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported signing key type %T", key)
+	}
+}
+
+func ecdsaHash(curve elliptic.Curve) (hash.Hash, crypto.Hash) {
+	if curve == elliptic.P384() {
+		return sha512.New384(), crypto.SHA384
+	}
+	return sha256.New(), crypto.SHA256
+}
+
+func curveSize(curve elliptic.Curve) int {
+	return (curve.Params().BitSize + 7) / 8
+}
+
+// parseASN1Signature parses an ASN.1 DER ECDSA signature, as returned by a
+// crypto.Signer
+func parseASN1Signature(der []byte) (r, s *big.Int, err error) {
+	r, s = new(big.Int), new(big.Int)
+	var inner cryptobyte.String
+	input := cryptobyte.String(der)
+	if !input.ReadASN1(&inner, asn1.SEQUENCE) ||
+		!input.Empty() ||
+		!inner.ReadASN1Integer(r) ||
+		!inner.ReadASN1Integer(s) ||
+		!inner.Empty() {
+		return nil, nil, errors.New("invalid ASN.1 ECDSA signature")
+	}
+	return r, s, nil
+}
@@ -0,0 +1,99 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// TokenAttributes are the attributes EncryptionService stores in each session
+// token it issues. The embedded User's fields are serialized at the top
+// level, so `username` is available in the decrypted attributes.
+type TokenAttributes struct {
+	User
+	TokenID  string    `json:"token_id,omitempty"`
+	IssuedAt time.Time `json:"issued_at,omitempty"`
+
+	// ExpiresAt is when the token stops authorizing requests. A zero
+	// ExpiresAt never expires.
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+
+	// ParentTokenIDs are the IDs of the tokens this token was refreshed
+	// from, most recent first. Revoking any of them revokes this token.
+	ParentTokenIDs []string `json:"parent_token_ids,omitempty"`
+
+	// ProofOfPossession is true if the registration request was signed
+	// with the private key of the token's public key
+	ProofOfPossession bool `json:"proof_of_possession,omitempty"`
+
+	// Scopes restrict the requests the token authorizes, and are enforced
+	// by ScopeMiddleware. A token without scopes authorizes every request.
+	Scopes []Scope `json:"scopes,omitempty"`
+}
+
+// newTokenAttributes returns TokenAttributes for a user with a new random
+// token ID, which expire after lifetime if it is positive
+func newTokenAttributes(user User, lifetime time.Duration) (*TokenAttributes, error) {
+	tokenID, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	attrs := &TokenAttributes{
+		User:     user,
+		TokenID:  tokenID,
+		IssuedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if lifetime > 0 {
+		attrs.ExpiresAt = attrs.IssuedAt.Add(lifetime)
+	}
+	return attrs, nil
+}
+
+// expiresAt returns a pointer to the attributes' expiry for responses, or
+// nil if they never expire
+func (a *TokenAttributes) expiresAt() *time.Time {
+	if a.ExpiresAt.IsZero() {
+		return nil
+	}
+	return &a.ExpiresAt
+}
+
+// expired returns true if the token expired more than grace before now
+func (a *TokenAttributes) expired(now time.Time, grace time.Duration) bool {
+	return !a.ExpiresAt.IsZero() && now.After(a.ExpiresAt.Add(grace))
+}
+
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ParseTokenAttributes converts decrypted session token attributes into
+// TokenAttributes. Decrypters that serialize attributes as JSON return them
+// as a map[string]interface{}, so those are converted through JSON.
+func ParseTokenAttributes(attributes any) (*TokenAttributes, error) {
+	switch v := attributes.(type) {
+	case *TokenAttributes:
+		return v, nil
+	case TokenAttributes:
+		return &v, nil
+	case nil:
+		return &TokenAttributes{}, nil
+	}
+	data, err := json.Marshal(attributes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal session token attributes: %w", err)
+	}
+	ta := &TokenAttributes{}
+	err = json.Unmarshal(data, ta)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session token attributes: %w", err)
+	}
+	return ta, nil
+}
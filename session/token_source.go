@@ -0,0 +1,93 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrNoSessionToken is returned by a TokenSource when the request has no session token
+var ErrNoSessionToken = errors.New("no session token in request")
+
+// TokenSource extracts a session token from a request
+type TokenSource interface {
+	// Token returns the session token in the request, or ErrNoSessionToken
+	Token(r *http.Request) ([]byte, error)
+
+	// CoveredComponent is the signature component identifier that must be
+	// covered for the token to be protected by the request's signature
+	CoveredComponent() string
+}
+
+// HeaderTokenSource reads the session token from a request header
+type HeaderTokenSource struct {
+	Name string
+}
+
+func (s HeaderTokenSource) Token(r *http.Request) ([]byte, error) {
+	tok := r.Header.Get(s.Name)
+	if tok == "" {
+		return nil, fmt.Errorf("%w: missing header %q", ErrNoSessionToken, s.Name)
+	}
+	return []byte(tok), nil
+}
+
+func (s HeaderTokenSource) CoveredComponent() string {
+	return strings.ToLower(s.Name)
+}
+
+// CookieTokenSource reads the session token from a cookie. The whole Cookie
+// header must be covered by the signature.
+type CookieTokenSource struct {
+	Name string
+}
+
+func (s CookieTokenSource) Token(r *http.Request) ([]byte, error) {
+	c, err := r.Cookie(s.Name)
+	if err != nil || c.Value == "" {
+		return nil, fmt.Errorf("%w: missing cookie %q", ErrNoSessionToken, s.Name)
+	}
+	return []byte(c.Value), nil
+}
+
+func (s CookieTokenSource) CoveredComponent() string {
+	return "cookie"
+}
+
+// QueryTokenSource reads the session token from a query parameter. The
+// query is covered by the signature through @target-uri.
+type QueryTokenSource struct {
+	Name string
+}
+
+func (s QueryTokenSource) Token(r *http.Request) ([]byte, error) {
+	tok := r.URL.Query().Get(s.Name)
+	if tok == "" {
+		return nil, fmt.Errorf("%w: missing query parameter %q", ErrNoSessionToken, s.Name)
+	}
+	return []byte(tok), nil
+}
+
+func (s QueryTokenSource) CoveredComponent() string {
+	return "@target-uri"
+}
+
+// ParseTokenSource parses a token source of the form "header:<name>",
+// "cookie:<name>", or "query:<name>"
+func ParseTokenSource(s string) (TokenSource, error) {
+	kind, name, ok := strings.Cut(s, ":")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("invalid token source %q, expected <header|cookie|query>:<name>", s)
+	}
+	switch kind {
+	case "header":
+		return HeaderTokenSource{Name: name}, nil
+	case "cookie":
+		return CookieTokenSource{Name: name}, nil
+	case "query":
+		return QueryTokenSource{Name: name}, nil
+	default:
+		return nil, fmt.Errorf("unknown token source type %q", kind)
+	}
+}
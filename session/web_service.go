@@ -1,20 +1,21 @@
 package session
 
 import (
+	"bytes"
 	"context"
-	"crypto/ecdsa"
-	"crypto/rsa"
-	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"slices"
+	"time"
 
-	"github.com/common-fate/httpsig/alg_ecdsa"
-	"github.com/common-fate/httpsig/alg_hmac"
-	"github.com/common-fate/httpsig/alg_rsa"
+	"github.com/common-fate/httpsig/signature"
+	"github.com/common-fate/httpsig/sigset"
 	"github.com/common-fate/httpsig/verifier"
+	"github.com/micahhausler/httpsig-scratch/keyalg"
 )
 
 type User struct {
@@ -22,19 +23,59 @@ type User struct {
 }
 
 type EncryptionRequest struct {
+	// UserInfo is ignored, the token's user comes from the EncryptionService's Authenticator
 	UserInfo  User   `json:"user_info"`
 	KeyID     string `json:"key_id"`
 	Alg       string `json:"alg"`
 	PublicKey string `json:"public_key"`
+	// Scopes optionally restrict the requests the session token authorizes
+	Scopes []Scope `json:"scopes,omitempty"`
 }
 
 type EncryptionResponse struct {
-	SessionToken []byte `json:"session_token,omitempty"`
-	Error        string `json:"error,omitempty"`
+	SessionToken []byte     `json:"session_token,omitempty"`
+	TokenID      string     `json:"token_id,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	Error        string     `json:"error,omitempty"`
 }
 
 type EncryptionService struct {
 	encrypter Encrypter
+
+	// Audience, if set, binds issued session tokens to the named service,
+	// typically the server's authority. Tokens only decrypt for a
+	// DecryptionService with the same Audience and Purpose.
+	Audience string
+	// Purpose optionally narrows issued session tokens to a particular use
+	Purpose string
+
+	// Authenticator authenticates callers of the token issuance handlers.
+	// If nil, every request is rejected.
+	Authenticator Authenticator
+
+	// ProofOfPossession, if set, requires session token registration
+	// requests to be signed with the private key being registered
+	ProofOfPossession *ProofOfPossession
+
+	// RequireSealedCredentials rejects HMAC credential requests without an
+	// ephemeral public key, so secret keys are never returned in plaintext
+	RequireSealedCredentials bool
+
+	// TokenLifetime is how long issued session tokens are valid for. If
+	// zero, tokens never expire.
+	TokenLifetime time.Duration
+
+	// Refresh, if set, configures RefreshHandler to reissue session tokens
+	Refresh *TokenRefresh
+}
+
+// maxEncryptionRequestBytes limits the size of a session token registration request
+const maxEncryptionRequestBytes = 1 << 20
+
+// bindingContext returns the context for encrypting session tokens bound to the
+// service's audience and purpose
+func (e *EncryptionService) bindingContext(ctx context.Context) context.Context {
+	return WithBinding(ctx, Binding{Audience: e.Audience, Purpose: e.Purpose})
 }
 
 func NewEncryptionService(encrypter Encrypter) *EncryptionService {
@@ -42,10 +83,9 @@ func NewEncryptionService(encrypter Encrypter) *EncryptionService {
 }
 
 // SessionTokenHandler returns an HTTP Handler that creates a session token for an EncryptionRequest.
-// Authenication should be handled outside this handler.
-//
-// To inject attributes into a session token, add it to the request's context,
-// and specify the context key in the SessionTokenHandler method.
+// The caller is authenticated with the service's Authenticator, which is the
+// only source of the token's user. If ProofOfPossession is set, the request
+// must also be signed with the key being registered.
 func (e *EncryptionService) SessionTokenHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -60,9 +100,22 @@ func (e *EncryptionService) SessionTokenHandler() http.Handler {
 			return
 		}
 
+		user, err := e.authenticate(r)
+		if err != nil {
+			slog.Error("failed to authenticate token request", "remote_addr", r.RemoteAddr, "error", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			resp.Error = "unauthorized"
+			enc.Encode(resp)
+			return
+		}
+
 		request := &EncryptionRequest{}
 		defer r.Body.Close()
-		err := json.NewDecoder(r.Body).Decode(request)
+		// the body is read up front so it can be verified with the submitted key
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEncryptionRequestBytes))
+		if err == nil {
+			err = json.Unmarshal(body, request)
+		}
 		if err != nil {
 			slog.Error("failed to decode request", "error", err)
 			resp.Error = "invalid request"
@@ -76,13 +129,51 @@ func (e *EncryptionService) SessionTokenHandler() http.Handler {
 			http.Error(w, "invalid request", http.StatusBadRequest)
 			return
 		}
+		_, err = keyalg.ParseKey(request.Alg, []byte(request.PublicKey))
+		if err != nil {
+			slog.Error("invalid public key for algorithm", "alg", request.Alg, "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			resp.Error = "public key does not match algorithm"
+			enc.Encode(resp)
+			return
+		}
+		err = validateScopes(request.Scopes)
+		if err != nil {
+			slog.Error("invalid session token scopes", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			resp.Error = err.Error()
+			enc.Encode(resp)
+			return
+		}
+		if e.ProofOfPossession != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			err = e.ProofOfPossession.verify(w, r, request)
+			if err != nil {
+				slog.Error("failed to verify proof of possession", "key_id", request.KeyID, "username", request.UserInfo.Username, "error", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				resp.Error = "request must be signed with the registered key"
+				enc.Encode(resp)
+				return
+			}
+		}
+
+		attrs, err := newTokenAttributes(*user, e.TokenLifetime)
+		if err != nil {
+			slog.Error("failed to create token attributes", "error", err)
+			resp.Error = "internal server error"
+			enc.Encode(resp)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		attrs.ProofOfPossession = e.ProofOfPossession != nil
+		attrs.Scopes = request.Scopes
 
 		sessionToken, err := e.encrypter.EncryptPublicKey(
-			r.Context(),
+			e.bindingContext(r.Context()),
 			request.KeyID,
 			request.Alg,
 			[]byte(request.PublicKey),
-			request.UserInfo,
+			attrs,
 		)
 		if err != nil {
 			slog.Error("failed to encrypt public key", "error", err)
@@ -92,6 +183,8 @@ func (e *EncryptionService) SessionTokenHandler() http.Handler {
 			return
 		}
 		resp.SessionToken = sessionToken
+		resp.TokenID = attrs.TokenID
+		resp.ExpiresAt = attrs.expiresAt()
 		err = enc.Encode(resp)
 		if err != nil {
 			slog.Error("failed to encode response", "error", err)
@@ -99,36 +192,68 @@ func (e *EncryptionService) SessionTokenHandler() http.Handler {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		slog.Info("Created session token", "method", r.Method, "url", r.URL.String(), "remote_addr", r.RemoteAddr)
+		slog.Info("Created session token", "method", r.Method, "url", r.URL.String(), "remote_addr", r.RemoteAddr, "token_id", attrs.TokenID, "username", user.Username)
 	})
 }
 
+// NewDecryptionService returns a DecryptionService that reads session tokens
+// from the sessionTokenName header, "x-session-token" if empty. Set
+// TokenSource to read them from elsewhere.
 func NewDecryptionService(decrypter Decrypter, sessionTokenName string) *DecryptionService {
 	if sessionTokenName == "" {
 		sessionTokenName = "x-session-token"
 	}
 	return &DecryptionService{
-		decrypter:        decrypter,
-		SessionTokenName: sessionTokenName,
+		decrypter:   decrypter,
+		TokenSource: HeaderTokenSource{Name: sessionTokenName},
 	}
 }
 
-type sessionTokenContextKey struct{}
-
+// DecryptionService is a RequestKeyDirectory that returns the key in a
+// request's session token. Wrap it with a RequestKeyDirectoryAdapter to use
+// it as a verifier.KeyDirectory.
 type DecryptionService struct {
-	decrypter        Decrypter
-	SessionTokenName string
+	decrypter Decrypter
+
+	// TokenSource is where the session token is read from in the request
+	TokenSource TokenSource
+
+	// Tag is the tag of the signature being verified, and should match the
+	// verifier's. The session token must be among the signature's covered
+	// components. If empty, every signature on the request must cover it.
+	Tag string
+
+	// RevocationStore, if set, is checked for every session token
+	RevocationStore RevocationStore
+
+	// Audience and Purpose must match those of the EncryptionService that
+	// issued a session token, or the token fails to decrypt
+	Audience string
+	Purpose  string
+}
+
+var _ RequestKeyDirectory = &DecryptionService{}
+
+// decrypt decrypts the session token with the service's audience and purpose
+func (d *DecryptionService) decrypt(ctx context.Context, token []byte) (keyID, alg string, publicKey []byte, attributes any, err error) {
+	binding := Binding{Audience: d.Audience, Purpose: d.Purpose}
+	keyID, alg, publicKey, attributes, err = d.decrypter.DecryptPublicKey(WithBinding(ctx, binding), token)
+	if errors.Is(err, ErrBindingMismatch) && !binding.IsZero() {
+		err = fmt.Errorf("session token is not valid for audience %q: %w", d.Audience, err)
+	}
+	return keyID, alg, publicKey, attributes, err
 }
 
-func (d *DecryptionService) Attributes(ctx context.Context) any {
-	tok := ctx.Value(sessionTokenContextKey{})
-	tokBytes, ok := tok.([]byte)
-	if !ok {
-		slog.Error("invalid session token", "session_token", tok, "type", fmt.Sprintf("%T", tok))
+// Attributes returns the attributes in the request's session token, or nil
+// if the request has no valid session token
+func (d *DecryptionService) Attributes(r *http.Request) any {
+	tok, err := d.TokenSource.Token(r)
+	if err != nil {
+		slog.Error("invalid session token", "error", err)
 		return nil
 	}
 
-	_, _, _, attributes, err := d.decrypter.DecryptPublicKey(ctx, tokBytes)
+	_, _, _, attributes, err := d.decrypt(r.Context(), tok)
 	if err != nil {
 		slog.Error("failed to decrypt session token", "error", err)
 		return nil
@@ -136,30 +261,69 @@ func (d *DecryptionService) Attributes(ctx context.Context) any {
 	return attributes
 }
 
-func (d *DecryptionService) GetSessionTokenDecryptingMiddleware() func(next http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		fn := func(w http.ResponseWriter, r *http.Request) {
-			ctx := context.WithValue(r.Context(), sessionTokenContextKey{}, r.Header.Get(d.SessionTokenName))
-			next.ServeHTTP(w, r.WithContext(ctx))
+// checkTokenCovered returns an error if the session token isn't covered by
+// the request's signature
+func (d *DecryptionService) checkTokenCovered(r *http.Request) error {
+	component := d.TokenSource.CoveredComponent()
+	set, err := sigset.Unmarshal(r)
+	if err != nil {
+		return err
+	}
+	messages := []*signature.Message{}
+	if d.Tag != "" {
+		msg, err := set.Find(d.Tag)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, msg)
+	} else {
+		for _, msg := range set.Messages {
+			messages = append(messages, msg)
+		}
+	}
+	if len(messages) == 0 {
+		return fmt.Errorf("no signature on request")
+	}
+	for _, msg := range messages {
+		if !slices.Contains(msg.Input.CoveredComponents, component) {
+			return fmt.Errorf("session token component %q is not covered by the signature", component)
 		}
-		return http.HandlerFunc(fn)
 	}
+	return nil
 }
 
-func (s *DecryptionService) GetKey(ctx context.Context, kid string, clientSpecifiedAlg string) (verifier.Algorithm, error) {
-	sessionTokenRaw := ctx.Value(sessionTokenContextKey{})
-	var sessionTokenBytes []byte
-	switch v := sessionTokenRaw.(type) {
-	case string:
-		sessionTokenBytes = []byte(v)
-	case []byte:
-		sessionTokenBytes = v
-	default:
-		slog.Error("invalid session token", "session_token", sessionTokenRaw, "type", fmt.Sprintf("%T", sessionTokenRaw))
-		return nil, fmt.Errorf("invalid session token")
+func (s *DecryptionService) GetRequestKey(r *http.Request, kid string, clientSpecifiedAlg string) (verifier.Algorithm, error) {
+	tok, err := s.requestToken(r, kid, clientSpecifiedAlg, 0)
+	if err != nil {
+		return nil, err
+	}
+	return keyalg.NewVerifier(tok.alg, tok.publicKey, tok.rawAttributes)
+}
+
+// requestToken is a decrypted session token from a request
+type requestToken struct {
+	keyID         string
+	alg           string
+	publicKey     []byte
+	rawAttributes any
+	attributes    *TokenAttributes
+}
+
+// requestToken reads and decrypts the request's session token, and checks
+// that it is for the signing key, unexpired, and not revoked. Tokens that
+// expired within grace are accepted, for refreshing.
+func (s *DecryptionService) requestToken(r *http.Request, kid, clientSpecifiedAlg string, grace time.Duration) (*requestToken, error) {
+	ctx := r.Context()
+	sessionTokenBytes, err := s.TokenSource.Token(r)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkTokenCovered(r)
+	if err != nil {
+		return nil, err
 	}
 
-	keyID, alg, publicKey, attributes, err := s.decrypter.DecryptPublicKey(ctx, sessionTokenBytes)
+	keyID, alg, publicKey, attributes, err := s.decrypt(ctx, sessionTokenBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -169,65 +333,30 @@ func (s *DecryptionService) GetKey(ctx context.Context, kid string, clientSpecif
 	if alg != clientSpecifiedAlg {
 		return nil, fmt.Errorf("invalid algorithm")
 	}
-
-	switch alg {
-	case "rsa-pss-sha512":
-		block, _ := pem.Decode(publicKey)
-		if block == nil {
-			return nil, fmt.Errorf("failed to decode PEM block containing public key")
-		}
-		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse DER encoded public key: %w", err)
-		}
-
-		kP, ok := pub.(*rsa.PublicKey)
-		if !ok {
-			return nil, fmt.Errorf("invalid RSA public key")
-		}
-		return &alg_rsa.RSAPSS512{
-			PublicKey: kP,
-			Attrs:     attributes,
-		}, nil
-	case "rsa-v1_5-sha256":
-		block, _ := pem.Decode(publicKey)
-		if block == nil {
-			return nil, fmt.Errorf("failed to decode PEM block containing public key")
-		}
-		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse DER encoded public key: %w", err)
-		}
-
-		kP, ok := pub.(*rsa.PublicKey)
-		if !ok {
-			return nil, fmt.Errorf("invalid RSA public key")
-		}
-		return &alg_rsa.RSAPKCS256{
-			PublicKey: kP,
-			Attrs:     attributes,
-		}, nil
-	case "ecdsa-p256-sha256":
-		block, _ := pem.Decode(publicKey)
-		if block == nil {
-			return nil, fmt.Errorf("failed to decode PEM block containing public key")
-		}
-		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	attrs, err := ParseTokenAttributes(attributes)
+	if err != nil {
+		return nil, err
+	}
+	if attrs.expired(time.Now(), grace) {
+		slog.Info("rejected expired session token", "token_id", attrs.TokenID, "username", attrs.Username, "expires_at", attrs.ExpiresAt)
+		return nil, fmt.Errorf("session token expired at %s", attrs.ExpiresAt.Format(time.RFC3339))
+	}
+	if s.RevocationStore != nil {
+		revoked, err := s.RevocationStore.IsRevoked(ctx, attrs)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse DER encoded public key: %w", err)
+			return nil, fmt.Errorf("failed to check session token revocation: %w", err)
 		}
-
-		kP, ok := pub.(*ecdsa.PublicKey)
-		if !ok {
-			return nil, fmt.Errorf("invalid ECDSA public key")
+		if revoked {
+			slog.Info("rejected revoked session token", "token_id", attrs.TokenID, "username", attrs.Username)
+			return nil, fmt.Errorf("session token has been revoked")
 		}
-		return &alg_ecdsa.P256{
-			PublicKey: kP,
-			Attrs:     attributes,
-		}, nil
-	case "hmac-sha256":
-		return alg_hmac.NewHMACWithAttributes(publicKey, attributes), nil
-	default:
-		return nil, fmt.Errorf("unsupported algorithm")
 	}
+
+	return &requestToken{
+		keyID:         keyID,
+		alg:           alg,
+		publicKey:     publicKey,
+		rawAttributes: attributes,
+		attributes:    attrs,
+	}, nil
 }
@@ -0,0 +1,150 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/alg_ecdsa"
+	"github.com/common-fate/httpsig/inmemory"
+)
+
+// staticEncrypter returns the key ID as the session token, and records the
+// public key and attributes of the last token
+type staticEncrypter struct {
+	publicKey  []byte
+	attributes any
+}
+
+func (e *staticEncrypter) EncryptPublicKey(ctx context.Context, keyID, alg string, publicKey []byte, attributes any) ([]byte, error) {
+	e.publicKey = publicKey
+	e.attributes = attributes
+	return []byte(keyID), nil
+}
+
+func TestSessionTokenHandlerChecksAlgorithm(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	cases := []struct {
+		alg        string
+		wantStatus int
+	}{
+		{"ecdsa-p256-sha256", http.StatusOK},
+		{"ecdsa-p384-sha384", http.StatusBadRequest},
+		{"rsa-pss-sha512", http.StatusBadRequest},
+		{"ed25519", http.StatusBadRequest},
+		{"unknown", http.StatusBadRequest},
+	}
+	svc := NewEncryptionService(&staticEncrypter{})
+	svc.Authenticator = staticAuthenticator{Username: "alice"}
+	handler := svc.SessionTokenHandler()
+	for _, tc := range cases {
+		t.Run(tc.alg, func(t *testing.T) {
+			body, err := json.Marshal(&EncryptionRequest{KeyID: "kid-1", Alg: tc.alg, PublicKey: pemKey})
+			if err != nil {
+				t.Fatalf("failed to marshal request: %v", err)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/session-token", bytes.NewReader(body)))
+			if w.Code != tc.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", tc.wantStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestSessionTokenHandlerProofOfPossession(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	encrypter := &staticEncrypter{}
+	svc := NewEncryptionService(encrypter)
+	svc.Authenticator = staticAuthenticator{Username: "alice"}
+	server := httptest.NewServer(svc.SessionTokenHandler())
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+	svc.ProofOfPossession = &ProofOfPossession{
+		Scheme:       "http",
+		Authority:    serverURL.Host,
+		NonceStorage: inmemory.NewNonceStorage(),
+	}
+
+	signedClient := func(kid string, signingKey *ecdsa.PrivateKey) *http.Client {
+		return httpsig.NewClient(httpsig.ClientOpts{
+			KeyID: kid,
+			Tag:   ProofOfPossessionTag,
+			Alg:   alg_ecdsa.NewP256Signer(signingKey),
+		})
+	}
+	cases := []struct {
+		name       string
+		client     *http.Client
+		wantStatus int
+	}{
+		{"signed with registered key", signedClient("kid-1", key), http.StatusOK},
+		{"signed with another key", signedClient("kid-1", otherKey), http.StatusUnauthorized},
+		{"signed with another key id", signedClient("kid-2", key), http.StatusUnauthorized},
+		{"unsigned", http.DefaultClient, http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			encrypter.attributes = nil
+			body, err := json.Marshal(&EncryptionRequest{
+				KeyID:     "kid-1",
+				Alg:       "ecdsa-p256-sha256",
+				PublicKey: pemKey,
+				UserInfo:  User{Username: "alice"},
+			})
+			if err != nil {
+				t.Fatalf("failed to marshal request: %v", err)
+			}
+			resp, err := tc.client.Post(server.URL+"/session-token", "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("failed to post: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("expected status %d, got %d", tc.wantStatus, resp.StatusCode)
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+			attrs, ok := encrypter.attributes.(*TokenAttributes)
+			if !ok || !attrs.ProofOfPossession {
+				t.Errorf("expected token to record proof of possession, got %#v", encrypter.attributes)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+/*
+Package streamdigest computes and verifies RFC 9530 Content-Digest fields
+without holding bodies in memory.
+
+The common-fate/httpsig library derives the `content-digest` component by
+reading the whole body into memory, on both the client and the server. This
+package instead hashes bodies as they stream: a client digests a body it can
+replay, or spools it to a temp file, and a server spools the body to a temp
+file with Verify, only passing it on once it matches its digest, so a handler
+never reads, or proxies, content that doesn't match. A
+Digest's Digester lets the library sign and verify the `content-digest`
+component from the streamed digest, without reading the body again.
+
+Clients choose the algorithm from the server's Want-Content-Digest field.
+*/
+package streamdigest
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/common-fate/httpsig/contentdigest"
+	"github.com/dunglas/httpsfv"
+)
+
+// SHA256 and SHA512 are the supported digest algorithms
+const (
+	SHA256 = "sha-256"
+	SHA512 = "sha-512"
+)
+
+// algorithms are the supported digest algorithms, by their key
+var algorithms = map[string]func() hash.Hash{
+	SHA256: sha256.New,
+	SHA512: sha512.New,
+}
+
+// ErrMismatch is returned when content doesn't match its digest
+var ErrMismatch = errors.New("content doesn't match its digest")
+
+// Supported returns true if the algorithm is supported
+func Supported(alg string) bool {
+	_, ok := algorithms[alg]
+	return ok
+}
+
+// Digest is the digest of content with an algorithm
+type Digest struct {
+	Algorithm string
+	Sum       []byte
+}
+
+// String returns the digest as a Content-Digest field value, such as
+// `sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:`
+func (d Digest) String() string {
+	dict := httpsfv.NewDictionary()
+	dict.Add(d.Algorithm, httpsfv.NewItem(d.Sum))
+	s, err := httpsfv.Marshal(dict)
+	if err != nil {
+		return d.Algorithm + "=:" + base64.StdEncoding.EncodeToString(d.Sum) + ":"
+	}
+	return s
+}
+
+// Digester returns a contentdigest.Digester that returns the digest without
+// reading the body. Use it to sign or verify a request's `content-digest`
+// component when its body has been, or will be, digested as it streams,
+// with the body hidden from the signer or verifier.
+func (d Digest) Digester() contentdigest.Digester {
+	return contentdigest.Digester{
+		Key:      d.Algorithm,
+		HashFunc: func() hash.Hash { return fixedHash(d.Sum) },
+	}
+}
+
+// Compute digests the content read from r with the algorithm, and returns
+// the number of bytes read
+func Compute(r io.Reader, alg string) (Digest, int64, error) {
+	newHash, ok := algorithms[alg]
+	if !ok {
+		return Digest{}, 0, fmt.Errorf("unsupported digest algorithm %q", alg)
+	}
+	h := newHash()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return Digest{}, n, err
+	}
+	return Digest{Algorithm: alg, Sum: h.Sum(nil)}, n, nil
+}
+
+// Parse returns the supported digests in the values of a Content-Digest
+// field, in order
+func Parse(values []string) ([]Digest, error) {
+	dict, err := httpsfv.UnmarshalDictionary(values)
+	if err != nil {
+		return nil, fmt.Errorf("Content-Digest header is malformed: %w", err)
+	}
+	digests := []Digest{}
+	for _, alg := range dict.Names() {
+		if !Supported(alg) {
+			continue
+		}
+		member, _ := dict.Get(alg)
+		item, ok := member.(httpsfv.Item)
+		if !ok {
+			return nil, fmt.Errorf("content digest %q is not an item", alg)
+		}
+		sum, ok := item.Value.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("content digest %q is not a byte sequence", alg)
+		}
+		digests = append(digests, Digest{Algorithm: alg, Sum: sum})
+	}
+	return digests, nil
+}
+
+// Want returns a Want-Content-Digest field value preferring the algorithms
+// in order, such as `sha-512=2, sha-256=1`
+func Want(algs ...string) string {
+	dict := httpsfv.NewDictionary()
+	for i, alg := range algs {
+		dict.Add(alg, httpsfv.NewItem(int64(len(algs)-i)))
+	}
+	s, _ := httpsfv.Marshal(dict)
+	return s
+}
+
+// Preferred returns the supported algorithm a Want-Content-Digest field
+// prefers most, or false if it doesn't want any supported algorithm
+func Preferred(values []string) (string, bool) {
+	dict, err := httpsfv.UnmarshalDictionary(values)
+	if err != nil {
+		return "", false
+	}
+	best, bestWeight := "", int64(0)
+	for _, alg := range dict.Names() {
+		member, _ := dict.Get(alg)
+		item, ok := member.(httpsfv.Item)
+		if !ok || !Supported(alg) {
+			continue
+		}
+		weight, ok := item.Value.(int64)
+		if !ok {
+			continue
+		}
+		// a weight of 0 means the algorithm isn't acceptable
+		if weight > bestWeight {
+			best, bestWeight = alg, weight
+		}
+	}
+	return best, best != ""
+}
+
+// ErrTooLarge is returned when content is longer than Spool's limit
+var ErrTooLarge = errors.New("content is too large to spool")
+
+// Spool copies the content read from r to a temp file as it digests it with
+// the algorithm, and returns the file, rewound, which is removed when it is
+// closed, along with the digest and the number of bytes read. If max is
+// positive, content longer than max bytes fails with ErrTooLarge.
+func Spool(r io.Reader, alg string, max int64) (io.ReadCloser, Digest, int64, error) {
+	if !Supported(alg) {
+		return nil, Digest{}, 0, fmt.Errorf("unsupported digest algorithm %q", alg)
+	}
+	f, err := os.CreateTemp("", "httpsig-body-")
+	if err != nil {
+		return nil, Digest{}, 0, err
+	}
+	spooled := &spooledBody{File: f}
+	if max > 0 {
+		r = io.LimitReader(r, max+1)
+	}
+	d, n, err := Compute(io.TeeReader(r, f), alg)
+	if err == nil && max > 0 && n > max {
+		err = ErrTooLarge
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spooled.Close()
+		return nil, d, n, err
+	}
+	return spooled, d, n, nil
+}
+
+// Verify spools the content read from r like Spool, and returns an error
+// wrapping ErrMismatch, without any of the content, if it doesn't match the
+// digest. Nothing is read from the returned file before the whole content
+// is checked.
+func Verify(r io.Reader, d Digest, max int64) (io.ReadCloser, error) {
+	spooled, got, _, err := Spool(r, d.Algorithm, max)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(got.Sum, d.Sum) != 1 {
+		spooled.Close()
+		return nil, fmt.Errorf("%w: %s", ErrMismatch, d.Algorithm)
+	}
+	return spooled, nil
+}
+
+// spooledBody is content spooled to a temp file
+type spooledBody struct {
+	*os.File
+}
+
+func (b *spooledBody) Close() error {
+	err := b.File.Close()
+	os.Remove(b.File.Name())
+	return err
+}
+
+// fixedHash is a hash.Hash that ignores its input, and sums to itself
+type fixedHash []byte
+
+func (h fixedHash) Write(p []byte) (int, error) { return len(p), nil }
+func (h fixedHash) Sum(b []byte) []byte         { return append(b, h...) }
+func (h fixedHash) Reset()                      {}
+func (h fixedHash) Size() int                   { return len(h) }
+func (h fixedHash) BlockSize() int              { return 1 }
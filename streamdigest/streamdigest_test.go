@@ -0,0 +1,136 @@
+package streamdigest
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompute(t *testing.T) {
+	cases := []struct {
+		alg     string
+		want    string
+		wantErr bool
+	}{
+		{alg: SHA256, want: `sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:`},
+		{alg: SHA512, want: `sha-512=:WZDPaVn/7XgHaAy8pmojAkGWoRx2UFChF41A2svX+TaPm+AbwAgBWnrIiYllu7BNNyealdVLvRwEmTHWXvJwew==:`},
+		{alg: "md5", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.alg, func(t *testing.T) {
+			d, n, err := Compute(strings.NewReader(`{"hello": "world"}`), tc.alg)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to compute digest: %v", err)
+			}
+			if n != 18 {
+				t.Errorf("expected 18 bytes, got %d", n)
+			}
+			if got := d.String(); got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	digests, err := Parse([]string{`md5=:AAAA:, sha-512=:AAAA:`, `sha-256=:BBBB:`})
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if len(digests) != 2 || digests[0].Algorithm != SHA512 || digests[1].Algorithm != SHA256 {
+		t.Errorf("expected sha-512 and sha-256 digests, got %v", digests)
+	}
+	if _, err := Parse([]string{`sha-256=1`}); err == nil {
+		t.Error("expected error for a digest that isn't a byte sequence, got none")
+	}
+}
+
+func TestPreferred(t *testing.T) {
+	cases := []struct {
+		value  string
+		want   string
+		wantOK bool
+	}{
+		{value: Want(SHA512, SHA256), want: SHA512, wantOK: true},
+		{value: `sha-256=3, sha-512=10`, want: SHA512, wantOK: true},
+		{value: `sha-512=0, sha-256=1, md5=5`, want: SHA256, wantOK: true},
+		{value: `md5=1`},
+		{value: `sha-256=:AAAA:`},
+	}
+	for _, tc := range cases {
+		got, ok := Preferred([]string{tc.value})
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("%s: expected %q %t, got %q %t", tc.value, tc.want, tc.wantOK, got, ok)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	d, _, err := Compute(strings.NewReader("hello"), SHA256)
+	if err != nil {
+		t.Fatalf("failed to compute digest: %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		content string
+		max     int64
+		wantErr error
+	}{
+		{name: "matching", content: "hello"},
+		{name: "matching within limit", content: "hello", max: 5},
+		{name: "mismatch", content: "jello", wantErr: ErrMismatch},
+		{name: "too large", content: "hello", max: 4, wantErr: ErrTooLarge},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := Verify(strings.NewReader(tc.content), d, tc.max)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("expected %v, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to verify: %v", err)
+			}
+			defer r.Close()
+			body, err := io.ReadAll(r)
+			if err != nil || string(body) != tc.content {
+				t.Errorf("expected %q, got %q: %v", tc.content, body, err)
+			}
+		})
+	}
+}
+
+func TestSpoolRemovesFile(t *testing.T) {
+	r, d, n, err := Spool(strings.NewReader("hello"), SHA256, 0)
+	if err != nil {
+		t.Fatalf("failed to spool: %v", err)
+	}
+	if n != 5 || d.String() != `sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:` {
+		t.Errorf("unexpected digest %s of %d bytes", d, n)
+	}
+	name := r.(*spooledBody).Name()
+	r.Close()
+	if _, err := os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected spooled file to be removed, got %v", err)
+	}
+}
+
+func TestDigester(t *testing.T) {
+	d := Digest{Algorithm: SHA256, Sum: []byte{1, 2, 3}}
+	h := d.Digester().HashFunc()
+	h.Write([]byte("ignored"))
+	if got := string(h.Sum(nil)); got != "\x01\x02\x03" {
+		t.Errorf("expected the fixed sum, got %x", got)
+	}
+}
@@ -0,0 +1,203 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/alg_hmac"
+	"github.com/common-fate/httpsig/inmemory"
+	"github.com/micahhausler/httpsig-scratch/routeverify"
+)
+
+func TestBuilderAcceptSignature(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	server := httptest.NewUnstartedServer(nil)
+	serverURL, err := url.Parse("http://" + server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+	middleware, err := routeverify.Middleware(routeverify.Opts{
+		NonceStorage: inmemory.NewNonceStorage(),
+		KeyDirectory: hmacKeyDirectory{secret: secret},
+		Tag:          "foo",
+		Scheme:       "http",
+		Authority:    serverURL.Host,
+		Routes: []routeverify.Route{
+			{Pattern: "GET /", RequiredComponents: []string{"@method", "@target-uri"}},
+			{Pattern: "/", RequiredComponents: []string{"@method", "@target-uri", "content-length", "content-digest"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	attempts := 0
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(body)
+		})).ServeHTTP(w, r)
+	})
+	server.Start()
+	defer server.Close()
+
+	newClient := func(acceptSignature bool) *http.Client {
+		return (&Builder{
+			CoveredComponents: StaticComponents{"@method", "@target-uri"},
+			AcceptSignature:   acceptSignature,
+			Signing: &httpsig.ClientOpts{
+				KeyID: "kid-1",
+				Tag:   "foo",
+				Alg:   alg_hmac.NewHMAC(secret),
+			},
+		}).Client()
+	}
+
+	cases := []struct {
+		name            string
+		acceptSignature bool
+		body            io.Reader
+		wantStatus      int
+		wantAttempts    int
+	}{
+		{
+			name:            "retries with the requested signature",
+			acceptSignature: true,
+			body:            strings.NewReader("hello"),
+			wantStatus:      http.StatusOK,
+			wantAttempts:    2,
+		},
+		{
+			name:         "disabled",
+			body:         strings.NewReader("hello"),
+			wantStatus:   http.StatusUnauthorized,
+			wantAttempts: 1,
+		},
+		{
+			name:            "body can't be replayed",
+			acceptSignature: true,
+			body:            io.MultiReader(strings.NewReader("hello")),
+			wantStatus:      http.StatusUnauthorized,
+			wantAttempts:    1,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts = 0
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, server.URL, tc.body)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			res, err := newClient(tc.acceptSignature).Do(req)
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			if res.StatusCode != tc.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", tc.wantStatus, res.StatusCode, body)
+			}
+			if res.StatusCode == http.StatusOK && string(body) != "hello" {
+				t.Errorf("expected the body to be replayed, got %q", body)
+			}
+			if attempts != tc.wantAttempts {
+				t.Errorf("expected %d attempts, got %d", tc.wantAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestBuilderAcceptSignatureDowngrade(t *testing.T) {
+	// the server rejects the first attempt with the Accept-Signature field,
+	// and records the Signature-Input of each attempt
+	var acceptSignature string
+	var inputs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inputs = append(inputs, r.Header.Get("Signature-Input"))
+		if len(inputs) == 1 {
+			w.Header().Set("Accept-Signature", acceptSignature)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := (&Builder{
+		CoveredComponents: StaticComponents{"@method", "@target-uri", "authorization"},
+		AcceptSignature:   true,
+		AcceptTags:        []string{"bar"},
+		Signing: &httpsig.ClientOpts{
+			KeyID: "kid-1",
+			Tag:   "foo",
+			Alg:   alg_hmac.NewHMAC([]byte("0123456789abcdef0123456789abcdef")),
+		},
+	}).Client()
+
+	cases := []struct {
+		name            string
+		acceptSignature string
+		wantStatus      int
+		wantInput       []string
+	}{
+		{
+			name:            "components are added, not replaced",
+			acceptSignature: `sig1=("@method" "@authority");tag="foo"`,
+			wantStatus:      http.StatusOK,
+			wantInput:       []string{`("@method" "@target-uri" "authorization" "@authority")`, `tag="foo"`},
+		},
+		{
+			name:            "allowed tag",
+			acceptSignature: `sig1=("@method");tag="bar"`,
+			wantStatus:      http.StatusOK,
+			wantInput:       []string{`("@method" "@target-uri" "authorization")`, `tag="bar"`},
+		},
+		{
+			name:            "tag the caller doesn't allow",
+			acceptSignature: `sig1=("@method");tag="baz"`,
+			wantStatus:      http.StatusUnauthorized,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			acceptSignature, inputs = tc.acceptSignature, nil
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			req.Header.Set("Authorization", "Bearer token")
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tc.wantStatus {
+				t.Fatalf("expected status %d, got %d", tc.wantStatus, res.StatusCode)
+			}
+			if tc.wantStatus != http.StatusOK {
+				if len(inputs) != 1 {
+					t.Errorf("expected 1 attempt, got %d", len(inputs))
+				}
+				return
+			}
+			if len(inputs) != 2 {
+				t.Fatalf("expected 2 attempts, got %d", len(inputs))
+			}
+			for _, want := range tc.wantInput {
+				if !strings.Contains(inputs[1], want) {
+					t.Errorf("expected the retry's Signature-Input to contain %s, got %s", want, inputs[1])
+				}
+			}
+		})
+	}
+}
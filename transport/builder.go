@@ -0,0 +1,475 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/contentdigest"
+	"github.com/common-fate/httpsig/sigbase"
+	"github.com/common-fate/httpsig/signature"
+	"github.com/common-fate/httpsig/signer"
+	"github.com/common-fate/httpsig/sigparams"
+	"github.com/common-fate/httpsig/sigset"
+	"github.com/micahhausler/httpsig-scratch/acceptsig"
+	"github.com/micahhausler/httpsig-scratch/streamdigest"
+)
+
+// HeaderFunc returns headers to set on a request, such as a session token
+// that can change between requests. It must not modify the request.
+type HeaderFunc func(req *http.Request) (http.Header, error)
+
+// Builder composes a signing http.RoundTripper. However it is configured,
+// each request goes through the same steps in order:
+//
+//  1. FallbackHeaders are added if the request doesn't set them
+//  2. Headers, then the headers from each HeaderFunc, are set, replacing
+//     any the request sets
+//  3. the Content-Digest header is set, if ContentDigest is true
+//  4. the request is signed, if Signing is set, covering the components
+//     CoveredComponents chooses for the request as it is now, and created
+//     at the server's time as far as ClockSkew has measured it
+//  5. if AcceptSignature is true and the server responds 401 Unauthorized
+//     with an Accept-Signature field, the steps are repeated once, signing
+//     the request with the components the server adds, and the tag it asks
+//     for if AcceptTags allows it
+//  6. if Retry is set and the request fails, the steps are repeated after a
+//     backoff
+//
+// so every header a signature covers is in place before it is signed. The
+// caller's request is never modified, as the http.RoundTripper contract
+// requires: the steps work on a clone.
+type Builder struct {
+	// Base sends the request once it is signed. If nil,
+	// http.DefaultTransport is used.
+	Base http.RoundTripper
+
+	// FallbackHeaders are added to requests that don't already set them.
+	// This is useful to ensure a signed header like `Content-Type` is set
+	// on all requests, including GETs.
+	FallbackHeaders http.Header
+
+	// Headers are set on every request
+	Headers http.Header
+
+	// HeaderFuncs return headers to set on each request
+	HeaderFuncs []HeaderFunc
+
+	// ContentDigest sets the RFC 9530 Content-Digest header from the body,
+	// and signs that digest. The body is digested as it streams from
+	// GetBody, or spooled to a temp file if it can't be replayed, rather
+	// than read into memory.
+	ContentDigest bool
+
+	// DigestAlgorithm is the Content-Digest algorithm, `sha-256` or
+	// `sha-512`. Defaults to the signing algorithm's, or `sha-256`. Once a
+	// server sends a Want-Content-Digest field, the algorithm it prefers is
+	// used instead.
+	DigestAlgorithm string
+
+	// Signing signs requests with HTTP message signatures. If nil,
+	// requests aren't signed. CoveredComponents defaults to
+	// httpsig.DefaultCoveredComponents().
+	Signing *httpsig.ClientOpts
+
+	// CoveredComponents, if set, chooses the components each request's
+	// signature covers, instead of Signing.CoveredComponents
+	CoveredComponents CoveredComponentPolicy
+
+	// AcceptSignature retries a request once if the server rejects it with
+	// an Accept-Signature field the signer can satisfy, covering the
+	// components it asks for as well as those the request was signed with,
+	// and using the nonce it asks for. The server can only ask for
+	// Signing.Tag, or one of AcceptTags. Requests with a body are only
+	// retried if GetBody can replay it.
+	AcceptSignature bool
+
+	// AcceptTags are the tags, besides Signing.Tag, a server's
+	// Accept-Signature field may ask the signature to have
+	AcceptTags []string
+
+	// Retry, if set, retries idempotent requests, and requests with an
+	// Idempotency-Key header, that fail with a network error or a 5xx
+	// response, and retries once on a 401 Unauthorized if the server's
+	// Date shows the local clock is off, after adjusting it. Each attempt is
+	// signed again with a fresh nonce and created time, since the server
+	// rejects a resent signature as a replay.
+	Retry *RetryPolicy
+
+	// ClockSkew, if set, tracks the server's clock from the Date field of
+	// each response, and signs requests with the local clock adjusted to
+	// it, so a drifting clock doesn't get signatures rejected
+	ClockSkew *ClockSkewOpts
+
+	// Expires, if set, adds an expires parameter to signatures, this long
+	// after their created time
+	Expires time.Duration
+}
+
+// Build returns the composed http.RoundTripper
+func (b *Builder) Build() http.RoundTripper {
+	return b.Wrap(b.Base)
+}
+
+// Wrap returns the composed http.RoundTripper sending requests with base
+// instead of the Builder's Base. It can be used as a client-go
+// rest.Config's WrapTransport, to sign requests after client-go has set up
+// TLS.
+func (b *Builder) Wrap(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &builtTransport{
+		base:            base,
+		fallbackHeaders: b.FallbackHeaders.Clone(),
+		headers:         b.Headers.Clone(),
+		headerFuncs:     append([]HeaderFunc(nil), b.HeaderFuncs...),
+		clock:           &clock{},
+	}
+	if b.Retry != nil {
+		retry := b.Retry.withDefaults()
+		t.retry = &retry
+	}
+	if b.ClockSkew != nil {
+		clockSkew := b.ClockSkew.withDefaults()
+		t.clockSkew = &clockSkew
+	}
+	if b.ContentDigest {
+		t.digestAlgorithm = b.DigestAlgorithm
+		if t.digestAlgorithm == "" && b.Signing != nil && b.Signing.Alg != nil {
+			t.digestAlgorithm = b.Signing.Alg.ContentDigest().Key
+		}
+		if !streamdigest.Supported(t.digestAlgorithm) {
+			t.digestAlgorithm = streamdigest.SHA256
+		}
+		t.wantDigest = &atomic.Pointer[string]{}
+	}
+	if b.Signing != nil {
+		coveredComponents := b.Signing.CoveredComponents
+		if coveredComponents == nil {
+			coveredComponents = httpsig.DefaultCoveredComponents()
+		}
+		t.signer = &signer.Transport{
+			KeyID:                 b.Signing.KeyID,
+			Tag:                   b.Signing.Tag,
+			Alg:                   b.Signing.Alg,
+			CoveredComponents:     coveredComponents,
+			OnDeriveSigningString: b.Signing.OnDeriveSigningString,
+			BaseTransport:         base,
+		}
+		t.coveredComponents = b.CoveredComponents
+		t.acceptSignature = b.AcceptSignature
+		t.acceptTags = append([]string(nil), b.AcceptTags...)
+		t.expires = b.Expires
+	}
+	return t
+}
+
+// Client returns an http.Client using the composed http.RoundTripper
+func (b *Builder) Client() *http.Client {
+	return &http.Client{Transport: b.Build()}
+}
+
+type builtTransport struct {
+	base            http.RoundTripper
+	fallbackHeaders http.Header
+	headers         http.Header
+	headerFuncs     []HeaderFunc
+	digestAlgorithm string
+	signer          *signer.Transport
+
+	// wantDigest is the digest algorithm the server last asked for
+	wantDigest *atomic.Pointer[string]
+
+	coveredComponents CoveredComponentPolicy
+	acceptSignature   bool
+	acceptTags        []string
+	retry             *RetryPolicy
+	expires           time.Duration
+	clockSkew         *ClockSkewOpts
+
+	// clock is the local clock, adjusted to the server's
+	clock *clock
+}
+
+func (t *builtTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.retry != nil {
+		return t.roundTripRetrying(req)
+	}
+	return t.roundTrip(req)
+}
+
+// roundTrip sends the request once, and again if the server asks for
+// another signature
+func (t *builtTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	req2, digest, err := t.prepare(req)
+	if err != nil {
+		// the RoundTripper must close the body, even on errors
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	if t.signer == nil {
+		return t.exchange(req2)
+	}
+	s := *t.signer
+	if t.coveredComponents != nil {
+		s.CoveredComponents = t.coveredComponents.CoveredComponents(req2)
+	}
+	res, err := t.send(s, req2, digest)
+	if err != nil || !t.acceptSignature || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	return t.retryAccepted(s, req, res)
+}
+
+// send signs the request and sends it. If its body has been digested, the
+// signature covers that digest, rather than the signer reading the body
+// into memory to digest it again.
+func (t *builtTransport) send(s signer.Transport, req *http.Request, digest *streamdigest.Digest) (*http.Response, error) {
+	created := t.clock.now()
+	var expires time.Time
+	if t.expires > 0 {
+		expires = created.Add(t.expires)
+	}
+	err := sign(s, req, created, expires, digest)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.exchange(req)
+}
+
+// sign adds a signature to the request, as the signer would, but with the
+// created time, and the expires time if it isn't zero. If the body has been
+// digested, it is hidden from the signer, which derives the `content-digest`
+// component from the digest.
+func sign(s signer.Transport, req *http.Request, created, expires time.Time, digest *streamdigest.Digest) error {
+	if s.Alg == nil {
+		return errors.New("algorithm must not be nil")
+	}
+	set, err := sigset.Unmarshal(req)
+	if err != nil {
+		return err
+	}
+	nonce, err := newNonce(s)
+	if err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	alg, unread := s.Alg, req
+	if digest != nil {
+		alg = digestedAlgorithm{Algorithm: s.Alg, digester: digest.Digester()}
+		hidden := *req
+		hidden.Body = http.NoBody
+		unread = &hidden
+	}
+	params := sigparams.Params{
+		KeyID:             s.KeyID,
+		Tag:               s.Tag,
+		Alg:               s.Alg.Type(),
+		Created:           created,
+		Expires:           expires,
+		CoveredComponents: s.CoveredComponents,
+		Nonce:             nonce,
+	}
+	base, err := sigbase.Derive(params, nil, unread, alg.ContentDigest())
+	if err != nil {
+		return fmt.Errorf("failed to derive signature base: %w", err)
+	}
+	stringToSign, err := base.CanonicalString(params)
+	if err != nil {
+		return fmt.Errorf("failed to create string to sign: %w", err)
+	}
+	if s.OnDeriveSigningString != nil {
+		s.OnDeriveSigningString(req.Context(), stringToSign)
+	}
+	sig, err := alg.Sign(req.Context(), stringToSign)
+	if err != nil {
+		return fmt.Errorf("failed to sign request: %w", err)
+	}
+	set.Add(&signature.Message{Input: params, Signature: sig})
+	return set.Include(req)
+}
+
+// newNonce returns the signer's nonce, or a random one if it doesn't set
+// GetNonce
+func newNonce(s signer.Transport) (string, error) {
+	if s.GetNonce != nil {
+		return s.GetNonce()
+	}
+	return acceptsig.NewNonce()
+}
+
+// digestedAlgorithm is a signing algorithm with a precomputed content digest
+type digestedAlgorithm struct {
+	signer.Algorithm
+	digester contentdigest.Digester
+}
+
+func (a digestedAlgorithm) ContentDigest() contentdigest.Digester {
+	return a.digester
+}
+
+// exchange sends the request with the base transport, and records the
+// digest algorithm the server wants from the response's Want-Content-Digest
+// field, and the server's time from its Date field if ClockSkew is set
+func (t *builtTransport) exchange(req *http.Request) (*http.Response, error) {
+	sent := time.Now()
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if t.wantDigest != nil {
+		if alg, ok := streamdigest.Preferred(res.Header.Values("Want-Content-Digest")); ok {
+			t.wantDigest.Store(&alg)
+		}
+	}
+	if t.clockSkew != nil {
+		if offset, ok := serverOffset(res, sent, time.Now()); ok {
+			skew := t.clock.smooth(offset, t.clockSkew.Smoothing)
+			if t.clockSkew.OnSkew != nil {
+				t.clockSkew.OnSkew(skew)
+			}
+		}
+	}
+	return res, nil
+}
+
+// retryAccepted sends the request again, signed by s as the response's
+// Accept-Signature field asks. The server can add covered components, but
+// not remove those s covers, or ask for a tag the caller doesn't allow. If
+// the server didn't ask for a signature the signer can make, or the
+// request's body can't be replayed, the response is returned as is.
+func (t *builtTransport) retryAccepted(s signer.Transport, req *http.Request, res *http.Response) (*http.Response, error) {
+	requests, err := acceptsig.FromResponse(res)
+	if err != nil {
+		return res, nil
+	}
+	requests = slices.DeleteFunc(requests, func(r acceptsig.Request) bool {
+		return r.Tag != "" && r.Tag != s.Tag && !slices.Contains(t.acceptTags, r.Tag)
+	})
+	accepted, ok := acceptsig.Find(requests, s.KeyID, s.Alg.Type())
+	if !ok {
+		return res, nil
+	}
+	retry := req.Clone(req.Context())
+	if hasBody(req) {
+		if req.GetBody == nil {
+			return res, nil
+		}
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return res, nil
+		}
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+	res.Body.Close()
+
+	req2, digest, err := t.prepare(retry)
+	if err != nil {
+		if retry.Body != nil {
+			retry.Body.Close()
+		}
+		return nil, err
+	}
+	s.CoveredComponents = slices.Clone(s.CoveredComponents)
+	for _, component := range accepted.CoveredComponents {
+		if !slices.Contains(s.CoveredComponents, component) {
+			s.CoveredComponents = append(s.CoveredComponents, component)
+		}
+	}
+	if accepted.Tag != "" {
+		s.Tag = accepted.Tag
+	}
+	if accepted.Nonce != "" {
+		s.GetNonce = func() (string, error) { return accepted.Nonce, nil }
+	}
+	return t.send(s, req2, digest)
+}
+
+// prepare returns a clone of the request with the headers set, and the
+// digest of its body if ContentDigest is set
+func (t *builtTransport) prepare(req *http.Request) (*http.Request, *streamdigest.Digest, error) {
+	req2 := req.Clone(req.Context())
+	if req2.Header == nil {
+		req2.Header = http.Header{}
+	}
+	for key, values := range t.fallbackHeaders {
+		if _, ok := req2.Header[http.CanonicalHeaderKey(key)]; !ok {
+			req2.Header[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+		}
+	}
+	setHeaders(req2.Header, t.headers)
+	for _, fn := range t.headerFuncs {
+		headers, err := fn(req2)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get request headers: %w", err)
+		}
+		setHeaders(req2.Header, headers)
+	}
+	if t.wantDigest == nil {
+		return req2, nil, nil
+	}
+	alg := t.digestAlgorithm
+	if want := t.wantDigest.Load(); want != nil {
+		alg = *want
+	}
+	digest, err := setContentDigest(req2, alg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return req2, &digest, nil
+}
+
+// setHeaders replaces the header's values with those in set
+func setHeaders(header, set http.Header) {
+	for key, values := range set {
+		header[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+	}
+}
+
+// setContentDigest sets the request's Content-Digest header, and its
+// ContentLength if it was unknown. The body is digested from GetBody if it
+// can be replayed, or else spooled to a temp file that replaces it.
+func setContentDigest(req *http.Request, alg string) (streamdigest.Digest, error) {
+	var (
+		digest streamdigest.Digest
+		n      int64
+		err    error
+	)
+	switch {
+	case !hasBody(req):
+		digest, n, err = streamdigest.Compute(http.NoBody, alg)
+	case req.GetBody != nil:
+		var body io.ReadCloser
+		body, err = req.GetBody()
+		if err != nil {
+			return digest, fmt.Errorf("failed to replay request body: %w", err)
+		}
+		digest, n, err = streamdigest.Compute(body, alg)
+		body.Close()
+	default:
+		var spooled io.ReadCloser
+		spooled, digest, n, err = streamdigest.Spool(req.Body, alg, 0)
+		req.Body.Close()
+		if err == nil {
+			req.Body = spooled
+		}
+	}
+	if err != nil {
+		return digest, fmt.Errorf("failed to digest request body: %w", err)
+	}
+	if hasBody(req) && req.ContentLength <= 0 {
+		req.ContentLength = n
+	}
+	req.Header.Set("Content-Digest", digest.String())
+	return digest, nil
+}
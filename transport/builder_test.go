@@ -0,0 +1,156 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/alg_hmac"
+	"github.com/common-fate/httpsig/inmemory"
+	"github.com/common-fate/httpsig/verifier"
+)
+
+type hmacKeyDirectory struct {
+	secret []byte
+}
+
+func (d hmacKeyDirectory) GetKey(ctx context.Context, kid string, alg string) (verifier.Algorithm, error) {
+	return alg_hmac.NewHMAC(d.secret), nil
+}
+
+func TestBuilder(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	var got *http.Request
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+	verify := httpsig.Middleware(httpsig.MiddlewareOpts{
+		NonceStorage: inmemory.NewNonceStorage(),
+		KeyDirectory: hmacKeyDirectory{secret: secret},
+		Tag:          "foo",
+		Scheme:       "http",
+		Authority:    serverURL.Host,
+	})
+	verified := verify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	// the verifier only passes on covered headers, so record them first
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Clone(r.Context())
+		verified.ServeHTTP(w, r)
+	}))
+
+	tokens := []string{"token-1", "token-2"}
+	client := (&Builder{
+		FallbackHeaders: http.Header{"Content-Type": []string{"application/json"}, "X-Fallback": []string{"fallback"}},
+		Headers:         http.Header{"X-Static": []string{"static"}},
+		HeaderFuncs: []HeaderFunc{func(req *http.Request) (http.Header, error) {
+			token := tokens[0]
+			tokens = tokens[1:]
+			return http.Header{"x-session-token": []string{token}}, nil
+		}},
+		ContentDigest: true,
+		Signing: &httpsig.ClientOpts{
+			KeyID: "kid-1",
+			Tag:   "foo",
+			Alg:   alg_hmac.NewHMAC(secret),
+			CoveredComponents: []string{
+				"@method", "@target-uri", "content-type", "content-length", "content-digest", "x-static", "x-session-token",
+			},
+		},
+	}).Client()
+
+	for _, want := range []string{"token-1", "token-2"} {
+		req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(`{"a":"b"}`))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Header.Set("X-Fallback", "caller")
+		req.Header.Set("X-Static", "caller")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to send request: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+
+		if got.Header.Get("x-session-token") != want {
+			t.Errorf("expected session token %q, got %q", want, got.Header.Get("x-session-token"))
+		}
+		if got.Header.Get("X-Fallback") != "caller" || got.Header.Get("X-Static") != "static" || got.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got unexpected headers %v", got.Header)
+		}
+		if !strings.HasPrefix(got.Header.Get("Content-Digest"), "sha-256=:") {
+			t.Errorf("expected a sha-256 Content-Digest header, got %q", got.Header.Get("Content-Digest"))
+		}
+
+		// the caller's request is unchanged
+		for _, name := range []string{"Content-Type", "X-Session-Token", "Content-Digest", "Signature", "Signature-Input"} {
+			if _, ok := req.Header[name]; ok {
+				t.Errorf("expected the caller's request not to have a %s header", name)
+			}
+		}
+		if req.Header.Get("X-Static") != "caller" {
+			t.Errorf("expected the caller's X-Static header to be unchanged, got %q", req.Header.Get("X-Static"))
+		}
+	}
+}
+
+type recordingTransport struct {
+	req *http.Request
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.req = req
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestBuilderHeaderFuncError(t *testing.T) {
+	base := &recordingTransport{}
+	rt := (&Builder{
+		Base: base,
+		HeaderFuncs: []HeaderFunc{func(req *http.Request) (http.Header, error) {
+			return nil, errors.New("no session token")
+		}},
+	}).Build()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	if _, err := rt.RoundTrip(req); err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if base.req != nil {
+		t.Error("expected the request not to be sent")
+	}
+}
+
+func TestNewTransportWithFallbackHeaders(t *testing.T) {
+	base := &recordingTransport{}
+	rt := NewTransportWithFallbackHeaders(base, http.Header{"Content-Type": []string{"application/json"}})
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatalf("failed to round trip: %v", err)
+	}
+	if base.req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("expected fallback Content-Type, got %q", base.req.Header.Get("Content-Type"))
+	}
+	if req.Header.Get("Content-Type") != "" {
+		t.Error("expected the caller's request not to be modified")
+	}
+}
@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ClockSkewOpts configures tracking the server's clock
+type ClockSkewOpts struct {
+	// Smoothing is the weight, between 0 and 1, of each measurement of the
+	// server's clock in the offset applied to the local clock. The Date
+	// field only has a resolution of a second, so smoothing keeps the
+	// offset from jumping around. Defaults to 0.2.
+	Smoothing float64
+
+	// OnSkew, if set, is called with the offset after each response with a
+	// Date field: how far ahead of the local clock the server's is. Clients
+	// can use it to warn when the local clock is far off.
+	OnSkew func(skew time.Duration)
+}
+
+func (o ClockSkewOpts) withDefaults() ClockSkewOpts {
+	if o.Smoothing <= 0 || o.Smoothing > 1 {
+		o.Smoothing = 0.2
+	}
+	return o
+}
+
+// clock is the local clock, adjusted by an offset to match the server's
+type clock struct {
+	mu       sync.Mutex
+	skew     time.Duration
+	measured bool
+}
+
+// now returns the server's time, as far as the clock knows
+func (c *clock) now() time.Time {
+	return time.Now().Add(c.offset())
+}
+
+// offset returns how far ahead of the local clock the server's is
+func (c *clock) offset() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.skew
+}
+
+// set replaces the offset
+func (c *clock) set(offset time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.skew, c.measured = offset, true
+}
+
+// smooth moves the offset towards a measured offset by the weight, between
+// 0 and 1, and returns the new offset. The first measurement is taken as is.
+func (c *clock) smooth(measured time.Duration, weight float64) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.measured {
+		c.skew, c.measured = measured, true
+		return c.skew
+	}
+	c.skew += time.Duration(weight * float64(measured-c.skew))
+	return c.skew
+}
+
+// serverOffset returns how far ahead of the local clock the server's was,
+// from the Date header of a response to a request sent at sent and received
+// at received, or false if the response has no Date
+func serverOffset(res *http.Response, sent, received time.Time) (time.Duration, bool) {
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return 0, false
+	}
+	// the Date is truncated to the second, and taken somewhere between
+	// sending the request and receiving the response
+	date = date.Add(time.Second / 2)
+	midpoint := sent.Add(received.Sub(sent) / 2)
+	return date.Sub(midpoint), true
+}
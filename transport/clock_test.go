@@ -0,0 +1,93 @@
+package transport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/alg_hmac"
+)
+
+func TestClockSmooth(t *testing.T) {
+	c := &clock{}
+	if got := c.smooth(10*time.Second, 0.2); got != 10*time.Second {
+		t.Errorf("expected the first measurement to be taken as is, got %s", got)
+	}
+	if got := c.smooth(20*time.Second, 0.2); got != 12*time.Second {
+		t.Errorf("expected 12s, got %s", got)
+	}
+	c.set(-time.Hour)
+	if got := c.offset(); got != -time.Hour {
+		t.Errorf("expected -1h, got %s", got)
+	}
+}
+
+var expiresParam = regexp.MustCompile(`;expires=(\d+)`)
+
+func TestBuilderClockSkew(t *testing.T) {
+	// the server's clock is an hour ahead, and it rejects signatures created
+	// more than a minute from its time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now().Add(time.Hour)
+		w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+		input := r.Header.Get("Signature-Input")
+		created := createdParam.FindStringSubmatch(input)
+		expires := expiresParam.FindStringSubmatch(input)
+		if created == nil || expires == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		createdAt, _ := strconv.ParseInt(created[1], 10, 64)
+		expiresAt, _ := strconv.ParseInt(expires[1], 10, 64)
+		if expiresAt-createdAt != 300 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if skew := now.Sub(time.Unix(createdAt, 0)); skew > time.Minute || skew < -time.Minute {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var skews []time.Duration
+	client := (&Builder{
+		ClockSkew: &ClockSkewOpts{
+			OnSkew: func(skew time.Duration) {
+				skews = append(skews, skew)
+			},
+		},
+		Expires: 5 * time.Minute,
+		Signing: &httpsig.ClientOpts{
+			KeyID:             "kid-1",
+			Tag:               "foo",
+			Alg:               alg_hmac.NewHMAC([]byte("0123456789abcdef0123456789abcdef")),
+			CoveredComponents: []string{"@method", "@target-uri"},
+		},
+	}).Client()
+
+	// the first request measures the skew, and the second is signed with it
+	for i, wantStatus := range []int{http.StatusUnauthorized, http.StatusOK} {
+		res, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("failed to send request: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != wantStatus {
+			t.Errorf("request %d: expected status %d, got %d", i, wantStatus, res.StatusCode)
+		}
+	}
+	if len(skews) != 2 {
+		t.Fatalf("expected 2 skew measurements, got %d", len(skews))
+	}
+	for _, skew := range skews {
+		if skew < time.Hour-2*time.Second || skew > time.Hour+2*time.Second {
+			t.Errorf("expected a skew of about an hour, got %s", skew)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/alg_hmac"
+	"github.com/common-fate/httpsig/inmemory"
+	"github.com/micahhausler/httpsig-scratch/routeverify"
+	"github.com/micahhausler/httpsig-scratch/streamdigest"
+)
+
+func TestBuilderContentDigest(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	server := httptest.NewUnstartedServer(nil)
+	serverURL, err := url.Parse("http://" + server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+	middleware, err := routeverify.Middleware(routeverify.Opts{
+		NonceStorage:      inmemory.NewNonceStorage(),
+		KeyDirectory:      hmacKeyDirectory{secret: secret},
+		Tag:               "foo",
+		Scheme:            "http",
+		Authority:         serverURL.Host,
+		WantContentDigest: []string{streamdigest.SHA512},
+		Routes: []routeverify.Route{
+			{Pattern: "/", RequiredComponents: []string{"@method", "@target-uri", "content-length", "content-digest"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	var gotDigest string
+	echo := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the verifier only passes on the headers the signature covers
+		gotDigest = r.Header.Get("Content-Digest")
+		echo.ServeHTTP(w, r)
+	})
+	server.Start()
+	defer server.Close()
+
+	client := (&Builder{
+		ContentDigest: true,
+		Signing: &httpsig.ClientOpts{
+			KeyID:             "kid-1",
+			Tag:               "foo",
+			Alg:               alg_hmac.NewHMAC(secret),
+			CoveredComponents: []string{"@method", "@target-uri", "content-length", "content-digest"},
+		},
+	}).Client()
+
+	// the cases share the client, which learns the server's preferred
+	// algorithm from the first response
+	cases := []struct {
+		name       string
+		body       io.Reader
+		wantStatus int
+		wantDigest string
+	}{
+		{
+			name:       "unwanted algorithm",
+			body:       strings.NewReader("hello"),
+			wantStatus: http.StatusUnauthorized,
+			wantDigest: "sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:",
+		},
+		{
+			name:       "replayed from GetBody",
+			body:       strings.NewReader("hello"),
+			wantStatus: http.StatusOK,
+			wantDigest: "sha-512=:m3HSJL1i83hdltRq0+o9czGb+8KJDKra4t/3JRlnPKcjI8PZm6XBHXx6zG4UuMXaDEZjR1wuXDre9G9zvN7AQw==:",
+		},
+		{
+			name:       "spooled",
+			body:       io.MultiReader(strings.NewReader("hello")),
+			wantStatus: http.StatusOK,
+			wantDigest: "sha-512=:m3HSJL1i83hdltRq0+o9czGb+8KJDKra4t/3JRlnPKcjI8PZm6XBHXx6zG4UuMXaDEZjR1wuXDre9G9zvN7AQw==:",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			gotDigest = ""
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, server.URL, tc.body)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			if res.StatusCode != tc.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tc.wantStatus, res.StatusCode, body)
+			}
+			if res.StatusCode == http.StatusOK && string(body) != "hello" {
+				t.Errorf("expected the body to be sent, got %q", body)
+			}
+			if gotDigest != tc.wantDigest {
+				t.Errorf("expected Content-Digest %q, got %q", tc.wantDigest, gotDigest)
+			}
+		})
+	}
+}
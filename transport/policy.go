@@ -0,0 +1,133 @@
+package transport
+
+import (
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+// CoveredComponentPolicy chooses the components a request's signature
+// covers. Builder uses it to sign each request with its own components.
+type CoveredComponentPolicy interface {
+	CoveredComponents(req *http.Request) []string
+}
+
+// CoveredComponentPolicyFunc adapts a function to a CoveredComponentPolicy
+type CoveredComponentPolicyFunc func(req *http.Request) []string
+
+func (f CoveredComponentPolicyFunc) CoveredComponents(req *http.Request) []string {
+	return f(req)
+}
+
+// StaticComponents covers the same components in every request
+type StaticComponents []string
+
+func (s StaticComponents) CoveredComponents(req *http.Request) []string {
+	return s
+}
+
+// ComponentRule adds covered components to requests matching its methods
+// and paths
+type ComponentRule struct {
+	// Methods the rule applies to. If empty, it applies to every method.
+	Methods []string
+
+	// Paths the rule applies to, either path.Match patterns like
+	// `/api/*/pods`, or path prefixes like `/api` that match `/api` and
+	// paths below it. If empty, it applies to every path.
+	Paths []string
+
+	// Components are covered by matching requests. Headers must be set on
+	// the request, or signing fails.
+	Components []string
+}
+
+func (r ComponentRule) matches(req *http.Request) bool {
+	if len(r.Methods) > 0 && !slices.Contains(r.Methods, req.Method) {
+		return false
+	}
+	if len(r.Paths) == 0 {
+		return true
+	}
+	requestPath := path.Clean("/" + req.URL.Path)
+	return slices.ContainsFunc(r.Paths, func(p string) bool { return matchPath(p, requestPath) })
+}
+
+func matchPath(pattern, requestPath string) bool {
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, _ := path.Match(pattern, requestPath)
+		return ok
+	}
+	prefix := strings.TrimSuffix(pattern, "/")
+	if prefix == "" {
+		return true
+	}
+	return requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/")
+}
+
+// ComponentPolicy covers components based on the request's method, path,
+// body, and headers. Components are covered in the order of its fields, and
+// each is covered at most once.
+type ComponentPolicy struct {
+	// Components are covered by every request
+	Components []string
+
+	// BodyComponents are covered by requests with a body. A request
+	// without a body, like most GETs, has no length or digest worth
+	// signing.
+	BodyComponents []string
+
+	// IfPresent headers are covered when they are set on the request,
+	// such as `content-type` or `x-session-token`
+	IfPresent []string
+
+	// Rules add components to matching requests
+	Rules []ComponentRule
+}
+
+var _ CoveredComponentPolicy = &ComponentPolicy{}
+
+// DefaultComponentPolicy covers the method and target URI of every request,
+// the length and digest of bodies, and the content type when it is set
+func DefaultComponentPolicy() *ComponentPolicy {
+	return &ComponentPolicy{
+		Components:     []string{"@method", "@target-uri"},
+		BodyComponents: []string{"content-length", "content-digest"},
+		IfPresent:      []string{"content-type"},
+	}
+}
+
+func (p *ComponentPolicy) CoveredComponents(req *http.Request) []string {
+	components := []string{}
+	add := func(cs ...string) {
+		for _, c := range cs {
+			c = strings.ToLower(c)
+			if !slices.Contains(components, c) {
+				components = append(components, c)
+			}
+		}
+	}
+	add(p.Components...)
+	if hasBody(req) {
+		add(p.BodyComponents...)
+	}
+	for _, header := range p.IfPresent {
+		if len(req.Header.Values(header)) > 0 {
+			add(header)
+		}
+	}
+	for _, rule := range p.Rules {
+		if rule.matches(req) {
+			add(rule.Components...)
+		}
+	}
+	return components
+}
+
+// hasBody returns true if the request has a body. A client request's
+// ContentLength of 0 with a non-nil Body means the length is unknown, not
+// that the body is empty.
+func hasBody(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody
+}
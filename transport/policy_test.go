@@ -0,0 +1,177 @@
+package transport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/alg_hmac"
+	"github.com/common-fate/httpsig/inmemory"
+	"github.com/common-fate/httpsig/sigparams"
+)
+
+func TestComponentPolicy(t *testing.T) {
+	policy := DefaultComponentPolicy()
+	policy.IfPresent = append(policy.IfPresent, "x-session-token")
+	policy.Rules = []ComponentRule{
+		{Methods: []string{http.MethodPost}, Paths: []string{"/api/*/pods"}, Components: []string{"idempotency-key"}},
+		{Paths: []string{"/admin"}, Components: []string{"Authorization", "@method"}},
+	}
+
+	cases := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		headers map[string]string
+		want    []string
+	}{
+		{
+			name:   "get without body",
+			method: http.MethodGet,
+			target: "/",
+			want:   []string{"@method", "@target-uri"},
+		},
+		{
+			name:    "post with body",
+			method:  http.MethodPost,
+			target:  "/",
+			body:    "{}",
+			headers: map[string]string{"Content-Type": "application/json"},
+			want:    []string{"@method", "@target-uri", "content-length", "content-digest", "content-type"},
+		},
+		{
+			name:    "session token when present",
+			method:  http.MethodGet,
+			target:  "/",
+			headers: map[string]string{"X-Session-Token": "token"},
+			want:    []string{"@method", "@target-uri", "x-session-token"},
+		},
+		{
+			name:   "matching rule",
+			method: http.MethodPost,
+			target: "/api/v1/pods",
+			body:   "{}",
+			want:   []string{"@method", "@target-uri", "content-length", "content-digest", "idempotency-key"},
+		},
+		{
+			name:   "rule for another method",
+			method: http.MethodGet,
+			target: "/api/v1/pods",
+			want:   []string{"@method", "@target-uri"},
+		},
+		{
+			name:   "prefix rule without duplicates",
+			method: http.MethodDelete,
+			target: "/admin/users/alice",
+			want:   []string{"@method", "@target-uri", "authorization"},
+		},
+		{
+			name:   "prefix rule doesn't match sibling",
+			method: http.MethodDelete,
+			target: "/administrators",
+			want:   []string{"@method", "@target-uri"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "http://example.com"+tc.target, nil)
+			if tc.body != "" {
+				req = httptest.NewRequest(tc.method, "http://example.com"+tc.target, strings.NewReader(tc.body))
+			}
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			got := policy.CoveredComponents(req)
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestBuilderCoveredComponentPolicy(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+	var signatureInput string
+	verify := httpsig.Middleware(httpsig.MiddlewareOpts{
+		NonceStorage: inmemory.NewNonceStorage(),
+		KeyDirectory: hmacKeyDirectory{secret: secret},
+		Tag:          "foo",
+		Scheme:       "http",
+		Authority:    serverURL.Host,
+		Validation: &sigparams.ValidateOpts{
+			BeforeDuration:            time.Minute,
+			RequiredCoveredComponents: map[string]bool{"@method": true, "@target-uri": true},
+		},
+	})
+	verified := verify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signatureInput = r.Header.Get("Signature-Input")
+		verified.ServeHTTP(w, r)
+	}))
+
+	policy := DefaultComponentPolicy()
+	policy.IfPresent = append(policy.IfPresent, "x-session-token")
+	client := (&Builder{
+		Headers:           http.Header{"X-Session-Token": []string{"token"}},
+		CoveredComponents: policy,
+		Signing: &httpsig.ClientOpts{
+			KeyID: "kid-1",
+			Tag:   "foo",
+			Alg:   alg_hmac.NewHMAC(secret),
+		},
+	}).Client()
+
+	cases := []struct {
+		name    string
+		send    func() (*http.Response, error)
+		want    string
+		notWant string
+	}{
+		{
+			name:    "get",
+			send:    func() (*http.Response, error) { return client.Get(server.URL) },
+			want:    `("@method" "@target-uri" "x-session-token")`,
+			notWant: "content-digest",
+		},
+		{
+			name: "post",
+			send: func() (*http.Response, error) {
+				return client.Post(server.URL, "application/json", strings.NewReader("{}"))
+			},
+			want: `("@method" "@target-uri" "content-length" "content-digest" "content-type" "x-session-token")`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.send()
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", res.StatusCode)
+			}
+			if !strings.Contains(signatureInput, tc.want) {
+				t.Errorf("expected signature input to contain %s, got %s", tc.want, signatureInput)
+			}
+			if tc.notWant != "" && strings.Contains(signatureInput, tc.notWant) {
+				t.Errorf("expected signature input not to contain %s, got %s", tc.notWant, signatureInput)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/micahhausler/httpsig-scratch/respsig"
+)
+
+// RetryPolicy configures how a Builder's transport retries requests
+type RetryPolicy struct {
+	// MaxAttempts is the most times a request is sent, not counting a
+	// retry after adjusting the clock. Defaults to 3.
+	MaxAttempts int
+
+	// MinBackoff is the delay before the first retry, which doubles for
+	// each retry after it, up to MaxBackoff. Each delay is jittered by up to
+	// half, so clients retrying together spread out. Default to 100ms and 5
+	// seconds.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxClockSkew is how far the server's Date can be from the local clock
+	// before a 401 Unauthorized is blamed on clock skew. Defaults to 5
+	// seconds.
+	MaxClockSkew time.Duration
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 3
+	}
+	if p.MinBackoff <= 0 {
+		p.MinBackoff = 100 * time.Millisecond
+	}
+	if p.MaxBackoff < p.MinBackoff {
+		p.MaxBackoff = max(5*time.Second, p.MinBackoff)
+	}
+	if p.MaxClockSkew <= 0 {
+		p.MaxClockSkew = 5 * time.Second
+	}
+	return p
+}
+
+// backoff returns the jittered delay before the retry after the attempt
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.MinBackoff << (attempt - 1)
+	if d > p.MaxBackoff || d <= 0 {
+		d = p.MaxBackoff
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// roundTripRetrying sends the request until it succeeds, can't be retried,
+// or runs out of attempts. Each attempt is prepared and signed again.
+// Requests with a body are only retried if GetBody can replay it.
+func (t *builtTransport) roundTripRetrying(req *http.Request) (*http.Response, error) {
+	replayable := !hasBody(req) || req.GetBody != nil
+	adjusted := false
+	attempt := req
+	for n := 1; ; n++ {
+		// ClockSkew may smooth the clock from the response before it's
+		// checked, so compare against the offset the attempt was signed with
+		signedOffset := t.clock.offset()
+		sent := time.Now()
+		res, err := t.roundTrip(attempt)
+		var wait time.Duration
+		switch {
+		case !replayable:
+			return res, err
+		case err == nil && res.StatusCode == http.StatusUnauthorized:
+			if adjusted || !t.adjustClock(res, signedOffset, sent, time.Now()) {
+				return res, nil
+			}
+			// the retry after adjusting the clock is immediate, and isn't
+			// counted
+			adjusted = true
+			n--
+		case n >= t.retry.MaxAttempts || !retryable(req, err, res):
+			return res, err
+		default:
+			wait = t.retry.backoff(n)
+		}
+		if res != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+			res.Body.Close()
+		}
+		err = sleep(req.Context(), wait)
+		if err != nil {
+			return nil, err
+		}
+		attempt, err = replay(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// adjustClock sets the clock's offset from the response's Date header, and
+// returns true if the request, signed with signedOffset, was off by more than
+// MaxClockSkew
+func (t *builtTransport) adjustClock(res *http.Response, signedOffset time.Duration, sent, received time.Time) bool {
+	offset, ok := serverOffset(res, sent, received)
+	if !ok {
+		return false
+	}
+	skew := offset - signedOffset
+	if skew <= t.retry.MaxClockSkew && skew >= -t.retry.MaxClockSkew {
+		return false
+	}
+	t.clock.set(offset)
+	return true
+}
+
+// retryable returns true if the request is idempotent and failed with a
+// network error, or a 5xx response, rather than being canceled. A response
+// whose signature doesn't verify came from the server, or from someone
+// pretending to be it, so it's never retried.
+func retryable(req *http.Request, err error, res *http.Response) bool {
+	if !idempotent(req) {
+		return false
+	}
+	if err != nil {
+		return req.Context().Err() == nil &&
+			!errors.Is(err, context.Canceled) &&
+			!errors.Is(err, context.DeadlineExceeded) &&
+			!errors.Is(err, respsig.ErrInvalidSignature)
+	}
+	return res.StatusCode >= 500
+}
+
+// idempotent returns true if sending the request twice has the same effect
+// as sending it once: its method is idempotent, or the caller set an
+// Idempotency-Key for the server to deduplicate it with
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// replay returns a clone of the request to send again, with its body from
+// GetBody
+func replay(req *http.Request) (*http.Request, error) {
+	req2 := req.Clone(req.Context())
+	if !hasBody(req) {
+		return req2, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, fmt.Errorf("failed to replay request body: %w", err)
+	}
+	req2.Body = body
+	return req2, nil
+}
+
+// sleep waits for d, or until the context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
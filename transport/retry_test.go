@@ -0,0 +1,277 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/common-fate/httpsig"
+	"github.com/common-fate/httpsig/alg_hmac"
+	"github.com/common-fate/httpsig/inmemory"
+	"github.com/micahhausler/httpsig-scratch/respsig"
+	"github.com/micahhausler/httpsig-scratch/routeverify"
+)
+
+func TestBuilderRetry(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	server := httptest.NewUnstartedServer(nil)
+	serverURL, err := url.Parse("http://" + server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %v", err)
+	}
+	middleware, err := routeverify.Middleware(routeverify.Opts{
+		NonceStorage: inmemory.NewNonceStorage(),
+		KeyDirectory: hmacKeyDirectory{secret: secret},
+		Tag:          "foo",
+		Scheme:       "http",
+		Authority:    serverURL.Host,
+		Routes: []routeverify.Route{
+			{Pattern: "/", RequiredComponents: []string{"@method", "@target-uri"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	// failures are how many times each path fails before it succeeds
+	failures := map[string]int{"/flaky": 2, "/reset": 1, "/down": 10}
+	attempts := 0
+	verified := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts <= failures[r.URL.Path] {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if r.URL.Path == "/reset" && attempts == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		verified.ServeHTTP(w, r)
+	})
+	server.Start()
+	defer server.Close()
+
+	client := (&Builder{
+		Base:          &http.Transport{DisableKeepAlives: true},
+		ContentDigest: true,
+		Retry: &RetryPolicy{
+			MinBackoff: time.Millisecond,
+			MaxBackoff: 2 * time.Millisecond,
+		},
+		Signing: &httpsig.ClientOpts{
+			KeyID:             "kid-1",
+			Tag:               "foo",
+			Alg:               alg_hmac.NewHMAC(secret),
+			CoveredComponents: []string{"@method", "@target-uri", "content-length", "content-digest"},
+		},
+	}).Client()
+
+	cases := []struct {
+		name         string
+		method       string
+		header       http.Header
+		path         string
+		body         io.Reader
+		wantStatus   int
+		wantAttempts int
+	}{
+		{
+			name:         "5xx with a fresh nonce",
+			method:       http.MethodPut,
+			path:         "/flaky",
+			body:         strings.NewReader("hello"),
+			wantStatus:   http.StatusOK,
+			wantAttempts: 3,
+		},
+		{
+			name:         "connection reset",
+			method:       http.MethodPut,
+			path:         "/reset",
+			body:         strings.NewReader("hello"),
+			wantStatus:   http.StatusOK,
+			wantAttempts: 2,
+		},
+		{
+			name:         "out of attempts",
+			method:       http.MethodPut,
+			path:         "/down",
+			body:         strings.NewReader("hello"),
+			wantStatus:   http.StatusServiceUnavailable,
+			wantAttempts: 3,
+		},
+		{
+			name:         "body can't be replayed",
+			method:       http.MethodPut,
+			path:         "/flaky",
+			body:         io.MultiReader(strings.NewReader("hello")),
+			wantStatus:   http.StatusServiceUnavailable,
+			wantAttempts: 1,
+		},
+		{
+			name:         "POST isn't idempotent",
+			method:       http.MethodPost,
+			path:         "/flaky",
+			body:         strings.NewReader("hello"),
+			wantStatus:   http.StatusServiceUnavailable,
+			wantAttempts: 1,
+		},
+		{
+			name:         "POST with an Idempotency-Key",
+			method:       http.MethodPost,
+			header:       http.Header{"Idempotency-Key": {"8e03978e-40d5-43e8-bc93-6894a57f9324"}},
+			path:         "/flaky",
+			body:         strings.NewReader("hello"),
+			wantStatus:   http.StatusOK,
+			wantAttempts: 3,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts = 0
+			req, err := http.NewRequestWithContext(context.Background(), tc.method, server.URL+tc.path, tc.body)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			if res.StatusCode != tc.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", tc.wantStatus, res.StatusCode, body)
+			}
+			if res.StatusCode == http.StatusOK && string(body) != "hello" {
+				t.Errorf("expected the body to be replayed, got %q", body)
+			}
+			if attempts != tc.wantAttempts {
+				t.Errorf("expected %d attempts, got %d", tc.wantAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestBuilderRetryInvalidResponseSignature(t *testing.T) {
+	// the server doesn't sign its responses
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	client := (&Builder{
+		Base: &respsig.Transport{
+			KeyDirectory: hmacKeyDirectory{secret: secret},
+		},
+		Retry: &RetryPolicy{
+			MinBackoff: time.Millisecond,
+			MaxBackoff: 2 * time.Millisecond,
+		},
+		Signing: &httpsig.ClientOpts{
+			KeyID:             "kid-1",
+			Tag:               "foo",
+			Alg:               alg_hmac.NewHMAC(secret),
+			CoveredComponents: []string{"@method", "@target-uri"},
+		},
+	}).Client()
+
+	res, err := client.Get(server.URL)
+	if err == nil {
+		res.Body.Close()
+		t.Fatal("expected the unsigned response to be rejected")
+	}
+	if !errors.Is(err, respsig.ErrInvalidSignature) {
+		t.Errorf("expected ErrInvalidSignature, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+var createdParam = regexp.MustCompile(`;created=(\d+)`)
+
+func TestBuilderRetryClockSkew(t *testing.T) {
+	// the server's clock is an hour ahead, and it rejects signatures created
+	// more than a minute from its time
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		now := time.Now().Add(time.Hour)
+		w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+		match := createdParam.FindStringSubmatch(r.Header.Get("Signature-Input"))
+		if match == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		created, _ := strconv.ParseInt(match[1], 10, 64)
+		if skew := now.Sub(time.Unix(created, 0)); skew > time.Minute || skew < -time.Minute {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		name      string
+		clockSkew *ClockSkewOpts
+	}{
+		{name: "retry"},
+		// tracking the clock updates it from the 401 before the retry
+		// policy checks it
+		{name: "retry and clock skew", clockSkew: &ClockSkewOpts{}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := (&Builder{
+				Retry:     &RetryPolicy{},
+				ClockSkew: tc.clockSkew,
+				Signing: &httpsig.ClientOpts{
+					KeyID:             "kid-1",
+					Tag:               "foo",
+					Alg:               alg_hmac.NewHMAC([]byte("0123456789abcdef0123456789abcdef")),
+					CoveredComponents: []string{"@method", "@target-uri"},
+				},
+			}).Client()
+
+			// the first request adjusts the clock, and the second is signed
+			// with it
+			for i, wantAttempts := range []int{2, 1} {
+				attempts = 0
+				res, err := client.Get(server.URL)
+				if err != nil {
+					t.Fatalf("failed to send request: %v", err)
+				}
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Errorf("request %d: expected status 200, got %d", i, res.StatusCode)
+				}
+				if attempts != wantAttempts {
+					t.Errorf("request %d: expected %d attempts, got %d", i, wantAttempts, attempts)
+				}
+			}
+		})
+	}
+}